@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type ArchiveCmd struct {
+	FileSelector
+	FilePermissions
+	RetryPolicy
+	// OlderThan is how old by creation time files must be to be archived,
+	// in calendar years, months and days.
+	OlderThan calendarAge
+	// To is the root of the archive, and DirFormat the Go time layout of
+	// the date directories under it that files are moved into.
+	To              string
+	DirFormat       string
+	NumWorkers      int
+	NumMoveWorkers  int
+	MaxPending      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	ClockOffsets    []clockOffsetRule
+	MinAge          time.Duration
+	OnParseError    string
+	CheckFreeSpace  string
+	Report          string
+	Manifest        string
+	Verbose         bool
+	DryRun          bool
+	Force           bool
+	NoLock          bool
+	ReplaceIfExists bool
+	Durable         bool
+	MaxNameLength   int
+	MaxPathLength   int
+	LongNames       string
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func ArchiveCommand(args []string) (*ArchiveCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	archiveCmd := &ArchiveCmd{
+		FileSelector: fileSelector,
+		DirFormat:    "2006/01",
+		OnParseError: "skip",
+		LongNames:    "skip",
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("older-than", "Archive files created longer ago than this many years, months, weeks or days e.g. 2y, 18mo, 6w or 90d. Required.", func(value string) error {
+		age, err := parseCalendarAge(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.OlderThan = age
+		return nil
+	})
+	flagset.Func("to", "Root directory of the archive, which may be on another filesystem e.g. a cold storage drive, or an rclone remote as rclone://REMOTE/PATH or an S3 bucket as s3://BUCKET/PREFIX. Required.", func(value string) error {
+		value, err := archiveCmd.FileSelector.localPath(value)
+		if err != nil {
+			return err
+		}
+		to, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.To = to
+		return nil
+	})
+	flagset.Func("dir-format", "Go time layout of the date directories under -to e.g. '2006' for years only or '2006/2006-01-02' for days. Slashes separate directories, and the layout may only produce letters, digits, spaces and . _ + -. (default 2006/01)", func(value string) error {
+		err := checkDirFormat(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.DirFormat = value
+		return nil
+	})
+	flagset.IntVar(&archiveCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means auto-tune based on the number of CPUs and measured throughput.")
+	flagset.IntVar(&archiveCmd.NumMoveWorkers, "num-move-workers", 0, "Number of concurrent workers moving files, separately from the -num-workers reading metadata. 0 means the workers reading metadata move the files themselves.")
+	flagset.IntVar(&archiveCmd.MaxPending, "max-pending", defaultMaxPending, "Maximum number of files queued up ahead of the workers.")
+	flagset.DurationVar(&archiveCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&archiveCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&archiveCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.DateSourceRules = append(archiveCmd.DateSourceRules, rule)
+		return nil
+	})
+	flagset.Func("clock-offset", "Amount to add to the creation times of files from cameras whose model or serial number matches a regex, to line up cameras whose clocks were off when merging them e.g. 'ILCE-7M3=-1m30s' or '^0123456$=+1h'. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseClockOffsetRule(value)
+		if err != nil {
+			return err
+		}
+		archiveCmd.ClockOffsets = append(archiveCmd.ClockOffsets, rule)
+		return nil
+	})
+	flagset.DurationVar(&archiveCmd.MinAge, "min-age", 0, "Skip files modified less than this long ago, as they may still be being written to.")
+	archiveCmd.FileSelector.RegisterFlags(flagset)
+	archiveCmd.FilePermissions.RegisterFlags(flagset)
+	archiveCmd.RetryPolicy.RegisterFlags(flagset)
+	flagset.BoolVar(&archiveCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&archiveCmd.DryRun, "dry-run", false, "Print archive operations without executing.")
+	flagset.BoolVar(&archiveCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&archiveCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	flagset.IntVar(&archiveCmd.MaxNameLength, "max-name", 255, "Maximum length in bytes of a new file name, which most filesystems limit to 255. 0 means no limit.")
+	flagset.IntVar(&archiveCmd.MaxPathLength, "max-path", 0, "Maximum length in bytes of a new file path e.g. 260 for tools limited to Windows' MAX_PATH, or 1024 for some SMB servers. 0 means no limit.")
+	flagset.Func("long-names", "What to do with a new path longer than -max-name or -max-path: skip (the default) or truncate (shorten its name, keeping the extension and adding a hash of the full name so that shortened names stay unique).", func(value string) error {
+		switch value {
+		case "skip", "truncate":
+			archiveCmd.LongNames = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be skip or truncate", value)
+	})
+	flagset.Func("check-free-space", "Before moving anything, add up the bytes to be moved onto each filesystem from other filesystems and, if one of them lacks the free space, abort without moving anything or warn and carry on. Holds the whole plan in memory, as -plan does.", func(value string) error {
+		switch value {
+		case "abort", "warn":
+			archiveCmd.CheckFreeSpace = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be abort or warn", value)
+	})
+	flagset.BoolVar(&archiveCmd.Durable, "durable", false, "Fsync each moved file and its directories so that moves survive a power loss. Slower.")
+	flagset.BoolVar(&archiveCmd.ReplaceIfExists, "replace-if-exists", false, "If a file with the same name already exists in the archive, replace it, moving the replaced file into a .exifutil-trash directory next to it (see exifutil trash).")
+	flagset.StringVar(&archiveCmd.Report, "report", "", "Write a record of every operation to this CSV file (or TSV, if it ends in .tsv).")
+	flagset.StringVar(&archiveCmd.Manifest, "manifest", "", "After the run, write the SHA-256 of every file moved or already in place to this file, in the format of sha256sum so that sha256sum -c can check it later for bit rot.")
+	flagset.Func("on-parse-error", "What to do when a file's creation time cannot be determined: skip (the default) or strict (abort the run). Files without a creation time are never archived.", func(value string) error {
+		switch value {
+		case "skip", "strict":
+			archiveCmd.OnParseError = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be skip or strict", value)
+	})
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if archiveCmd.OlderThan.IsZero() {
+		return nil, fmt.Errorf("-older-than is required")
+	}
+	if archiveCmd.To == "" {
+		return nil, fmt.Errorf("-to is required")
+	}
+	err = archiveCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	archiveCmd.logger = newLogger(archiveCmd.Stdout, archiveCmd.Verbose)
+	return archiveCmd, nil
+}
+
+// calendarAge is an age in calendar years, months and days, so that e.g. 2
+// years ago is the same date two years back whatever the leap days.
+type calendarAge struct {
+	Years  int
+	Months int
+	Days   int
+}
+
+// parseCalendarAge parses an age like 2y, 18mo, 6w or 90d.
+func parseCalendarAge(value string) (calendarAge, error) {
+	for _, unit := range []string{"mo", "y", "w", "d"} {
+		number, ok := strings.CutSuffix(value, unit)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil || n <= 0 {
+			return calendarAge{}, fmt.Errorf("invalid age %q, must be a positive number followed by y, mo, w or d", value)
+		}
+		switch unit {
+		case "y":
+			return calendarAge{Years: n}, nil
+		case "mo":
+			return calendarAge{Months: n}, nil
+		case "w":
+			return calendarAge{Days: 7 * n}, nil
+		default:
+			return calendarAge{Days: n}, nil
+		}
+	}
+	return calendarAge{}, fmt.Errorf("invalid age %q, must be a positive number followed by y, mo, w or d", value)
+}
+
+// IsZero reports whether the age is zero.
+func (age calendarAge) IsZero() bool {
+	return age == calendarAge{}
+}
+
+// Before returns the time age before t.
+func (age calendarAge) Before(t time.Time) time.Time {
+	return t.AddDate(-age.Years, -age.Months, -age.Days)
+}
+
+// Run moves the files under the roots created longer ago than OlderThan into
+// date directories under To, leaving the rest where they are. It is meant to
+// be run periodically, e.g. from cron, to keep a working tree down to its
+// recent files.
+func (archiveCmd *ArchiveCmd) Run(ctx context.Context) error {
+	createdBefore := archiveCmd.OlderThan.Before(time.Now())
+	moveCmd := &MoveCmd{
+		FileSelector:    archiveCmd.FileSelector,
+		FilePermissions: archiveCmd.FilePermissions,
+		RetryPolicy:     archiveCmd.RetryPolicy,
+		MoveOptions: MoveOptions{
+			NumWorkers:      archiveCmd.NumWorkers,
+			NumMoveWorkers:  archiveCmd.NumMoveWorkers,
+			MaxPending:      archiveCmd.MaxPending,
+			Timeout:         archiveCmd.Timeout,
+			Charset:         archiveCmd.Charset,
+			ExifToolConfig:  archiveCmd.ExifToolConfig,
+			ExifToolArgs:    archiveCmd.ExifToolArgs,
+			NoCache:         archiveCmd.NoCache,
+			DateSourceRules: archiveCmd.DateSourceRules,
+			ClockOffsets:    archiveCmd.ClockOffsets,
+			MinAge:          archiveCmd.MinAge,
+			OnParseError:    archiveCmd.OnParseError,
+			CheckFreeSpace:  archiveCmd.CheckFreeSpace,
+			Report:          archiveCmd.Report,
+			Manifest:        archiveCmd.Manifest,
+			Verbose:         archiveCmd.Verbose,
+			DryRun:          archiveCmd.DryRun,
+			Force:           archiveCmd.Force,
+			NoLock:          archiveCmd.NoLock,
+			ReplaceIfExists: archiveCmd.ReplaceIfExists,
+			Durable:         archiveCmd.Durable,
+			MaxNameLength:   archiveCmd.MaxNameLength,
+			MaxPathLength:   archiveCmd.MaxPathLength,
+			LongNames:       archiveCmd.LongNames,
+		},
+		DirTemplate:   template.Must(newMoveTemplate("{{" + strconv.Quote(archiveCmd.To) + "}}/{{.CreationTime.Format " + strconv.Quote(archiveCmd.DirFormat) + "}}")),
+		NameTemplate:  template.Must(newMoveTemplate("{{.Name}}")),
+		CreatedBefore: createdBefore,
+		Stdout:        archiveCmd.Stdout,
+		Stderr:        archiveCmd.Stderr,
+		logger:        archiveCmd.logger,
+		// Files already in the archive, if it is under a root, stay put.
+		placed: func(filePath string) bool {
+			return strings.HasPrefix(filePath, archiveCmd.To+string(filepath.Separator))
+		},
+	}
+	return moveCmd.Run(ctx)
+}
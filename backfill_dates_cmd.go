@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BackfillDatesCmd struct {
+	FileSelector
+	// Sources are where the dates are taken from, in order: gps, filename,
+	// sidecar, dir or mtime.
+	Sources []string
+	// NamePatterns match dates in file names. They capture the year, month
+	// and day, and optionally the hour, minute and second, in groups named
+	// after them.
+	NamePatterns   []*regexp.Regexp
+	NumWorkers     int
+	Timeout        time.Duration
+	Charset        string
+	ExifToolConfig string
+	ExifToolArgs   []string
+	NoCache        bool
+	MinAge         time.Duration
+	StableFor      time.Duration
+	Verbose        bool
+	DryRun         bool
+	Force          bool
+	NoLock         bool
+	Stdout         io.Writer
+	Stderr         io.Writer
+	logger         *slog.Logger
+}
+
+// backfillSources are the sources backfill-dates can take dates from.
+var backfillSources = []string{"gps", "filename", "sidecar", "dir", "mtime"}
+
+// defaultNameDatePatterns match the dates phones, cameras, messaging apps
+// and screenshot tools put in file names, e.g. IMG_20210601_120000.jpg,
+// PXL_20210601_120000123.jpg, Screenshot_2021-06-01-12-00-00.png,
+// WhatsApp Image 2021-06-01 at 12.00.00.jpeg and IMG-20210601-WA0001.jpg.
+var defaultNameDatePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?:^|\D)(?P<year>(?:19|20)\d{2})[-_.]?(?P<month>\d{2})[-_.]?(?P<day>\d{2})(?:[-_ T.]|\sat\s)?(?P<hour>\d{2})[-_.:h]?(?P<minute>\d{2})[-_.:m]?(?P<second>\d{2})`),
+	regexp.MustCompile(`(?:^|\D)(?P<year>(?:19|20)\d{2})[-_.]?(?P<month>\d{2})[-_.]?(?P<day>\d{2})(?:\D|$)`),
+}
+
+func BackfillDatesCommand(args []string) (*BackfillDatesCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	backfillDatesCmd := &BackfillDatesCmd{
+		FileSelector: fileSelector,
+		Sources:      []string{"gps", "filename", "sidecar"},
+		NamePatterns: defaultNameDatePatterns,
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	var namePatterns []*regexp.Regexp
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("sources", "Comma separated sources of the dates to write, tried in order: gps (the GPS timestamp), filename (a date in the file name), sidecar (a Google Takeout JSON sidecar), dir (a date at the start of the name of a directory containing the file, as -dir-dates) or mtime (the modification time). (default gps,filename,sidecar)", func(value string) error {
+		var sources []string
+		for _, source := range strings.Split(value, ",") {
+			source = strings.TrimSpace(source)
+			if !slices.Contains(backfillSources, source) {
+				return fmt.Errorf("unknown source %q (supported: %s)", source, strings.Join(backfillSources, ", "))
+			}
+			sources = append(sources, source)
+		}
+		backfillDatesCmd.Sources = sources
+		return nil
+	})
+	flagset.Func("name-date-pattern", "Regex matched against file names in place of the default patterns, for the filename source. It must capture the year, month and day in groups named year, month and day, and may capture the time in groups named hour, minute and second e.g. '^scan_(?P<day>\\d{2})(?P<month>\\d{2})(?P<year>\\d{4})'. Can be repeated, the first matching pattern wins.", func(value string) error {
+		r, err := parseNameDatePattern(value)
+		if err != nil {
+			return err
+		}
+		namePatterns = append(namePatterns, r)
+		return nil
+	})
+	flagset.IntVar(&backfillDatesCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means auto-tune based on the number of CPUs and measured throughput.")
+	flagset.DurationVar(&backfillDatesCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&backfillDatesCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		backfillDatesCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		backfillDatesCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&backfillDatesCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.DurationVar(&backfillDatesCmd.MinAge, "min-age", 0, "Skip files modified less than this long ago, as they may still be being written to.")
+	flagset.DurationVar(&backfillDatesCmd.StableFor, "stable-for", 0, "Skip files whose size changes over this interval, as they may still be being written to.")
+	backfillDatesCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&backfillDatesCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&backfillDatesCmd.DryRun, "dry-run", false, "Print the dates that would be written without executing.")
+	flagset.BoolVar(&backfillDatesCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&backfillDatesCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(namePatterns) > 0 {
+		backfillDatesCmd.NamePatterns = namePatterns
+	}
+	err = backfillDatesCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	backfillDatesCmd.logger = newLogger(backfillDatesCmd.Stdout, backfillDatesCmd.Verbose)
+	return backfillDatesCmd, nil
+}
+
+// parseNameDatePattern parses a -name-date-pattern, which must capture the
+// year, month and day in groups named after them.
+func parseNameDatePattern(value string) (*regexp.Regexp, error) {
+	r, err := regexp.Compile(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"year", "month", "day"} {
+		if r.SubexpIndex(name) < 0 {
+			return nil, fmt.Errorf("%q has no (?P<%s>...) group", value, name)
+		}
+	}
+	return r, nil
+}
+
+// nameCreationTime returns the date and time in name matched by the first
+// of patterns that matches with a valid date, or the zero time if none do.
+// File names don't say which time zone they are in, so the time is the
+// wall clock time in UTC.
+func nameCreationTime(name string, patterns []*regexp.Regexp) time.Time {
+	for _, pattern := range patterns {
+		match := pattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		group := func(name string) int {
+			i := pattern.SubexpIndex(name)
+			if i < 0 || match[i] == "" {
+				return 0
+			}
+			n, _ := strconv.Atoi(match[i])
+			return n
+		}
+		year, month, day := group("year"), group("month"), group("day")
+		hour, minute, second := group("hour"), group("minute"), group("second")
+		t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+		// time.Date normalizes out of range values like a 13th month, which
+		// means the digits weren't a date after all.
+		if t.Year() != year || int(t.Month()) != month || t.Day() != day || t.Hour() != hour || t.Minute() != minute || t.Second() != second {
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// backfillTime returns the date to write into the DateTimeOriginal of
+// filePath and the source it came from, or the zero time if none of Sources
+// has one. hasOffset reports whether the date is an instant, which is
+// written with its offset, rather than a wall clock time in no particular
+// time zone. listings holds the directories listed for the dir source.
+func (backfillDatesCmd *BackfillDatesCmd) backfillTime(logger *slog.Logger, filePath string, exif Exif, listings *dirListings) (t time.Time, source string, hasOffset bool, err error) {
+	for _, source := range backfillDatesCmd.Sources {
+		switch source {
+		case "gps":
+			value, _ := exif.Tags["GPSDateTime"].(string)
+			if value == "" {
+				continue
+			}
+			t, err := parseExifTime(value)
+			if err != nil {
+				logger.Warn(err.Error(), slog.String("GPSDateTime", value))
+				continue
+			}
+			return t.Local(), source, true, nil
+		case "filename":
+			t := nameCreationTime(filepath.Base(filePath), backfillDatesCmd.NamePatterns)
+			if !t.IsZero() {
+				return t, source, false, nil
+			}
+		case "sidecar":
+			t := takeoutCreationTime(logger, filePath)
+			if !t.IsZero() {
+				return t.Local(), source, true, nil
+			}
+		case "dir":
+			t, err := dirCreationTime(filePath, defaultDirDatePatterns, listings)
+			if err != nil {
+				return time.Time{}, "", false, err
+			}
+			if !t.IsZero() {
+				return t, source, false, nil
+			}
+		case "mtime":
+			fileInfo, err := os.Stat(filePath)
+			if err != nil {
+				return time.Time{}, "", false, err
+			}
+			return fileInfo.ModTime().Local(), source, true, nil
+		}
+	}
+	return time.Time{}, "", false, nil
+}
+
+// Run writes a DateTimeOriginal into every file that lacks one, taken from
+// the first of Sources that has a date for it, so that exifutil and other
+// tools find the date in the file itself from then on. Files that already
+// have a DateTimeOriginal are left alone.
+func (backfillDatesCmd *BackfillDatesCmd) Run(ctx context.Context) error {
+	unmount, err := backfillDatesCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if !backfillDatesCmd.DryRun {
+		err := backfillDatesCmd.CheckSafety(backfillDatesCmd.Force, backfillDatesCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if !backfillDatesCmd.DryRun && !backfillDatesCmd.NoLock {
+		unlock, err := backfillDatesCmd.Lock(backfillDatesCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var cache *exifCache
+	if !backfillDatesCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			backfillDatesCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	// Only a DateTimeOriginal counts, not the other tags a creation time is
+	// usually taken from.
+	dateSourceRules := []dateSourceRule{{ModelRegexp: regexp.MustCompile(""), Sources: []string{"SubSecDateTimeOriginal"}}}
+	tags := backfillDatesCmd.Where.Tags()
+	if slices.Contains(backfillDatesCmd.Sources, "gps") && !slices.Contains(tags, "GPSDateTime") {
+		tags = append(slices.Clip(tags), "GPSDateTime")
+	}
+	var waitGroup sync.WaitGroup
+	var numProcessed atomic.Int64
+	var lastProcessed atomic.Value
+	var numWorkersAlive atomic.Int64
+	var skippedMutex sync.Mutex
+	var skipped []string
+	var listings dirListings
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	filePaths := make(chan string)
+	// stopTuner is replaced below if the number of workers is auto-tuned.
+	stopTuner := func() {}
+	// Closing filePaths tells the workers to exit once they have finished the
+	// file they are currently working on.
+	stopWorkers := sync.OnceFunc(func() {
+		stopTuner()
+		close(filePaths)
+		waitGroup.Wait()
+	})
+	defer stopWorkers()
+	startWorker := func() error {
+		exifTool, err := startExifTool(ctx, backfillDatesCmd.Stderr, backfillDatesCmd.Timeout, backfillDatesCmd.Charset, backfillDatesCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = dateSourceRules
+		exifTool.ReadArgs = backfillDatesCmd.ExifToolArgs
+		exifTool.Tags = tags
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					backfillDatesCmd.logger.Warn(err.Error())
+				}
+			}()
+			// If every worker has exited early because its exiftool session
+			// died, nothing is left to receive from filePaths and the walker
+			// would block forever.
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for filePath := range filePaths {
+				if ctx.Err() != nil {
+					continue
+				}
+				numProcessed.Add(1)
+				lastProcessed.Store(filePath)
+				logger := backfillDatesCmd.logger.With(slog.String("filePath", filePath))
+				if backfillDatesCmd.MinAge > 0 || backfillDatesCmd.StableFor > 0 {
+					err := checkFileStable(ctx, filePath, backfillDatesCmd.MinAge, backfillDatesCmd.StableFor)
+					if err != nil {
+						logger.Warn(err.Error())
+						continue
+					}
+				}
+				exifs, err := exifTool.FileExifs(logger, filePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				if len(exifs) == 0 {
+					logger.Error("exiftool returned empty array")
+					continue
+				}
+				if !backfillDatesCmd.MatchExifs(exifs) {
+					logger.Debug("not selected by -where")
+					continue
+				}
+				if !exifs[0].CreationTime.IsZero() {
+					logger.Debug("file already has a DateTimeOriginal")
+					continue
+				}
+				t, source, hasOffset, err := backfillDatesCmd.backfillTime(logger, filePath, exifs[0], &listings)
+				if err != nil {
+					logger.Error(err.Error())
+					continue
+				}
+				if t.IsZero() {
+					logger.Info("no date found, skipping")
+					skippedMutex.Lock()
+					skipped = append(skipped, filePath)
+					skippedMutex.Unlock()
+					continue
+				}
+				value := t.Format("2006:01:02 15:04:05")
+				if hasOffset {
+					value += t.Format("-07:00")
+				}
+				if backfillDatesCmd.DryRun {
+					fmt.Fprintf(backfillDatesCmd.Stdout, "%s DateTimeOriginal=%s (%s)\n", filePath, value, source)
+					continue
+				}
+				args := []string{"-P", "-overwrite_original", "-DateTimeOriginal=" + t.Format("2006:01:02 15:04:05")}
+				if hasOffset {
+					args = append(args, "-OffsetTimeOriginal="+t.Format("-07:00"))
+				}
+				_, err = exifTool.Execute(append(args, filePath)...)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				logger.Info("wrote DateTimeOriginal", slog.String("DateTimeOriginal", value), slog.String("dateSource", source))
+			}
+			exitedEarly = false
+		}()
+		return nil
+	}
+	numWorkers := backfillDatesCmd.NumWorkers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	for i := 0; i < numWorkers; i++ {
+		err := startWorker()
+		if err != nil {
+			return err
+		}
+	}
+	if backfillDatesCmd.NumWorkers == 0 {
+		tunerCtx, cancelTuner := context.WithCancel(ctx)
+		tunerDone := make(chan struct{})
+		go func() {
+			defer close(tunerDone)
+			autoTuneWorkers(tunerCtx, backfillDatesCmd.logger, &numProcessed, numWorkers, startWorker)
+		}()
+		stopTuner = func() {
+			cancelTuner()
+			<-tunerDone
+		}
+	}
+
+	walkErr := backfillDatesCmd.Walk(nil, func(root, filePath string) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case filePaths <- filePath:
+			return nil
+		}
+	})
+	stopWorkers()
+	if len(skipped) > 0 {
+		fmt.Fprintf(backfillDatesCmd.Stderr, "skipped %d files without a DateTimeOriginal that none of the sources had a date for:\n", len(skipped))
+		for _, filePath := range skipped {
+			fmt.Fprintln(backfillDatesCmd.Stderr, "  "+filePath)
+		}
+	}
+	if ctx.Err() != nil {
+		lastFilePath, _ := lastProcessed.Load().(string)
+		fmt.Fprintf(backfillDatesCmd.Stderr, "stopped after processing %d files (last processed: %s)\n", numProcessed.Load(), lastFilePath)
+		return context.Cause(ctx)
+	}
+	return walkErr
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type BenchCmd struct {
+	FileSelector
+	// Sample is the number of files picked at random to benchmark on.
+	Sample int
+	// Seed, if non-zero, makes the sample the same from run to run.
+	Seed uint64
+	// Workers are the numbers of workers to measure.
+	Workers []int
+	// Destination, if set, is the directory whose file system moves are
+	// measured on.
+	Destination    string
+	Timeout        time.Duration
+	Charset        string
+	ExifToolConfig string
+	ExifToolArgs   []string
+	Verbose        bool
+	Stdout         io.Writer
+	Stderr         io.Writer
+	logger         *slog.Logger
+}
+
+func BenchCommand(args []string) (*BenchCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	benchCmd := &BenchCmd{
+		FileSelector: fileSelector,
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	for n := 1; n <= 4*runtime.NumCPU(); n *= 2 {
+		benchCmd.Workers = append(benchCmd.Workers, n)
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.IntVar(&benchCmd.Sample, "sample", 100, "Number of files picked at random to benchmark on.")
+	flagset.Uint64Var(&benchCmd.Seed, "seed", 0, "Seed of the random sample, to benchmark on the same files again. 0 means a different sample every time.")
+	flagset.Func("workers", "Comma separated numbers of workers to measure e.g. 1,2,4,8. (default powers of two up to 4 per CPU)", func(value string) error {
+		benchCmd.Workers = nil
+		for _, field := range strings.Split(value, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid number of workers %q", field)
+			}
+			benchCmd.Workers = append(benchCmd.Workers, n)
+		}
+		return nil
+	})
+	flagset.Func("to", "Directory to measure moves into, on the file system the files would be moved to. Moves are only measured if it is given, on empty scratch files that are removed afterwards.", func(value string) error {
+		destination, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		benchCmd.Destination = destination
+		return nil
+	})
+	flagset.DurationVar(&benchCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&benchCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		benchCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		benchCmd.ExifToolArgs = args
+		return nil
+	})
+	benchCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&benchCmd.Verbose, "verbose", false, "Verbose output.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = benchCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	if benchCmd.Sample <= 0 {
+		return nil, fmt.Errorf("-sample must be positive")
+	}
+	slices.Sort(benchCmd.Workers)
+	benchCmd.Workers = slices.Compact(benchCmd.Workers)
+	benchCmd.logger = newLogger(benchCmd.Stderr, benchCmd.Verbose)
+	return benchCmd, nil
+}
+
+// benchResult is the throughput measured with a number of workers.
+type benchResult struct {
+	Workers     int
+	FilesPerSec float64
+}
+
+// Run measures how many files per second metadata can be read from a random
+// sample of the selected files, and optionally moved on the destination's
+// file system, with each number of workers, as well as how fast the sample
+// is hashed with each hash algorithm, and suggests the settings for
+// -num-workers, -num-move-workers and -hash-algorithm.
+func (benchCmd *BenchCmd) Run(ctx context.Context) error {
+	unmount, err := benchCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	random := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	if benchCmd.Seed != 0 {
+		random = rand.New(rand.NewPCG(benchCmd.Seed, benchCmd.Seed))
+	}
+	var sample []string
+	var numFiles int
+	err = benchCmd.Walk(nil, func(root, filePath string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		numFiles++
+		if len(sample) < benchCmd.Sample {
+			sample = append(sample, filePath)
+			return nil
+		}
+		i := random.IntN(numFiles)
+		if i < benchCmd.Sample {
+			sample[i] = filePath
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		fmt.Fprintln(benchCmd.Stderr, "no files selected")
+		return nil
+	}
+	// The first pass over the sample only warms up the OS's file cache, so
+	// that the first number of workers measured isn't the only one to read
+	// from disk.
+	fmt.Fprintf(benchCmd.Stderr, "reading the metadata of %d of %d files once to warm up\n", len(sample), numFiles)
+	_, err = benchCmd.benchExtract(ctx, sample, benchCmd.Workers[len(benchCmd.Workers)-1])
+	if err != nil {
+		return err
+	}
+	var extractResults []benchResult
+	for _, numWorkers := range benchCmd.Workers {
+		filesPerSec, err := benchCmd.benchExtract(ctx, sample, numWorkers)
+		if err != nil {
+			return err
+		}
+		extractResults = append(extractResults, benchResult{Workers: numWorkers, FilesPerSec: filesPerSec})
+	}
+	var moveResults []benchResult
+	if benchCmd.Destination != "" {
+		for _, numWorkers := range benchCmd.Workers {
+			filesPerSec, err := benchCmd.benchMove(ctx, len(sample), numWorkers)
+			if err != nil {
+				return err
+			}
+			moveResults = append(moveResults, benchResult{Workers: numWorkers, FilesPerSec: filesPerSec})
+		}
+	}
+	hashResults := make(map[string]float64)
+	for _, algorithm := range []string{hashSHA256, hashSHA256Tree} {
+		bytesPerSec, err := benchCmd.benchHash(ctx, sample, algorithm)
+		if err != nil {
+			return err
+		}
+		hashResults[algorithm] = bytesPerSec
+	}
+	writer := tabwriter.NewWriter(benchCmd.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if len(moveResults) > 0 {
+		fmt.Fprintln(writer, "workers\tread files/s\tmove files/s\t")
+	} else {
+		fmt.Fprintln(writer, "workers\tread files/s\t")
+	}
+	for i, result := range extractResults {
+		fmt.Fprintf(writer, "%d\t%.1f\t", result.Workers, result.FilesPerSec)
+		if len(moveResults) > 0 {
+			fmt.Fprintf(writer, "%.1f\t", moveResults[i].FilesPerSec)
+		}
+		fmt.Fprintln(writer)
+	}
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "hash algorithm\tMB/s\t")
+	for _, algorithm := range []string{hashSHA256, hashSHA256Tree} {
+		fmt.Fprintf(writer, "%s\t%.1f\t\n", algorithm, hashResults[algorithm]/1e6)
+	}
+	writer.Flush()
+	suggestion := fmt.Sprintf("-num-workers %d", bestWorkers(extractResults))
+	if len(moveResults) > 0 {
+		suggestion += fmt.Sprintf(" -num-move-workers %d", bestWorkers(moveResults))
+	}
+	// sha256 is the default, since its hashes are the ones every other
+	// tool gives, so sha256-tree is only suggested where it is faster.
+	if hashResults[hashSHA256Tree] >= 1.05*hashResults[hashSHA256] {
+		suggestion += " -hash-algorithm " + hashSHA256Tree
+	}
+	fmt.Fprintln(benchCmd.Stdout, "suggested settings: "+suggestion)
+	return nil
+}
+
+// bestWorkers returns the smallest number of workers whose throughput is
+// within 5% of the best, since more workers than that cost memory and
+// exiftool sessions for little gain.
+func bestWorkers(results []benchResult) int {
+	var best float64
+	for _, result := range results {
+		best = max(best, result.FilesPerSec)
+	}
+	for _, result := range results {
+		if result.FilesPerSec >= 0.95*best {
+			return result.Workers
+		}
+	}
+	return results[len(results)-1].Workers
+}
+
+// benchExtract reads the metadata of every file in sample with numWorkers
+// exiftool sessions and returns the number of files read per second. Starting
+// the sessions isn't part of the measurement.
+func (benchCmd *BenchCmd) benchExtract(ctx context.Context, sample []string, numWorkers int) (float64, error) {
+	var exifTools []*exifTool
+	defer func() {
+		for _, exifTool := range exifTools {
+			err := exifTool.Close()
+			if err != nil {
+				benchCmd.logger.Warn(err.Error())
+			}
+		}
+	}()
+	for i := 0; i < numWorkers; i++ {
+		exifTool, err := startExifTool(ctx, benchCmd.Stderr, benchCmd.Timeout, benchCmd.Charset, benchCmd.ExifToolConfig)
+		if err != nil {
+			return 0, err
+		}
+		exifTool.ReadArgs = benchCmd.ExifToolArgs
+		exifTools = append(exifTools, exifTool)
+	}
+	queue := make(chan string)
+	var waitGroup sync.WaitGroup
+	startTime := time.Now()
+	for _, exifTool := range exifTools {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for filePath := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				logger := benchCmd.logger.With(slog.String("filePath", filePath))
+				_, err := exifTool.FileExifs(logger, filePath)
+				if err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errExifToolTimeout) {
+						err := exifTool.Restart()
+						if err != nil {
+							logger.Error(err.Error())
+						}
+					}
+				}
+			}
+		}()
+	}
+	for _, filePath := range sample {
+		queue <- filePath
+	}
+	close(queue)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	elapsed := time.Since(startTime)
+	benchCmd.logger.Info("read metadata", slog.Int("workers", numWorkers), slog.Duration("elapsed", elapsed))
+	return float64(len(sample)) / elapsed.Seconds(), nil
+}
+
+// benchHash hashes every file in sample, one after the other like the files
+// looked up in an archive, with algorithm and returns the number of bytes
+// hashed per second.
+func (benchCmd *BenchCmd) benchHash(ctx context.Context, sample []string, algorithm string) (float64, error) {
+	var numBytes int64
+	startTime := time.Now()
+	for _, filePath := range sample {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return 0, err
+		}
+		_, err = hashFileWith(ctx, algorithm, filePath)
+		if err != nil {
+			return 0, err
+		}
+		numBytes += fileInfo.Size()
+	}
+	elapsed := time.Since(startTime)
+	benchCmd.logger.Info("hashed files", slog.String("algorithm", algorithm), slog.Duration("elapsed", elapsed))
+	return float64(numBytes) / elapsed.Seconds(), nil
+}
+
+// benchMove moves numFiles empty scratch files into directories of their
+// own under Destination with numWorkers workers, like a move into a dated
+// directory structure, and returns the number of files moved per second.
+// Moves within a file system are renames that don't depend on the size of
+// the file. The scratch files are removed afterwards.
+func (benchCmd *BenchCmd) benchMove(ctx context.Context, numFiles, numWorkers int) (float64, error) {
+	err := os.MkdirAll(benchCmd.Destination, 0755)
+	if err != nil {
+		return 0, err
+	}
+	scratchDir, err := os.MkdirTemp(benchCmd.Destination, ".exifutil-bench-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(scratchDir)
+	srcDir := filepath.Join(scratchDir, "src")
+	err = os.Mkdir(srcDir, 0755)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < numFiles; i++ {
+		file, err := os.Create(filepath.Join(srcDir, strconv.Itoa(i)))
+		if err != nil {
+			return 0, err
+		}
+		file.Close()
+	}
+	queue := make(chan int)
+	var waitGroup sync.WaitGroup
+	var errMutex sync.Mutex
+	var moveErr error
+	startTime := time.Now()
+	for i := 0; i < numWorkers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				dir := filepath.Join(scratchDir, "dst", strconv.Itoa(i%12+1))
+				err := os.MkdirAll(dir, 0755)
+				if err == nil {
+					err = renameNoReplace(osFS{}, filepath.Join(srcDir, strconv.Itoa(i)), filepath.Join(dir, strconv.Itoa(i)), false)
+				}
+				if err != nil {
+					errMutex.Lock()
+					if moveErr == nil {
+						moveErr = err
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < numFiles; i++ {
+		queue <- i
+	}
+	close(queue)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if moveErr != nil {
+		return 0, moveErr
+	}
+	elapsed := time.Since(startTime)
+	benchCmd.logger.Info("moved files", slog.Int("workers", numWorkers), slog.Duration("elapsed", elapsed))
+	return float64(numFiles) / elapsed.Seconds(), nil
+}
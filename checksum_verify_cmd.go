@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type ChecksumVerifyCmd struct {
+	// Manifest is the manifest written by -manifest to verify against.
+	Manifest   string
+	NumWorkers int
+	// NoNew skips looking for files that aren't in the manifest.
+	NoNew         bool
+	IncludeHidden bool
+	Verbose       bool
+	Stdout        io.Writer
+	Stderr        io.Writer
+	logger        *slog.Logger
+}
+
+func ChecksumVerifyCommand(args []string) (*ChecksumVerifyCmd, error) {
+	checksumVerifyCmd := &ChecksumVerifyCmd{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil checksum-verify [FLAGS] MANIFEST")
+		flagset.PrintDefaults()
+	}
+	flagset.IntVar(&checksumVerifyCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means one per CPU.")
+	flagset.BoolVar(&checksumVerifyCmd.NoNew, "no-new", false, "Don't look for files under the directory of the manifest that aren't in it.")
+	flagset.BoolVar(&checksumVerifyCmd.IncludeHidden, "include-hidden", false, "Don't skip .DS_Store, Thumbs.db, desktop.ini and AppleDouble ._ files when looking for new files.")
+	flagset.BoolVar(&checksumVerifyCmd.Verbose, "verbose", false, "Verbose output.")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("expected 1 manifest, got %d", flagset.NArg())
+	}
+	checksumVerifyCmd.Manifest, err = filepath.Abs(flagset.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	if checksumVerifyCmd.NumWorkers == 0 {
+		checksumVerifyCmd.NumWorkers = runtime.NumCPU()
+	}
+	checksumVerifyCmd.logger = newLogger(checksumVerifyCmd.Stdout, checksumVerifyCmd.Verbose)
+	return checksumVerifyCmd, nil
+}
+
+// Run re-hashes every file in the manifest and reports the ones whose
+// contents changed (corrupted) or that are gone (missing), as well as files
+// under the manifest's directory that aren't in it (new).
+func (checksumVerifyCmd *ChecksumVerifyCmd) Run(ctx context.Context) error {
+	entries, err := readManifest(checksumVerifyCmd.Manifest)
+	if err != nil {
+		return err
+	}
+	var numCorrupted, numMissing, numNew int
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	queue := make(chan manifestEntry)
+	for i := 0; i < checksumVerifyCmd.NumWorkers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for entry := range queue {
+				logger := checksumVerifyCmd.logger.With(slog.String("filePath", entry.FilePath))
+				hash, err := hashFile(ctx, entry.FilePath)
+				if err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
+					if errors.Is(err, fs.ErrNotExist) {
+						mutex.Lock()
+						numMissing++
+						mutex.Unlock()
+						fmt.Fprintf(checksumVerifyCmd.Stdout, "missing: %s\n", entry.FilePath)
+						continue
+					}
+					logger.Error(err.Error())
+					continue
+				}
+				if hash != entry.SHA256 {
+					mutex.Lock()
+					numCorrupted++
+					mutex.Unlock()
+					fmt.Fprintf(checksumVerifyCmd.Stdout, "corrupted: %s\n", entry.FilePath)
+					continue
+				}
+				logger.Info("verified file")
+			}
+		}()
+	}
+loop:
+	for _, entry := range entries {
+		select {
+		case <-ctx.Done():
+			break loop
+		case queue <- entry:
+		}
+	}
+	close(queue)
+	waitGroup.Wait()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if !checksumVerifyCmd.NoNew {
+		known := make(map[string]bool)
+		for _, entry := range entries {
+			known[entry.FilePath] = true
+		}
+		err := filepath.WalkDir(filepath.Dir(checksumVerifyCmd.Manifest), func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if dirEntry.IsDir() && dirEntry.Name() == trashDirName {
+				return fs.SkipDir
+			}
+			if !dirEntry.Type().IsRegular() || path == checksumVerifyCmd.Manifest || known[path] {
+				return nil
+			}
+			if !checksumVerifyCmd.IncludeHidden && isHiddenSystemFile(dirEntry.Name()) {
+				return nil
+			}
+			numNew++
+			fmt.Fprintf(checksumVerifyCmd.Stdout, "new: %s\n", path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(checksumVerifyCmd.Stderr, "verified %d files: %d corrupted, %d missing, %d new\n", len(entries), numCorrupted, numMissing, numNew)
+	if numCorrupted > 0 || numMissing > 0 {
+		return fmt.Errorf("%d corrupted and %d missing files", numCorrupted, numMissing)
+	}
+	return nil
+}
+
+// readManifest reads a manifest written by manifestWriter, in either the
+// sha256sum or the CSV/TSV format, resolving relative paths against the
+// directory of the manifest.
+func readManifest(name string) ([]manifestEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dir := filepath.Dir(name)
+	resolve := func(filePath string) string {
+		filePath = filepath.FromSlash(filePath)
+		if filepath.IsAbs(filePath) {
+			return filePath
+		}
+		return filepath.Join(dir, filePath)
+	}
+	var entries []manifestEntry
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".csv" || ext == ".tsv" {
+		reader := csv.NewReader(file)
+		if ext == ".tsv" {
+			reader.Comma = '\t'
+		}
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 || !slices.Equal(records[0][:min(2, len(records[0]))], []string{"sha256", "path"}) {
+			return nil, fmt.Errorf("%s: not a manifest", name)
+		}
+		for _, record := range records[1:] {
+			entries = append(entries, manifestEntry{SHA256: record[0], FilePath: resolve(record[1])})
+		}
+		return entries, nil
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// A leading backslash marks a name with escaped backslashes or
+		// newlines in it.
+		escaped := strings.HasPrefix(line, `\`)
+		line = strings.TrimPrefix(line, `\`)
+		hash, filePath, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != 64 || filePath == "" {
+			return nil, fmt.Errorf("%s:%d: expected SHA256  PATH", name, lineNumber)
+		}
+		// sha256sum marks files hashed in binary mode with a * in place of
+		// the second space.
+		filePath = filePath[1:]
+		if escaped {
+			filePath = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(filePath)
+		}
+		entries = append(entries, manifestEntry{SHA256: strings.ToLower(hash), FilePath: resolve(filePath)})
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CompareCmd struct {
+	SrcDir          string
+	DstDir          string
+	FileRegexps     []*regexp.Regexp
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	IncludeHidden   bool
+	HashAlgorithm   string
+	Verbose         bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func CompareCommand(args []string) (*CompareCmd, error) {
+	compareCmd := &CompareCmd{
+		ExifToolArgs:  defaultReadArgs,
+		HashAlgorithm: hashSHA256,
+		Stdout:        stdout,
+		Stderr:        stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil compare [FLAGS] SRC_DIR DST_DIR")
+		flagset.PrintDefaults()
+	}
+	flagset.IntVar(&compareCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means one per CPU.")
+	flagset.DurationVar(&compareCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&compareCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		compareCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		compareCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&compareCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		compareCmd.DateSourceRules = append(compareCmd.DateSourceRules, rule)
+		return nil
+	})
+	flagset.BoolVar(&compareCmd.IncludeHidden, "include-hidden", false, "Don't skip .DS_Store, Thumbs.db, desktop.ini and AppleDouble ._ files.")
+	flagset.Func("hash-algorithm", "Hash algorithm used to find files with the same contents: sha256 hashes each file on a single CPU, giving the same hashes as sha256sum, and sha256-tree hashes the chunks of large files on every CPU at once, to keep up with fast drives, giving hashes of large files that no other tool does. exifutil bench measures both on a sample of the files. (default sha256)", func(value string) error {
+		algorithm, err := parseHashAlgorithm(value)
+		if err != nil {
+			return err
+		}
+		compareCmd.HashAlgorithm = algorithm
+		return nil
+	})
+	flagset.BoolVar(&compareCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.Func("file", "Include file regex. Can be repeated. If omitted, all files are compared.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		compareCmd.FileRegexps = append(compareCmd.FileRegexps, r)
+		return nil
+	})
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 2 {
+		flagset.Usage()
+		return nil, fmt.Errorf("expected 2 directories, got %d", flagset.NArg())
+	}
+	compareCmd.SrcDir, err = filepath.Abs(flagset.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	compareCmd.DstDir, err = filepath.Abs(flagset.Arg(1))
+	if err != nil {
+		return nil, err
+	}
+	if compareCmd.NumWorkers == 0 {
+		compareCmd.NumWorkers = runtime.NumCPU()
+	}
+	compareCmd.logger = newLogger(compareCmd.Stdout, compareCmd.Verbose)
+	return compareCmd, nil
+}
+
+// compareFile is a file in one of the two trees being compared.
+type compareFile struct {
+	FilePath string
+	Hash     string
+	// CreationTime is only fetched for files whose hash has no match in the
+	// other tree.
+	CreationTime time.Time
+}
+
+func (compareCmd *CompareCmd) Run(ctx context.Context) error {
+	srcFiles, err := compareCmd.listFiles(compareCmd.SrcDir)
+	if err != nil {
+		return err
+	}
+	dstFiles, err := compareCmd.listFiles(compareCmd.DstDir)
+	if err != nil {
+		return err
+	}
+	files := append(srcFiles, dstFiles...)
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.FilePath
+	}
+	hashes, err := hashFiles(ctx, compareCmd.logger, compareCmd.NumWorkers, compareCmd.HashAlgorithm, paths)
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		file.Hash = hashes[i]
+	}
+	srcHashes := make(map[string]bool)
+	for _, file := range srcFiles {
+		srcHashes[file.Hash] = true
+	}
+	dstHashes := make(map[string]bool)
+	for _, file := range dstFiles {
+		dstHashes[file.Hash] = true
+	}
+	var srcOnly, dstOnly []*compareFile
+	for _, file := range srcFiles {
+		if !dstHashes[file.Hash] {
+			srcOnly = append(srcOnly, file)
+		}
+	}
+	for _, file := range dstFiles {
+		if !srcHashes[file.Hash] {
+			dstOnly = append(dstOnly, file)
+		}
+	}
+	// Files whose contents differ may still be the same photo if only its
+	// metadata was rewritten, so fall back to matching on creation time.
+	err = compareCmd.fetchCreationTimes(ctx, append(srcOnly, dstOnly...))
+	if err != nil {
+		return err
+	}
+	dstByTime := make(map[string][]*compareFile)
+	for _, file := range dstOnly {
+		if file.CreationTime.IsZero() {
+			continue
+		}
+		key := compareKey(file)
+		dstByTime[key] = append(dstByTime[key], file)
+	}
+	matched := make(map[*compareFile]bool)
+	var numChanged, numMissingFromDst, numMissingFromSrc int
+	for _, file := range srcOnly {
+		if !file.CreationTime.IsZero() {
+			key := compareKey(file)
+			if candidates := dstByTime[key]; len(candidates) > 0 {
+				dstByTime[key] = candidates[1:]
+				matched[candidates[0]] = true
+				numChanged++
+				fmt.Fprintf(compareCmd.Stdout, "changed: %s <=> %s\n", file.FilePath, candidates[0].FilePath)
+				continue
+			}
+		}
+		numMissingFromDst++
+		fmt.Fprintf(compareCmd.Stdout, "missing from %s: %s\n", compareCmd.DstDir, file.FilePath)
+	}
+	for _, file := range dstOnly {
+		if matched[file] {
+			continue
+		}
+		numMissingFromSrc++
+		fmt.Fprintf(compareCmd.Stdout, "missing from %s: %s\n", compareCmd.SrcDir, file.FilePath)
+	}
+	fmt.Fprintf(compareCmd.Stderr, "compared %d files in %s with %d files in %s: %d changed, %d missing from %s, %d missing from %s\n",
+		len(srcFiles), compareCmd.SrcDir, len(dstFiles), compareCmd.DstDir, numChanged, numMissingFromDst, compareCmd.DstDir, numMissingFromSrc, compareCmd.SrcDir)
+	if numMissingFromDst > 0 {
+		return fmt.Errorf("%d files missing from %s", numMissingFromDst, compareCmd.DstDir)
+	}
+	return nil
+}
+
+// compareKey returns the key used to match files with different contents
+// across the two trees. It is only accurate to the second because
+// CreateDate-based creation times are given random milliseconds.
+func compareKey(file *compareFile) string {
+	return file.CreationTime.UTC().Format("2006-01-02T15:04:05") + strings.ToLower(filepath.Ext(file.FilePath))
+}
+
+func (compareCmd *CompareCmd) listFiles(root string) ([]*compareFile, error) {
+	var files []*compareFile
+	err := filepath.WalkDir(root, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.IsDir() && dirEntry.Name() == trashDirName {
+			return fs.SkipDir
+		}
+		if !dirEntry.Type().IsRegular() {
+			return nil
+		}
+		if !compareCmd.IncludeHidden && isHiddenSystemFile(dirEntry.Name()) {
+			return nil
+		}
+		if len(compareCmd.FileRegexps) > 0 && !slices.ContainsFunc(compareCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+			return fileRegexp.MatchString(dirEntry.Name())
+		}) {
+			return nil
+		}
+		files = append(files, &compareFile{FilePath: path})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// hashFiles hashes the files at paths with numWorkers workers, and returns
+// their hashes in the same order. It stops at the first file that can't be
+// hashed.
+func hashFiles(ctx context.Context, logger *slog.Logger, numWorkers int, algorithm string, paths []string) ([]string, error) {
+	hashes := make([]string, len(paths))
+	var waitGroup sync.WaitGroup
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	queue := make(chan int)
+	for i := 0; i < numWorkers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range queue {
+				hash, err := hashFileWith(ctx, algorithm, paths[i])
+				if err != nil {
+					cancel(err)
+					continue
+				}
+				hashes[i] = hash
+				logger.Info("hashed file", slog.String("filePath", paths[i]), slog.String("hash", hash))
+			}
+		}()
+	}
+loop:
+	for i := range paths {
+		select {
+		case <-ctx.Done():
+			break loop
+		case queue <- i:
+		}
+	}
+	close(queue)
+	waitGroup.Wait()
+	err := context.Cause(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func hashFile(ctx context.Context, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, &contextReader{ctx: ctx, reader: file})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Hash algorithms for -hash-algorithm. hashSHA256Tree hashes the chunks of a
+// file in parallel, which a single SHA-256 can't do, and so keeps up with
+// fast drives where hashFile is limited to the speed of one core. Files no
+// larger than one chunk get the same hash from both.
+const (
+	hashSHA256     = "sha256"
+	hashSHA256Tree = "sha256-tree"
+)
+
+// hashChunkSize is the size of the chunks hashSHA256Tree hashes in parallel.
+const hashChunkSize = 4 << 20
+
+// hashChunkSlots bounds the chunks being hashed at once across every
+// hashFileTree call to one per CPU, however many files the worker pools hash
+// concurrently, and hashChunkBuffers holds the buffers they are read into.
+var (
+	hashChunkSlots   = make(chan struct{}, runtime.GOMAXPROCS(0))
+	hashChunkBuffers = sync.Pool{New: func() any {
+		buf := make([]byte, hashChunkSize)
+		return &buf
+	}}
+)
+
+// parseHashAlgorithm parses the value of -hash-algorithm.
+func parseHashAlgorithm(value string) (string, error) {
+	switch value {
+	case hashSHA256, hashSHA256Tree:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid hash algorithm %q, must be %s or %s", value, hashSHA256, hashSHA256Tree)
+}
+
+// hashFileWith hashes filePath with algorithm. Hashes from different
+// algorithms must not be compared.
+func hashFileWith(ctx context.Context, algorithm, filePath string) (string, error) {
+	if algorithm == hashSHA256Tree {
+		return hashFileTree(ctx, filePath)
+	}
+	return hashFile(ctx, filePath)
+}
+
+// hashFileTree returns the SHA-256 of the SHA-256s of every hashChunkSize
+// chunk of filePath, which are hashed in parallel as hashChunkSlots allow.
+func hashFileTree(ctx context.Context, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fileInfo.Size() <= hashChunkSize {
+		file.Close()
+		return hashFile(ctx, filePath)
+	}
+	numChunks := int((fileInfo.Size() + hashChunkSize - 1) / hashChunkSize)
+	sums := make([][sha256.Size]byte, numChunks)
+	var nextChunk atomic.Int64
+	var waitGroup sync.WaitGroup
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	for i := 0; i < min(runtime.GOMAXPROCS(0), numChunks); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for {
+				chunk := int(nextChunk.Add(1) - 1)
+				if chunk >= numChunks || ctx.Err() != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case hashChunkSlots <- struct{}{}:
+				}
+				buf := hashChunkBuffers.Get().(*[]byte)
+				n, err := file.ReadAt(*buf, int64(chunk)*hashChunkSize)
+				if err == nil || errors.Is(err, io.EOF) {
+					sums[chunk] = sha256.Sum256((*buf)[:n])
+				}
+				hashChunkBuffers.Put(buf)
+				<-hashChunkSlots
+				if err != nil && !errors.Is(err, io.EOF) {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+	err = context.Cause(ctx)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(hashSHA256Tree + "\x00"))
+	for _, sum := range sums {
+		hash.Write(sum[:])
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (compareCmd *CompareCmd) fetchCreationTimes(ctx context.Context, files []*compareFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var cache *exifCache
+	if !compareCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			compareCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var waitGroup sync.WaitGroup
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	// Wait for the workers before cancelling ctx, otherwise the exiftool
+	// processes of files still being worked on are killed.
+	defer waitGroup.Wait()
+	queue := make(chan *compareFile)
+	defer close(queue)
+	for i := 0; i < min(compareCmd.NumWorkers, len(files)); i++ {
+		exifTool, err := startExifTool(ctx, compareCmd.Stderr, compareCmd.Timeout, compareCmd.Charset, compareCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = compareCmd.DateSourceRules
+		exifTool.ReadArgs = compareCmd.ExifToolArgs
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					compareCmd.logger.Warn(err.Error())
+				}
+			}()
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for file := range queue {
+				logger := compareCmd.logger.With(slog.String("filePath", file.FilePath))
+				exifs, err := exifTool.FileExifs(logger, file.FilePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				exif, err := fileExif(logger, file.FilePath, exifs)
+				if err != nil {
+					logger.Info(err.Error())
+					continue
+				}
+				file.CreationTime = exif.CreationTime
+			}
+			exitedEarly = false
+		}()
+	}
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case queue <- file:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHashFileWith(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []int{0, 1000, hashChunkSize, 2*hashChunkSize + 1} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		filePath := filepath.Join(dir, "file")
+		err := os.WriteFile(filePath, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		want := hex.EncodeToString(sum[:])
+		// The default gives the same hash as sha256sum.
+		for _, algorithm := range []string{"", hashSHA256} {
+			got, err := hashFileWith(t.Context(), algorithm, filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%d bytes, %q: got %s, want %s", size, algorithm, got, want)
+			}
+		}
+		// The tree hash only matches for files of up to one chunk.
+		got, err := hashFileWith(t.Context(), hashSHA256Tree, filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == want) != (size <= hashChunkSize) {
+			t.Errorf("%d bytes, %s: got %s, sha256 is %s", size, hashSHA256Tree, got, want)
+		}
+	}
+}
+
+func TestHashAlgorithmDefaults(t *testing.T) {
+	index, err := newArchiveIndex(t.Context(), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.algorithm != hashSHA256 {
+		t.Errorf("archive index: got %s, want %s", index.algorithm, hashSHA256)
+	}
+	dir := t.TempDir()
+	compareCmd, err := CompareCommand([]string{dir, dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compareCmd.HashAlgorithm != hashSHA256 {
+		t.Errorf("compare: got %s, want %s", compareCmd.HashAlgorithm, hashSHA256)
+	}
+	reconcileCmd, err := ReconcileCommand([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconcileCmd.HashAlgorithm != hashSHA256 {
+		t.Errorf("reconcile: got %s, want %s", reconcileCmd.HashAlgorithm, hashSHA256)
+	}
+}
+
+func TestHashFiles(t *testing.T) {
+	dir := t.TempDir()
+	var paths, want []string
+	for i := range 10 {
+		data := []byte(strings.Repeat("x", i))
+		filePath := filepath.Join(dir, fmt.Sprintf("%d.jpg", i))
+		err := os.WriteFile(filePath, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		paths = append(paths, filePath)
+		want = append(want, hex.EncodeToString(sum[:]))
+	}
+	logger := newLogger(io.Discard, false)
+	got, err := hashFiles(t.Context(), logger, 3, hashSHA256, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	_, err = hashFiles(t.Context(), logger, 3, hashSHA256, append(paths, filepath.Join(dir, "missing.jpg")))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: got error %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestHashFileTreeConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i := range 2 * cap(hashChunkSlots) {
+		data := make([]byte, 2*hashChunkSize+i)
+		for j := range data {
+			data[j] = byte(i + j*7)
+		}
+		filePath := filepath.Join(dir, fmt.Sprintf("%d.mp4", i))
+		err := os.WriteFile(filePath, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filePath)
+	}
+	var want []string
+	for _, filePath := range paths {
+		hash, err := hashFileTree(t.Context(), filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, hash)
+	}
+	// More files than there are chunk slots, all hashed at once, share the
+	// slots without deadlocking or mixing up their chunks.
+	got, err := hashFiles(t.Context(), newLogger(io.Discard, false), len(paths), hashSHA256Tree, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
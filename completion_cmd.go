@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type CompletionCmd struct {
+	// Shell is one of bash, zsh or fish.
+	Shell  string
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func CompletionCommand(args []string) (*CompletionCmd, error) {
+	completionCmd := &CompletionCmd{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil completion bash|zsh|fish")
+		fmt.Fprintln(flagset.Output(), "")
+		fmt.Fprintln(flagset.Output(), "Print a completion script for the shell e.g. add 'source <(exifutil completion bash)' to ~/.bashrc,")
+		fmt.Fprintln(flagset.Output(), "'source <(exifutil completion zsh)' to ~/.zshrc or run")
+		fmt.Fprintln(flagset.Output(), "'exifutil completion fish > ~/.config/fish/completions/exifutil.fish'.")
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("expected a shell, got %d arguments", flagset.NArg())
+	}
+	switch flagset.Arg(0) {
+	case "bash", "zsh", "fish":
+		completionCmd.Shell = flagset.Arg(0)
+	default:
+		return nil, fmt.Errorf("invalid shell %q, must be bash, zsh or fish", flagset.Arg(0))
+	}
+	return completionCmd, nil
+}
+
+// completionSubcommand is a subcommand as offered by a completion script.
+type completionSubcommand struct {
+	Name        string
+	Description string
+	// Actions are the words that may follow the subcommand e.g. list,
+	// restore and empty for trash.
+	Actions []string
+	Flags   []completionFlag
+}
+
+// completionFlag is a flag of a subcommand.
+type completionFlag struct {
+	Name        string
+	Description string
+	TakesValue  bool
+	// Values are the values offered for the flag, if it takes one of a
+	// fixed set.
+	Values []string
+	// FileExt is the extension of the files offered for the flag, if it
+	// takes a file of one type.
+	FileExt string
+}
+
+// completionValues are the values offered for flags that take one of a
+// fixed set, keyed by the flag name or, where a subcommand accepts fewer
+// values than the others, by the subcommand and flag name.
+var completionValues = map[string][]string{
+	"on-parse-error":         {"skip", "strict", "fallback"},
+	"archive on-parse-error": {"skip", "strict"},
+	"long-names":             {"skip", "truncate"},
+	"normalize-names":        {"nfc", "nfd"},
+	"ambiguous-time":         {"earlier", "later", "skip"},
+	"check-free-space":       {"abort", "warn"},
+	"hash-algorithm":         {hashSHA256, hashSHA256Tree},
+	"strategy":               {"dir", "prefix"},
+	"format":                 {"jsonl", "csv", "tsv"},
+	"charset":                {"utf8", "cp1252", "latin1", "cp932"},
+	"move date-source":       {"mtime"},
+	"rename date-source":     {"mtime"},
+	"partition date-source":  {"mtime"},
+}
+
+// completionFileExts are the extensions of the files offered for flags that
+// take a file of one type, keyed by the flag name.
+var completionFileExts = map[string]string{
+	"ext-config": ".json",
+}
+
+// helptextRegexp matches a subcommand in helptext.
+var helptextRegexp = regexp.MustCompile(`(?m)^  exifutil ([a-z][a-z-]*) +# (.*)$`)
+
+// usageFlagRegexp matches the line PrintDefaults starts each flag with,
+// which names the type of its value unless it is a bool flag.
+var usageFlagRegexp = regexp.MustCompile(`^  -([\w-]+)( \S+)?$`)
+
+// completionSubcommands returns the subcommands listed in helptext, with the
+// flags each prints when run with -h. Asking the subcommands themselves
+// keeps the scripts in step with their flags without listing them twice.
+func completionSubcommands(ctx context.Context) ([]completionSubcommand, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var subcommands []completionSubcommand
+	for _, match := range helptextRegexp.FindAllStringSubmatch(helptext, -1) {
+		subcommand := completionSubcommand{Name: match[1], Description: match[2]}
+		usage, err := subcommandUsage(ctx, executable, subcommand.Name, "-h")
+		if err != nil {
+			return nil, err
+		}
+		parseUsage(&subcommand, usage)
+		// Subcommands that want an action first, like trash, only get as
+		// far as their flags once given one.
+		if len(subcommand.Flags) == 0 && len(subcommand.Actions) > 0 {
+			usage, err := subcommandUsage(ctx, executable, subcommand.Name, subcommand.Actions[0], "-h")
+			if err != nil {
+				return nil, err
+			}
+			subcommand.Actions = nil
+			parseUsage(&subcommand, usage)
+		}
+		subcommands = append(subcommands, subcommand)
+	}
+	return subcommands, nil
+}
+
+// subcommandUsage runs exifutil with args, which end in -h, and returns the
+// usage it prints.
+func subcommandUsage(ctx context.Context, executable string, args ...string) (string, error) {
+	var b bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	// Subcommands exit with an error for -h when they want an action
+	// first, after printing their usage all the same.
+	_ = cmd.Run()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return b.String(), nil
+}
+
+// parseUsage adds the actions and flags in the usage printed by subcommand
+// to it.
+func parseUsage(subcommand *completionSubcommand, usage string) {
+	for _, line := range strings.Split(usage, "\n") {
+		if rest, ok := strings.CutPrefix(line, "Usage: exifutil "+subcommand.Name+" "); ok {
+			for _, word := range strings.Fields(rest) {
+				word = strings.Trim(word, "[]")
+				if word == "" || word[0] < 'a' || word[0] > 'z' || word == "ARGS..." {
+					continue
+				}
+				subcommand.Actions = append(subcommand.Actions, strings.Split(word, "|")...)
+			}
+			continue
+		}
+		if description, ok := strings.CutPrefix(line, "    \t"); ok && len(subcommand.Flags) > 0 {
+			completionFlag := &subcommand.Flags[len(subcommand.Flags)-1]
+			if completionFlag.Description == "" {
+				completionFlag.Description = description
+			}
+			continue
+		}
+		match := usageFlagRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		completionFlag := completionFlag{Name: match[1], TakesValue: match[2] != ""}
+		if completionFlag.TakesValue {
+			completionFlag.Values = completionValues[subcommand.Name+" "+completionFlag.Name]
+			if completionFlag.Values == nil {
+				completionFlag.Values = completionValues[completionFlag.Name]
+			}
+			switch completionFlag.Name {
+			case "month-names":
+				for locale := range localeMonthNames {
+					completionFlag.Values = append(completionFlag.Values, "locale:"+locale)
+				}
+				slices.Sort(completionFlag.Values)
+			case "media-type":
+				// The patterns of a rule are up to the user, but its name
+				// is usually one of the defaults.
+				for _, rule := range defaultMediaTypes {
+					completionFlag.Values = append(completionFlag.Values, rule.Name+"=")
+				}
+			}
+			completionFlag.FileExt = completionFileExts[completionFlag.Name]
+		}
+		subcommand.Flags = append(subcommand.Flags, completionFlag)
+	}
+}
+
+// firstSentence returns the first sentence of a flag description, which is
+// all a completion menu has room for.
+func firstSentence(description string) string {
+	for i := 0; ; {
+		j := strings.Index(description[i:], ". ")
+		if j < 0 {
+			return strings.TrimSuffix(description, ".")
+		}
+		i += j
+		if !strings.HasSuffix(description[:i], "e.g") && !strings.HasSuffix(description[:i], "i.e") {
+			return description[:i]
+		}
+		i += 2
+	}
+}
+
+// Run prints the completion script for Shell.
+func (completionCmd *CompletionCmd) Run(ctx context.Context) error {
+	subcommands, err := completionSubcommands(ctx)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	switch completionCmd.Shell {
+	case "bash":
+		writeBashCompletion(&b, subcommands)
+	case "zsh":
+		writeZshCompletion(&b, subcommands)
+	case "fish":
+		writeFishCompletion(&b, subcommands)
+	}
+	_, err = io.WriteString(completionCmd.Stdout, b.String())
+	return err
+}
+
+// writeBashCompletion writes a bash completion script. Anything that isn't
+// a subcommand, action, flag or flag value falls back to file names.
+func writeBashCompletion(b *strings.Builder, subcommands []completionSubcommand) {
+	var names []string
+	for _, subcommand := range subcommands {
+		names = append(names, subcommand.Name)
+	}
+	b.WriteString("# bash completion for exifutil, generated by exifutil completion bash.\n")
+	b.WriteString("_exifutil() {\n")
+	b.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	b.WriteString("\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(b, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	b.WriteString("\t\treturn\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("\tcase \"${COMP_WORDS[1]} $prev\" in\n")
+	for _, subcommand := range subcommands {
+		for _, completionFlag := range subcommand.Flags {
+			if len(completionFlag.Values) > 0 {
+				fmt.Fprintf(b, "\t%q)\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\t\t;;\n", subcommand.Name+" -"+completionFlag.Name, strings.Join(completionFlag.Values, " "))
+			} else if completionFlag.FileExt != "" {
+				fmt.Fprintf(b, "\t%q)\n\t\tcompopt -o filenames 2>/dev/null\n\t\tCOMPREPLY=($(compgen -d -- \"$cur\") $(compgen -f -X '!*%s' -- \"$cur\"))\n\t\treturn\n\t\t;;\n", subcommand.Name+" -"+completionFlag.Name, completionFlag.FileExt)
+			}
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tlocal words\n")
+	b.WriteString("\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, subcommand := range subcommands {
+		var flags []string
+		for _, completionFlag := range subcommand.Flags {
+			flags = append(flags, "-"+completionFlag.Name)
+		}
+		fmt.Fprintf(b, "\t%s)\n", subcommand.Name)
+		if len(subcommand.Actions) > 0 {
+			fmt.Fprintf(b, "\t\t[ \"$COMP_CWORD\" -eq 2 ] && words=%q\n", strings.Join(subcommand.Actions, " "))
+		}
+		fmt.Fprintf(b, "\t\t[[ $cur == -* ]] && words=%q\n", strings.Join(flags, " "))
+		b.WriteString("\t\t;;\n")
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [ -n \"$words\" ]; then\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -o default -F _exifutil exifutil\n")
+}
+
+// writeZshCompletion writes a zsh completion script, which can be sourced
+// or installed as _exifutil in a directory on the fpath.
+func writeZshCompletion(b *strings.Builder, subcommands []completionSubcommand) {
+	b.WriteString("#compdef exifutil\n")
+	b.WriteString("# zsh completion for exifutil, generated by exifutil completion zsh.\n")
+	b.WriteString("_exifutil() {\n")
+	b.WriteString("\tif (( CURRENT == 2 )); then\n")
+	b.WriteString("\t\tlocal -a subcommands=(\n")
+	for _, subcommand := range subcommands {
+		fmt.Fprintf(b, "\t\t\t%s\n", zshQuote(subcommand.Name+":"+subcommand.Description))
+	}
+	b.WriteString("\t\t)\n")
+	b.WriteString("\t\t_describe subcommand subcommands\n")
+	b.WriteString("\t\treturn\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("\tcase \"${words[2]} ${words[CURRENT-1]}\" in\n")
+	for _, subcommand := range subcommands {
+		for _, completionFlag := range subcommand.Flags {
+			if len(completionFlag.Values) > 0 {
+				fmt.Fprintf(b, "\t%s)\n\t\tcompadd -- %s\n\t\treturn\n\t\t;;\n", zshQuote(subcommand.Name+" -"+completionFlag.Name), strings.Join(completionFlag.Values, " "))
+			} else if completionFlag.FileExt != "" {
+				fmt.Fprintf(b, "\t%s)\n\t\t_files -g '*%s'\n\t\treturn\n\t\t;;\n", zshQuote(subcommand.Name+" -"+completionFlag.Name), completionFlag.FileExt)
+			}
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tlocal -a flags actions\n")
+	b.WriteString("\tcase \"${words[2]}\" in\n")
+	for _, subcommand := range subcommands {
+		fmt.Fprintf(b, "\t%s)\n", subcommand.Name)
+		b.WriteString("\t\tflags=(\n")
+		for _, completionFlag := range subcommand.Flags {
+			fmt.Fprintf(b, "\t\t\t%s\n", zshQuote("-"+completionFlag.Name+":"+firstSentence(completionFlag.Description)))
+		}
+		b.WriteString("\t\t)\n")
+		if len(subcommand.Actions) > 0 {
+			fmt.Fprintf(b, "\t\tactions=(%s)\n", strings.Join(subcommand.Actions, " "))
+		}
+		b.WriteString("\t\t;;\n")
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ ${words[CURRENT]} == -* ]]; then\n")
+	b.WriteString("\t\t_describe flag flags\n")
+	b.WriteString("\telif (( CURRENT == 3 && ${#actions} > 0 )); then\n")
+	b.WriteString("\t\tcompadd -- $actions\n")
+	b.WriteString("\telse\n")
+	b.WriteString("\t\t_files\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n")
+	b.WriteString("if [ \"$funcstack[1]\" = \"_exifutil\" ]; then\n")
+	b.WriteString("\t_exifutil \"$@\"\n")
+	b.WriteString("else\n")
+	b.WriteString("\tcompdef _exifutil exifutil\n")
+	b.WriteString("fi\n")
+}
+
+// zshQuote quotes s as a single zsh word, escaping the colons _describe
+// would otherwise take as the end of the value. The colon separating the
+// value from its description is the first one, so it is left alone.
+func zshQuote(s string) string {
+	value, description, ok := strings.Cut(s, ":")
+	if ok {
+		s = value + ":" + strings.ReplaceAll(description, ":", `\:`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeFishCompletion writes a fish completion script.
+func writeFishCompletion(b *strings.Builder, subcommands []completionSubcommand) {
+	var names []string
+	for _, subcommand := range subcommands {
+		names = append(names, subcommand.Name)
+	}
+	b.WriteString("# fish completion for exifutil, generated by exifutil completion fish.\n")
+	b.WriteString("complete -c exifutil -f\n")
+	for _, subcommand := range subcommands {
+		fmt.Fprintf(b, "complete -c exifutil -n 'not __fish_seen_subcommand_from %s' -a %s -d %s\n", strings.Join(names, " "), subcommand.Name, fishQuote(subcommand.Description))
+	}
+	for _, subcommand := range subcommands {
+		condition := "__fish_seen_subcommand_from " + subcommand.Name
+		if len(subcommand.Actions) > 0 {
+			fmt.Fprintf(b, "complete -c exifutil -n %s -a %s\n", fishQuote(condition+"; and not __fish_seen_subcommand_from "+strings.Join(subcommand.Actions, " ")), fishQuote(strings.Join(subcommand.Actions, " ")))
+		}
+		for _, completionFlag := range subcommand.Flags {
+			fmt.Fprintf(b, "complete -c exifutil -n %s -o %s", fishQuote(condition), completionFlag.Name)
+			if len(completionFlag.Values) > 0 {
+				fmt.Fprintf(b, " -x -a %s", fishQuote(strings.Join(completionFlag.Values, " ")))
+			} else if completionFlag.FileExt != "" {
+				fmt.Fprintf(b, " -x -a %s", fishQuote("(__fish_complete_suffix "+completionFlag.FileExt+")"))
+			} else if completionFlag.TakesValue {
+				b.WriteString(" -r -F")
+			}
+			fmt.Fprintf(b, " -d %s\n", fishQuote(firstSentence(completionFlag.Description)))
+		}
+		// Anything else, like the directories to work on, is a file.
+		fmt.Fprintf(b, "complete -c exifutil -n %s -F\n", fishQuote(condition))
+	}
+}
+
+// fishQuote quotes s as a single fish word.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
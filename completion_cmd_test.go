@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseUsage(t *testing.T) {
+	usage := "Usage: exifutil partition [FLAGS] [DIR...]\n" +
+		"  -date-source value\n" +
+		"    \tTags to take the creation time from.\n" +
+		"  -ext-config value\n" +
+		"    \tJSON file configuring how files are treated by their extension.\n" +
+		"  -hash-algorithm value\n" +
+		"    \tHash algorithm.\n" +
+		"  -media-type value\n" +
+		"    \tWith -split-media, the directory NAME.\n" +
+		"  -month-names value\n" +
+		"    \tMonth names.\n" +
+		"  -split-media\n" +
+		"    \tPut the date directories of photos and videos under separate directories.\n"
+	subcommand := completionSubcommand{Name: "partition"}
+	parseUsage(&subcommand, usage)
+	flags := make(map[string]completionFlag)
+	for _, completionFlag := range subcommand.Flags {
+		flags[completionFlag.Name] = completionFlag
+	}
+	tests := []struct {
+		name    string
+		values  []string
+		fileExt string
+	}{
+		{name: "date-source", values: []string{"mtime"}},
+		{name: "ext-config", fileExt: ".json"},
+		{name: "hash-algorithm", values: []string{hashSHA256, hashSHA256Tree}},
+		{name: "media-type", values: []string{"photos=", "videos="}},
+		{name: "split-media"},
+	}
+	for _, tt := range tests {
+		completionFlag, ok := flags[tt.name]
+		if !ok {
+			t.Errorf("-%s: not found", tt.name)
+			continue
+		}
+		if !slices.Equal(completionFlag.Values, tt.values) || completionFlag.FileExt != tt.fileExt {
+			t.Errorf("-%s: got values %q and file extension %q, want %q and %q", tt.name, completionFlag.Values, completionFlag.FileExt, tt.values, tt.fileExt)
+		}
+	}
+	if values := flags["month-names"].Values; !slices.Contains(values, "locale:de") {
+		t.Errorf("-month-names: got values %q, want the locales", values)
+	}
+
+	// Files of the flag's type are offered by every shell.
+	subcommands := []completionSubcommand{subcommand}
+	for shell, write := range map[string]func(*strings.Builder, []completionSubcommand){
+		"bash": writeBashCompletion,
+		"zsh":  writeZshCompletion,
+		"fish": writeFishCompletion,
+	} {
+		var b strings.Builder
+		write(&b, subcommands)
+		want := map[string]string{
+			"bash": `compgen -f -X '!*.json'`,
+			"zsh":  `_files -g '*.json'`,
+			"fish": `-o ext-config -x -a '(__fish_complete_suffix .json)'`,
+		}[shell]
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%s: script has no %q:\n%s", shell, want, b.String())
+		}
+		if !strings.Contains(b.String(), "photos= videos=") {
+			t.Errorf("%s: script has no media type names:\n%s", shell, b.String())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+type CtlCmd struct {
+	// Socket is the path of the unix socket the daemon listens on.
+	Socket string
+	// Args is the command line for the daemon to run, starting with the
+	// subcommand.
+	Args   []string
+	Stdout io.Writer
+	Stderr io.Writer
+	logger *slog.Logger
+}
+
+func CtlCommand(args []string) (*CtlCmd, error) {
+	ctlCmd := &CtlCmd{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil ctl [FLAGS] rename|partition|move [ARGS...]")
+		flagset.PrintDefaults()
+	}
+	flagset.Func("socket", "Path of the unix socket the daemon listens on. (default daemon.sock in the exifutil user cache directory)", func(value string) error {
+		socket, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		ctlCmd.Socket = socket
+		return nil
+	})
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("no subcommand given")
+	}
+	ctlCmd.Args = flagset.Args()
+	if ctlCmd.Socket == "" {
+		ctlCmd.Socket, err = defaultDaemonSocket()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctlCmd.logger = newLogger(ctlCmd.Stderr, false)
+	return ctlCmd, nil
+}
+
+// Run has the daemon run the command in the current directory and passes
+// its output through. Interrupting Run interrupts the command.
+func (ctlCmd *CtlCmd) Run(ctx context.Context) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("unix", ctlCmd.Socket)
+	if err != nil {
+		return fmt.Errorf("%w (is exifutil daemon running?)", err)
+	}
+	defer conn.Close()
+	stopOnDone := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stopOnDone()
+	b, err := json.Marshal(daemonRequest{Dir: dir, Args: ctlCmd.Args})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var message daemonMessage
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			return err
+		}
+		if message.Done {
+			if message.Error != "" {
+				return errors.New(message.Error)
+			}
+			return nil
+		}
+		switch message.Stream {
+		case "stdout":
+			io.WriteString(ctlCmd.Stdout, message.Data)
+		case "stderr":
+			io.WriteString(ctlCmd.Stderr, message.Data)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("the daemon closed the connection before the command finished")
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+type DaemonCmd struct {
+	// Socket is the path of the unix socket to listen on.
+	Socket string
+	// RPCAddr, if set, is the address to serve the JSON-RPC API on.
+	RPCAddr string
+	// RPCToken is the bearer token every RPC request must carry. If it isn't
+	// set, Run generates one and writes it to RPCTokenFile.
+	RPCToken string
+	// RPCTokenFile is where a generated RPCToken is written to.
+	RPCTokenFile string
+	Verbose      bool
+	Stdout       io.Writer
+	Stderr       io.Writer
+	logger       *slog.Logger
+}
+
+func DaemonCommand(args []string) (*DaemonCmd, error) {
+	// The package-level stdout and stderr are pointed at each client in
+	// turn, so the daemon's own output goes straight to the process's.
+	daemonCmd := &DaemonCmd{
+		Stdout: &syncWriter{mutex: &sync.Mutex{}, w: os.Stdout},
+		Stderr: &syncWriter{mutex: &sync.Mutex{}, w: os.Stderr},
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Func("socket", "Path of the unix socket to listen on. (default daemon.sock in the exifutil user cache directory)", func(value string) error {
+		socket, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		daemonCmd.Socket = socket
+		return nil
+	})
+	flagset.StringVar(&daemonCmd.RPCAddr, "rpc-addr", "", "Also serve a JSON-RPC 2.0 API for submitting, following and cancelling jobs on this address under /rpc e.g. localhost:9102. Only loopback addresses are allowed unless -rpc-token is set.")
+	flagset.StringVar(&daemonCmd.RPCToken, "rpc-token", "", "Token the RPC API requires in an 'Authorization: Bearer TOKEN' header. If not set, a random token is generated on every start and written to rpc-token in the directory of -socket, readable only by you. (default $EXIFUTIL_RPC_TOKEN)")
+	flagset.BoolVar(&daemonCmd.Verbose, "verbose", false, "Log every command run.")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", flagset.Args())
+	}
+	if daemonCmd.RPCToken == "" {
+		daemonCmd.RPCToken = os.Getenv("EXIFUTIL_RPC_TOKEN")
+	}
+	if daemonCmd.Socket == "" {
+		daemonCmd.Socket, err = defaultDaemonSocket()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if daemonCmd.RPCAddr != "" && daemonCmd.RPCToken == "" {
+		// A generated token only keeps out whoever can't read the user's
+		// files, which is nobody on another machine.
+		if !isLoopbackAddr(daemonCmd.RPCAddr) {
+			return nil, fmt.Errorf("-rpc-addr %s is not a loopback address, which requires -rpc-token", daemonCmd.RPCAddr)
+		}
+		daemonCmd.RPCTokenFile = filepath.Join(filepath.Dir(daemonCmd.Socket), "rpc-token")
+	}
+	daemonCmd.logger = newLogger(daemonCmd.Stderr, daemonCmd.Verbose)
+	return daemonCmd, nil
+}
+
+// defaultDaemonSocket returns the path of the socket the daemon listens on
+// and exifutil ctl connects to if not told otherwise.
+func defaultDaemonSocket() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userCacheDir, "exifutil", "daemon.sock"), nil
+}
+
+// isLoopbackAddr reports whether the host of addr, a host:port, can only be
+// reached from this machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeRPCToken generates a random token and writes it to tokenFile,
+// readable only by the user.
+func writeRPCToken(tokenFile string) (string, error) {
+	err := os.MkdirAll(filepath.Dir(tokenFile), 0755)
+	if err != nil {
+		return "", err
+	}
+	// A temporary file is created with mode 0600, and renaming it over the
+	// token file replaces a token file of any mode.
+	tempFile, err := os.CreateTemp(filepath.Dir(tokenFile), "rpc-token-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	token := rand.Text()
+	_, err = io.WriteString(tempFile, token+"\n")
+	if err != nil {
+		tempFile.Close()
+		return "", err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tempFile.Name(), tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// daemonRequest is what exifutil ctl sends the daemon: the command line to
+// run, and the directory to run it in so that relative paths mean what they
+// do to the client.
+type daemonRequest struct {
+	Dir  string
+	Args []string
+}
+
+// daemonMessage is one line of the daemon's response: output of the command
+// (Stream is stdout or stderr), or, once the command is done, Done with the
+// error it failed with if any.
+type daemonMessage struct {
+	Stream string `json:",omitempty"`
+	Data   string `json:",omitempty"`
+	Done   bool   `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// daemonStreamWriter sends what is written to it to the client as
+// daemonMessages of one stream.
+type daemonStreamWriter struct {
+	mutex   *sync.Mutex
+	encoder *json.Encoder
+	stream  string
+}
+
+func (writer *daemonStreamWriter) Write(p []byte) (n int, err error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	err = writer.encoder.Encode(daemonMessage{Stream: writer.stream, Data: string(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Run serves commands sent by exifutil ctl until interrupted. Commands run
+// one at a time, since each one runs in its client's working directory and
+// writes to its client through the package-level stdout and stderr. The
+// exiftool processes they start are kept running in between.
+func (daemonCmd *DaemonCmd) Run(ctx context.Context) error {
+	err := os.MkdirAll(filepath.Dir(daemonCmd.Socket), 0755)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", daemonCmd.Socket)
+	if err != nil {
+		// A socket left behind by a daemon that didn't exit cleanly refuses
+		// connections, and is safe to replace.
+		conn, dialErr := net.Dial("unix", daemonCmd.Socket)
+		if dialErr == nil {
+			conn.Close()
+			return fmt.Errorf("a daemon is already listening on %s", daemonCmd.Socket)
+		}
+		removeErr := os.Remove(daemonCmd.Socket)
+		if removeErr != nil {
+			return err
+		}
+		listener, err = net.Listen("unix", daemonCmd.Socket)
+		if err != nil {
+			return err
+		}
+	}
+	defer listener.Close()
+	err = os.Chmod(daemonCmd.Socket, 0600)
+	if err != nil {
+		return err
+	}
+	exifToolSessions = newExifToolPool(ctx, 4*runtime.NumCPU())
+	defer func() {
+		exifToolSessions.Close()
+		exifToolSessions = nil
+	}()
+	stopListening := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stopListening()
+	fmt.Fprintf(daemonCmd.Stderr, "listening on %s\n", daemonCmd.Socket)
+	var runMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	defer waitGroup.Wait()
+	if daemonCmd.RPCAddr != "" {
+		if daemonCmd.RPCToken == "" {
+			daemonCmd.RPCToken, err = writeRPCToken(daemonCmd.RPCTokenFile)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(daemonCmd.Stderr, "wrote the RPC token to %s\n", daemonCmd.RPCTokenFile)
+		}
+		jobs, err := newDaemonJobs(ctx, daemonCmd, &runMutex)
+		if err != nil {
+			return err
+		}
+		defer jobs.Close()
+		stopRPC, err := jobs.Serve(daemonCmd.RPCAddr)
+		if err != nil {
+			return err
+		}
+		defer stopRPC()
+		fmt.Fprintf(daemonCmd.Stderr, "serving the RPC API on %s\n", daemonCmd.RPCAddr)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer conn.Close()
+			daemonCmd.serve(ctx, &runMutex, conn)
+		}()
+	}
+}
+
+// serve runs the command sent over conn.
+func (daemonCmd *DaemonCmd) serve(ctx context.Context, runMutex *sync.Mutex, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	var request daemonRequest
+	line, err := reader.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &request)
+	}
+	if err == nil && len(request.Args) == 0 {
+		err = fmt.Errorf("no subcommand given")
+	}
+	var writeMutex sync.Mutex
+	encoder := json.NewEncoder(conn)
+	if err != nil {
+		encoder.Encode(daemonMessage{Done: true, Error: err.Error()})
+		return
+	}
+	// The client closing the connection, like when ctl is interrupted,
+	// interrupts the command.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		cancel()
+	}()
+	clientStdout := &daemonStreamWriter{mutex: &writeMutex, encoder: encoder, stream: "stdout"}
+	clientStderr := &daemonStreamWriter{mutex: &writeMutex, encoder: encoder, stream: "stderr"}
+	if !runMutex.TryLock() {
+		fmt.Fprintln(clientStderr, "waiting for the command in progress to finish")
+		runMutex.Lock()
+	}
+	defer runMutex.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	logger := daemonCmd.logger.With(slog.Any("args", request.Args), slog.String("dir", request.Dir))
+	logger.Info("running command")
+	err = daemonCmd.run(ctx, request, "", clientStdout, clientStderr)
+	if err != nil {
+		logger.Info(err.Error())
+		writeMutex.Lock()
+		encoder.Encode(daemonMessage{Done: true, Error: request.Args[0] + ": " + err.Error()})
+		writeMutex.Unlock()
+		return
+	}
+	writeMutex.Lock()
+	encoder.Encode(daemonMessage{Done: true})
+	writeMutex.Unlock()
+}
+
+// run runs the command of request with its output going to clientStdout and
+// clientStderr. If report is set, it is where the command writes its report
+// unless it was given -report.
+func (daemonCmd *DaemonCmd) run(ctx context.Context, request daemonRequest, report string, clientStdout, clientStderr io.Writer) error {
+	err := os.Chdir(request.Dir)
+	if err != nil {
+		return err
+	}
+	stdoutWriter, stderrWriter := stdout.(*syncWriter), stderr.(*syncWriter)
+	outputMutex.Lock()
+	processStdout, processStderr := stdoutWriter.w, stderrWriter.w
+	stdoutWriter.w, stderrWriter.w = clientStdout, clientStderr
+	outputMutex.Unlock()
+	defer func() {
+		outputMutex.Lock()
+		stdoutWriter.w, stderrWriter.w = processStdout, processStderr
+		outputMutex.Unlock()
+	}()
+	cmd, err := newWatchedCommand(request.Args[0], request.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if report != "" {
+		switch cmd := cmd.(type) {
+		case *RenameCmd:
+			cmd.Report = cmp.Or(cmd.Report, report)
+		case *PartitionCmd:
+			cmd.Report = cmp.Or(cmd.Report, report)
+		case *MoveCmd:
+			cmd.Report = cmp.Or(cmd.Report, report)
+		}
+	}
+	return cmd.Run(ctx)
+}
+
+// maxJobOutput is how much of the end of each job's output the daemon keeps.
+const maxJobOutput = 64 * 1024
+
+// maxFinishedJobs is how many finished jobs the daemon remembers, along with
+// their reports.
+const maxFinishedJobs = 100
+
+// daemonJob is a command submitted through the RPC API.
+type daemonJob struct {
+	ID      int64
+	Request daemonRequest
+	// Report is where the job's report is written, if the command wasn't
+	// given -report.
+	Report string
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+	// state is queued, running, done, failed or canceled.
+	state  string
+	err    string
+	output []byte
+}
+
+// Write keeps the last maxJobOutput bytes of the job's output.
+func (job *daemonJob) Write(p []byte) (n int, err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.output = append(job.output, p...)
+	if len(job.output) > maxJobOutput {
+		job.output = job.output[len(job.output)-maxJobOutput:]
+	}
+	return len(p), nil
+}
+
+// daemonJobs runs the jobs submitted through the RPC API, one at a time
+// along with the commands sent by exifutil ctl.
+type daemonJobs struct {
+	ctx       context.Context
+	daemonCmd *DaemonCmd
+	runMutex  *sync.Mutex
+	// reportDir holds the reports of jobs whose command wasn't given
+	// -report.
+	reportDir string
+	mutex     sync.Mutex
+	lastID    int64
+	jobs      map[int64]*daemonJob
+	// queue is the order jobs are run in. A job is taken off once it
+	// starts.
+	queue     chan *daemonJob
+	waitGroup sync.WaitGroup
+}
+
+func newDaemonJobs(ctx context.Context, daemonCmd *DaemonCmd, runMutex *sync.Mutex) (*daemonJobs, error) {
+	reportDir, err := os.MkdirTemp("", "exifutil-daemon-*")
+	if err != nil {
+		return nil, err
+	}
+	jobs := &daemonJobs{
+		ctx:       ctx,
+		daemonCmd: daemonCmd,
+		runMutex:  runMutex,
+		reportDir: reportDir,
+		jobs:      make(map[int64]*daemonJob),
+		queue:     make(chan *daemonJob, 1024),
+	}
+	jobs.waitGroup.Add(1)
+	go func() {
+		defer jobs.waitGroup.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case job := <-jobs.queue:
+				jobs.run(job)
+			}
+		}
+	}()
+	return jobs, nil
+}
+
+// Close waits for the job in progress to be interrupted and removes the
+// reports. The daemon's context must be done.
+func (jobs *daemonJobs) Close() {
+	jobs.waitGroup.Wait()
+	os.RemoveAll(jobs.reportDir)
+}
+
+func (jobs *daemonJobs) run(job *daemonJob) {
+	job.mutex.Lock()
+	if job.state == "canceled" {
+		job.mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(jobs.ctx)
+	defer cancel()
+	job.cancel = cancel
+	job.mutex.Unlock()
+	jobs.runMutex.Lock()
+	defer jobs.runMutex.Unlock()
+	job.mutex.Lock()
+	if ctx.Err() == nil {
+		job.state = "running"
+	}
+	job.mutex.Unlock()
+	logger := jobs.daemonCmd.logger.With(slog.Int64("job", job.ID), slog.Any("args", job.Request.Args), slog.String("dir", job.Request.Dir))
+	logger.Info("running job")
+	err := ctx.Err()
+	if err == nil {
+		err = jobs.daemonCmd.run(ctx, job.Request, job.Report, job, job)
+	}
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		job.state = "canceled"
+	case err != nil:
+		logger.Info(err.Error())
+		job.state = "failed"
+		job.err = err.Error()
+	default:
+		job.state = "done"
+	}
+}
+
+// Submit queues a job and returns its ID.
+func (jobs *daemonJobs) Submit(request daemonRequest) (int64, error) {
+	if len(request.Args) == 0 {
+		return 0, fmt.Errorf("no subcommand given")
+	}
+	if !filepath.IsAbs(request.Dir) {
+		return 0, fmt.Errorf("dir must be an absolute path")
+	}
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	jobs.lastID++
+	job := &daemonJob{
+		ID:      jobs.lastID,
+		Request: request,
+		Report:  filepath.Join(jobs.reportDir, strconv.FormatInt(jobs.lastID, 10)+".csv"),
+		state:   "queued",
+	}
+	select {
+	case jobs.queue <- job:
+	default:
+		return 0, fmt.Errorf("too many jobs queued")
+	}
+	jobs.jobs[job.ID] = job
+	jobs.forgetFinished()
+	return job.ID, nil
+}
+
+// forgetFinished forgets the oldest finished jobs beyond maxFinishedJobs.
+// jobs.mutex must be held.
+func (jobs *daemonJobs) forgetFinished() {
+	ids := slices.Sorted(maps.Keys(jobs.jobs))
+	var finished []int64
+	for _, id := range ids {
+		job := jobs.jobs[id]
+		job.mutex.Lock()
+		if job.state != "queued" && job.state != "running" {
+			finished = append(finished, id)
+		}
+		job.mutex.Unlock()
+	}
+	for _, id := range finished[:max(0, len(finished)-maxFinishedJobs)] {
+		os.Remove(jobs.jobs[id].Report)
+		delete(jobs.jobs, id)
+	}
+}
+
+func (jobs *daemonJobs) job(id int64) (*daemonJob, error) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	job, ok := jobs.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("no job %d", id)
+	}
+	return job, nil
+}
+
+// Cancel interrupts a running job or stops a queued one from running.
+func (jobs *daemonJobs) Cancel(id int64) error {
+	job, err := jobs.job(id)
+	if err != nil {
+		return err
+	}
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	switch job.state {
+	case "queued":
+		job.state = "canceled"
+		if job.cancel != nil {
+			job.cancel()
+		}
+	case "running":
+		job.cancel()
+	}
+	return nil
+}
+
+// jobStatus is the result of the status and list methods.
+type jobStatus struct {
+	ID    int64    `json:"id"`
+	Dir   string   `json:"dir"`
+	Args  []string `json:"args"`
+	State string   `json:"state"`
+	Error string   `json:"error,omitempty"`
+	// Counts is the number of files per report status so far e.g. moved or
+	// failed.
+	Counts map[string]int `json:"counts"`
+	Output string         `json:"output,omitempty"`
+}
+
+func (jobs *daemonJobs) Status(id int64, withOutput bool) (jobStatus, error) {
+	job, err := jobs.job(id)
+	if err != nil {
+		return jobStatus{}, err
+	}
+	counts := make(map[string]int)
+	records, _ := jobs.readReport(job)
+	for _, record := range records[min(1, len(records)):] {
+		counts[record[len(record)-1]]++
+	}
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	status := jobStatus{
+		ID:     job.ID,
+		Dir:    job.Request.Dir,
+		Args:   job.Request.Args,
+		State:  job.state,
+		Error:  job.err,
+		Counts: counts,
+	}
+	if withOutput {
+		status.Output = string(job.output)
+	}
+	return status, nil
+}
+
+// readReport reads the job's report, or the part of it written so far.
+func (jobs *daemonJobs) readReport(job *daemonJob) ([][]string, error) {
+	file, err := os.Open(job.Report)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
+
+// rpcRequest and rpcResponse are JSON-RPC 2.0 messages.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serve serves the RPC API on addr under /rpc until the returned function
+// is called. The methods are:
+//
+//   - submit {"dir": DIR, "args": ["move", ...]} queues a command and returns
+//     {"id": ID}.
+//   - status {"id": ID} returns the job's state (queued, running, done,
+//     failed or canceled), its error, the number of files per report status
+//     so far and the end of its output.
+//   - list returns the status of every job, without output.
+//   - cancel {"id": ID} interrupts the job, or stops it from running if it
+//     is still queued.
+//   - report {"id": ID} returns the job's report as {"columns": [...],
+//     "rows": [[...], ...]}.
+func (jobs *daemonJobs) Serve(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /rpc", jobs.ServeHTTP)
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			jobs.daemonCmd.logger.Error(err.Error(), slog.String("rpcAddr", addr))
+		}
+	}()
+	return func() { server.Close() }, nil
+}
+
+func (jobs *daemonJobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := jobs.daemonCmd.RPCToken
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Browsers can send a cross-origin POST of a form or text/plain without
+	// asking first, but not one of application/json.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var request rpcRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request)
+	if err != nil {
+		json.NewEncoder(w).Encode(rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: -32700, Message: err.Error()}, ID: json.RawMessage("null")})
+		return
+	}
+	result, rpcErr := jobs.call(request)
+	response := rpcResponse{JSONRPC: "2.0", Result: result, Error: rpcErr, ID: request.ID}
+	if response.ID == nil {
+		response.ID = json.RawMessage("null")
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (jobs *daemonJobs) call(request rpcRequest) (any, *rpcError) {
+	var params struct {
+		ID   int64    `json:"id"`
+		Dir  string   `json:"dir"`
+		Args []string `json:"args"`
+	}
+	if len(request.Params) > 0 {
+		err := json.Unmarshal(request.Params, &params)
+		if err != nil {
+			return nil, &rpcError{Code: -32602, Message: err.Error()}
+		}
+	}
+	switch request.Method {
+	case "submit":
+		id, err := jobs.Submit(daemonRequest{Dir: params.Dir, Args: params.Args})
+		if err != nil {
+			return nil, &rpcError{Code: -32000, Message: err.Error()}
+		}
+		return map[string]int64{"id": id}, nil
+	case "status":
+		status, err := jobs.Status(params.ID, true)
+		if err != nil {
+			return nil, &rpcError{Code: -32000, Message: err.Error()}
+		}
+		return status, nil
+	case "list":
+		jobs.mutex.Lock()
+		ids := slices.Sorted(maps.Keys(jobs.jobs))
+		jobs.mutex.Unlock()
+		statuses := []jobStatus{}
+		for _, id := range ids {
+			status, err := jobs.Status(id, false)
+			if err != nil {
+				continue
+			}
+			statuses = append(statuses, status)
+		}
+		return statuses, nil
+	case "cancel":
+		err := jobs.Cancel(params.ID)
+		if err != nil {
+			return nil, &rpcError{Code: -32000, Message: err.Error()}
+		}
+		return map[string]any{}, nil
+	case "report":
+		job, err := jobs.job(params.ID)
+		if err != nil {
+			return nil, &rpcError{Code: -32000, Message: err.Error()}
+		}
+		records, err := jobs.readReport(job)
+		if err != nil {
+			return nil, &rpcError{Code: -32000, Message: err.Error()}
+		}
+		result := map[string]any{"columns": []string{}, "rows": [][]string{}}
+		if len(records) > 0 {
+			result["columns"], result["rows"] = records[0], records[1:]
+		}
+		return result, nil
+	}
+	return nil, &rpcError{Code: -32601, Message: fmt.Sprintf("no method %q", request.Method)}
+}
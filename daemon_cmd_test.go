@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDaemonCommandRPCAddr(t *testing.T) {
+	t.Setenv("EXIFUTIL_RPC_TOKEN", "")
+	socket := filepath.Join(t.TempDir(), "daemon.sock")
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: []string{"-rpc-addr", "localhost:9102"}},
+		{args: []string{"-rpc-addr", "127.0.0.1:9102"}},
+		{args: []string{"-rpc-addr", "[::1]:9102"}},
+		{args: []string{"-rpc-addr", ":9102"}, wantErr: true},
+		{args: []string{"-rpc-addr", "0.0.0.0:9102"}, wantErr: true},
+		{args: []string{"-rpc-addr", "192.168.1.2:9102"}, wantErr: true},
+		{args: []string{"-rpc-addr", "photos.example.com:9102"}, wantErr: true},
+		{args: []string{"-rpc-addr", "0.0.0.0:9102", "-rpc-token", "secret"}},
+	}
+	for _, tt := range tests {
+		daemonCmd, err := DaemonCommand(append([]string{"-socket", socket}, tt.args...))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error: %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if err == nil && daemonCmd.RPCToken == "" && daemonCmd.RPCTokenFile != filepath.Join(filepath.Dir(socket), "rpc-token") {
+			t.Errorf("%q: got token file %q, want rpc-token next to the socket", tt.args, daemonCmd.RPCTokenFile)
+		}
+	}
+}
+
+func TestWriteRPCToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "exifutil", "rpc-token")
+	err := os.MkdirAll(filepath.Dir(tokenFile), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token file left readable by others is replaced, not reused.
+	err = os.WriteFile(tokenFile, []byte("old\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := writeRPCToken(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == "" || string(b) != token+"\n" {
+		t.Errorf("got token %q and file %q", token, b)
+	}
+	fileInfo, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileInfo.Mode().Perm(); mode != 0600 && runtime.GOOS != "windows" {
+		t.Errorf("got mode %o, want 0600", mode)
+	}
+	entries, err := os.ReadDir(filepath.Dir(tokenFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the token file", len(entries))
+	}
+}
+
+func TestDaemonJobsServeHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	jobs, err := newDaemonJobs(ctx, &DaemonCmd{RPCToken: "secret"}, &sync.Mutex{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobs.Close()
+	defer cancel()
+	tests := []struct {
+		authorization string
+		contentType   string
+		wantStatus    int
+	}{
+		{authorization: "", contentType: "application/json", wantStatus: http.StatusUnauthorized},
+		{authorization: "Bearer wrong", contentType: "application/json", wantStatus: http.StatusUnauthorized},
+		{authorization: "Bearer secret", contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{authorization: "Bearer secret", contentType: "", wantStatus: http.StatusUnsupportedMediaType},
+		{authorization: "Bearer secret", contentType: "application/json", wantStatus: http.StatusOK},
+		{authorization: "Bearer secret", contentType: "application/json; charset=utf-8", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc": "2.0", "method": "list", "id": 1}`))
+		if tt.authorization != "" {
+			request.Header.Set("Authorization", tt.authorization)
+		}
+		if tt.contentType != "" {
+			request.Header.Set("Content-Type", tt.contentType)
+		}
+		recorder := httptest.NewRecorder()
+		jobs.ServeHTTP(recorder, request)
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%q %q: got status %d, want %d", tt.authorization, tt.contentType, recorder.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusOK && !strings.Contains(recorder.Body.String(), `"result":[]`) {
+			t.Errorf("%q %q: got %s, want an empty list", tt.authorization, tt.contentType, recorder.Body.String())
+		}
+	}
+
+	// Without a token, nothing is let through.
+	jobs.daemonCmd.RPCToken = ""
+	request := httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc": "2.0", "method": "list", "id": 1}`))
+	request.Header.Set("Authorization", "Bearer ")
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	jobs.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: got status %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
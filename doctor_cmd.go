@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errDoctorFailed = errors.New("some checks failed")
+
+type DoctorCmd struct {
+	Roots          []string
+	FileRegexps    []*regexp.Regexp
+	Timeout        time.Duration
+	Charset        string
+	ExifToolConfig string
+	ExifToolArgs   []string
+	Verbose        bool
+	Stdout         io.Writer
+	Stderr         io.Writer
+	logger         *slog.Logger
+}
+
+func DoctorCommand(args []string) (*DoctorCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	doctorCmd := &DoctorCmd{
+		Roots:        []string{cwd},
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.DurationVar(&doctorCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file. Zero means no timeout.")
+	flagset.StringVar(&doctorCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		doctorCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		doctorCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&doctorCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.Func("root", "Specify an additional root directory to check. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		doctorCmd.Roots = append(doctorCmd.Roots, root)
+		return nil
+	})
+	flagset.Func("file", "Include file regex, used to pick the sample file whose extraction is timed. Can be repeated.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		doctorCmd.FileRegexps = append(doctorCmd.FileRegexps, r)
+		return nil
+	})
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		// Positional arguments take the place of the current directory.
+		doctorCmd.Roots = doctorCmd.Roots[1:]
+		for _, arg := range flagset.Args() {
+			root, err := filepath.Abs(arg)
+			if err != nil {
+				return nil, err
+			}
+			doctorCmd.Roots = append(doctorCmd.Roots, root)
+		}
+	}
+	doctorCmd.logger = newLogger(doctorCmd.Stdout, doctorCmd.Verbose)
+	return doctorCmd, nil
+}
+
+// Run prints the result of each check on its own line, prefixed with ok,
+// warn, fail or info. It returns an error if any check failed so that
+// scripts can tell a working environment from a broken one.
+func (doctorCmd *DoctorCmd) Run(ctx context.Context) error {
+	failed := false
+	report := func(status, format string, a ...any) {
+		if status == "fail" {
+			failed = true
+		}
+		fmt.Fprintf(doctorCmd.Stdout, "%-4s  %s\n", status, fmt.Sprintf(format, a...))
+	}
+	exifToolPath, err := exec.LookPath("exiftool")
+	if err != nil {
+		report("fail", "exiftool not found in PATH: %v", err)
+		return errDoctorFailed
+	}
+	report("ok", "exiftool found at %s", exifToolPath)
+	start := time.Now()
+	exifTool, err := startExifTool(ctx, doctorCmd.Stderr, doctorCmd.Timeout, doctorCmd.Charset, doctorCmd.ExifToolConfig)
+	if err != nil {
+		report("fail", "could not start exiftool: %v", err)
+		return errDoctorFailed
+	}
+	exifTool.ReadArgs = doctorCmd.ExifToolArgs
+	defer func() {
+		err := exifTool.Close()
+		if err != nil {
+			doctorCmd.logger.Warn(err.Error())
+		}
+	}()
+	version, err := exifTool.Execute("-ver")
+	if err != nil {
+		report("fail", "exiftool did not respond: %v", err)
+		return errDoctorFailed
+	}
+	report("ok", "exiftool version %s, ready in %s", strings.TrimSpace(string(version)), time.Since(start).Round(time.Millisecond))
+
+	// Time one cold and a few warm extractions of a sample file. A cold
+	// extraction much slower than a warm one means exiftool spends most of
+	// its time waiting on the disk (or network), which more workers than
+	// CPUs can hide.
+	var coldLatency, warmLatency time.Duration
+	for _, root := range doctorCmd.Roots {
+		filePath, err := doctorCmd.sampleFile(root)
+		if err != nil {
+			report("fail", "%s: %v", root, err)
+			continue
+		}
+		if filePath == "" {
+			report("warn", "%s: no files to time extraction on", root)
+			continue
+		}
+		logger := doctorCmd.logger.With(slog.String("filePath", filePath))
+		const numWarm = 3
+		var latencies []time.Duration
+		for i := 0; i < 1+numWarm; i++ {
+			start := time.Now()
+			exifs, err := exifTool.FileExifs(logger, filePath)
+			if err != nil {
+				report("fail", "%s: %v", filePath, err)
+				break
+			}
+			latencies = append(latencies, time.Since(start))
+			if i > 0 {
+				continue
+			}
+			_, err = fileExif(logger, filePath, exifs)
+			if err != nil {
+				report("warn", "%s: %v", filePath, err)
+			}
+		}
+		if len(latencies) < 1+numWarm {
+			continue
+		}
+		cold, warm := latencies[0], slices.Min(latencies[1:])
+		report("ok", "%s: extracted with %q in %s (%s when cached by the OS)", filePath, strings.Join(doctorCmd.ExifToolArgs, " "), cold.Round(time.Millisecond), warm.Round(time.Millisecond))
+		coldLatency, warmLatency = max(coldLatency, cold), max(warmLatency, warm)
+	}
+
+	for _, root := range doctorCmd.Roots {
+		file, err := os.CreateTemp(root, ".exifutil-doctor-*")
+		if err != nil {
+			report("fail", "%s is not writable: %v", root, err)
+			continue
+		}
+		file.Close()
+		caseInsensitive := false
+		upperPath := filepath.Join(root, strings.ToUpper(filepath.Base(file.Name())))
+		if fileInfo, err := os.Stat(file.Name()); err == nil {
+			if upperInfo, err := os.Stat(upperPath); err == nil {
+				caseInsensitive = os.SameFile(fileInfo, upperInfo)
+			}
+		}
+		err = os.Remove(file.Name())
+		if err != nil {
+			report("warn", "%s: %v", root, err)
+		}
+		report("ok", "%s is writable", root)
+		if caseInsensitive {
+			report("warn", "%s is on a case-insensitive filesystem, names differing only in case (e.g. from -normalize-ext) refer to the same file", root)
+		}
+	}
+
+	numWorkers := runtime.NumCPU()
+	if warmLatency > 0 {
+		ratio := int(coldLatency / warmLatency)
+		numWorkers = min(max(numWorkers, numWorkers*ratio), 4*runtime.NumCPU())
+	}
+	report("info", "recommended -num-workers=%d (%d CPUs), or 0 to tune automatically during the run", numWorkers, runtime.NumCPU())
+	if failed {
+		return errDoctorFailed
+	}
+	return nil
+}
+
+// sampleFile returns the first file under root (not recursing into
+// subdirectories) matching the -file regexes, or any file that isn't a
+// hidden system file if there are none.
+func (doctorCmd *DoctorCmd) sampleFile(root string) (string, error) {
+	dirEntries, err := os.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !dirEntry.Type().IsRegular() || isHiddenSystemFile(name) || strings.HasPrefix(name, ".exifutil-doctor-") {
+			continue
+		}
+		if len(doctorCmd.FileRegexps) > 0 && !slices.ContainsFunc(doctorCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+			return fileRegexp.MatchString(name)
+		}) {
+			continue
+		}
+		return filepath.Join(root, name), nil
+	}
+	return "", nil
+}
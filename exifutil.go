@@ -1,80 +1,4474 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
 type Exif struct {
 	CreationTime time.Time
+	// CreationTimeSource is the tag (or other source) CreationTime was
+	// taken from.
+	CreationTimeSource string
+	// DateOnly reports whether CreationTime is exactly midnight, which
+	// usually means the source only had a date, like the dates scanners
+	// write for everything they scan.
+	DateOnly bool `json:",omitempty"`
+	// LocalTime reports whether CreationTime came from a date without a UTC
+	// offset, so that it is the camera's wall clock time placed in UTC.
+	LocalTime bool `json:"-"`
+	// AmbiguousTime reports whether CreationTime was a wall clock time that
+	// a daylight saving time change made ambiguous (or skipped over) in the
+	// -time-zone it was placed in, and was resolved by -ambiguous-time.
+	AmbiguousTime bool `json:",omitempty"`
+	Make          string
+	Model         string
+	// SerialNumber is the serial number of the camera, if it records one.
+	SerialNumber string `json:",omitempty"`
+	// Country and City are where the file was taken according to its IPTC
+	// or XMP location tags, which some cameras, phones and photo managers
+	// fill in.
+	Country string `json:",omitempty"`
+	City    string `json:",omitempty"`
+	// GPSPosition is where the file was taken, if it was geotagged.
+	GPSPosition *GPSPosition `json:",omitempty"`
+	// FileTypeExtension is the lowercase extension of the file's actual
+	// type, as told by its contents rather than its name.
+	FileTypeExtension string `json:"-"`
+	// Tags are the tags referred to by a -where expression or a template,
+	// or needed by an option like -auto-rotate, keyed by the name they are
+	// referred to by.
+	Tags map[string]any `json:"-"`
 }
 
-func parseExifs(logger *slog.Logger, data []byte) []Exif {
-	type RawExif struct {
-		FileSize               string
-		SubSecDateTimeOriginal string
-		CreateDate             string
-		TimeZone               string
+// GPSPosition is a position in signed decimal degrees, negative for south
+// and west.
+type GPSPosition struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// rawExif holds the tags requested from exiftool -json that are needed to
+// build an Exif.
+type rawExif struct {
+	FileSize               string
+	SubSecDateTimeOriginal string
+	CreateDate             string
+	TimeZone               string
+	// DateCreated is the XMP creation date, which is often the only date in
+	// screenshots and web exports (PNG, WebP, AVIF) that lack EXIF.
+	DateCreated string
+	// CreationTime is the PNG "Creation Time" text chunk.
+	CreationTime string
+	Make         string
+	Model        string
+	SerialNumber string
+	Country      string
+	City         string
+	// GPSLatitude and GPSLongitude are the composite tags, which include the
+	// hemisphere e.g. 37 deg 46' 30.00" N.
+	GPSLatitude  string
+	GPSLongitude string
+	// FileTypeExtension is the extension exiftool recommends for the file
+	// type it detected from the file's magic bytes.
+	FileTypeExtension string
+	// WhereTags are the tags exifTool.Tags asked for, which aren't otherwise
+	// part of rawExif. exiftool never outputs a tag named _whereTags, so it
+	// is only ever set by ExecuteJSON and the cache.
+	WhereTags map[string]any `json:"_whereTags,omitempty"`
+}
+
+// dateSources are the tags a creation time can be read from, in their
+// default order of priority.
+var dateSources = []string{"SubSecDateTimeOriginal", "CreateDate", "DateCreated", "CreationTime"}
+
+// dateSourceRule replaces the order of dateSources for files whose Model
+// matches ModelRegexp, for cameras known to write a wrong date into one of
+// the tags that would otherwise take precedence.
+type dateSourceRule struct {
+	ModelRegexp *regexp.Regexp
+	Sources     []string
+}
+
+// anyModelRegexp matches every camera model, including none.
+var anyModelRegexp = regexp.MustCompile("")
+
+// parseDateSourceRule parses a -date-source value of the form
+// MODEL_REGEX=TAG,TAG e.g. '^FC\d+$=CreateDate,SubSecDateTimeOriginal'.
+// Tags left out of the list are not consulted at all.
+func parseDateSourceRule(value string) (dateSourceRule, error) {
+	if value == "mtime" {
+		return dateSourceRule{}, fmt.Errorf("mtime is only supported by rename, partition and move")
 	}
-	var rawExifs []RawExif
-	err := json.Unmarshal(data, &rawExifs)
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return dateSourceRule{}, fmt.Errorf("expected MODEL_REGEX=TAG,TAG, got %q", value)
+	}
+	modelRegexp, err := regexp.Compile(value[:i])
 	if err != nil {
-		logger.Error(err.Error(), slog.String("data", string(data)))
-		return []Exif{}
+		return dateSourceRule{}, err
 	}
-	exifs := make([]Exif, 0, len(rawExifs))
-	for _, rawExif := range rawExifs {
-		var exif Exif
-		if rawExif.SubSecDateTimeOriginal != "" {
-			if strings.Contains(rawExif.SubSecDateTimeOriginal, "+") || strings.Contains(rawExif.SubSecDateTimeOriginal, "-") {
-				exif.CreationTime, err = time.ParseInLocation("2006:01:02 15:04:05.999-07:00", rawExif.SubSecDateTimeOriginal, time.UTC)
-				if err != nil {
-					logger.Error(err.Error(), slog.String("SubSecDateTimeOriginal", rawExif.SubSecDateTimeOriginal))
-				}
-			} else {
-				exif.CreationTime, err = time.ParseInLocation("2006:01:02 15:04:05.999", rawExif.SubSecDateTimeOriginal, time.UTC)
-				if err != nil {
-					logger.Error(err.Error(), slog.String("SubSecDateTimeOriginal", rawExif.SubSecDateTimeOriginal))
+	rule := dateSourceRule{ModelRegexp: modelRegexp}
+	for _, name := range strings.Split(value[i+1:], ",") {
+		source, err := parseDateSource(name)
+		if err != nil {
+			return dateSourceRule{}, err
+		}
+		rule.Sources = append(rule.Sources, source)
+	}
+	return rule, nil
+}
+
+// parseDateSource returns the one of dateSources that name refers to.
+func parseDateSource(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	// SubSecDateTimeOriginal is DateTimeOriginal with the subseconds and
+	// offset tags folded in, so accept the more familiar name too.
+	if strings.EqualFold(name, "DateTimeOriginal") {
+		name = "SubSecDateTimeOriginal"
+	}
+	index := slices.IndexFunc(dateSources, func(source string) bool {
+		return strings.EqualFold(source, name)
+	})
+	if index < 0 {
+		return "", fmt.Errorf("unknown tag %q (supported: %s)", name, strings.Join(dateSources, ", "))
+	}
+	return dateSources[index], nil
+}
+
+// extHandler is how rename, partition and move treat files of an extension,
+// as configured in an -ext-config file.
+type extHandler struct {
+	// Extractor is where the creation time comes from: exiftool (the
+	// default) or mtime, the modification time, for files exiftool can't
+	// date. Files whose metadata isn't read are never selected by -where.
+	Extractor string `json:"extractor"`
+	// DateSources are the tags the creation time is taken from, in order,
+	// for files from cameras no -date-source rule matches.
+	DateSources []string `json:"dateSources"`
+	// Sidecar makes files of the extension companions of the file with the
+	// same name (IMG_1234.xmp) or named after its full name
+	// (IMG_1234.CR2.xmp), moved and renamed together with it.
+	Sidecar bool `json:"sidecar"`
+	// Skip leaves files of the extension out of the walk.
+	Skip bool `json:"skip"`
+}
+
+// parseExtConfig reads an -ext-config file, a JSON object of extHandlers
+// keyed by extension e.g. {"xmp": {"sidecar": true}, "png": {"extractor":
+// "mtime"}}, and returns them keyed by lowercase extension with the dot.
+func parseExtConfig(name string) (map[string]extHandler, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var config map[string]extHandler
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	extHandlers := make(map[string]extHandler)
+	for ext, handler := range config {
+		ext = "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+		if ext == "." || strings.ContainsAny(ext[1:], `./\`) {
+			return nil, fmt.Errorf("%s: invalid extension %q", name, ext)
+		}
+		switch handler.Extractor {
+		case "", "exiftool", "mtime":
+		default:
+			return nil, fmt.Errorf("%s: %s: invalid extractor %q, must be exiftool or mtime", name, ext, handler.Extractor)
+		}
+		for i, dateSource := range handler.DateSources {
+			handler.DateSources[i], err = parseDateSource(dateSource)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", name, ext, err)
+			}
+		}
+		if handler.Sidecar && handler.Skip {
+			return nil, fmt.Errorf("%s: %s: a sidecar cannot also be skipped", name, ext)
+		}
+		extHandlers[ext] = handler
+	}
+	return extHandlers, nil
+}
+
+// defaultExtConfig returns the extHandlers of extensions.json in the
+// exifutil user config directory, if there is one, for when -ext-config is
+// not given.
+func defaultExtConfig() (map[string]extHandler, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, nil
+	}
+	extHandlers, err := parseExtConfig(filepath.Join(configDir, "exifutil", "extensions.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return extHandlers, err
+}
+
+// clockOffsetRule shifts the creation times of files from cameras whose
+// model or serial number matches CameraRegexp by Offset, for putting
+// cameras whose clocks were off on the same timeline as the rest.
+type clockOffsetRule struct {
+	CameraRegexp *regexp.Regexp
+	Offset       time.Duration
+}
+
+// parseClockOffsetRule parses a -clock-offset value of the form
+// CAMERA_REGEX=OFFSET e.g. 'ILCE-7M3=-1m30s'.
+func parseClockOffsetRule(value string) (clockOffsetRule, error) {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return clockOffsetRule{}, fmt.Errorf("expected CAMERA_REGEX=OFFSET, got %q", value)
+	}
+	cameraRegexp, err := regexp.Compile(value[:i])
+	if err != nil {
+		return clockOffsetRule{}, err
+	}
+	offset, err := time.ParseDuration(strings.TrimPrefix(value[i+1:], "+"))
+	if err != nil {
+		return clockOffsetRule{}, err
+	}
+	return clockOffsetRule{CameraRegexp: cameraRegexp, Offset: offset}, nil
+}
+
+// applyClockOffset adds the Offset of the first rule matching the camera of
+// exif to its creation time, if the creation time came from the camera's
+// clock in the first place.
+func applyClockOffset(exif Exif, rules []clockOffsetRule) Exif {
+	if exif.CreationTime.IsZero() || !slices.Contains(dateSources, exif.CreationTimeSource) {
+		return exif
+	}
+	for _, rule := range rules {
+		if rule.CameraRegexp.MatchString(exif.Model) || (exif.SerialNumber != "" && rule.CameraRegexp.MatchString(exif.SerialNumber)) {
+			exif.CreationTime = exif.CreationTime.Add(rule.Offset)
+			break
+		}
+	}
+	return exif
+}
+
+// errAmbiguousTime is returned by applyTimeZone for a wall clock time that
+// is ambiguous or doesn't exist in the time zone, under the skip policy.
+var errAmbiguousTime = errors.New("creation time is ambiguous because of a daylight saving time change")
+
+// applyTimeZone places the creation time of exif in location if it is a
+// LocalTime, leaving times with a UTC offset of their own alone. A time that
+// a daylight saving time change repeats (or skips over) is resolved by
+// policy: earlier takes the earlier of the two instants it could be, later
+// takes the later one, and skip returns
+// errAmbiguousTime. Without an explicit policy, Go picks one of the two
+// depending on its version and platform.
+func applyTimeZone(exif Exif, location *time.Location, policy string) (Exif, error) {
+	if location == nil || !exif.LocalTime || exif.CreationTime.IsZero() {
+		return exif, nil
+	}
+	wall := exif.CreationTime
+	// Zones change offset at most once a day, so the offsets in effect 14
+	// hours either side of the wall clock time are the only candidates.
+	_, before := wall.Add(-14 * time.Hour).In(location).Zone()
+	_, after := wall.Add(14 * time.Hour).In(location).Zone()
+	var valid []time.Time
+	for _, offset := range []int{before, after} {
+		t := wall.Add(-time.Duration(offset) * time.Second).In(location)
+		if _, actual := t.Zone(); actual == offset && !slices.ContainsFunc(valid, t.Equal) {
+			valid = append(valid, t)
+		}
+	}
+	if len(valid) == 1 {
+		exif.CreationTime = valid[0]
+		return exif, nil
+	}
+	if policy == "skip" {
+		return exif, errAmbiguousTime
+	}
+	exif.AmbiguousTime = true
+	if len(valid) == 0 {
+		// The clocks went forward over the time, which can only have been
+		// written by a clock that didn't. It could be in either offset.
+		for _, offset := range []int{before, after} {
+			valid = append(valid, wall.Add(-time.Duration(offset)*time.Second).In(time.FixedZone("", offset)))
+		}
+	}
+	slices.SortFunc(valid, func(a, b time.Time) int { return a.Compare(b) })
+	if policy == "later" {
+		exif.CreationTime = valid[1]
+	} else {
+		exif.CreationTime = valid[0]
+	}
+	return exif, nil
+}
+
+// parseRawExif builds an Exif out of rawExif, taking the creation time from
+// the first of dateSources (or the sources of the first rule matching the
+// camera model) that holds a valid date.
+func parseRawExif(logger *slog.Logger, rawExif rawExif, rules []dateSourceRule) Exif {
+	exif := Exif{
+		Make:              rawExif.Make,
+		Model:             rawExif.Model,
+		SerialNumber:      rawExif.SerialNumber,
+		Country:           rawExif.Country,
+		City:              rawExif.City,
+		FileTypeExtension: strings.ToLower(rawExif.FileTypeExtension),
+		Tags:              rawExif.WhereTags,
+	}
+	sources := dateSources
+	for _, rule := range rules {
+		if rule.ModelRegexp.MatchString(rawExif.Model) {
+			sources = rule.Sources
+			break
+		}
+	}
+	for _, source := range sources {
+		var value string
+		switch source {
+		case "SubSecDateTimeOriginal":
+			value = rawExif.SubSecDateTimeOriginal
+		case "CreateDate":
+			value = rawExif.CreateDate
+			if value != "" && !hasUTCOffset(value) {
+				value += rawExif.TimeZone
+			}
+		case "DateCreated":
+			value = rawExif.DateCreated
+		case "CreationTime":
+			value = rawExif.CreationTime
+		}
+		if value == "" {
+			continue
+		}
+		creationTime, err := parseExifTime(value)
+		if err != nil {
+			logger.Error(err.Error(), slog.String(source, value))
+			continue
+		}
+		if creationTime.IsZero() {
+			continue
+		}
+		exif.DateOnly = creationTime.Hour() == 0 && creationTime.Minute() == 0 && creationTime.Second() == 0 && creationTime.Nanosecond() == 0
+		// RFC 1123 dates (which always have a comma after the weekday) end
+		// in a zone, even if it is only a name.
+		exif.LocalTime = !hasUTCOffset(value) && !strings.Contains(value, ",")
+		// CreateDate has no subseconds, so add random milliseconds to keep
+		// files taken within the same second from getting the same name.
+		if source == "CreateDate" {
+			creationTime = creationTime.Add(time.Duration(rand.IntN(1000)) * time.Millisecond)
+		}
+		exif.CreationTime = creationTime
+		exif.CreationTimeSource = source
+		break
+	}
+	if rawExif.GPSLatitude != "" && rawExif.GPSLongitude != "" {
+		latitude, err := parseGPSCoordinate(rawExif.GPSLatitude)
+		if err != nil {
+			logger.Debug(err.Error(), slog.String("GPSLatitude", rawExif.GPSLatitude))
+			return exif
+		}
+		longitude, err := parseGPSCoordinate(rawExif.GPSLongitude)
+		if err != nil {
+			logger.Debug(err.Error(), slog.String("GPSLongitude", rawExif.GPSLongitude))
+			return exif
+		}
+		exif.GPSPosition = &GPSPosition{Latitude: latitude, Longitude: longitude}
+	}
+	return exif
+}
+
+// gpsCoordinateRegexp matches a coordinate as printed by exiftool e.g.
+// 37 deg 46' 30.00" N. The hemisphere is missing if the file has no
+// GPSLatitudeRef or GPSLongitudeRef.
+var gpsCoordinateRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?) deg (\d+(?:\.\d+)?)' (\d+(?:\.\d+)?)"(?: ([NSEW]))?$`)
+
+// parseGPSCoordinate parses a coordinate as printed by exiftool into signed
+// decimal degrees.
+func parseGPSCoordinate(value string) (float64, error) {
+	match := gpsCoordinateRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, fmt.Errorf("unrecognized GPS coordinate format %q", value)
+	}
+	degrees, _ := strconv.ParseFloat(match[1], 64)
+	minutes, _ := strconv.ParseFloat(match[2], 64)
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+	coordinate := degrees + minutes/60 + seconds/3600
+	if match[4] == "S" || match[4] == "W" {
+		coordinate = -coordinate
+	}
+	return coordinate, nil
+}
+
+// exifTimeLayouts are the layouts exiftool prints dates in. The fractional
+// seconds are optional when parsing, and Z07:00 accepts both Z and an offset
+// like +08:00. Dates without an offset are taken to be in UTC. XMP dates may
+// omit the time entirely, and PNG Creation Time chunks are free text that
+// encoders usually fill with an RFC 1123 date, which exiftool passes through
+// as-is.
+var exifTimeLayouts = []string{
+	"2006:01:02 15:04:05.999999999Z07:00",
+	"2006:01:02 15:04:05.999999999",
+	"2006:01:02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// parseExifTime parses a date as printed by exiftool e.g.
+// 2024:03:05 10:11:12.123+08:00. Cameras without a clock set write an
+// all-zero placeholder, which is returned as the zero time without an error.
+func parseExifTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "0000:00:00") {
+		return time.Time{}, nil
+	}
+	for _, layout := range exifTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date format %q", value)
+}
+
+// hasUTCOffset reports whether an exiftool date ends in Z or a UTC offset
+// like +08:00.
+func hasUTCOffset(value string) bool {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "Z") {
+		return true
+	}
+	if len(value) < 6 {
+		return false
+	}
+	sign, offset := value[len(value)-6], value[len(value)-5:]
+	return (sign == '+' || sign == '-') && offset[2] == ':'
+}
+
+// errNoCreationTime is returned by fileExif when none of the metadata
+// sources contain the creation time of a file.
+var errNoCreationTime = errors.New("unable to fetch file creation time")
+
+// fileExif returns the Exif for filePath from the exifs exiftool returned for
+// it, falling back to the file's Google Takeout sidecar if exiftool could
+// not find a creation time.
+func fileExif(logger *slog.Logger, filePath string, exifs []Exif) (Exif, error) {
+	if len(exifs) == 0 {
+		return Exif{}, fmt.Errorf("exiftool returned empty array")
+	}
+	exif := exifs[0]
+	if exif.CreationTime.IsZero() {
+		exif.CreationTime = takeoutCreationTime(logger, filePath)
+		exif.CreationTimeSource = "GoogleTakeout"
+	}
+	if exif.CreationTime.IsZero() {
+		return Exif{}, errNoCreationTime
+	}
+	return exif, nil
+}
+
+// defaultDirDatePatterns match directory names starting with a date like
+// 2001-07-14, 2001-07 or 2001, most specific first.
+var defaultDirDatePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(?P<year>(?:19|20)\d{2})[-_. ](?P<month>\d{2})[-_. ](?P<day>\d{2})\b`),
+	regexp.MustCompile(`^(?P<year>(?:19|20)\d{2})[-_. ](?P<month>\d{2})\b`),
+	regexp.MustCompile(`^(?P<year>(?:19|20)\d{2})\b`),
+}
+
+// parseDirDatePattern parses a -dir-date-pattern, which must capture the
+// year in a group named year.
+func parseDirDatePattern(value string) (*regexp.Regexp, error) {
+	r, err := regexp.Compile(value)
+	if err != nil {
+		return nil, err
+	}
+	if r.SubexpIndex("year") < 0 {
+		return nil, fmt.Errorf("%q has no (?P<year>...) group", value)
+	}
+	return r, nil
+}
+
+// dirCreationTime infers the creation time of a file without any dates in
+// its metadata (like a scanned negative) from the name of the nearest
+// directory containing it that matches one of patterns, e.g. "2001-07
+// Italy". Patterns capture the year and optionally the month and day in
+// groups named year, month and day, and a missing month or day is taken to
+// be the first. Every file in a directory gets the same date, so each is
+// given a time of day after its position among the files of the directory
+// as listings has them (see positionOffset), keeping them in order and
+// their canonical names distinct. It returns the zero time if no directory
+// matches.
+func dirCreationTime(filePath string, patterns []*regexp.Regexp, listings *dirListings) (time.Time, error) {
+	for dir := filepath.Dir(filePath); ; dir = filepath.Dir(dir) {
+		name := filepath.Base(dir)
+		for _, pattern := range patterns {
+			match := pattern.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			group := func(name string, defaultValue int) (int, error) {
+				i := pattern.SubexpIndex(name)
+				if i < 0 || match[i] == "" {
+					return defaultValue, nil
 				}
+				return strconv.Atoi(match[i])
 			}
-		} else if rawExif.CreateDate != "" {
-			exif.CreationTime, err = time.ParseInLocation("2006:01:02 15:04:05-07:00", rawExif.CreateDate+rawExif.TimeZone, time.UTC)
+			year, err := group("year", 0)
 			if err != nil {
-				logger.Error(err.Error(), slog.String("SubSecDateTimeOriginal", rawExif.SubSecDateTimeOriginal))
+				return time.Time{}, fmt.Errorf("%s: invalid year: %w", dir, err)
 			}
-			exif.CreationTime = exif.CreationTime.Add(time.Duration(rand.IntN(1000)) * time.Millisecond)
+			month, err := group("month", 1)
+			if err != nil || month < 1 || month > 12 {
+				return time.Time{}, fmt.Errorf("%s: invalid month %q", dir, match[pattern.SubexpIndex("month")])
+			}
+			day, err := group("day", 1)
+			if err != nil || day < 1 || day > 31 {
+				return time.Time{}, fmt.Errorf("%s: invalid day %q", dir, match[pattern.SubexpIndex("day")])
+			}
+			names, err := listings.List(filepath.Dir(filePath))
+			if err != nil {
+				return time.Time{}, err
+			}
+			position, _ := slices.BinarySearch(names, filepath.Base(filePath))
+			return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Add(positionOffset(position, len(names))), nil
+		}
+		if filepath.Dir(dir) == dir {
+			return time.Time{}, nil
 		}
-		exifs = append(exifs, exif)
 	}
-	return exifs
 }
 
-func compileRegexp(pattern string) (*regexp.Regexp, error) {
-	n := strings.Count(pattern, ".")
-	if n == 0 {
-		return regexp.Compile(pattern)
+// dirListings are the sorted names of the files in directories, as they
+// were when each directory was first listed. Files renamed in place into
+// dated names would otherwise shift the positions dirCreationTime gives the
+// rest of their directory, and listing a directory once for every file in
+// it takes time quadratic in its size.
+type dirListings struct {
+	mutex sync.Mutex
+	names map[string][]string
+}
+
+// List returns the sorted names of the files in dir, listing it if it
+// hasn't been already.
+func (listings *dirListings) List(dir string) ([]string, error) {
+	listings.mutex.Lock()
+	defer listings.mutex.Unlock()
+	if names, ok := listings.names[dir]; ok {
+		return names, nil
 	}
-	if strings.HasPrefix(pattern, "./") && len(pattern) > 2 {
-		pattern = pattern[2:]
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
-	var b strings.Builder
-	b.Grow(len(pattern) + n)
-	j := 0
-	for j < len(pattern) {
-		prev, _ := utf8.DecodeLastRuneInString(b.String())
-		curr, width := utf8.DecodeRuneInString(pattern[j:])
-		next, _ := utf8.DecodeRuneInString(pattern[j+width:])
-		j += width
-		if prev != '\\' && curr == '.' && (('a' <= next && next <= 'z') || ('A' <= next && next <= 'Z')) {
-			b.WriteString("\\.")
-		} else {
-			b.WriteRune(curr)
+	// os.ReadDir sorts the entries by name.
+	var names []string
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			names = append(names, dirEntry.Name())
 		}
 	}
-	return regexp.Compile(b.String())
+	if listings.names == nil {
+		listings.names = make(map[string][]string)
+	}
+	listings.names[dir] = names
+	return names, nil
+}
+
+// positionOffset returns the time of day given to the file at position
+// among numFiles files dated by dirCreationTime: position seconds, or for
+// directories with more files than there are seconds in a day, spacing as
+// small as the milliseconds of canonical names allow, so that no file
+// spills over into the next day. Past 86400000 files, the rest share the
+// last millisecond of the day.
+func positionOffset(position, numFiles int) time.Duration {
+	spacing := time.Second
+	if numFiles > 0 {
+		spacing = max(min(spacing, (24*time.Hour/time.Duration(numFiles)).Truncate(time.Millisecond)), time.Millisecond)
+	}
+	return min(time.Duration(position)*spacing, 24*time.Hour-time.Millisecond)
+}
+
+// takeoutCreationTime returns the photoTakenTime recorded in the Google
+// Takeout JSON sidecar of filePath, or the zero time if there is no sidecar.
+func takeoutCreationTime(logger *slog.Logger, filePath string) time.Time {
+	// Takeout names the sidecar after the full filename, but newer exports
+	// add a .supplemental-metadata suffix and some older ones drop the
+	// extension.
+	sidecarPaths := []string{
+		filePath + ".json",
+		filePath + ".supplemental-metadata.json",
+		strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".json",
+	}
+	for _, sidecarPath := range sidecarPaths {
+		data, err := os.ReadFile(sidecarPath)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				logger.Warn(err.Error(), slog.String("sidecarPath", sidecarPath))
+			}
+			continue
+		}
+		var sidecar struct {
+			PhotoTakenTime struct {
+				Timestamp string `json:"timestamp"`
+			} `json:"photoTakenTime"`
+		}
+		err = json.Unmarshal(data, &sidecar)
+		if err != nil {
+			logger.Warn(err.Error(), slog.String("sidecarPath", sidecarPath))
+			continue
+		}
+		if sidecar.PhotoTakenTime.Timestamp == "" {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(sidecar.PhotoTakenTime.Timestamp, 10, 64)
+		if err != nil {
+			logger.Warn(err.Error(), slog.String("sidecarPath", sidecarPath))
+			continue
+		}
+		return time.Unix(timestamp, 0).UTC()
+	}
+	return time.Time{}
+}
+
+// applePhotosRegexp matches the names Photos.app gives to originals
+// (IMG_1234.HEIC), edited variants (IMG_E1234.jpg) and adjustment sidecars
+// (IMG_1234.AAE, IMG_O1234.AAE) when exporting unmodified originals.
+var applePhotosRegexp = regexp.MustCompile(`^IMG_([EO]?)(\d+)(\.[^.]+)$`)
+
+type companionFile struct {
+	FilePath string
+	// Suffix is appended to the new name of the original (before the
+	// extension) to derive the new name of the companion file.
+	Suffix string
+	// AppleDouble is set for the ._ file holding the resource fork and
+	// extended attributes of the original (or of another companion with the
+	// same Suffix), which macOS writes on filesystems such as FAT and exFAT
+	// that can't store them natively.
+	AppleDouble bool
+	// FullName is set for a sidecar named after the full name of the
+	// original (IMG_1234.CR2.xmp), which is named after the full new name
+	// of the original in turn.
+	FullName bool
+}
+
+// applePhotosCompanions returns the edited variants and .AAE sidecars that
+// Photos.app exported alongside the original at filePath.
+func applePhotosCompanions(filePath string) []companionFile {
+	match := applePhotosRegexp.FindStringSubmatch(filepath.Base(filePath))
+	if match == nil || match[1] != "" || strings.EqualFold(match[3], ".aae") {
+		return nil
+	}
+	dir, number := filepath.Dir(filePath), match[2]
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var companionFiles []companionFile
+	variants := []struct{ prefix, suffix string }{
+		{prefix: "IMG_", suffix: ""},
+		{prefix: "IMG_E", suffix: "_E"},
+		{prefix: "IMG_O", suffix: "_O"},
+	}
+	for _, variant := range variants {
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if dirEntry.IsDir() || !strings.HasPrefix(name, variant.prefix+number+".") || name == filepath.Base(filePath) {
+				continue
+			}
+			// The only companion sharing the original's name is its .AAE
+			// sidecar, anything else (e.g. a RAW+JPEG pair) is a separate
+			// original.
+			if variant.prefix == "IMG_" && !strings.EqualFold(filepath.Ext(name), ".aae") {
+				continue
+			}
+			companionFiles = append(companionFiles, companionFile{
+				FilePath: filepath.Join(dir, name),
+				Suffix:   variant.suffix,
+			})
+		}
+	}
+	return companionFiles
+}
+
+// applePhotosCompanionNames returns the names of the edited variants and
+// .AAE sidecars in a directory whose original is also present in that
+// directory. Such files are moved together with their original and should
+// not be processed on their own.
+func applePhotosCompanionNames(dirEntries []fs.DirEntry) map[string]bool {
+	hasOriginal := make(map[string]bool)
+	for _, dirEntry := range dirEntries {
+		match := applePhotosRegexp.FindStringSubmatch(dirEntry.Name())
+		if match != nil && match[1] == "" && !strings.EqualFold(match[3], ".aae") {
+			hasOriginal[match[2]] = true
+		}
+	}
+	companionNames := make(map[string]bool)
+	for _, dirEntry := range dirEntries {
+		match := applePhotosRegexp.FindStringSubmatch(dirEntry.Name())
+		if match == nil || (match[1] == "" && !strings.EqualFold(match[3], ".aae")) {
+			continue
+		}
+		if hasOriginal[match[2]] {
+			companionNames[dirEntry.Name()] = true
+		}
+	}
+	return companionNames
+}
+
+// fileCompanions returns the files that should be moved together with the
+// file at filePath: its Photos.app companions, its sidecars according to
+// extHandlers, and the AppleDouble files of it and of those companions.
+func fileCompanions(filePath string, extHandlers map[string]extHandler) []companionFile {
+	companionFiles := append(applePhotosCompanions(filePath), sidecarCompanions(filePath, extHandlers)...)
+	for _, file := range append([]companionFile{{FilePath: filePath}}, companionFiles...) {
+		appleDoublePath := filepath.Join(filepath.Dir(file.FilePath), "._"+filepath.Base(file.FilePath))
+		fileInfo, err := os.Lstat(appleDoublePath)
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		companionFiles = append(companionFiles, companionFile{
+			FilePath:    appleDoublePath,
+			Suffix:      file.Suffix,
+			AppleDouble: true,
+		})
+	}
+	return companionFiles
+}
+
+// sidecarCompanions returns the files next to the file at filePath whose
+// extension extHandlers mark as a sidecar, and which are named after it
+// with or without its extension.
+func sidecarCompanions(filePath string, extHandlers map[string]extHandler) []companionFile {
+	if len(extHandlers) == 0 || extHandlers[strings.ToLower(filepath.Ext(filePath))].Sidecar {
+		return nil
+	}
+	dir, name := filepath.Split(filePath)
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var companionFiles []companionFile
+	for _, dirEntry := range dirEntries {
+		sidecarName := dirEntry.Name()
+		ext := filepath.Ext(sidecarName)
+		if dirEntry.IsDir() || !extHandlers[strings.ToLower(ext)].Sidecar {
+			continue
+		}
+		switch strings.TrimSuffix(sidecarName, ext) {
+		case name:
+			companionFiles = append(companionFiles, companionFile{FilePath: filepath.Join(dir, sidecarName), FullName: true})
+		case stem:
+			companionFiles = append(companionFiles, companionFile{FilePath: filepath.Join(dir, sidecarName)})
+		}
+	}
+	return companionFiles
+}
+
+// sidecarCompanionNames returns the names of the sidecars in a directory
+// whose original is also present in that directory. Like Photos.app
+// companions, they are moved together with their original.
+func sidecarCompanionNames(dirEntries []fs.DirEntry, extHandlers map[string]extHandler) map[string]bool {
+	companionNames := make(map[string]bool)
+	if len(extHandlers) == 0 {
+		return companionNames
+	}
+	originals := make(map[string]bool)
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || extHandlers[strings.ToLower(filepath.Ext(name))].Sidecar {
+			continue
+		}
+		originals[name] = true
+		originals[strings.TrimSuffix(name, filepath.Ext(name))] = true
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		ext := filepath.Ext(name)
+		if !dirEntry.IsDir() && extHandlers[strings.ToLower(ext)].Sidecar && originals[strings.TrimSuffix(name, ext)] {
+			companionNames[name] = true
+		}
+	}
+	return companionNames
+}
+
+// appleDoubleCompanionNames returns the names of the AppleDouble files in a
+// directory whose file is also present in that directory. Like Photos.app
+// companions, they are moved together with their file.
+func appleDoubleCompanionNames(dirEntries []fs.DirEntry) map[string]bool {
+	names := make(map[string]bool)
+	for _, dirEntry := range dirEntries {
+		names[dirEntry.Name()] = true
+	}
+	companionNames := make(map[string]bool)
+	for _, dirEntry := range dirEntries {
+		name, ok := strings.CutPrefix(dirEntry.Name(), "._")
+		if ok && names[name] {
+			companionNames[dirEntry.Name()] = true
+		}
+	}
+	return companionNames
+}
+
+// motionPhotoBrands are the major brands of the MP4 videos that Samsung and
+// Google phones embed in motion photos.
+var motionPhotoBrands = map[string]bool{
+	"mp41": true,
+	"mp42": true,
+	"isom": true,
+	"iso6": true,
+	"avc1": true,
+	"qt  ": true,
+}
+
+// motionPhotoVideo returns the offset and length of the MP4 video that
+// Samsung and Google phones embed after the image data of a motion photo
+// (JPEG or HEIC), or ok false if the file at filePath has none. The video
+// is found by its ftyp box and measured by walking its top-level boxes, so
+// that trailers following it (like Samsung's) are left out. The file is
+// scanned through a buffer rather than read whole, and only the box headers
+// are read to walk the boxes.
+func motionPhotoVideo(filePath string) (offset, length int64, ok bool, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	size := fileInfo.Size()
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, 0, size), 64<<10)
+	// window holds the last four bytes read, ending at pos.
+	var window uint32
+	var header [16]byte
+	for pos := int64(0); ; {
+		c, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return 0, 0, false, nil
+			}
+			return 0, 0, false, err
+		}
+		pos++
+		window = window<<8 | uint32(c)
+		if window != 0x66747970 { // ftyp
+			continue
+		}
+		i := pos - 4
+		start := i - 4
+		// The HEIC image itself starts with an ftyp box at offset 0.
+		if i < 8 || i+8 > size {
+			continue
+		}
+		_, err = file.ReadAt(header[:12], start)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		boxSize := binary.BigEndian.Uint32(header[:])
+		if boxSize < 16 || boxSize > 256 || !motionPhotoBrands[string(header[8:12])] {
+			continue
+		}
+		end, hasMovie := start, false
+		for end+8 <= size {
+			n := min(int64(len(header)), size-end)
+			_, err := file.ReadAt(header[:n], end)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			boxSize := uint64(binary.BigEndian.Uint32(header[:]))
+			boxType := header[4:8]
+			switch boxSize {
+			case 0:
+				boxSize = uint64(size - end)
+			case 1:
+				if n < 16 {
+					boxSize = 0
+				} else {
+					boxSize = binary.BigEndian.Uint64(header[8:])
+				}
+			}
+			if boxSize < 8 || boxSize > uint64(size-end) || !isBoxType(boxType) {
+				break
+			}
+			if string(boxType) == "moov" {
+				hasMovie = true
+			}
+			end += int64(boxSize)
+		}
+		if hasMovie {
+			return start, end - start, true, nil
+		}
+	}
+}
+
+// isBoxType reports whether b looks like the four character type of an
+// ISO base media file format box.
+func isBoxType(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// motionVideoExt returns the extension, including the dot, of the video
+// component of the motion photo or .livp at filePath, or ok false if it has
+// none.
+func motionVideoExt(filePath string) (ext string, ok bool, err error) {
+	if isLivp(filePath) {
+		livp, err := openLivp(filePath)
+		if err != nil {
+			return "", false, err
+		}
+		defer livp.Close()
+		return strings.ToLower(path.Ext(livp.Video.Name)), true, nil
+	}
+	_, _, ok, err = motionPhotoVideo(filePath)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return ".mp4", true, nil
+}
+
+// writeMotionVideo writes the video component of the motion photo or .livp
+// at filePath to videoPath, which must not exist. It is written under a
+// temporary name first so that videoPath never holds a partial video, and
+// gets the modification time of filePath.
+func writeMotionVideo(filePath, videoPath string) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	var reader io.ReadCloser
+	if isLivp(filePath) {
+		livp, err := openLivp(filePath)
+		if err != nil {
+			return err
+		}
+		defer livp.Close()
+		reader, err = livp.Video.Open()
+		if err != nil {
+			return err
+		}
+	} else {
+		offset, length, ok, err := motionPhotoVideo(filePath)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: no embedded video", filePath)
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		reader = struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(file, offset, length), file}
+	}
+	defer reader.Close()
+	tempFile, err := os.CreateTemp(filepath.Dir(videoPath), ".exifutil-*"+filepath.Ext(videoPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = io.Copy(tempFile, reader)
+	if err == nil {
+		err = tempFile.Close()
+	} else {
+		tempFile.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(tempFile.Name(), fileInfo.ModTime(), fileInfo.ModTime())
+	if err != nil {
+		return err
+	}
+	return renameNoReplace(osFS{}, tempFile.Name(), videoPath, false)
+}
+
+// isHiddenSystemFile reports whether name is one of the files that macOS
+// and Windows scatter across every directory they touch (.DS_Store,
+// Thumbs.db, desktop.ini and AppleDouble ._ files). They are skipped
+// unless -include-hidden is set.
+func isHiddenSystemFile(name string) bool {
+	if strings.HasPrefix(name, "._") {
+		return true
+	}
+	switch strings.ToLower(name) {
+	case ".ds_store", "thumbs.db", "desktop.ini":
+		return true
+	}
+	return false
+}
+
+// checkFileStable returns an error if filePath looks like it is still being
+// written to i.e. it was modified less than minAge ago, or its size or
+// modification time changes over the stableFor interval.
+func checkFileStable(ctx context.Context, filePath string, minAge, stableFor time.Duration) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(fileInfo.ModTime()); age < minAge {
+		return fmt.Errorf("file was modified %s ago (less than -min-age %s), skipping", age.Round(time.Second), minAge)
+	}
+	if stableFor <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(stableFor)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	newFileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if newFileInfo.Size() != fileInfo.Size() || !newFileInfo.ModTime().Equal(fileInfo.ModTime()) {
+		return fmt.Errorf("file changed within -stable-for %s, skipping", stableFor)
+	}
+	return nil
+}
+
+// settleTracker remembers the files watch has seen changing across its
+// runs, so that a burst of changes to a file (its creation, many writes, a
+// chmod) leads to it being processed once, after it has been left alone for
+// quiet, rather than once per run while it is still being written. Its
+// methods may be called concurrently, and on a nil *settleTracker, which
+// considers every file settled.
+type settleTracker struct {
+	quiet time.Duration
+	mutex sync.Mutex
+	// files holds the files that were seen changing, and are not settled
+	// yet.
+	files map[string]settleEntry
+	// run is incremented by Prune after every run, so that files that
+	// disappeared before settling can be forgotten.
+	run int
+}
+
+// settleEntry is what a file looked like when it was last seen changing.
+type settleEntry struct {
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+	// ChangedAt is when the file was first seen looking like this.
+	ChangedAt time.Time
+	Run       int
+}
+
+func newSettleTracker(quiet time.Duration) *settleTracker {
+	return &settleTracker{
+		quiet: quiet,
+		files: make(map[string]settleEntry),
+	}
+}
+
+// Settled returns an error if the file at filePath has changed less than
+// quiet ago. The first time a file is seen its modification time is all
+// there is to go by, after that any change to its size, modification time
+// or mode starts the wait over.
+func (tracker *settleTracker) Settled(filePath string) error {
+	if tracker == nil {
+		return nil
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	entry, ok := tracker.files[filePath]
+	if !ok || entry.Size != fileInfo.Size() || !entry.ModTime.Equal(fileInfo.ModTime()) || entry.Mode != fileInfo.Mode() {
+		changedAt := now
+		if !ok {
+			changedAt = fileInfo.ModTime()
+		}
+		entry = settleEntry{
+			Size:      fileInfo.Size(),
+			ModTime:   fileInfo.ModTime(),
+			Mode:      fileInfo.Mode(),
+			ChangedAt: changedAt,
+		}
+	}
+	if age := now.Sub(entry.ChangedAt); age < tracker.quiet {
+		entry.Run = tracker.run
+		tracker.files[filePath] = entry
+		return fmt.Errorf("file changed %s ago (less than -settle %s), leaving it for a later run", age.Round(time.Second), tracker.quiet)
+	}
+	delete(tracker.files, filePath)
+	return nil
+}
+
+// Prune forgets the files that were not seen during the run that just
+// ended, which were moved or deleted by something else before settling.
+func (tracker *settleTracker) Prune() {
+	if tracker == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for filePath, entry := range tracker.files {
+		if entry.Run != tracker.run {
+			delete(tracker.files, filePath)
+		}
+	}
+	tracker.run++
+}
+
+// fileSystem is the part of the os package that files are renamed, trashed
+// and given directories with, so that those moves can be tried out on an
+// in-memory filesystem. osFS is the operating system's.
+type fileSystem interface {
+	Rename(oldPath, newPath string) error
+	MkdirAll(dir string, perm fs.FileMode) error
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+	Open(name string) (fsFile, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (fsFile, error)
+}
+
+// fsFile is a file opened from a fileSystem.
+type fsFile interface {
+	io.ReadWriteCloser
+	Stat() (fs.FileInfo, error)
+	Sync() error
+}
+
+// osFS is the fileSystem of the os package.
+type osFS struct{}
+
+func (osFS) Rename(oldPath, newPath string) error { return os.Rename(oldPath, newPath) }
+
+func (osFS) MkdirAll(dir string, perm fs.FileMode) error { return os.MkdirAll(dir, perm) }
+
+func (osFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) Open(name string) (fsFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (fsFile, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// renameNoReplace renames oldPath to newPath. If newPath already exists and
+// replaceIfExists is false, it returns fs.ErrExist. If replaceIfExists is
+// true, the existing file is moved to the trash instead of being
+// overwritten.
+func renameNoReplace(fsys fileSystem, oldPath, newPath string, replaceIfExists bool) error {
+	newFileInfo, err := fsys.Stat(newPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		// On case-insensitive filesystems newPath may be oldPath with
+		// different case, which is a rename and not a replacement.
+		oldFileInfo, err := fsys.Stat(oldPath)
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(oldFileInfo, newFileInfo) {
+			if !replaceIfExists {
+				return fs.ErrExist
+			}
+			err := moveToTrash(fsys, newPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fsys.Rename(oldPath, newPath)
+}
+
+// keyedMutex is a set of mutexes identified by string keys, created on
+// demand and dropped once nobody holds or waits on them. The zero value is
+// ready to use.
+type keyedMutex struct {
+	mutex   sync.Mutex
+	entries map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mutex sync.Mutex
+	// refs is the number of goroutines holding or waiting on mutex.
+	refs int
+}
+
+// Lock locks the mutex of key and returns the function that unlocks it.
+func (km *keyedMutex) Lock(key string) (unlock func()) {
+	km.mutex.Lock()
+	if km.entries == nil {
+		km.entries = make(map[string]*keyedMutexEntry)
+	}
+	entry := km.entries[key]
+	if entry == nil {
+		entry = &keyedMutexEntry{}
+		km.entries[key] = entry
+	}
+	entry.refs++
+	km.mutex.Unlock()
+	entry.mutex.Lock()
+	return func() {
+		entry.mutex.Unlock()
+		km.mutex.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(km.entries, key)
+		}
+		km.mutex.Unlock()
+	}
+}
+
+// trashDirName is the directory, created next to a replaced file, that the
+// replaced file is moved into. Each day gets its own subdirectory, named
+// after the date, with an index of where its files came from.
+const trashDirName = ".exifutil-trash"
+
+const trashIndexName = "index.csv"
+
+// trashEntry is a row of a trash index.
+type trashEntry struct {
+	// Name is the name of the file in the trash, which is its original name
+	// unless a file with that name was already trashed the same day.
+	Name         string
+	OriginalPath string
+	TrashedAt    time.Time
+}
+
+// trashMutex serializes picking a free name in the trash and appending to
+// its index.
+var trashMutex sync.Mutex
+
+// moveToTrash moves filePath into the trash in its directory so that it can
+// be restored with exifutil trash restore.
+func moveToTrash(fsys fileSystem, filePath string) error {
+	trashedAt := time.Now()
+	dir := filepath.Join(filepath.Dir(filePath), trashDirName, trashedAt.Format("2006-01-02"))
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	err := fsys.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(filePath)
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		_, err := fsys.Lstat(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name = strings.TrimSuffix(filepath.Base(filePath), ext) + "." + strconv.Itoa(i) + ext
+	}
+	// Index the file before moving it, so that an interruption in between
+	// leaves a dangling index entry rather than a file nobody knows the
+	// origin of.
+	file, err := fsys.OpenFile(filepath.Join(dir, trashIndexName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	writer := csv.NewWriter(file)
+	if fileInfo.Size() == 0 {
+		_ = writer.Write([]string{"name", "original_path", "trashed_at"})
+	}
+	_ = writer.Write([]string{name, filePath, trashedAt.Format(time.RFC3339)})
+	writer.Flush()
+	err = writer.Error()
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return fsys.Rename(filePath, filepath.Join(dir, name))
+}
+
+// readTrashIndex returns the entries of the trash index in dir, a dated
+// subdirectory of a trashDirName directory.
+func readTrashIndex(dir string) ([]trashEntry, error) {
+	file, err := os.Open(filepath.Join(dir, trashIndexName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []trashEntry
+	for i, record := range records {
+		if i == 0 || len(record) < 3 {
+			continue
+		}
+		trashedAt, err := time.Parse(time.RFC3339, record[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", file.Name(), i+1, err)
+		}
+		entries = append(entries, trashEntry{
+			Name:         record[0],
+			OriginalPath: record[1],
+			TrashedAt:    trashedAt,
+		})
+	}
+	return entries, nil
+}
+
+// writeTrashIndex replaces the trash index in dir with entries.
+func writeTrashIndex(dir string, entries []trashEntry) error {
+	records := [][]string{{"name", "original_path", "trashed_at"}}
+	for _, entry := range entries {
+		records = append(records, []string{entry.Name, entry.OriginalPath, entry.TrashedAt.Format(time.RFC3339)})
+	}
+	var b bytes.Buffer
+	err := csv.NewWriter(&b).WriteAll(records)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(b.Bytes())
+	if err == nil {
+		err = tempFile.Close()
+	} else {
+		tempFile.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filepath.Join(dir, trashIndexName))
+}
+
+// syncMove flushes a file that was renamed from oldPath to newPath to disk,
+// along with the directory entries of both its old and new parent
+// directories, so that the move survives a power loss.
+func syncMove(oldPath, newPath string) error {
+	err := syncFile(newPath)
+	if err != nil {
+		return err
+	}
+	err = syncDir(osFS{}, filepath.Dir(newPath))
+	if err != nil {
+		return err
+	}
+	if filepath.Dir(oldPath) != filepath.Dir(newPath) {
+		err = syncDir(osFS{}, filepath.Dir(oldPath))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// mkdirAllSync is like os.MkdirAll, but also flushes the directory entry of
+// every directory it creates to disk.
+func mkdirAllSync(fsys fileSystem, dir string) error {
+	var missingDirs []string
+	for {
+		_, err := fsys.Stat(dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		missingDirs = append(missingDirs, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	if len(missingDirs) == 0 {
+		return nil
+	}
+	err := fsys.MkdirAll(missingDirs[0], 0755)
+	if err != nil {
+		return err
+	}
+	for _, missingDir := range missingDirs {
+		err := syncDir(fsys, filepath.Dir(missingDir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateName shortens the stem of name by at least excess bytes, keeping
+// its extension and appending ~ and a hash of the full name so that names
+// that only differed in the truncated part stay distinct. It reports false
+// if the stem is too short to be shortened by that much.
+func truncateName(name string, excess int) (string, bool) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	hash := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(hash[:4])
+	keep := len(stem) - excess - len(suffix)
+	if keep < 1 {
+		return "", false
+	}
+	// Don't cut a multi-byte character in half.
+	for keep > 0 && !utf8.RuneStart(stem[keep]) {
+		keep--
+	}
+	if keep == 0 {
+		return "", false
+	}
+	return stem[:keep] + suffix + ext, true
+}
+
+// fixExtSkipExts are extensions of files that are deliberately named
+// differently from their actual type, such as THM thumbnails (JPEGs) and
+// GoPro LRV proxies (MP4s), which would lose their association with the
+// file they belong to if fixExt renamed them.
+var fixExtSkipExts = map[string]bool{
+	"thm":  true,
+	"lrv":  true,
+	"lrf":  true,
+	"insp": true,
+	"insv": true,
+}
+
+// fixExtAliases map file type extensions to the extension of the type they
+// are a variant of, for files that are fine being named after either e.g.
+// MPO files are JPEGs with extra images appended.
+var fixExtAliases = map[string]string{
+	"mpo": "jpg",
+	"jpe": "jpg",
+}
+
+// fixExt replaces the extension of name with typeExt, the extension of the
+// file's actual type, unless the two are equivalent according to extMap
+// (e.g. .JPEG for a JPEG, with jpeg=jpg) or typeExt is unknown. The new
+// extension is lowercase and replaced according to extMap.
+func fixExt(name, typeExt string, extMap map[string]string) string {
+	if typeExt == "" {
+		return name
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if fixExtSkipExts[ext] {
+		return name
+	}
+	canonical := func(ext string) string {
+		if to, ok := fixExtAliases[ext]; ok {
+			ext = to
+		}
+		if to, ok := extMap[ext]; ok {
+			ext = to
+		}
+		return ext
+	}
+	if canonical(ext) == canonical(typeExt) {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "." + canonical(typeExt)
+}
+
+// FilePermissions are applied to the directories a subcommand creates and
+// the files it moves, for trees shared between several users. Subcommands
+// embed it so that the permission flags behave the same everywhere. The zero
+// value leaves permissions as they are, creating directories with mode 0755
+// less the umask.
+type FilePermissions struct {
+	// DirMode, if non-zero, is the exact mode of created directories
+	// regardless of the umask.
+	DirMode fs.FileMode
+	// FileMode, if non-zero, is applied to every moved file.
+	FileMode fs.FileMode
+	// ChownParent gives created directories and moved files the owner and
+	// group of the directory they are in. Unix only.
+	ChownParent bool
+}
+
+// RegisterFlags adds -dir-mode, -file-mode and -chown-parent to flagset.
+func (perms *FilePermissions) RegisterFlags(flagset *flag.FlagSet) {
+	flagset.Func("dir-mode", "Octal mode of created directories e.g. 2775, applied regardless of the umask. (default 0755 less the umask)", func(value string) error {
+		mode, err := parseFileMode(value)
+		if err != nil {
+			return err
+		}
+		perms.DirMode = mode
+		return nil
+	})
+	flagset.Func("file-mode", "Octal mode to set on every moved file e.g. 0664. (default unchanged)", func(value string) error {
+		mode, err := parseFileMode(value)
+		if err != nil {
+			return err
+		}
+		perms.FileMode = mode
+		return nil
+	})
+	flagset.BoolFunc("chown-parent", "Give created directories and moved files the owner and group of the directory they are in. Unix only, and usually requires root.", func(value string) error {
+		chownParent, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if chownParent && runtime.GOOS == "windows" {
+			return fmt.Errorf("not supported on windows")
+		}
+		perms.ChownParent = chownParent
+		return nil
+	})
+}
+
+// RetryPolicy retries filesystem operations that fail with errors that are
+// usually transient on network mounts, like EIO or ESTALE from an NFS or SMB
+// server that briefly went away, instead of giving up on the file.
+type RetryPolicy struct {
+	// Retries is the maximum number of times an operation is retried.
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubling before each
+	// retry after that.
+	RetryBackoff time.Duration
+}
+
+// RegisterFlags adds -retries and -retry-backoff to flagset.
+func (retryPolicy *RetryPolicy) RegisterFlags(flagset *flag.FlagSet) {
+	flagset.IntVar(&retryPolicy.Retries, "retries", 3, "Number of times to retry a rename, mkdir or stat that failed with an error that is usually transient on network mounts, like EIO or ESTALE. 0 means no retries.")
+	flagset.DurationVar(&retryPolicy.RetryBackoff, "retry-backoff", time.Second, "Time to wait before the first retry, doubling before each retry after that.")
+}
+
+// Do calls op until it succeeds, fails with an error that isn't transient or
+// has been retried Retries times, and returns its last error. numRetries, if
+// not nil, is incremented on every retry.
+func (retryPolicy *RetryPolicy) Do(ctx context.Context, logger *slog.Logger, numRetries *atomic.Int64, op func() error) error {
+	backoff := retryPolicy.RetryBackoff
+	for retry := 1; ; retry++ {
+		err := op()
+		if err == nil || retry > retryPolicy.Retries || !isTransientError(err) {
+			return err
+		}
+		logger.Warn(err.Error()+", retrying", slog.Int("retry", retry), slog.Duration("backoff", backoff))
+		if numRetries != nil {
+			numRetries.Add(1)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// parseFileMode parses an octal file mode e.g. 0755 or 2775. The setuid,
+// setgid and sticky bits are accepted in their octal form.
+func parseFileMode(value string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || n > 0o7777 {
+		return 0, fmt.Errorf("invalid octal mode %q", value)
+	}
+	mode := fs.FileMode(n & 0o777)
+	if n&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if n&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if n&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode, nil
+}
+
+// MkdirAll is like os.MkdirAll, except that the directories it creates get
+// DirMode and, if ChownParent is set, their parent's owner. If durable is
+// set, the directory entry of every directory it creates is flushed to disk
+// as well. DirMode and ChownParent are applied with the os package, whatever
+// fsys is.
+func (perms *FilePermissions) MkdirAll(fsys fileSystem, dir string, durable bool) error {
+	if perms.DirMode == 0 && !perms.ChownParent {
+		if durable {
+			return mkdirAllSync(fsys, dir)
+		}
+		return fsys.MkdirAll(dir, 0755)
+	}
+	var missingDirs []string
+	for {
+		_, err := fsys.Stat(dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		missingDirs = append(missingDirs, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for i := len(missingDirs) - 1; i >= 0; i-- {
+		missingDir := missingDirs[i]
+		err := os.Mkdir(missingDir, 0755)
+		if err != nil {
+			// Another worker got there first, and takes care of the rest.
+			if errors.Is(err, fs.ErrExist) {
+				continue
+			}
+			return err
+		}
+		if perms.DirMode != 0 {
+			err := os.Chmod(missingDir, perms.DirMode)
+			if err != nil {
+				return err
+			}
+		}
+		if perms.ChownParent {
+			err := chownToParent(missingDir)
+			if err != nil {
+				return err
+			}
+		}
+		if durable {
+			err := syncDir(fsys, filepath.Dir(missingDir))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply sets FileMode and, if ChownParent is set, the owner of the directory
+// it is in on filePath, which has just been moved there.
+func (perms *FilePermissions) Apply(filePath string) error {
+	if perms.FileMode != 0 {
+		err := os.Chmod(filePath, perms.FileMode)
+		if err != nil {
+			return err
+		}
+	}
+	if perms.ChownParent {
+		err := chownToParent(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localeMonthNames holds the month names for each locale supported by
+// -month-names=locale:xx.
+var localeMonthNames = map[string][12]string{
+	"en": {"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	"de": {"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+	"fr": {"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+	"es": {"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+	"it": {"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+	"nl": {"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+	"pt": {"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+	"sv": {"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+}
+
+// parseMonthNames parses a -month-names value, which is either locale:xx or
+// a comma separated list of 12 month names.
+func parseMonthNames(value string) ([12]string, error) {
+	if locale, ok := strings.CutPrefix(value, "locale:"); ok {
+		monthNames, ok := localeMonthNames[strings.ToLower(locale)]
+		if !ok {
+			locales := make([]string, 0, len(localeMonthNames))
+			for locale := range localeMonthNames {
+				locales = append(locales, locale)
+			}
+			slices.Sort(locales)
+			return [12]string{}, fmt.Errorf("unsupported locale %q (supported: %s)", locale, strings.Join(locales, ", "))
+		}
+		return monthNames, nil
+	}
+	names := strings.Split(value, ",")
+	if len(names) != 12 {
+		return [12]string{}, fmt.Errorf("expected locale:xx or 12 comma separated month names, got %d names", len(names))
+	}
+	var monthNames [12]string
+	for i, name := range names {
+		monthNames[i] = strings.TrimSpace(name)
+	}
+	return monthNames, nil
+}
+
+// defaultExtMap is the -ext-map used by -normalize-ext if none is given.
+var defaultExtMap = map[string]string{
+	"jpeg": "jpg",
+	"tif":  "tiff",
+}
+
+// defaultReadArgs are the -exiftool-args used when reading metadata. -fast
+// stops exiftool from scanning to the end of JPEGs for trailers and past the
+// audio/video data of AVI and WAV files, none of which hold tags exifutil
+// reads. -fast2 and -n are not safe defaults: -fast2 skips maker notes, where
+// TimeZone usually lives, and stops at the image data of PNGs, before which
+// the Creation Time chunk isn't always written, while -n turns TimeZone into
+// a number of minutes.
+var defaultReadArgs = []string{"-fast"}
+
+// parseExifToolArgs parses an -exiftool-args value, a space separated list
+// of exiftool arguments. Arguments that would break the -stay_open protocol
+// exifutil talks to exiftool over are rejected.
+func parseExifToolArgs(value string) ([]string, error) {
+	args := strings.Fields(value)
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "-execute", "-stay_open", "-@", "-common_args":
+			return nil, fmt.Errorf("%s is not allowed", arg)
+		}
+	}
+	return args, nil
+}
+
+// parseExifToolConfig resolves the path of an exiftool config file, which
+// exiftool would otherwise silently ignore if it doesn't exist.
+func parseExifToolConfig(value string) (string, error) {
+	config, err := filepath.Abs(value)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(config)
+	if err != nil {
+		return "", err
+	}
+	return config, nil
+}
+
+// parseExtMap parses an -ext-map value, a comma separated list of from=to
+// pairs of extensions e.g. jpeg=jpg,tif=tiff.
+func parseExtMap(value string) (map[string]string, error) {
+	extMap := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		from, to, ok := strings.Cut(pair, "=")
+		from = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(from), "."))
+		to = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(to), "."))
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected from=to e.g. jpeg=jpg", pair)
+		}
+		extMap[from] = to
+	}
+	return extMap, nil
+}
+
+// normalizeExt lowercases the extension of name and replaces it according
+// to extMap, whose keys and values are lowercase extensions without the
+// leading dot.
+func normalizeExt(name string, extMap map[string]string) string {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return name
+	}
+	newExt := strings.ToLower(ext[1:])
+	if to, ok := extMap[newExt]; ok {
+		newExt = to
+	}
+	return strings.TrimSuffix(name, ext) + "." + newExt
+}
+
+// strftime formats t according to a strftime-like format, using monthNames
+// for %B and %b. Supported verbs are %Y %y %m %d %H %M %S %j %B %b %z and
+// %%.
+func strftime(format string, t time.Time, monthNames [12]string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'j':
+			b.WriteString(t.Format("002"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'B':
+			b.WriteString(monthNames[t.Month()-1])
+		case 'b':
+			name := []rune(monthNames[t.Month()-1])
+			b.WriteString(string(name[:min(3, len(name))]))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
+
+// FileSelector decides which files a subcommand works on. Subcommands embed
+// it so that the selection flags behave the same everywhere.
+type FileSelector struct {
+	Roots []string
+	// FilePaths are selected directly, without a walk or any -file regex
+	// having to match them.
+	FilePaths   []string
+	FileRegexps []*regexp.Regexp
+	// ExcludeRegexps deselect files matched by FileRegexps, and keep the
+	// walk out of directories whose names they match.
+	ExcludeRegexps []*regexp.Regexp
+	Recursive      bool
+	IncludeHidden  bool
+	// Where, if set, deselects files whose metadata it doesn't match. It is
+	// up to each subcommand to check it once it has read the metadata.
+	Where *whereExpr
+	// remotes are the rclone remotes of the roots, and of the destinations
+	// of subcommands that move files, to be mounted by MountRemotes. They
+	// are shared by the copies of the FileSelector.
+	remotes *rcloneRemotes
+}
+
+// newFileSelector returns a FileSelector rooted at the current directory.
+func newFileSelector() (FileSelector, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return FileSelector{}, err
+	}
+	return FileSelector{Roots: []string{cwd}, remotes: &rcloneRemotes{}}, nil
+}
+
+// localPath returns the local path of a root or destination, recording its
+// rclone remote, if it is on one, to be mounted by MountRemotes.
+func (selector *FileSelector) localPath(path string) (string, error) {
+	if selector.remotes == nil {
+		selector.remotes = &rcloneRemotes{}
+	}
+	return selector.remotes.localPath(path)
+}
+
+// MountRemotes mounts the rclone remotes of the roots and destinations, and
+// returns a function that unmounts them, to be called when the subcommand
+// returns.
+func (selector *FileSelector) MountRemotes() (unmount func(), err error) {
+	return selector.remotes.Mount()
+}
+
+// RegisterFlags adds -root, -file, -exclude, -recursive, -include-hidden and
+// -where to flagset.
+func (selector *FileSelector) RegisterFlags(flagset *flag.FlagSet) {
+	flagset.Func("root", "Specify an additional root directory to watch, or an rclone remote as rclone://REMOTE/PATH or an S3 bucket as s3://BUCKET/PREFIX. Can be repeated.", func(value string) error {
+		value, err := selector.localPath(value)
+		if err != nil {
+			return err
+		}
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		selector.Roots = append(selector.Roots, root)
+		return nil
+	})
+	flagset.Func("file", "Include file regex. Can be repeated.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		selector.FileRegexps = append(selector.FileRegexps, r)
+		return nil
+	})
+	flagset.Func("exclude", "Exclude file or directory regex, matched against names and applied after -file. Can be repeated.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		selector.ExcludeRegexps = append(selector.ExcludeRegexps, r)
+		return nil
+	})
+	flagset.BoolVar(&selector.Recursive, "recursive", false, "Walk the roots recursively.")
+	flagset.BoolVar(&selector.IncludeHidden, "include-hidden", false, "Don't skip .DS_Store, Thumbs.db, desktop.ini and AppleDouble ._ files.")
+	flagset.Func("where", "Only select files whose metadata matches this expression e.g. 'Model == \"ILCE-7M3\" && ISO > 3200'. Tags are named as in exiftool -json output and compared as numbers if both sides are numbers (including fractions like 1/200), otherwise as strings. Supports == != < <= > >= =~ (regex match) !~ && || ! and parentheses. A tag on its own is true if it is present and not empty or 0.", func(value string) error {
+		expr, err := parseWhereExpr(value)
+		if err != nil {
+			return err
+		}
+		selector.Where = expr
+		return nil
+	})
+}
+
+// MatchExifs reports whether a file with the metadata exifs, as returned
+// by exifTool.FileExifs, is selected by Where.
+func (selector *FileSelector) MatchExifs(exifs []Exif) bool {
+	if selector.Where == nil {
+		return true
+	}
+	return len(exifs) > 0 && selector.Where.Match(exifs[0])
+}
+
+// whereExpr is a filter on the metadata of a file, parsed from -where.
+type whereExpr struct {
+	root *whereNode
+	// tags are the names of the tags the expression refers to.
+	tags []string
+}
+
+// whereNode is a node of a whereExpr's syntax tree. Op is one of the
+// operators, "tag" for a tag (named by Tag) or "literal" for a string or
+// float64 Value.
+type whereNode struct {
+	Op          string
+	Left, Right *whereNode
+	Tag         string
+	Value       any
+	Regexp      *regexp.Regexp
+}
+
+// whereTokenRegexp matches the next token of a -where expression, ignoring
+// leading whitespace.
+var whereTokenRegexp = regexp.MustCompile(`^\s*(&&|\|\||==|!=|<=|>=|=~|!~|[<>!()]|"(?:[^"\\]|\\.)*"|-?\d+(?:\.\d+)?(?:/\d+)?\b|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// parseWhereExpr parses a -where expression.
+func parseWhereExpr(expr string) (*whereExpr, error) {
+	var tokens []string
+	rest := expr
+	for strings.TrimSpace(rest) != "" {
+		match := whereTokenRegexp.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("invalid expression %q: unexpected %q", expr, strings.TrimSpace(rest))
+		}
+		tokens = append(tokens, match[1])
+		rest = rest[len(match[0]):]
+	}
+	parser := &whereParser{expr: expr, tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if len(parser.tokens) > 0 {
+		return nil, fmt.Errorf("invalid expression %q: unexpected %q", expr, parser.tokens[0])
+	}
+	return &whereExpr{root: root, tags: parser.tags}, nil
+}
+
+// whereParser is a recursive descent parser of -where expressions, in order
+// of increasing precedence: ||, &&, !, comparisons.
+type whereParser struct {
+	expr   string
+	tokens []string
+	tags   []string
+}
+
+func (parser *whereParser) next() string {
+	if len(parser.tokens) == 0 {
+		return ""
+	}
+	token := parser.tokens[0]
+	parser.tokens = parser.tokens[1:]
+	return token
+}
+
+func (parser *whereParser) peek() string {
+	if len(parser.tokens) == 0 {
+		return ""
+	}
+	return parser.tokens[0]
+}
+
+func (parser *whereParser) parseOr() (*whereNode, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "||" {
+		parser.next()
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereNode{Op: "||", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (parser *whereParser) parseAnd() (*whereNode, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "&&" {
+		parser.next()
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereNode{Op: "&&", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (parser *whereParser) parseNot() (*whereNode, error) {
+	if parser.peek() == "!" {
+		parser.next()
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &whereNode{Op: "!", Left: operand}, nil
+	}
+	return parser.parseComparison()
+}
+
+func (parser *whereParser) parseComparison() (*whereNode, error) {
+	left, err := parser.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := parser.peek()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		parser.next()
+		right, err := parser.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &whereNode{Op: op, Left: left, Right: right}, nil
+	case "=~", "!~":
+		parser.next()
+		right, err := parser.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		pattern, ok := right.Value.(string)
+		if right.Op != "literal" || !ok {
+			return nil, fmt.Errorf("invalid expression %q: %s must be followed by a quoted regex", parser.expr, op)
+		}
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %w", parser.expr, err)
+		}
+		return &whereNode{Op: op, Left: left, Regexp: r}, nil
+	}
+	return left, nil
+}
+
+func (parser *whereParser) parseOperand() (*whereNode, error) {
+	token := parser.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("invalid expression %q: unexpected end", parser.expr)
+	case token == "(":
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next() != ")" {
+			return nil, fmt.Errorf("invalid expression %q: missing )", parser.expr)
+		}
+		return node, nil
+	case token[0] == '"':
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %w", parser.expr, err)
+		}
+		return &whereNode{Op: "literal", Value: value}, nil
+	case token[0] == '-' || (token[0] >= '0' && token[0] <= '9'):
+		value, ok := whereNumber(token)
+		if !ok {
+			return nil, fmt.Errorf("invalid expression %q: invalid number %q", parser.expr, token)
+		}
+		return &whereNode{Op: "literal", Value: value}, nil
+	case token[0] == '_' || unicode.IsLetter(rune(token[0])):
+		if !slices.ContainsFunc(parser.tags, func(tag string) bool { return strings.EqualFold(tag, token) }) {
+			parser.tags = append(parser.tags, token)
+		}
+		return &whereNode{Op: "tag", Tag: token}, nil
+	}
+	return nil, fmt.Errorf("invalid expression %q: unexpected %q", parser.expr, token)
+}
+
+// Tags returns the names of the tags the expression refers to.
+func (expr *whereExpr) Tags() []string {
+	if expr == nil {
+		return nil
+	}
+	return expr.tags
+}
+
+// Match reports whether the metadata in exif matches the expression. A nil
+// expression matches everything.
+func (expr *whereExpr) Match(exif Exif) bool {
+	if expr == nil {
+		return true
+	}
+	return whereTruthy(expr.root.eval(exif.Tags))
+}
+
+func (node *whereNode) eval(tags map[string]any) any {
+	switch node.Op {
+	case "literal":
+		return node.Value
+	case "tag":
+		for name, value := range tags {
+			if strings.EqualFold(name, node.Tag) {
+				return value
+			}
+		}
+		return nil
+	case "&&":
+		return whereTruthy(node.Left.eval(tags)) && whereTruthy(node.Right.eval(tags))
+	case "||":
+		return whereTruthy(node.Left.eval(tags)) || whereTruthy(node.Right.eval(tags))
+	case "!":
+		return !whereTruthy(node.Left.eval(tags))
+	case "=~", "!~":
+		value := node.Left.eval(tags)
+		if value == nil {
+			return node.Op == "!~"
+		}
+		return node.Regexp.MatchString(whereString(value)) == (node.Op == "=~")
+	}
+	// A tag that is missing is neither equal to, less than nor greater than
+	// anything.
+	left, right := node.Left.eval(tags), node.Right.eval(tags)
+	if left == nil || right == nil {
+		return node.Op == "!="
+	}
+	var c int
+	leftNumber, leftOK := whereNumberValue(left)
+	rightNumber, rightOK := whereNumberValue(right)
+	if leftOK && rightOK {
+		c = cmp.Compare(leftNumber, rightNumber)
+	} else {
+		c = strings.Compare(whereString(left), whereString(right))
+	}
+	switch node.Op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// whereTruthy reports whether value counts as true on its own: present and
+// not false, empty or 0.
+func whereTruthy(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	}
+	return true
+}
+
+// whereNumberValue returns value as a number, if it is one or is a string
+// holding one.
+func whereNumberValue(value any) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case string:
+		return whereNumber(strings.TrimSpace(value))
+	}
+	return 0, false
+}
+
+// whereNumber parses a number or a fraction like 1/200, the way exiftool
+// prints exposure times.
+func whereNumber(s string) (float64, bool) {
+	numerator, denominator, isFraction := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0, false
+	}
+	if !isFraction {
+		return n, true
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d == 0 {
+		return 0, false
+	}
+	return n / d, true
+}
+
+// whereString returns value as a string for string comparisons.
+func whereString(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// ParseArgs handles the positional arguments left over after parsing the
+// flags. Directories are walked like -root and files are selected as-is,
+// and either takes the place of the current directory.
+func (selector *FileSelector) ParseArgs(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	roots, filePaths, err := splitFileArgs(args, selector.localPath)
+	if err != nil {
+		return err
+	}
+	selector.Roots = append(selector.Roots[1:], roots...)
+	selector.FilePaths = filePaths
+	return nil
+}
+
+// Match reports whether a file named name found during the walk is
+// selected.
+func (selector *FileSelector) Match(name string) bool {
+	if !selector.IncludeHidden && isHiddenSystemFile(name) {
+		return false
+	}
+	matchString := func(r *regexp.Regexp) bool {
+		return r.MatchString(name)
+	}
+	return slices.ContainsFunc(selector.FileRegexps, matchString) && !slices.ContainsFunc(selector.ExcludeRegexps, matchString)
+}
+
+// Walk calls fn with FilePaths and then with every selected file under the
+// roots, along with the root it was found in, stopping at the first error.
+// The root of each of FilePaths is taken to be its directory. skipDir, if
+// not nil, is called with the path of every directory below a root and
+// keeps the walk out of it if it returns true.
+func (selector *FileSelector) Walk(skipDir func(dirPath string) bool, fn func(root, filePath string) error) error {
+	for _, filePath := range selector.FilePaths {
+		err := fn(filepath.Dir(filePath), filePath)
+		if err != nil {
+			return err
+		}
+	}
+	for _, root := range selector.Roots {
+		err := fs.WalkDir(os.DirFS(root), ".", func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if dirEntry.IsDir() {
+				if path == "." {
+					return nil
+				}
+				if !selector.Recursive || dirEntry.Name() == trashDirName {
+					return fs.SkipDir
+				}
+				if slices.ContainsFunc(selector.ExcludeRegexps, func(r *regexp.Regexp) bool {
+					return r.MatchString(dirEntry.Name())
+				}) {
+					return fs.SkipDir
+				}
+				if skipDir != nil && skipDir(filepath.Join(root, path)) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if dirEntry.Name() == lockFileName || !selector.Match(dirEntry.Name()) {
+				return nil
+			}
+			return fn(root, filepath.Join(root, path))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// safetyFileLimit is the number of files above which CheckSafety asks
+// before going ahead.
+const safetyFileLimit = 100000
+
+// CheckSafety guards against a mistyped root (or running in the wrong
+// directory) reorganizing far more than intended. It asks for confirmation
+// if a root is the root of a filesystem, the home directory or the
+// directory of home directories, or if a recursive walk would select more
+// than safetyFileLimit files. Without a terminal to ask on it fails
+// instead, unless force is set.
+func (selector *FileSelector) CheckSafety(force bool, stderr io.Writer) error {
+	if force {
+		return nil
+	}
+	homeDir, _ := os.UserHomeDir()
+	samePath := func(a, b string) bool {
+		if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+			return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+		}
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	var reasons []string
+	for _, root := range selector.Roots {
+		switch {
+		case filepath.Dir(root) == root:
+			reasons = append(reasons, root+" is the root of a filesystem")
+		case homeDir != "" && samePath(root, homeDir):
+			reasons = append(reasons, root+" is the home directory")
+		case homeDir != "" && samePath(root, filepath.Dir(homeDir)):
+			reasons = append(reasons, root+" holds every user's home directory")
+		}
+	}
+	if len(reasons) == 0 && selector.Recursive {
+		var numFiles int
+		errLimit := errors.New("limit reached")
+		err := selector.Walk(nil, func(root, filePath string) error {
+			numFiles++
+			if numFiles > safetyFileLimit {
+				return errLimit
+			}
+			return nil
+		})
+		if errors.Is(err, errLimit) {
+			reasons = append(reasons, fmt.Sprintf("more than %d files are selected", safetyFileLimit))
+		}
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	reason := strings.Join(reasons, ", ")
+	fileInfo, err := os.Stdin.Stat()
+	if err != nil || fileInfo.Mode()&fs.ModeCharDevice == 0 {
+		return fmt.Errorf("refusing to run because %s (use -force if this is intended)", reason)
+	}
+	fmt.Fprintf(stderr, "%s. Continue? [y/N] ", reason)
+	answer := <-stdinLines()
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("aborted")
+	}
+	return nil
+}
+
+// lockFileName is the lock file Lock creates in each root. The walk never
+// selects it.
+const lockFileName = ".exifutil.lock"
+
+// lockHeartbeat is how often a held lock file is touched, and lockStaleAfter
+// how long after its last touch it is taken to have been left behind by an
+// exifutil that didn't exit cleanly, like after a power loss.
+const (
+	lockHeartbeat  = 30 * time.Second
+	lockStaleAfter = 2 * time.Minute
+)
+
+// lockOwner is the content of a lock file.
+type lockOwner struct {
+	PID       int
+	Hostname  string
+	StartTime time.Time
+}
+
+// Lock takes an advisory lock on each root (and the directory of each of
+// FilePaths), so that two exifutil runs don't rename the same files from
+// under each other. A lock is a lock file holding the PID and hostname of
+// its owner, which is touched every lockHeartbeat until unlock is called.
+// Locks whose owner has died, or which haven't been touched for
+// lockStaleAfter, are taken over.
+func (selector *FileSelector) Lock(logger *slog.Logger) (unlock func(), err error) {
+	dirs := slices.Clone(selector.Roots)
+	for _, filePath := range selector.FilePaths {
+		dirs = append(dirs, filepath.Dir(filePath))
+	}
+	slices.Sort(dirs)
+	dirs = slices.Compact(dirs)
+	hostname, _ := os.Hostname()
+	owner := lockOwner{PID: os.Getpid(), Hostname: hostname, StartTime: time.Now()}
+	b, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+	var lockFiles []string
+	release := func() {
+		for _, lockFile := range lockFiles {
+			// Only remove the lock file if it is still ours, and hasn't been
+			// taken over because this run stalled.
+			data, err := os.ReadFile(lockFile)
+			if err == nil && bytes.Equal(data, b) {
+				os.Remove(lockFile)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		lockFile := filepath.Join(dir, lockFileName)
+		for attempt := 0; ; attempt++ {
+			file, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				_, err = file.Write(b)
+				if err == nil {
+					err = file.Close()
+				} else {
+					file.Close()
+				}
+				if err != nil {
+					os.Remove(lockFile)
+					release()
+					return nil, err
+				}
+				lockFiles = append(lockFiles, lockFile)
+				break
+			}
+			if !errors.Is(err, fs.ErrExist) || attempt > 0 {
+				release()
+				return nil, err
+			}
+			stale, other, err := staleLock(lockFile)
+			if err != nil {
+				release()
+				return nil, err
+			}
+			if !stale {
+				release()
+				return nil, fmt.Errorf("%s is locked by exifutil (pid %d on %s, since %s), use -no-lock to run anyway", dir, other.PID, other.Hostname, other.StartTime.Format(time.DateTime))
+			}
+			logger.Warn("taking over lock left behind by exifutil", slog.String("lockFile", lockFile), slog.Int("pid", other.PID), slog.String("hostname", other.Hostname))
+			err = os.Remove(lockFile)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				release()
+				return nil, err
+			}
+		}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				for _, lockFile := range lockFiles {
+					err := os.Chtimes(lockFile, now, now)
+					if err != nil {
+						logger.Warn(err.Error(), slog.String("lockFile", lockFile))
+					}
+				}
+			}
+		}
+	}()
+	return sync.OnceFunc(func() {
+		close(done)
+		<-stopped
+		release()
+	}), nil
+}
+
+// staleLock reports whether the lock file at lockFile was left behind,
+// either because its owner on this host is no longer running or because it
+// hasn't been touched for lockStaleAfter, and returns its owner.
+func staleLock(lockFile string) (stale bool, owner lockOwner, err error) {
+	data, err := os.ReadFile(lockFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, owner, nil
+	}
+	if err != nil {
+		return false, owner, err
+	}
+	fileInfo, err := os.Stat(lockFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, owner, nil
+	}
+	if err != nil {
+		return false, owner, err
+	}
+	// A lock file that can't be read is most likely one whose owner died
+	// while writing it.
+	if json.Unmarshal(data, &owner) != nil {
+		return time.Since(fileInfo.ModTime()) > lockStaleAfter, owner, nil
+	}
+	hostname, _ := os.Hostname()
+	if owner.Hostname == hostname && owner.PID != os.Getpid() && !processAlive(owner.PID) {
+		return true, owner, nil
+	}
+	return time.Since(fileInfo.ModTime()) > lockStaleAfter, owner, nil
+}
+
+// splitFileArgs sorts positional arguments into directories, which are walked
+// like -root, and files, which are processed as-is without needing to match
+// any -file regex. Each argument is passed through localPath first.
+func splitFileArgs(args []string, localPath func(string) (string, error)) (roots []string, filePaths []string, err error) {
+	for _, arg := range args {
+		remote := isRemotePath(arg)
+		arg, err := localPath(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		// A remote is only mounted once the subcommand runs, so a path on
+		// one is taken to be a directory.
+		if remote {
+			roots = append(roots, path)
+			continue
+		}
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fileInfo.IsDir() {
+			roots = append(roots, path)
+		} else {
+			filePaths = append(filePaths, path)
+		}
+	}
+	return roots, filePaths, nil
+}
+
+// urlSchemeRegexp matches the scheme of a URL like gs://bucket/prefix or
+// sftp://host/path. Windows drive letters are a single letter followed by
+// :\ or :/ and so don't match.
+var urlSchemeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]+://`)
+
+// checkLocalPath rejects a root or destination given as the URL of an
+// object store or remote share, which would otherwise be taken to be a
+// relative path. exifutil only reads and moves files through the local
+// filesystem, so they have to be mounted first, or given as rclone:// or
+// s3:// paths for localPath to mount.
+func checkLocalPath(path string) error {
+	if urlSchemeRegexp.MatchString(path) {
+		return fmt.Errorf("%s: remote storage is not supported, mount it first (e.g. with rclone mount, s3fs or sshfs) and use the path of the mount, or use an rclone remote as rclone://REMOTE/PATH or an S3 bucket as s3://BUCKET/PREFIX", path)
+	}
+	return nil
+}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	n := strings.Count(pattern, ".")
+	if n == 0 {
+		return regexp.Compile(pattern)
+	}
+	if strings.HasPrefix(pattern, "./") && len(pattern) > 2 {
+		pattern = pattern[2:]
+	}
+	var b strings.Builder
+	b.Grow(len(pattern) + n)
+	j := 0
+	for j < len(pattern) {
+		prev, _ := utf8.DecodeLastRuneInString(b.String())
+		curr, width := utf8.DecodeRuneInString(pattern[j:])
+		next, _ := utf8.DecodeRuneInString(pattern[j+width:])
+		j += width
+		if prev != '\\' && curr == '.' && (('a' <= next && next <= 'z') || ('A' <= next && next <= 'Z')) {
+			b.WriteString("\\.")
+		} else {
+			b.WriteRune(curr)
+		}
+	}
+	return regexp.Compile(b.String())
+}
+
+// errAllWorkersExited is the cause a run is aborted with when every worker
+// has exited because its exiftool session died.
+var errAllWorkersExited = errors.New("all workers have exited, see the errors above")
+
+// errPinnedWorkerExited is the cause a run with -pin-dirs is aborted with
+// when a worker has exited because its exiftool session died, as the files
+// of its directories can't be handed to another worker.
+var errPinnedWorkerExited = errors.New("a worker pinned to directories has exited, see the errors above")
+
+// errExifToolTimeout is returned by exifTool.Execute when exiftool takes
+// longer than the configured timeout to respond.
+var errExifToolTimeout = errors.New("exiftool timed out")
+
+// errUnreadableFile is returned by exifTool.FileExifs for a file that
+// couldn't be handed to exiftool, such as a corrupt .livp. Unlike its other
+// errors, exiftool is still running after it.
+var errUnreadableFile = errors.New("unable to read file")
+
+// exifTool is an exiftool process kept running with -stay_open so that it
+// can service multiple requests without paying the startup cost each time.
+type exifTool struct {
+	// Timeout is the maximum amount of time exiftool is given to respond to
+	// a single Execute. Zero means no timeout.
+	Timeout time.Duration
+	// Charset is the character set exiftool should assume file names are
+	// encoded in. Empty means exiftool's default.
+	Charset string
+	// Config, if set, is the exiftool config file loaded in place of the
+	// user's .ExifTool_config.
+	Config string
+	// configKey identifies the contents of Config in cache keys, since
+	// user-defined tags change what exiftool reads.
+	configKey string
+	// Cache, if set, is consulted by FileExifs before asking exiftool.
+	Cache *exifCache
+	// DateSourceRules are passed to parseRawExif by FileExifs.
+	DateSourceRules []dateSourceRule
+	// ExtHandlers give the date sources of files of their extension, for
+	// files from cameras none of DateSourceRules match.
+	ExtHandlers map[string]extHandler
+	// ReadArgs are passed to exiftool along with each file read by
+	// FileExifs.
+	ReadArgs []string
+	// Tags are extra tags FileExifs keeps in Exif.Tags, for -where and
+	// templates.
+	Tags []string
+	// ctx kills the process (including any Execute in progress) when it is
+	// done.
+	ctx     context.Context
+	stderr  io.Writer
+	session exifToolSession
+	// stopOnDone, if set, stops the process from being killed once ctx is
+	// done. It is set for processes taken from exifToolSessions, which
+	// outlive ctx.
+	stopOnDone func() bool
+	buf        bytes.Buffer
+	// timedOut is set when the process was killed for exceeding Timeout.
+	timedOut atomic.Bool
+}
+
+// exifToolSession is what an exifTool sends its commands to, one argument
+// per line each followed by -execute, and reads the output of each command
+// from, up to the {ready} that ends it. It is normally an exifToolProcess.
+type exifToolSession interface {
+	// Stdin is where commands are written.
+	Stdin() io.Writer
+	// Stdout is where their output is read from.
+	Stdout() *bufio.Reader
+	// Stop kills the session without waiting for it to end, failing any
+	// read of its output in progress.
+	Stop()
+	// Kill stops the session and waits for it to end.
+	Kill()
+	// Close tells the session to end and stops it.
+	Close() error
+}
+
+// startExifToolSession starts the session of an exifTool, or of
+// exifToolSessions. It is a variable so that tests can replay canned
+// exiftool output without running exiftool.
+var startExifToolSession = startExifToolProcess
+
+// exifToolProcess is a running exiftool -stay_open process.
+type exifToolProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startExifTool(ctx context.Context, stderr io.Writer, timeout time.Duration, charset, config string) (*exifTool, error) {
+	exifTool := &exifTool{
+		Timeout: timeout,
+		Charset: charset,
+		Config:  config,
+		ctx:     ctx,
+		stderr:  stderr,
+	}
+	if config != "" {
+		fileInfo, err := os.Stat(config)
+		if err != nil {
+			return nil, err
+		}
+		exifTool.configKey = fmt.Sprintf("-config %s %d %d", config, fileInfo.Size(), fileInfo.ModTime().UnixNano())
+	}
+	err := exifTool.start()
+	if err != nil {
+		return nil, err
+	}
+	return exifTool, nil
+}
+
+func (exifTool *exifTool) start() error {
+	if exifToolSessions != nil {
+		session, err := exifToolSessions.Get(exifTool.Charset, exifTool.Config)
+		if err != nil {
+			return err
+		}
+		exifTool.session = session
+		exifTool.stopOnDone = context.AfterFunc(exifTool.ctx, session.Stop)
+		return nil
+	}
+	session, err := startExifToolSession(exifTool.ctx, exifTool.stderr, exifTool.Charset, exifTool.Config)
+	if err != nil {
+		return err
+	}
+	exifTool.session = session
+	return nil
+}
+
+func startExifToolProcess(ctx context.Context, stderr io.Writer, charset, config string) (exifToolSession, error) {
+	args := []string{"-stay_open", "True", "-@", "-"}
+	// exiftool only honors -config as its very first argument.
+	if config != "" {
+		args = append([]string{"-config", config}, args...)
+	}
+	commonArgs := slices.Clone(exifToolPlatformArgs)
+	if charset != "" {
+		commonArgs = append(commonArgs, "-charset", "filename="+charset)
+	}
+	if len(commonArgs) > 0 {
+		args = append(args, "-common_args")
+		args = append(args, commonArgs...)
+	}
+	cmd := exec.CommandContext(ctx, "exiftool", args...)
+	setpgid(cmd)
+	cmd.Cancel = func() error {
+		stop(cmd)
+		return nil
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cmd.String(), err)
+	}
+	return &exifToolProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// Execute passes args to exiftool (one argument per line) and returns its
+// output. The returned slice is only valid until the next call to Execute.
+// If exiftool does not respond within the timeout the process is killed and
+// errExifToolTimeout is returned, after which the caller should Restart it.
+func (exifTool *exifTool) Execute(args ...string) ([]byte, error) {
+	stopTimer, err := exifTool.send(args)
+	if err != nil {
+		return nil, err
+	}
+	defer stopTimer()
+	exifTool.buf.Reset()
+	err = readUntilReady(exifTool.session.Stdout(), &exifTool.buf)
+	if err != nil {
+		return nil, exifTool.readError(err)
+	}
+	return exifTool.buf.Bytes(), nil
+}
+
+// FileExifs returns the exifs of a single file, from the cache if the file is
+// unchanged since it was last read and from exiftool otherwise.
+func (exifTool *exifTool) FileExifs(logger *slog.Logger, filePath string) ([]Exif, error) {
+	// Entries cached without Tags don't have them, so they are part of
+	// the key.
+	cacheArgs := exifTool.ReadArgs
+	if len(exifTool.Tags) > 0 {
+		cacheArgs = append(slices.Clip(cacheArgs), "-where "+strings.Join(exifTool.Tags, ","))
+	}
+	if exifTool.configKey != "" {
+		cacheArgs = append(slices.Clip(cacheArgs), exifTool.configKey)
+	}
+	key, rawExifs, ok := exifTool.Cache.Lookup(filePath, cacheArgs)
+	if !ok {
+		// exiftool only sees a ZIP archive in a .livp, so the still image
+		// inside is read in its place.
+		readPath := filePath
+		if isLivp(filePath) {
+			stillPath, err := extractLivpStill(filePath)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", errUnreadableFile, err)
+			}
+			defer os.Remove(stillPath)
+			readPath = stillPath
+		}
+		var err error
+		rawExifs, err = exifTool.ExecuteJSON(logger, append(slices.Clip(exifTool.ReadArgs), readPath)...)
+		if err != nil {
+			return nil, err
+		}
+		// A .livp keeps its extension, even with -fix-ext.
+		if readPath != filePath {
+			for i := range rawExifs {
+				rawExifs[i].FileTypeExtension = "livp"
+			}
+		}
+		exifTool.Cache.Store(logger, key, rawExifs)
+	}
+	rules := exifTool.DateSourceRules
+	if sources := exifTool.ExtHandlers[strings.ToLower(filepath.Ext(filePath))].DateSources; len(sources) > 0 {
+		rules = append(slices.Clip(rules), dateSourceRule{ModelRegexp: anyModelRegexp, Sources: sources})
+	}
+	exifs := make([]Exif, 0, len(rawExifs))
+	for _, rawExif := range rawExifs {
+		exifs = append(exifs, parseRawExif(logger, rawExif, rules))
+	}
+	return exifs, nil
+}
+
+// ExecuteJSON is like Execute, except that it passes -json to exiftool and
+// decodes its output one element at a time so that memory use is bounded by
+// the largest element rather than the entire output.
+func (exifTool *exifTool) ExecuteJSON(logger *slog.Logger, args ...string) ([]rawExif, error) {
+	stopTimer, err := exifTool.send(append([]string{"-json"}, args...))
+	if err != nil {
+		return nil, err
+	}
+	defer stopTimer()
+	// exiftool doesn't print anything (not even an empty array) if it could
+	// not read any of the files, so check if there is an array to decode.
+	stdout := exifTool.session.Stdout()
+	var c byte
+	for {
+		c, err = stdout.ReadByte()
+		if err != nil {
+			return nil, exifTool.readError(err)
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			break
+		}
+	}
+	_ = stdout.UnreadByte()
+	if c != '[' {
+		err = readUntilReady(stdout, io.Discard)
+		if err != nil {
+			return nil, exifTool.readError(err)
+		}
+		return nil, nil
+	}
+	var rawExifs []rawExif
+	decoder := json.NewDecoder(stdout)
+	err = func() error {
+		_, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		for decoder.More() {
+			var rawExif rawExif
+			if len(exifTool.Tags) == 0 {
+				err := decoder.Decode(&rawExif)
+				if err != nil {
+					return err
+				}
+				rawExifs = append(rawExifs, rawExif)
+				continue
+			}
+			var data json.RawMessage
+			err := decoder.Decode(&data)
+			if err != nil {
+				return err
+			}
+			err = json.Unmarshal(data, &rawExif)
+			if err != nil {
+				return err
+			}
+			var tags map[string]any
+			err = json.Unmarshal(data, &tags)
+			if err != nil {
+				return err
+			}
+			rawExif.WhereTags = make(map[string]any)
+			for name, value := range tags {
+				for _, tag := range exifTool.Tags {
+					if strings.EqualFold(name, tag) {
+						rawExif.WhereTags[tag] = value
+					}
+				}
+			}
+			rawExifs = append(rawExifs, rawExif)
+		}
+		_, err = decoder.Token()
+		return err
+	}()
+	if err != nil {
+		if exifTool.timedOut.Load() || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, exifTool.readError(err)
+		}
+		// Malformed JSON is not fatal, skip ahead to the {ready} marker so
+		// the next command starts from a clean slate.
+		logger.Error(err.Error())
+		rawExifs = nil
+	}
+	// The decoder reads ahead, so whatever it has buffered is the start of
+	// the remaining output.
+	err = readUntilReady(bufio.NewReader(io.MultiReader(decoder.Buffered(), stdout)), io.Discard)
+	if err != nil {
+		return nil, exifTool.readError(err)
+	}
+	return rawExifs, nil
+}
+
+// send writes args to exiftool followed by -execute and starts the timeout
+// timer. The returned function must be called to stop the timer once the
+// output has been read.
+func (exifTool *exifTool) send(args []string) (stopTimer func(), err error) {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(quoteExifToolArg(arg) + "\n")
+	}
+	b.WriteString("-execute\n")
+	_, err = io.WriteString(exifTool.session.Stdin(), b.String())
+	if err != nil {
+		return nil, err
+	}
+	exifTool.timedOut.Store(false)
+	if exifTool.Timeout <= 0 {
+		return func() {}, nil
+	}
+	timer := time.AfterFunc(exifTool.Timeout, func() {
+		exifTool.timedOut.Store(true)
+		exifTool.session.Stop()
+	})
+	return func() { timer.Stop() }, nil
+}
+
+// exifToolArgReplacer escapes the characters that are special in exiftool's
+// C string arguments.
+var exifToolArgReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// quoteExifToolArg makes arg safe to pass to exiftool through -@. Arguments
+// are passed one per line, and exiftool strips leading and trailing white
+// space from each line and ignores lines starting with #, so any arg which
+// would be mangled by this (usually a file path with a newline in it) is
+// passed as a #[CSTR] C string instead.
+func quoteExifToolArg(arg string) string {
+	if arg == strings.TrimSpace(arg) && !strings.HasPrefix(arg, "#") && !strings.ContainsAny(arg, "\n\r") {
+		return arg
+	}
+	return "#[CSTR]" + exifToolArgReplacer.Replace(arg)
+}
+
+// readError converts an error encountered while reading exiftool's output
+// into the cause of the context or errExifToolTimeout if the read failed
+// because exiftool was killed.
+func (exifTool *exifTool) readError(err error) error {
+	if exifTool.ctx.Err() != nil {
+		return context.Cause(exifTool.ctx)
+	}
+	if exifTool.timedOut.Load() {
+		return fmt.Errorf("%w after %s", errExifToolTimeout, exifTool.Timeout)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("exiftool returned EOF prematurely")
+	}
+	return err
+}
+
+// exifCacheVersion is part of every exifCache key, and should be bumped
+// whenever the tags requested in rawExif change.
+const exifCacheVersion = 6
+
+// exifCache stores the tags exiftool read from files on disk so that
+// repeated runs over the same files (such as a -dry-run followed by a real
+// run) don't need to invoke exiftool again. The tags are stored rather than
+// the Exifs built from them so that -date-source rules apply to cached files
+// too. Files are identified by their device and inode (or path, on
+// Windows), size and modification time, which unlike a content hash can be
+// computed without reading the file and survive renames. Its methods may be
+// called on a nil *exifCache, in which case nothing is cached.
+type exifCache struct {
+	dir string
+}
+
+// openExifCache opens the cache in the user's cache directory, e.g.
+// ~/.cache/exifutil on Linux.
+func openExifCache() (*exifCache, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(userCacheDir, "exifutil", "exif")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &exifCache{dir: dir}, nil
+}
+
+// Lookup returns the cached tags of filePath as read with readArgs, along
+// with the key to Store them under if they are not cached. An empty key means
+// filePath cannot be cached.
+func (cache *exifCache) Lookup(filePath string, readArgs []string) (key string, rawExifs []rawExif, ok bool) {
+	if cache == nil {
+		return "", nil, false
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return "", nil, false
+	}
+	// Different read args may read different tags (e.g. -fast2 skips maker
+	// notes), so they are part of the key.
+	hash := sha256.Sum256(fmt.Appendf(nil, "v%d\x00%s\x00%d\x00%d\x00%s", exifCacheVersion, fileIdentity(filePath, fileInfo), fileInfo.Size(), fileInfo.ModTime().UnixNano(), strings.Join(readArgs, "\x00")))
+	key = hex.EncodeToString(hash[:])
+	data, err := os.ReadFile(cache.path(key))
+	if err != nil {
+		return key, nil, false
+	}
+	err = json.Unmarshal(data, &rawExifs)
+	if err != nil {
+		return key, nil, false
+	}
+	return key, rawExifs, true
+}
+
+// Store caches rawExifs under key. Failures are logged and otherwise
+// ignored, since the cache is only an optimization.
+func (cache *exifCache) Store(logger *slog.Logger, key string, rawExifs []rawExif) {
+	if cache == nil || key == "" || len(rawExifs) == 0 {
+		return
+	}
+	data, err := json.Marshal(rawExifs)
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	path := cache.path(key)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	// Write to a temporary file first so that concurrent runs never see a
+	// partially written entry.
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Close()
+	} else {
+		tempFile.Close()
+	}
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		logger.Warn(err.Error())
+	}
+}
+
+// path spreads entries over 256 subdirectories to keep directory sizes
+// manageable for large archives.
+func (cache *exifCache) path(key string) string {
+	return filepath.Join(cache.dir, key[:2], key+".json")
+}
+
+// readUntilReady copies lines from reader to dst until it encounters the
+// {ready} marker exiftool prints once it has finished executing a command.
+// The marker is usually on a line of its own, except after binary (-b)
+// output which does not end in a newline.
+func readUntilReady(reader *bufio.Reader, dst io.Writer) error {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if data, ok := bytes.CutSuffix(line, []byte("{ready}\n")); ok {
+			_, _ = dst.Write(data)
+			return nil
+		}
+		_, _ = dst.Write(line)
+	}
+}
+
+// Restart kills the current exiftool process and starts a new one in its
+// place.
+func (exifTool *exifTool) Restart() error {
+	if exifTool.ctx.Err() != nil {
+		return context.Cause(exifTool.ctx)
+	}
+	if exifTool.stopOnDone != nil {
+		exifTool.stopOnDone()
+	}
+	exifTool.session.Kill()
+	return exifTool.start()
+}
+
+// Close tells exiftool to exit and stops the process, or hands the process
+// back to exifToolSessions if it came from there and is still usable.
+func (exifTool *exifTool) Close() error {
+	if exifTool.stopOnDone != nil {
+		exifTool.stopOnDone()
+		if exifTool.ctx.Err() == nil && !exifTool.timedOut.Load() {
+			exifToolSessions.Put(exifTool.Charset, exifTool.Config, exifTool.session)
+			return nil
+		}
+	}
+	if exifTool.ctx.Err() != nil {
+		exifTool.session.Kill()
+		return nil
+	}
+	return exifTool.session.Close()
+}
+
+func (process *exifToolProcess) Stdin() io.Writer { return process.stdin }
+
+func (process *exifToolProcess) Stdout() *bufio.Reader { return process.stdout }
+
+// Stop kills the process without waiting for it to exit.
+func (process *exifToolProcess) Stop() {
+	stop(process.cmd)
+}
+
+// Close tells exiftool to exit and stops the process.
+func (process *exifToolProcess) Close() error {
+	_, err := io.WriteString(process.stdin, "-stay_open\n"+
+		"False\n")
+	process.Kill()
+	return err
+}
+
+// Kill stops the process without asking exiftool to exit first.
+func (process *exifToolProcess) Kill() {
+	stop(process.cmd)
+	_ = process.cmd.Wait()
+}
+
+// exifToolSessions, if set, keeps exiftool processes running after their
+// exifTool is closed, for the next exifTool started to pick up instead of
+// starting its own. Only the daemon sets it, so that the runs it serves
+// skip exiftool's startup time.
+var exifToolSessions *exifToolPool
+
+// exifToolPool holds idle exiftool processes by the character set and config
+// file they were started with. Its processes are killed once ctx is done. Their stderr is
+// the package-level stderr, as it was when they were started.
+type exifToolPool struct {
+	ctx   context.Context
+	mutex sync.Mutex
+	idle  map[string][]exifToolSession
+	// maxIdle is the most processes kept idle per character set and config
+	// file. Processes handed back beyond that are closed.
+	maxIdle int
+}
+
+func newExifToolPool(ctx context.Context, maxIdle int) *exifToolPool {
+	return &exifToolPool{
+		ctx:     ctx,
+		idle:    make(map[string][]exifToolSession),
+		maxIdle: maxIdle,
+	}
+}
+
+// Get returns an idle process started with charset and config, or starts a
+// new one if there is none.
+func (pool *exifToolPool) Get(charset, config string) (exifToolSession, error) {
+	key := charset + "\x00" + config
+	for {
+		pool.mutex.Lock()
+		processes := pool.idle[key]
+		if len(processes) == 0 {
+			pool.mutex.Unlock()
+			return startExifToolSession(pool.ctx, stderr, charset, config)
+		}
+		process := processes[len(processes)-1]
+		pool.idle[key] = processes[:len(processes)-1]
+		pool.mutex.Unlock()
+		// A process may have died while it sat idle.
+		if sessionAlive(process) {
+			return process, nil
+		}
+		process.Kill()
+	}
+}
+
+// sessionAlive checks that session still responds.
+func sessionAlive(session exifToolSession) bool {
+	timer := time.AfterFunc(10*time.Second, session.Stop)
+	defer timer.Stop()
+	_, err := io.WriteString(session.Stdin(), "-ver\n"+
+		"-execute\n")
+	if err != nil {
+		return false
+	}
+	return readUntilReady(session.Stdout(), io.Discard) == nil
+}
+
+// Put hands a process that is done with back to the pool.
+func (pool *exifToolPool) Put(charset, config string, process exifToolSession) {
+	key := charset + "\x00" + config
+	pool.mutex.Lock()
+	if pool.ctx.Err() == nil && len(pool.idle[key]) < pool.maxIdle {
+		pool.idle[key] = append(pool.idle[key], process)
+		process = nil
+	}
+	pool.mutex.Unlock()
+	if process != nil {
+		process.Close()
+	}
+}
+
+// Close closes every idle process.
+func (pool *exifToolPool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for key, processes := range pool.idle {
+		for _, process := range processes {
+			process.Close()
+		}
+		delete(pool.idle, key)
+	}
+}
+
+// Result is the outcome of an operation on a single file, for applications
+// embedding the commands to show progress and errors as they happen. Action
+// is the status written to the report e.g. moved, dry-run, exists or failed.
+// NewPath and Exif may be empty if the operation failed before they could be
+// determined, and Err is set when the file was left in place because of an
+// error.
+type Result struct {
+	Path    string
+	NewPath string
+	Action  string
+	Err     error
+	Exif    Exif
+}
+
+// reportWriter records the outcome of every file operation as a row in a CSV
+// (or TSV, if the file name ends in .tsv) report. A nil *reportWriter
+// discards everything written to it.
+type reportWriter struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newReportWriter(name string) (*reportWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	writer := csv.NewWriter(file)
+	if strings.EqualFold(filepath.Ext(name), ".tsv") {
+		writer.Comma = '\t'
+	}
+	err = writer.Write([]string{"path", "new_path", "creation_time", "creation_time_source", "status", "ambiguous_time"})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &reportWriter{
+		file:   file,
+		writer: writer,
+	}, nil
+}
+
+// Write records the outcome of an operation on filePath. newFilePath and exif
+// may be empty if the operation failed before they could be determined.
+func (reportWriter *reportWriter) Write(filePath, newFilePath string, exif Exif, status string) {
+	if reportWriter == nil {
+		return
+	}
+	var creationTime string
+	if !exif.CreationTime.IsZero() {
+		creationTime = exif.CreationTime.Format(time.RFC3339Nano)
+	}
+	reportWriter.mutex.Lock()
+	defer reportWriter.mutex.Unlock()
+	var ambiguousTime string
+	if exif.AmbiguousTime {
+		ambiguousTime = "true"
+	}
+	_ = reportWriter.writer.Write([]string{filePath, newFilePath, creationTime, exif.CreationTimeSource, status, ambiguousTime})
+	// Flush every row, so that the report can be followed while the run is
+	// in progress and survives the run being killed.
+	reportWriter.writer.Flush()
+}
+
+func (reportWriter *reportWriter) Close() error {
+	if reportWriter == nil {
+		return nil
+	}
+	reportWriter.writer.Flush()
+	err := reportWriter.writer.Error()
+	if err != nil {
+		reportWriter.file.Close()
+		return err
+	}
+	return reportWriter.file.Close()
+}
+
+// manifestWriter records the SHA-256 of every file a run leaves in place,
+// for checking an organized archive for bit rot later. The manifest is in
+// the format of sha256sum, so that sha256sum -c can check it, unless its
+// name ends in .csv or .tsv, in which case it also has the creation time of
+// every file. A nil *manifestWriter discards everything added to it.
+type manifestWriter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	entries []manifestEntry
+}
+
+type manifestEntry struct {
+	FilePath     string
+	SHA256       string
+	CreationTime time.Time
+}
+
+func newManifestWriter(name string) (*manifestWriter, error) {
+	// Create the file up front so that a bad path fails the run before it
+	// starts rather than after.
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestWriter{file: file}, nil
+}
+
+// Add hashes filePath and records it with the creation time in exif.
+func (manifestWriter *manifestWriter) Add(filePath string, exif Exif) error {
+	if manifestWriter == nil {
+		return nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	manifestWriter.mutex.Lock()
+	defer manifestWriter.mutex.Unlock()
+	manifestWriter.entries = append(manifestWriter.entries, manifestEntry{
+		FilePath:     filePath,
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		CreationTime: exif.CreationTime,
+	})
+	return nil
+}
+
+// Close writes the entries sorted by path. Paths under the directory of the
+// manifest are relative to it, so that it can be checked from there even
+// if the archive is moved.
+func (manifestWriter *manifestWriter) Close() error {
+	if manifestWriter == nil {
+		return nil
+	}
+	slices.SortFunc(manifestWriter.entries, func(a, b manifestEntry) int {
+		return strings.Compare(a.FilePath, b.FilePath)
+	})
+	manifestDir, err := filepath.Abs(filepath.Dir(manifestWriter.file.Name()))
+	if err != nil {
+		manifestWriter.file.Close()
+		return err
+	}
+	relativePath := func(filePath string) string {
+		rel, err := filepath.Rel(manifestDir, filePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filePath
+		}
+		return rel
+	}
+	writer := bufio.NewWriter(manifestWriter.file)
+	ext := strings.ToLower(filepath.Ext(manifestWriter.file.Name()))
+	if ext == ".csv" || ext == ".tsv" {
+		csvWriter := csv.NewWriter(writer)
+		if ext == ".tsv" {
+			csvWriter.Comma = '\t'
+		}
+		_ = csvWriter.Write([]string{"sha256", "path", "creation_time"})
+		for _, entry := range manifestWriter.entries {
+			var creationTime string
+			if !entry.CreationTime.IsZero() {
+				creationTime = entry.CreationTime.Format(time.RFC3339Nano)
+			}
+			_ = csvWriter.Write([]string{entry.SHA256, relativePath(entry.FilePath), creationTime})
+		}
+		csvWriter.Flush()
+		err = csvWriter.Error()
+	} else {
+		for _, entry := range manifestWriter.entries {
+			name := filepath.ToSlash(relativePath(entry.FilePath))
+			// sha256sum escapes names with backslashes or newlines in them,
+			// and marks their lines with a leading backslash.
+			if strings.ContainsAny(name, "\\\n\r") {
+				name = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(name)
+				writer.WriteString(`\`)
+			}
+			writer.WriteString(entry.SHA256 + "  " + name + "\n")
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		manifestWriter.file.Close()
+		return err
+	}
+	return manifestWriter.file.Close()
+}
+
+// digiKamWriter writes an SQL script that updates a digiKam database for the
+// files a run moved, so that the catalog follows them instead of filling up
+// with missing files. digiKam has to be closed while the script is run with
+// e.g. sqlite3 digikam4.db < FILE. Only albums of the album root of the
+// collection are touched, as other collections may have albums and files of
+// the same names. A nil *digiKamWriter discards everything added to it.
+type digiKamWriter struct {
+	mutex sync.Mutex
+	// root is the digiKam collection (album root) the moved files are in.
+	root   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newDigiKamWriter(name, root string) (*digiKamWriter, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	writer.WriteString("BEGIN;\n")
+	// digiKam identifies the album root by the volume it is on and its
+	// specificPath within the volume, which is the end of root. A root
+	// identified by its path instead has a specificPath of /.
+	slashRoot := filepath.ToSlash(strings.TrimPrefix(root, filepath.VolumeName(root)))
+	fmt.Fprintf(writer, "CREATE TEMP TABLE exifutil_album_root AS SELECT id FROM AlbumRoots WHERE (specificPath <> '/' AND substr(%s, -length(specificPath)) = specificPath) OR (specificPath = '/' AND identifier IN (%s, %s)) ORDER BY length(specificPath) DESC LIMIT 1;\n",
+		quoteSQL(slashRoot), quoteSQL("volumeid:?path="+slashRoot), quoteSQL("volumeid:?path="+strings.ReplaceAll(slashRoot, " ", "%20")))
+	return &digiKamWriter{root: root, file: file, writer: writer}, nil
+}
+
+// quoteSQL quotes s as an SQL string literal.
+func quoteSQL(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Add records the move of filePath to newFilePath. Moves into or out of the
+// collection can't be expressed as an update and are skipped with an error.
+func (digiKamWriter *digiKamWriter) Add(filePath, newFilePath string) error {
+	if digiKamWriter == nil {
+		return nil
+	}
+	// digiKam stores the directory of each album relative to its album
+	// root, with a leading slash and forward slashes e.g. /2024/03.
+	albumPath := func(filePath string) (string, bool) {
+		rel, err := filepath.Rel(digiKamWriter.root, filepath.Dir(filePath))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", false
+		}
+		if rel == "." {
+			return "/", true
+		}
+		return "/" + filepath.ToSlash(rel), true
+	}
+	album, ok := albumPath(filePath)
+	if !ok {
+		return fmt.Errorf("%s is outside digiKam collection %s", filePath, digiKamWriter.root)
+	}
+	newAlbum, ok := albumPath(newFilePath)
+	if !ok {
+		return fmt.Errorf("%s is outside digiKam collection %s", newFilePath, digiKamWriter.root)
+	}
+	digiKamWriter.mutex.Lock()
+	defer digiKamWriter.mutex.Unlock()
+	if newAlbum != album {
+		// Create the new album in the album root, unless it already exists.
+		fmt.Fprintf(digiKamWriter.writer, "INSERT INTO Albums (albumRoot, relativePath, date) SELECT albumRoot, %s, date('now') FROM Albums WHERE albumRoot = (SELECT id FROM exifutil_album_root) AND relativePath = %s AND NOT EXISTS (SELECT 1 FROM Albums AS a WHERE a.albumRoot = Albums.albumRoot AND a.relativePath = %s);\n",
+			quoteSQL(newAlbum), quoteSQL(album), quoteSQL(newAlbum))
+	}
+	fmt.Fprintf(digiKamWriter.writer, "UPDATE Images SET album = (SELECT id FROM Albums WHERE albumRoot = (SELECT id FROM exifutil_album_root) AND relativePath = %s), name = %s WHERE name = %s AND album = (SELECT id FROM Albums WHERE albumRoot = (SELECT id FROM exifutil_album_root) AND relativePath = %s);\n",
+		quoteSQL(newAlbum), quoteSQL(filepath.Base(newFilePath)), quoteSQL(filepath.Base(filePath)), quoteSQL(album))
+	return nil
+}
+
+func (digiKamWriter *digiKamWriter) Close() error {
+	if digiKamWriter == nil {
+		return nil
+	}
+	digiKamWriter.writer.WriteString("DROP TABLE exifutil_album_root;\n")
+	digiKamWriter.writer.WriteString("COMMIT;\n")
+	err := digiKamWriter.writer.Flush()
+	if err != nil {
+		digiKamWriter.file.Close()
+		return err
+	}
+	return digiKamWriter.file.Close()
+}
+
+// parseAnnounce parses an -announce value, immich=URL or photoprism=URL.
+func parseAnnounce(value string) (kind, url string, err error) {
+	kind, url, ok := strings.Cut(value, "=")
+	if !ok || (kind != "immich" && kind != "photoprism") {
+		return "", "", fmt.Errorf("invalid value %q, must be immich=URL or photoprism=URL", value)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", "", fmt.Errorf("invalid URL %q, must start with http:// or https://", url)
+	}
+	return kind, strings.TrimSuffix(url, "/"), nil
+}
+
+// announcer tells a self-hosted gallery, Immich or PhotoPrism, to rescan
+// the directories a run moved files out of and into, so that it picks up
+// the changes without waiting for its next scheduled scan. Its methods may
+// be called concurrently, and on a nil *announcer, which announces nothing.
+type announcer struct {
+	mutex sync.Mutex
+	// kind is immich or photoprism. For immich, url is the URL of the
+	// external library e.g. https://immich.example.com/api/libraries/ID,
+	// and for photoprism the URL of the server.
+	kind string
+	url  string
+	// root is the directory PhotoPrism indexes as its originals, as this
+	// machine sees it.
+	root  string
+	token string
+	dirs  map[string]bool
+}
+
+func newAnnouncer(value, root, token string) (*announcer, error) {
+	kind, url, err := parseAnnounce(value)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "photoprism" {
+		if root == "" {
+			return nil, fmt.Errorf("-announce photoprism=URL needs -announce-root")
+		}
+		root, err = filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &announcer{kind: kind, url: url, root: root, token: token, dirs: make(map[string]bool)}, nil
+}
+
+// Add records the move of filePath to newFilePath.
+func (announcer *announcer) Add(filePath, newFilePath string) {
+	if announcer == nil {
+		return
+	}
+	announcer.mutex.Lock()
+	defer announcer.mutex.Unlock()
+	announcer.dirs[filepath.Dir(filePath)] = true
+	announcer.dirs[filepath.Dir(newFilePath)] = true
+}
+
+// Announce asks the gallery to rescan the directories added, if any. Immich
+// can only scan a whole library, which it is asked to do once. PhotoPrism
+// is asked to index each directory under root, and to clean up the files
+// that have gone from it.
+func (announcer *announcer) Announce(ctx context.Context) error {
+	if announcer == nil {
+		return nil
+	}
+	announcer.mutex.Lock()
+	dirs := slices.Sorted(maps.Keys(announcer.dirs))
+	announcer.mutex.Unlock()
+	if len(dirs) == 0 {
+		return nil
+	}
+	if announcer.kind == "immich" {
+		return announcer.post(ctx, announcer.url+"/scan", map[string]any{})
+	}
+	var errs []error
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(announcer.root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			errs = append(errs, fmt.Errorf("%s is outside PhotoPrism originals %s", dir, announcer.root))
+			continue
+		}
+		if rel == "." {
+			rel = ""
+		}
+		err = announcer.post(ctx, announcer.url+"/api/v1/index", map[string]any{
+			"path":    filepath.ToSlash(rel),
+			"rescan":  false,
+			"cleanup": true,
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// post sends body to url as JSON, authenticated with the token the way the
+// gallery expects.
+func (announcer *announcer) post(ctx context.Context, url string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if announcer.token != "" {
+		if announcer.kind == "immich" {
+			request.Header.Set("X-Api-Key", announcer.token)
+		} else {
+			request.Header.Set("Authorization", "Bearer "+announcer.token)
+		}
+	}
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return nil
+}
+
+// archiveIndex finds files whose contents are already somewhere in an
+// archive, regardless of their name or directory. Only the sizes of the
+// archive's files are read up front: a file is hashed the first time a file
+// of the same size is looked up, so that importing a card into a large
+// archive hashes little more than the card. Its methods may be called
+// concurrently, and on a nil *archiveIndex, which finds nothing.
+type archiveIndex struct {
+	// mutex guards the maps, but is never held while hashing.
+	mutex sync.Mutex
+	// sizeMutexes maps sizes to a mutex held while hashing the archive files
+	// of that size, so that two workers looking up files of the same size
+	// don't both hash the same archive files, or miss the ones the other is
+	// hashing, while files of other sizes are looked up meanwhile.
+	sizeMutexes map[int64]*sync.Mutex
+	// unhashed maps sizes to the archive files of that size not hashed yet.
+	unhashed map[int64][]string
+	// hashed maps sizes to the hashes of archive files of that size, and
+	// those to the files' paths.
+	hashed map[int64]map[string]string
+	// algorithm is the hash algorithm files are hashed with.
+	algorithm string
+}
+
+func newArchiveIndex(ctx context.Context, dirs []string, algorithm string) (*archiveIndex, error) {
+	if algorithm == "" {
+		algorithm = hashSHA256
+	}
+	index := &archiveIndex{
+		sizeMutexes: make(map[int64]*sync.Mutex),
+		unhashed:    make(map[int64][]string),
+		hashed:      make(map[int64]map[string]string),
+		algorithm:   algorithm,
+	}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dirEntry.IsDir() && dirEntry.Name() == trashDirName {
+				return fs.SkipDir
+			}
+			if !dirEntry.Type().IsRegular() || isHiddenSystemFile(dirEntry.Name()) {
+				return nil
+			}
+			fileInfo, err := dirEntry.Info()
+			if err != nil {
+				return err
+			}
+			index.unhashed[fileInfo.Size()] = append(index.unhashed[fileInfo.Size()], path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// Lookup returns the path of a file in the archive, other than filePath
+// itself, with the same contents as filePath, or an empty string if there is
+// none.
+func (index *archiveIndex) Lookup(ctx context.Context, logger *slog.Logger, filePath string) (string, error) {
+	if index == nil {
+		return "", nil
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	size := fileInfo.Size()
+	index.mutex.Lock()
+	if len(index.unhashed[size]) == 0 && len(index.hashed[size]) == 0 {
+		index.mutex.Unlock()
+		return "", nil
+	}
+	sizeMutex := index.sizeMutexes[size]
+	if sizeMutex == nil {
+		sizeMutex = &sync.Mutex{}
+		index.sizeMutexes[size] = sizeMutex
+	}
+	index.mutex.Unlock()
+	hash, err := hashFileWith(ctx, index.algorithm, filePath)
+	if err != nil {
+		return "", err
+	}
+	sizeMutex.Lock()
+	defer sizeMutex.Unlock()
+	index.mutex.Lock()
+	unhashed := index.unhashed[size]
+	delete(index.unhashed, size)
+	index.mutex.Unlock()
+	for i, archivedPath := range unhashed {
+		archivedHash, err := hashFileWith(ctx, index.algorithm, archivedPath)
+		if err != nil {
+			if ctx.Err() != nil {
+				index.mutex.Lock()
+				index.unhashed[size] = append(index.unhashed[size], unhashed[i:]...)
+				index.mutex.Unlock()
+				return "", err
+			}
+			logger.Warn(err.Error(), slog.String("archivedPath", archivedPath))
+			continue
+		}
+		index.mutex.Lock()
+		if index.hashed[size] == nil {
+			index.hashed[size] = make(map[string]string)
+		}
+		if _, ok := index.hashed[size][archivedHash]; !ok {
+			index.hashed[size][archivedHash] = archivedPath
+		}
+		index.mutex.Unlock()
+	}
+	index.mutex.Lock()
+	archivedPath, ok := index.hashed[size][hash]
+	index.mutex.Unlock()
+	if !ok {
+		return "", nil
+	}
+	if archivedPath == filePath {
+		return "", nil
+	}
+	archivedInfo, err := os.Stat(archivedPath)
+	if err != nil {
+		// The archived copy was moved or deleted since it was hashed.
+		index.mutex.Lock()
+		delete(index.hashed[size], hash)
+		index.mutex.Unlock()
+		return "", nil
+	}
+	if os.SameFile(fileInfo, archivedInfo) {
+		return "", nil
+	}
+	return archivedPath, nil
+}
+
+// Add adds a file that was just put in the archive to the index, so that
+// further copies of it in the same run are found as well.
+func (index *archiveIndex) Add(filePath string) {
+	if index == nil {
+		return
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.unhashed[fileInfo.Size()] = append(index.unhashed[fileInfo.Size()], filePath)
+}
+
+// skipList remembers files whose creation time could not be determined, by
+// the hash of their contents, so that later runs can skip them instead of
+// failing on them over and over. Like with archiveIndex, a file is only
+// hashed if a file of the same size is on the list. Its methods may be
+// called concurrently, and on a nil *skipList, which skips nothing.
+type skipList struct {
+	mutex sync.Mutex
+	path  string
+	// entries maps sizes to the hashes of the files of that size on the
+	// list, and those to their entries.
+	entries map[int64]map[string]skipListEntry
+}
+
+// skipListEntry is a row of the skip list.
+type skipListEntry struct {
+	Hash      string
+	Size      int64
+	Path      string
+	Reason    string
+	SkippedAt time.Time
+}
+
+// skipListPath returns the path of the skip list in the user's cache
+// directory, e.g. ~/.cache/exifutil/skiplist.csv on Linux.
+func skipListPath() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userCacheDir, "exifutil", "skiplist.csv"), nil
+}
+
+// readSkipList returns the entries of the skip list at path, oldest first. A
+// skip list that doesn't exist has no entries.
+func readSkipList(path string) ([]skipListEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []skipListEntry
+	for i, record := range records {
+		if i == 0 || len(record) < 5 {
+			continue
+		}
+		size, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", path, i+1, err)
+		}
+		skippedAt, err := time.Parse(time.RFC3339, record[4])
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %w", path, i+1, err)
+		}
+		entries = append(entries, skipListEntry{
+			Hash:      record[0],
+			Size:      size,
+			Path:      record[2],
+			Reason:    record[3],
+			SkippedAt: skippedAt,
+		})
+	}
+	return entries, nil
+}
+
+// openSkipList reads the skip list in the user's cache directory.
+func openSkipList() (*skipList, error) {
+	path, err := skipListPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readSkipList(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &skipList{
+		path:    path,
+		entries: make(map[int64]map[string]skipListEntry),
+	}
+	for _, entry := range entries {
+		if list.entries[entry.Size] == nil {
+			list.entries[entry.Size] = make(map[string]skipListEntry)
+		}
+		list.entries[entry.Size][entry.Hash] = entry
+	}
+	return list, nil
+}
+
+// Lookup returns the entry of the file on the list with the same contents
+// as filePath, if there is one.
+func (list *skipList) Lookup(ctx context.Context, filePath string) (skipListEntry, bool, error) {
+	if list == nil {
+		return skipListEntry{}, false, nil
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return skipListEntry{}, false, err
+	}
+	list.mutex.Lock()
+	numEntries := len(list.entries[fileInfo.Size()])
+	list.mutex.Unlock()
+	if numEntries == 0 {
+		return skipListEntry{}, false, nil
+	}
+	hash, err := hashFile(ctx, filePath)
+	if err != nil {
+		return skipListEntry{}, false, err
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	entry, ok := list.entries[fileInfo.Size()][hash]
+	return entry, ok, nil
+}
+
+// Add puts filePath on the list, along with the reason it was skipped.
+func (list *skipList) Add(ctx context.Context, filePath, reason string) error {
+	if list == nil {
+		return nil
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	entry := skipListEntry{
+		Hash:      hash,
+		Size:      fileInfo.Size(),
+		Path:      filePath,
+		Reason:    reason,
+		SkippedAt: time.Now(),
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if _, ok := list.entries[entry.Size][entry.Hash]; ok {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(list.path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(list.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err = file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	writer := csv.NewWriter(file)
+	if fileInfo.Size() == 0 {
+		_ = writer.Write([]string{"hash", "size", "path", "reason", "skipped_at"})
+	}
+	_ = writer.Write([]string{entry.Hash, strconv.FormatInt(entry.Size, 10), entry.Path, entry.Reason, entry.SkippedAt.Format(time.RFC3339)})
+	writer.Flush()
+	err = writer.Error()
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if list.entries[entry.Size] == nil {
+		list.entries[entry.Size] = make(map[string]skipListEntry)
+	}
+	list.entries[entry.Size][entry.Hash] = entry
+	return nil
+}
+
+// autoTuneWorkers keeps adding workers for as long as doing so measurably
+// improves throughput, up to 4 workers per CPU. Workers spend most of their
+// time waiting on exiftool, which in turn may be waiting on slow disk or
+// network I/O, so the right number of workers depends on latency that can
+// only be measured, not derived from the number of CPUs.
+func autoTuneWorkers(ctx context.Context, logger *slog.Logger, numProcessed *atomic.Int64, numWorkers int, startWorker func() error) {
+	const interval = 3 * time.Second
+	maxWorkers := 4 * runtime.NumCPU()
+	step := max(runtime.NumCPU()/2, 1)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	prevCount := numProcessed.Load()
+	prevThroughput := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		count := numProcessed.Load()
+		throughput := float64(count-prevCount) / interval.Seconds()
+		prevCount = count
+		if throughput == 0 {
+			continue
+		}
+		if prevThroughput > 0 && throughput < prevThroughput*1.1 {
+			logger.Info("settled on number of workers", slog.Int("numWorkers", numWorkers), slog.Float64("filesPerSecond", throughput))
+			return
+		}
+		if numWorkers >= maxWorkers {
+			return
+		}
+		for i := 0; i < step && numWorkers < maxWorkers; i++ {
+			err := startWorker()
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			numWorkers++
+		}
+		logger.Info("increased number of workers", slog.Int("numWorkers", numWorkers), slog.Float64("filesPerSecond", throughput))
+		prevThroughput = throughput
+	}
+}
+
+// formatBytes formats n as a human readable size in binary units e.g.
+// 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// defaultMaxPending is the default number of files the walker may queue up
+// ahead of the workers. It only needs to be large enough to keep the workers
+// busy while the walker is reading a slow directory.
+const defaultMaxPending = 256
+
+// maxSkippedListed is the maximum number of skipped files listed at the end
+// of a run.
+const maxSkippedListed = 1000
+
+// logProgress periodically logs how many files have been processed and how
+// many are queued up waiting for a worker, until ctx is done. The last
+// processed file serves as a rough checkpoint for resuming an interrupted
+// run.
+func logProgress(ctx context.Context, logger *slog.Logger, numProcessed *atomic.Int64, lastProcessed *atomic.Value, queueDepth func() int) {
+	const interval = 10 * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		lastFilePath, _ := lastProcessed.Load().(string)
+		logger.Info("progress", slog.Int64("numProcessed", numProcessed.Load()), slog.Int("queueDepth", queueDepth()), slog.String("lastProcessed", lastFilePath))
+	}
+}
+
+// stdinLines returns the lines typed on stdin. They are read by a single
+// goroutine for the life of the process, so that the confirmation prompt and
+// the progress snapshots of later runs can share stdin without one of them
+// swallowing a line meant for the other.
+var stdinLines = sync.OnceValue(func() <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	return lines
+})
+
+// progressTracker keeps track of what a run is doing so that a snapshot of
+// it can be printed on request. Its methods may be called concurrently, and
+// on a nil *progressTracker, in which case they do nothing.
+type progressTracker struct {
+	startTime     time.Time
+	numProcessed  *atomic.Int64
+	queueDepth    func() int
+	numWalked     atomic.Int64
+	walkFinished  atomic.Bool
+	mutex         sync.Mutex
+	statusCounts  map[string]int64
+	currentFiles  map[string]currentFile
+	workerNumbers map[string]int
+}
+
+// currentFile is the file a worker is working on.
+type currentFile struct {
+	FilePath  string
+	StartTime time.Time
+}
+
+func newProgressTracker(numProcessed *atomic.Int64, queueDepth func() int) *progressTracker {
+	return &progressTracker{
+		startTime:     time.Now(),
+		numProcessed:  numProcessed,
+		queueDepth:    queueDepth,
+		statusCounts:  make(map[string]int64),
+		currentFiles:  make(map[string]currentFile),
+		workerNumbers: make(map[string]int),
+	}
+}
+
+// Worker returns a new name for a worker of the given kind e.g. "worker 3".
+func (tracker *progressTracker) Worker(kind string) string {
+	if tracker == nil {
+		return ""
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.workerNumbers[kind]++
+	return kind + " " + strconv.Itoa(tracker.workerNumbers[kind])
+}
+
+// Start records that worker has started on filePath. An empty filePath means
+// the worker is idle.
+func (tracker *progressTracker) Start(worker, filePath string) {
+	if tracker == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.currentFiles[worker] = currentFile{FilePath: filePath, StartTime: time.Now()}
+}
+
+// Stop records that worker has exited.
+func (tracker *progressTracker) Stop(worker string) {
+	if tracker == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.currentFiles, worker)
+}
+
+func (tracker *progressTracker) Count(status string) {
+	if tracker == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.statusCounts[status]++
+}
+
+// Walked records that the walk has queued another file.
+func (tracker *progressTracker) Walked() {
+	if tracker == nil {
+		return
+	}
+	tracker.numWalked.Add(1)
+}
+
+// WalkFinished records that every file has been queued, after which the ETA
+// can be worked out.
+func (tracker *progressTracker) WalkFinished() {
+	if tracker == nil {
+		return
+	}
+	tracker.walkFinished.Store(true)
+}
+
+// Print writes a snapshot of the run to w: the counts so far, the queue
+// depth, the file each worker is on and the ETA.
+func (tracker *progressTracker) Print(w io.Writer) {
+	if tracker == nil {
+		return
+	}
+	elapsed := time.Since(tracker.startTime)
+	numProcessed := tracker.numProcessed.Load()
+	numWalked := tracker.numWalked.Load()
+	tracker.mutex.Lock()
+	statuses := slices.Sorted(maps.Keys(tracker.statusCounts))
+	counts := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		counts = append(counts, fmt.Sprintf("%d %s", tracker.statusCounts[status], status))
+	}
+	workers := slices.SortedFunc(maps.Keys(tracker.currentFiles), func(a, b string) int {
+		nameA, numberA, _ := strings.Cut(a, " ")
+		nameB, numberB, _ := strings.Cut(b, " ")
+		indexA, _ := strconv.Atoi(numberA)
+		indexB, _ := strconv.Atoi(numberB)
+		return cmp.Or(strings.Compare(nameA, nameB), cmp.Compare(indexA, indexB))
+	})
+	currentFiles := make([]currentFile, len(workers))
+	for i, worker := range workers {
+		currentFiles[i] = tracker.currentFiles[worker]
+	}
+	tracker.mutex.Unlock()
+	eta := "unknown until the walk finishes"
+	if tracker.walkFinished.Load() {
+		eta = "unknown"
+		if remaining := numWalked - numProcessed; remaining <= 0 {
+			eta = "0s"
+		} else if numProcessed > 0 {
+			eta = (time.Duration(remaining) * elapsed / time.Duration(numProcessed)).Round(time.Second).String()
+		}
+	}
+	summary := "nothing yet"
+	if len(counts) > 0 {
+		summary = strings.Join(counts, ", ")
+	}
+	fmt.Fprintf(w, "progress after %s: %d processed of %d found (%s), %d queued, ETA %s\n",
+		elapsed.Round(time.Second), numProcessed, numWalked, summary, tracker.queueDepth(), eta)
+	for i, worker := range workers {
+		currentFile := currentFiles[i]
+		if currentFile.FilePath == "" {
+			fmt.Fprintf(w, "  %s: idle\n", worker)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %s (%s)\n", worker, currentFile.FilePath, time.Since(currentFile.StartTime).Round(time.Millisecond))
+	}
+}
+
+// printProgressOnRequest prints a snapshot of tracker to w whenever one of
+// progressSignals is received or, if stdin is a terminal, Enter is pressed,
+// until ctx is done.
+func printProgressOnRequest(ctx context.Context, w io.Writer, tracker *progressTracker) {
+	signals := make(chan os.Signal, 1)
+	if len(progressSignals) > 0 {
+		signal.Notify(signals, progressSignals...)
+		defer signal.Stop(signals)
+	}
+	var lines <-chan string
+	fileInfo, err := os.Stdin.Stat()
+	if err == nil && fileInfo.Mode()&fs.ModeCharDevice != 0 {
+		lines = stdinLines()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		case _, ok := <-lines:
+			if !ok {
+				lines = nil
+				continue
+			}
+		}
+		tracker.Print(w)
+	}
+}
+
+// runMetrics holds the counters and gauges exposed by -metrics-addr. Its
+// methods may be called on a nil *runMetrics, in which case they do nothing.
+type runMetrics struct {
+	numProcessed *atomic.Int64
+	numWorkers   *atomic.Int64
+	queueDepth   func() int
+	numRestarts  atomic.Int64
+	mutex        sync.Mutex
+	// statusCounts is the number of files per report status e.g. moved or
+	// failed.
+	statusCounts map[string]int64
+}
+
+func (metrics *runMetrics) Count(status string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if metrics.statusCounts == nil {
+		metrics.statusCounts = make(map[string]int64)
+	}
+	metrics.statusCounts[status]++
+}
+
+func (metrics *runMetrics) CountRestart() {
+	if metrics == nil {
+		return
+	}
+	metrics.numRestarts.Add(1)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (metrics *runMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP exifutil_files_processed_total Files picked up by a worker.")
+	fmt.Fprintln(w, "# TYPE exifutil_files_processed_total counter")
+	fmt.Fprintf(w, "exifutil_files_processed_total %d\n", metrics.numProcessed.Load())
+	fmt.Fprintln(w, "# HELP exifutil_files_total Files by outcome, as recorded in -report.")
+	fmt.Fprintln(w, "# TYPE exifutil_files_total counter")
+	metrics.mutex.Lock()
+	statuses := slices.Sorted(maps.Keys(metrics.statusCounts))
+	for _, status := range statuses {
+		fmt.Fprintf(w, "exifutil_files_total{status=%q} %d\n", status, metrics.statusCounts[status])
+	}
+	metrics.mutex.Unlock()
+	fmt.Fprintln(w, "# HELP exifutil_exiftool_restarts_total Times an exiftool process was restarted after timing out.")
+	fmt.Fprintln(w, "# TYPE exifutil_exiftool_restarts_total counter")
+	fmt.Fprintf(w, "exifutil_exiftool_restarts_total %d\n", metrics.numRestarts.Load())
+	fmt.Fprintln(w, "# HELP exifutil_workers Workers currently running.")
+	fmt.Fprintln(w, "# TYPE exifutil_workers gauge")
+	fmt.Fprintf(w, "exifutil_workers %d\n", metrics.numWorkers.Load())
+	fmt.Fprintln(w, "# HELP exifutil_queue_depth Files queued up waiting for a worker.")
+	fmt.Fprintln(w, "# TYPE exifutil_queue_depth gauge")
+	fmt.Fprintf(w, "exifutil_queue_depth %d\n", metrics.queueDepth())
+}
+
+// serveMetrics serves metrics on addr under /metrics until the returned
+// function is called.
+func serveMetrics(logger *slog.Logger, addr string, metrics *runMetrics) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(err.Error(), slog.String("metricsAddr", addr))
+		}
+	}()
+	return func() { server.Close() }, nil
+}
+
+// contextReader is an io.Reader that stops reading once its context is done,
+// so that long reads (such as hashing or copying large files) can be
+// interrupted.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (contextReader *contextReader) Read(p []byte) (n int, err error) {
+	if contextReader.ctx.Err() != nil {
+		return 0, context.Cause(contextReader.ctx)
+	}
+	return contextReader.reader.Read(p)
+}
+
+// outputMutex serializes writes to stdout and stderr, which are usually the
+// same terminal.
+var outputMutex sync.Mutex
+
+// stdout and stderr are the default Stdout and Stderr of every subcommand.
+// Workers print dry-run lines and log concurrently, and without them
+// sharing a lock a long line from one worker can be torn by another's (or
+// by a log line from the progress logger) once it is bigger than what the
+// OS writes atomically.
+var (
+	stdout io.Writer = &syncWriter{mutex: &outputMutex, w: os.Stdout}
+	stderr io.Writer = &syncWriter{mutex: &outputMutex, w: os.Stderr}
+)
+
+// syncWriter passes each Write to w whole while holding mutex, so that
+// concurrent writers sharing the mutex never interleave within a Write.
+// Callers should write a whole line at a time.
+type syncWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+}
+
+func (syncWriter *syncWriter) Write(p []byte) (n int, err error) {
+	syncWriter.mutex.Lock()
+	defer syncWriter.mutex.Unlock()
+	return syncWriter.w.Write(p)
+}
+
+func newLogger(w io.Writer, verbose bool) *slog.Logger {
+	logLevel := slog.LevelError
+	if verbose {
+		logLevel = slog.LevelInfo
+	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     logLevel,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			switch attr.Key {
+			case slog.TimeKey:
+				return slog.Attr{}
+			case slog.SourceKey:
+				source := attr.Value.Any().(*slog.Source)
+				return slog.Any(slog.SourceKey, &slog.Source{
+					Function: source.Function,
+					File:     filepath.Base(source.File),
+					Line:     source.Line,
+				})
+			default:
+				return attr
+			}
+		},
+	}))
+}
+
+// canonicalFilePath returns the path filePath would have if it were named
+// after its creation time.
+func canonicalFilePath(filePath string, creationTime time.Time) string {
+	return filepath.Join(filepath.Dir(filePath), creationTime.Format("2006-01-02T150405.000-0700")+filepath.Ext(filePath))
 }
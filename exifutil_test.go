@@ -0,0 +1,1146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory fileSystem of slash separated absolute paths, for
+// testing moves without touching the disk. The root directory always
+// exists.
+type memFS struct {
+	mutex   sync.Mutex
+	entries map[string]*memEntry
+	// errs are returned in order, one per call, by the operation and path
+	// they are keyed by e.g. "rename /a/b.jpg", in place of carrying the
+	// operation out. Operations are named as in the os package's errors.
+	errs map[string][]error
+	// beforeRename, if set, is called at the start of every Rename.
+	beforeRename func(oldPath, newPath string)
+}
+
+type memEntry struct {
+	dir  bool
+	data []byte
+}
+
+func newMemFS(files map[string]string) *memFS {
+	fsys := &memFS{entries: make(map[string]*memEntry), errs: make(map[string][]error)}
+	for name, data := range files {
+		err := fsys.MkdirAll(path.Dir(name), 0755)
+		if err != nil {
+			panic(err)
+		}
+		fsys.entries[name] = &memEntry{data: []byte(data)}
+	}
+	return fsys
+}
+
+// fail makes the next calls of op on name return errs, in order.
+func (fsys *memFS) fail(op, name string, errs ...error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	fsys.errs[op+" "+name] = append(fsys.errs[op+" "+name], errs...)
+}
+
+// injectedErr pops the next error set up for op on name by fail. It must be
+// called with the mutex held.
+func (fsys *memFS) injectedErr(op, name string) error {
+	errs := fsys.errs[op+" "+name]
+	if len(errs) == 0 {
+		return nil
+	}
+	fsys.errs[op+" "+name] = errs[1:]
+	return &fs.PathError{Op: op, Path: name, Err: errs[0]}
+}
+
+// readFile returns the contents of the file name, and whether it exists.
+func (fsys *memFS) readFile(name string) (string, bool) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	entry := fsys.entries[name]
+	if entry == nil || entry.dir {
+		return "", false
+	}
+	return string(entry.data), true
+}
+
+// names returns the paths of every file and directory, sorted.
+func (fsys *memFS) names() []string {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	var names []string
+	for name := range fsys.entries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (fsys *memFS) exists(name string) bool {
+	return name == "/" || fsys.entries[name] != nil
+}
+
+func (fsys *memFS) Rename(oldPath, newPath string) error {
+	if fsys.beforeRename != nil {
+		fsys.beforeRename(oldPath, newPath)
+	}
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if err := fsys.injectedErr("rename", oldPath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errors.Unwrap(err)}
+	}
+	entry := fsys.entries[oldPath]
+	if entry == nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	parent := fsys.entries[path.Dir(newPath)]
+	if !fsys.exists(path.Dir(newPath)) || (parent != nil && !parent.dir) {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if existing := fsys.entries[newPath]; existing != nil && existing.dir {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EISDIR}
+	}
+	for name, child := range fsys.entries {
+		if strings.HasPrefix(name, oldPath+"/") {
+			delete(fsys.entries, name)
+			fsys.entries[newPath+strings.TrimPrefix(name, oldPath)] = child
+		}
+	}
+	delete(fsys.entries, oldPath)
+	fsys.entries[newPath] = entry
+	return nil
+}
+
+func (fsys *memFS) MkdirAll(dir string, perm fs.FileMode) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if err := fsys.injectedErr("mkdir", dir); err != nil {
+		return err
+	}
+	var missingDirs []string
+	for ; dir != "/"; dir = path.Dir(dir) {
+		entry := fsys.entries[dir]
+		if entry != nil {
+			if !entry.dir {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missingDirs = append(missingDirs, dir)
+	}
+	for _, missingDir := range missingDirs {
+		fsys.entries[missingDir] = &memEntry{dir: true}
+	}
+	return nil
+}
+
+func (fsys *memFS) Stat(name string) (fs.FileInfo, error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if err := fsys.injectedErr("stat", name); err != nil {
+		return nil, err
+	}
+	return fsys.stat("stat", name)
+}
+
+func (fsys *memFS) Lstat(name string) (fs.FileInfo, error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if err := fsys.injectedErr("lstat", name); err != nil {
+		return nil, err
+	}
+	return fsys.stat("lstat", name)
+}
+
+// stat must be called with the mutex held.
+func (fsys *memFS) stat(op, name string) (fs.FileInfo, error) {
+	if name == "/" {
+		return memFileInfo{name: "/", dir: true}, nil
+	}
+	entry := fsys.entries[name]
+	if entry == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return memFileInfo{name: path.Base(name), dir: entry.dir, size: int64(len(entry.data))}, nil
+}
+
+func (fsys *memFS) Remove(name string) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if err := fsys.injectedErr("remove", name); err != nil {
+		return err
+	}
+	if fsys.entries[name] == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for other := range fsys.entries {
+		if strings.HasPrefix(other, name+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(fsys.entries, name)
+	return nil
+}
+
+func (fsys *memFS) Open(name string) (fsFile, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fsys *memFS) OpenFile(name string, flag int, perm fs.FileMode) (fsFile, error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if err := fsys.injectedErr("open", name); err != nil {
+		return nil, err
+	}
+	entry := fsys.entries[name]
+	if entry == nil && name != "/" {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		parent := fsys.entries[path.Dir(name)]
+		if !fsys.exists(path.Dir(name)) || (parent != nil && !parent.dir) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		entry = &memEntry{}
+		fsys.entries[name] = entry
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if entry == nil {
+		entry = &memEntry{dir: true}
+	}
+	if flag&os.O_TRUNC != 0 {
+		entry.data = nil
+	}
+	return &memFile{fsys: fsys, name: name, entry: entry, flag: flag}, nil
+}
+
+type memFile struct {
+	fsys   *memFS
+	name   string
+	entry  *memEntry
+	flag   int
+	offset int
+}
+
+func (file *memFile) Read(p []byte) (int, error) {
+	file.fsys.mutex.Lock()
+	defer file.fsys.mutex.Unlock()
+	if file.offset >= len(file.entry.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, file.entry.data[file.offset:])
+	file.offset += n
+	return n, nil
+}
+
+func (file *memFile) Write(p []byte) (int, error) {
+	file.fsys.mutex.Lock()
+	defer file.fsys.mutex.Unlock()
+	if file.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &fs.PathError{Op: "write", Path: file.name, Err: fs.ErrPermission}
+	}
+	if file.flag&os.O_APPEND != 0 {
+		file.offset = len(file.entry.data)
+	}
+	data := append(file.entry.data[:file.offset:file.offset], p...)
+	if end := file.offset + len(p); end < len(file.entry.data) {
+		data = append(data, file.entry.data[end:]...)
+	}
+	file.entry.data = data
+	file.offset += len(p)
+	return len(p), nil
+}
+
+func (file *memFile) Stat() (fs.FileInfo, error) {
+	file.fsys.mutex.Lock()
+	defer file.fsys.mutex.Unlock()
+	return memFileInfo{name: path.Base(file.name), dir: file.entry.dir, size: int64(len(file.entry.data))}, nil
+}
+
+func (file *memFile) Sync() error { return nil }
+
+func (file *memFile) Close() error { return nil }
+
+type memFileInfo struct {
+	name string
+	dir  bool
+	size int64
+}
+
+func (info memFileInfo) Name() string { return info.name }
+
+func (info memFileInfo) Size() int64 { return info.size }
+
+func (info memFileInfo) Mode() fs.FileMode {
+	if info.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (info memFileInfo) ModTime() time.Time { return time.Time{} }
+
+func (info memFileInfo) IsDir() bool { return info.dir }
+
+func (info memFileInfo) Sys() any { return nil }
+
+func TestRenameNoReplace(t *testing.T) {
+	trashDir := "/a/" + trashDirName + "/" + time.Now().Format("2006-01-02")
+	tests := []struct {
+		name            string
+		files           map[string]string
+		fail            [][2]string
+		newPath         string
+		replaceIfExists bool
+		wantErr         error
+		wantFiles       map[string]string
+	}{{
+		name:      "free",
+		files:     map[string]string{"/a/x.jpg": "x"},
+		newPath:   "/a/y.jpg",
+		wantFiles: map[string]string{"/a/y.jpg": "x"},
+	}, {
+		name:      "collision",
+		files:     map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+		newPath:   "/a/y.jpg",
+		wantErr:   fs.ErrExist,
+		wantFiles: map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+	}, {
+		name:            "replace",
+		files:           map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+		newPath:         "/a/y.jpg",
+		replaceIfExists: true,
+		wantFiles:       map[string]string{"/a/y.jpg": "x", trashDir + "/y.jpg": "y"},
+	}, {
+		name:      "missing directory",
+		files:     map[string]string{"/a/x.jpg": "x"},
+		newPath:   "/b/y.jpg",
+		wantErr:   fs.ErrNotExist,
+		wantFiles: map[string]string{"/a/x.jpg": "x"},
+	}, {
+		name:      "stat error",
+		files:     map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+		fail:      [][2]string{{"stat", "/a/y.jpg"}},
+		newPath:   "/a/y.jpg",
+		wantErr:   syscall.EIO,
+		wantFiles: map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+	}, {
+		name:      "rename error",
+		files:     map[string]string{"/a/x.jpg": "x"},
+		fail:      [][2]string{{"rename", "/a/x.jpg"}},
+		newPath:   "/a/y.jpg",
+		wantErr:   syscall.EIO,
+		wantFiles: map[string]string{"/a/x.jpg": "x"},
+	}, {
+		name:            "trash error",
+		files:           map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+		fail:            [][2]string{{"mkdir", trashDir}},
+		newPath:         "/a/y.jpg",
+		replaceIfExists: true,
+		wantErr:         syscall.EIO,
+		wantFiles:       map[string]string{"/a/x.jpg": "x", "/a/y.jpg": "y"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := newMemFS(tt.files)
+			for _, fail := range tt.fail {
+				fsys.fail(fail[0], fail[1], syscall.EIO)
+			}
+			err := renameNoReplace(fsys, "/a/x.jpg", tt.newPath, tt.replaceIfExists)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			for name, want := range tt.wantFiles {
+				got, ok := fsys.readFile(name)
+				if !ok || got != want {
+					t.Errorf("%s: got %q (exists: %v), want %q", name, got, ok, want)
+				}
+			}
+			for _, name := range fsys.names() {
+				_, ok := fsys.readFile(name)
+				if _, want := tt.wantFiles[name]; ok && !want && path.Base(name) != trashIndexName {
+					t.Errorf("%s: unexpected file", name)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveToTrash(t *testing.T) {
+	trashDir := "/a/" + trashDirName + "/" + time.Now().Format("2006-01-02")
+	fsys := newMemFS(map[string]string{"/a/y.jpg": "first"})
+	err := moveToTrash(fsys, "/a/y.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.entries["/a/y.jpg"] = &memEntry{data: []byte("second")}
+	err = moveToTrash(fsys, "/a/y.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{trashDir + "/y.jpg": "first", trashDir + "/y.1.jpg": "second"} {
+		got, ok := fsys.readFile(name)
+		if !ok || got != want {
+			t.Errorf("%s: got %q (exists: %v), want %q", name, got, ok, want)
+		}
+	}
+	if _, ok := fsys.readFile("/a/y.jpg"); ok {
+		t.Errorf("/a/y.jpg: still exists")
+	}
+	index, _ := fsys.readFile(trashDir + "/" + trashIndexName)
+	lines := strings.Split(strings.TrimSpace(index), "\n")
+	if len(lines) != 3 || lines[0] != "name,original_path,trashed_at" || !strings.HasPrefix(lines[1], "y.jpg,/a/y.jpg,") || !strings.HasPrefix(lines[2], "y.1.jpg,/a/y.jpg,") {
+		t.Errorf("got index %q", index)
+	}
+
+	// A file that can't be indexed stays where it is.
+	fsys = newMemFS(map[string]string{"/a/y.jpg": "y"})
+	fsys.fail("open", trashDir+"/"+trashIndexName, syscall.EIO)
+	err = moveToTrash(fsys, "/a/y.jpg")
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("got error %v, want %v", err, syscall.EIO)
+	}
+	if _, ok := fsys.readFile("/a/y.jpg"); !ok {
+		t.Errorf("/a/y.jpg: moved despite the error")
+	}
+}
+
+func TestMkdirAllSync(t *testing.T) {
+	fsys := newMemFS(map[string]string{"/a/x.jpg": "x"})
+	err := mkdirAllSync(fsys, "/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/a/b", "/a/b/c"} {
+		fileInfo, err := fsys.Stat(dir)
+		if err != nil || !fileInfo.IsDir() {
+			t.Errorf("%s: not created: %v", dir, err)
+		}
+	}
+	err = mkdirAllSync(fsys, "/a/x.jpg/d")
+	if !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("got error %v, want %v", err, syscall.ENOTDIR)
+	}
+	fsys.fail("stat", "/e", syscall.EIO)
+	err = mkdirAllSync(fsys, "/e/f")
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("got error %v, want %v", err, syscall.EIO)
+	}
+}
+
+func TestExifTimeLayouts(t *testing.T) {
+	// Every layout parses what it formats, down to the precision it
+	// keeps.
+	want := time.Date(2024, time.March, 5, 10, 11, 12, 123000000, time.FixedZone("", 8*60*60))
+	for _, layout := range exifTimeLayouts {
+		value := want.Format(layout)
+		got, err := parseExifTime(value)
+		if err != nil {
+			t.Errorf("%s: %v", layout, err)
+			continue
+		}
+		if got.Format(layout) != value {
+			t.Errorf("%s: %q parsed as %s", layout, value, got)
+		}
+	}
+}
+
+func TestParseExifTime(t *testing.T) {
+	utc := func(hour, min, sec, nsec int) time.Time {
+		return time.Date(2024, time.March, 5, hour, min, sec, nsec, time.UTC)
+	}
+	tests := []struct {
+		value     string
+		want      time.Time
+		wantZone  int
+		hasOffset bool
+		wantErr   bool
+	}{
+		{value: "2024:03:05 10:11:12", want: utc(10, 11, 12, 0)},
+		{value: "2024:03:05 10:11:12.000", want: utc(10, 11, 12, 0)},
+		{value: "2024:03:05 10:11:12.999", want: utc(10, 11, 12, 999000000)},
+		{value: "2024:03:05 10:11:12.5", want: utc(10, 11, 12, 500000000)},
+		{value: "2024:03:05 10:11:12+08:00", want: utc(2, 11, 12, 0), wantZone: 8 * 60 * 60, hasOffset: true},
+		{value: "2024:03:05 10:11:12.000+08:00", want: utc(2, 11, 12, 0), wantZone: 8 * 60 * 60, hasOffset: true},
+		{value: "2024:03:05 10:11:12.999-05:30", want: utc(15, 41, 12, 999000000), wantZone: -(5*60 + 30) * 60, hasOffset: true},
+		{value: "2024:03:05 10:11:12Z", want: utc(10, 11, 12, 0), hasOffset: true},
+		{value: "2024:03:05 10:11:12.999Z", want: utc(10, 11, 12, 999000000), hasOffset: true},
+		{value: "2024:03:05", want: utc(0, 0, 0, 0)},
+		{value: " 2024:03:05 10:11:12 ", want: utc(10, 11, 12, 0)},
+		{value: "Tue, 05 Mar 2024 10:11:12 +0800", want: utc(2, 11, 12, 0), wantZone: 8 * 60 * 60},
+		{value: "Tue, 05 Mar 2024 10:11:12 GMT", want: utc(10, 11, 12, 0)},
+		{value: "0000:00:00 00:00:00", want: time.Time{}},
+		{value: "0000:00:00 00:00:00+00:00", want: time.Time{}, hasOffset: true},
+		{value: "0000:00:00", want: time.Time{}},
+		{value: "2024-03-05T10:11:12", wantErr: true},
+		{value: "2024:03:05 10:11", wantErr: true},
+		{value: "2024:13:05 10:11:12", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseExifTime(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error: %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: got %s, want %s", tt.value, got, tt.want)
+		}
+		if _, zone := got.Zone(); !tt.wantErr && zone != tt.wantZone {
+			t.Errorf("%q: got offset %d, want %d", tt.value, zone, tt.wantZone)
+		}
+		if hasUTCOffset(tt.value) != tt.hasOffset {
+			t.Errorf("%q: hasUTCOffset %v, want %v", tt.value, !tt.hasOffset, tt.hasOffset)
+		}
+	}
+}
+
+// unquoteExifToolArg reads a line of a -@ argument file as exiftool does,
+// returning "" for a comment.
+func unquoteExifToolArg(line string) string {
+	if !strings.HasPrefix(line, "#[CSTR]") {
+		if strings.HasPrefix(line, "#") {
+			return ""
+		}
+		return strings.TrimSpace(line)
+	}
+	var b strings.Builder
+	escaped := false
+	for _, char := range strings.TrimPrefix(line, "#[CSTR]") {
+		switch {
+		case escaped && char == 'n':
+			b.WriteRune('\n')
+		case escaped && char == 'r':
+			b.WriteRune('\r')
+		case escaped && char == 't':
+			b.WriteRune('\t')
+		case !escaped && char == '\\':
+			escaped = true
+			continue
+		default:
+			b.WriteRune(char)
+		}
+		escaped = false
+	}
+	return b.String()
+}
+
+func TestQuoteExifToolArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{arg: "/photos/IMG_0001.JPG", want: "/photos/IMG_0001.JPG"},
+		{arg: "-DateTimeOriginal", want: "-DateTimeOriginal"},
+		{arg: `C:\photos\IMG_0001.JPG`, want: `C:\photos\IMG_0001.JPG`},
+		{arg: "/photos/a#b.jpg", want: "/photos/a#b.jpg"},
+		{arg: "/photos/a\tb.jpg", want: "/photos/a\tb.jpg"},
+		{arg: "/photos/line\nbreak.jpg", want: `#[CSTR]/photos/line\nbreak.jpg`},
+		{arg: "/photos/carriage\rreturn.jpg", want: `#[CSTR]/photos/carriage\rreturn.jpg`},
+		{arg: " leading space.jpg", want: "#[CSTR] leading space.jpg"},
+		{arg: "trailing space.jpg ", want: "#[CSTR]trailing space.jpg "},
+		{arg: "trailing tab.jpg\t", want: `#[CSTR]trailing tab.jpg\t`},
+		{arg: "#comment.jpg", want: "#[CSTR]#comment.jpg"},
+		{arg: `\\server\share\line` + "\n" + `break.jpg`, want: `#[CSTR]\\\\server\\share\\line\nbreak.jpg`},
+		{arg: ` C:\photos\ `, want: `#[CSTR] C:\\photos\\ `},
+		{arg: `#[CSTR]literal.jpg`, want: `#[CSTR]#[CSTR]literal.jpg`},
+	}
+	for _, tt := range tests {
+		got := quoteExifToolArg(tt.arg)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.arg, got, tt.want)
+		}
+		if strings.ContainsAny(got, "\n\r") {
+			t.Errorf("%q: %q spans more than one line", tt.arg, got)
+		}
+		if unquoted := unquoteExifToolArg(got); unquoted != tt.arg {
+			t.Errorf("%q: exiftool would read %q", tt.arg, unquoted)
+		}
+	}
+}
+
+// fakeExifTool is an exifToolSession that replays the canned exiftool -json
+// output in testdata/exiftool, named after the base name of the file read
+// plus .json, instead of running exiftool. Files without one get no output,
+// as exiftool prints nothing for files it can't read.
+type fakeExifTool struct {
+	stdinReader  *io.PipeReader
+	stdinWriter  *io.PipeWriter
+	stdoutReader *bufio.Reader
+	stdoutWriter *io.PipeWriter
+	done         chan struct{}
+	mutex        sync.Mutex
+	// commands are the commands received so far, without -execute.
+	commands [][]string
+}
+
+// useFakeExifTool makes every exifTool started until the end of the test
+// talk to a fakeExifTool, and returns the commands they sent.
+func useFakeExifTool(t *testing.T) func() [][]string {
+	t.Helper()
+	var mutex sync.Mutex
+	var fakes []*fakeExifTool
+	startExifToolSession = func(ctx context.Context, stderr io.Writer, charset, config string) (exifToolSession, error) {
+		fake := startFakeExifTool(ctx)
+		mutex.Lock()
+		fakes = append(fakes, fake)
+		mutex.Unlock()
+		return fake, nil
+	}
+	t.Cleanup(func() {
+		startExifToolSession = startExifToolProcess
+	})
+	return func() [][]string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var commands [][]string
+		for _, fake := range fakes {
+			fake.mutex.Lock()
+			commands = append(commands, fake.commands...)
+			fake.mutex.Unlock()
+		}
+		return commands
+	}
+}
+
+func startFakeExifTool(ctx context.Context) *fakeExifTool {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	fake := &fakeExifTool{
+		stdinReader:  stdinReader,
+		stdinWriter:  stdinWriter,
+		stdoutReader: bufio.NewReader(stdoutReader),
+		stdoutWriter: stdoutWriter,
+		done:         make(chan struct{}),
+	}
+	go fake.serve()
+	context.AfterFunc(ctx, fake.Stop)
+	return fake
+}
+
+// serve reads commands from stdin as exiftool -stay_open True -@ - does,
+// and answers each one followed by {ready}.
+func (fake *fakeExifTool) serve() {
+	defer close(fake.done)
+	defer fake.stdoutWriter.Close()
+	scanner := bufio.NewScanner(fake.stdinReader)
+	var args []string
+	for scanner.Scan() {
+		arg := unquoteExifToolArg(scanner.Text())
+		if arg == "" {
+			continue
+		}
+		if slices.Equal(args, []string{"-stay_open"}) && arg == "False" {
+			return
+		}
+		if arg != "-execute" {
+			args = append(args, arg)
+			continue
+		}
+		fake.mutex.Lock()
+		fake.commands = append(fake.commands, args)
+		fake.mutex.Unlock()
+		_, err := io.WriteString(fake.stdoutWriter, fakeExifToolOutput(args)+"{ready}\n")
+		if err != nil {
+			return
+		}
+		args = nil
+	}
+}
+
+// fakeExifToolOutput is what exiftool would print for a command.
+func fakeExifToolOutput(args []string) string {
+	switch {
+	case slices.Contains(args, "-ver"):
+		return "13.10\n"
+	case slices.Contains(args, "-json"):
+		data, err := os.ReadFile(filepath.Join("testdata", "exiftool", filepath.Base(args[len(args)-1])+".json"))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	default:
+		return "    1 image files updated\n"
+	}
+}
+
+func (fake *fakeExifTool) Stdin() io.Writer { return fake.stdinWriter }
+
+func (fake *fakeExifTool) Stdout() *bufio.Reader { return fake.stdoutReader }
+
+// Stop fails any read of the output with io.EOF, as a killed exiftool does.
+func (fake *fakeExifTool) Stop() {
+	fake.stdinReader.Close()
+	fake.stdoutWriter.Close()
+}
+
+func (fake *fakeExifTool) Kill() {
+	fake.Stop()
+	<-fake.done
+}
+
+func (fake *fakeExifTool) Close() error {
+	_, err := io.WriteString(fake.stdinWriter, "-stay_open\n"+
+		"False\n")
+	fake.Kill()
+	return err
+}
+
+// readFixture decodes a file of testdata/exiftool.
+func readFixture(t *testing.T, name string) []rawExif {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "exiftool", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rawExifs []rawExif
+	err = json.Unmarshal(data, &rawExifs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rawExifs
+}
+
+func TestParseRawExif(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    Exif
+		// randomMillis is set for CreateDate, which is given random
+		// milliseconds.
+		randomMillis bool
+	}{{
+		fixture: "no-timezone.jpg",
+		want: Exif{
+			CreationTime:       time.Date(2021, 3, 4, 5, 6, 7, 890e6, time.UTC),
+			CreationTimeSource: "SubSecDateTimeOriginal",
+			LocalTime:          true,
+			Make:               "Canon",
+			Model:              "Canon EOS 5D Mark III",
+			SerialNumber:       "123456789012",
+			GPSPosition:        &GPSPosition{Latitude: 37.775, Longitude: -122.4194},
+			FileTypeExtension:  "jpg",
+		},
+	}, {
+		fixture: "date-only.tif",
+		want: Exif{
+			CreationTime:       time.Date(2003, 6, 15, 0, 0, 0, 0, time.UTC),
+			CreationTimeSource: "DateCreated",
+			DateOnly:           true,
+			LocalTime:          true,
+			Make:               "EPSON",
+			Model:              "Perfection V600",
+			FileTypeExtension:  "tif",
+		},
+	}, {
+		fixture: "quicktime-utc.mov",
+		want: Exif{
+			CreationTime:       time.Date(2022, 7, 8, 9, 10, 11, 0, time.UTC),
+			CreationTimeSource: "CreateDate",
+			LocalTime:          true,
+			Make:               "Apple",
+			Model:              "iPhone 12",
+			FileTypeExtension:  "mov",
+		},
+		randomMillis: true,
+	}}
+	logger := newLogger(io.Discard, false)
+	for _, tt := range tests {
+		rawExifs := readFixture(t, tt.fixture)
+		if len(rawExifs) != 1 {
+			t.Fatalf("%s: got %d elements, want 1", tt.fixture, len(rawExifs))
+		}
+		got := parseRawExif(logger, rawExifs[0], nil)
+		checkExif(t, tt.fixture, got, tt.want, tt.randomMillis)
+	}
+
+	// A -date-source rule for the camera model takes precedence.
+	rawExifs := readFixture(t, "no-timezone.jpg")
+	rules := []dateSourceRule{{ModelRegexp: anyModelRegexp, Sources: []string{"CreateDate"}}}
+	got := parseRawExif(logger, rawExifs[0], rules)
+	if got.CreationTimeSource != "CreateDate" || got.CreationTime.Truncate(time.Second) != time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC) {
+		t.Errorf("with rule: got %s from %s, want 2021-03-04 05:06:07 from CreateDate", got.CreationTime, got.CreationTimeSource)
+	}
+
+	// A TimeZone is appended to a CreateDate without an offset.
+	rawExif := rawExifs[0]
+	rawExif.SubSecDateTimeOriginal = ""
+	rawExif.TimeZone = "+09:00"
+	got = parseRawExif(logger, rawExif, nil)
+	if got.LocalTime || !got.CreationTime.Truncate(time.Second).Equal(time.Date(2021, 3, 3, 20, 6, 7, 0, time.UTC)) {
+		t.Errorf("with TimeZone: got %s (local %v), want 2021-03-04 05:06:07+09:00", got.CreationTime, got.LocalTime)
+	}
+}
+
+// checkExif compares the fields of an Exif that parseRawExif sets.
+func checkExif(t *testing.T, name string, got, want Exif, randomMillis bool) {
+	t.Helper()
+	creationTime := got.CreationTime
+	if randomMillis {
+		if creationTime.Sub(want.CreationTime) < 0 || creationTime.Sub(want.CreationTime) >= time.Second {
+			t.Errorf("%s: got creation time %s, want %s plus under a second", name, creationTime, want.CreationTime)
+		}
+		creationTime = want.CreationTime
+	}
+	if !creationTime.Equal(want.CreationTime) {
+		t.Errorf("%s: got creation time %s, want %s", name, creationTime, want.CreationTime)
+	}
+	if got.CreationTimeSource != want.CreationTimeSource || got.DateOnly != want.DateOnly || got.LocalTime != want.LocalTime {
+		t.Errorf("%s: got source %s, date only %v, local time %v, want %s, %v, %v", name, got.CreationTimeSource, got.DateOnly, got.LocalTime, want.CreationTimeSource, want.DateOnly, want.LocalTime)
+	}
+	if got.Make != want.Make || got.Model != want.Model || got.SerialNumber != want.SerialNumber || got.FileTypeExtension != want.FileTypeExtension {
+		t.Errorf("%s: got %q %q %q %q, want %q %q %q %q", name, got.Make, got.Model, got.SerialNumber, got.FileTypeExtension, want.Make, want.Model, want.SerialNumber, want.FileTypeExtension)
+	}
+	if (got.GPSPosition == nil) != (want.GPSPosition == nil) {
+		t.Errorf("%s: got position %v, want %v", name, got.GPSPosition, want.GPSPosition)
+	} else if got.GPSPosition != nil && (math.Abs(got.GPSPosition.Latitude-want.GPSPosition.Latitude) > 1e-4 || math.Abs(got.GPSPosition.Longitude-want.GPSPosition.Longitude) > 1e-4) {
+		t.Errorf("%s: got position %+v, want %+v", name, *got.GPSPosition, *want.GPSPosition)
+	}
+}
+
+func TestFileExifs(t *testing.T) {
+	commands := useFakeExifTool(t)
+	exifTool, err := startExifTool(t.Context(), io.Discard, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exifTool.Close()
+	exifTool.ReadArgs = defaultReadArgs
+	exifTool.Tags = []string{"Orientation"}
+	logger := newLogger(io.Discard, false)
+
+	// Malformed output is skipped without losing track of the {ready}
+	// that ends it, so the next file is read as normal.
+	for _, name := range []string{"corrupt.jpg", "unknown.jpg"} {
+		exifs, err := exifTool.FileExifs(logger, filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(exifs) != 0 {
+			t.Errorf("%s: got %d exifs, want none", name, len(exifs))
+		}
+	}
+	exifs, err := exifTool.FileExifs(logger, filepath.Join(t.TempDir(), "no-timezone.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exifs) != 1 {
+		t.Fatalf("got %d exifs, want 1", len(exifs))
+	}
+	checkExif(t, "no-timezone.jpg", exifs[0], Exif{
+		CreationTime:       time.Date(2021, 3, 4, 5, 6, 7, 890e6, time.UTC),
+		CreationTimeSource: "SubSecDateTimeOriginal",
+		LocalTime:          true,
+		Make:               "Canon",
+		Model:              "Canon EOS 5D Mark III",
+		SerialNumber:       "123456789012",
+		GPSPosition:        &GPSPosition{Latitude: 37.775, Longitude: -122.4194},
+		FileTypeExtension:  "jpg",
+	}, false)
+	if got := exifs[0].Tags["Orientation"]; got != "Rotate 90 CW" {
+		t.Errorf("got Orientation %v, want Rotate 90 CW", got)
+	}
+	sent := commands()
+	if len(sent) != 3 || !slices.Equal(sent[2][:2], []string{"-json", "-fast"}) {
+		t.Errorf("got commands %q, want -json -fast FILE three times", sent)
+	}
+
+	// A killed exiftool fails the read, and Restart starts another.
+	exifTool.session.Stop()
+	_, err = exifTool.FileExifs(logger, filepath.Join(t.TempDir(), "date-only.tif"))
+	if err == nil {
+		t.Fatal("read from a stopped exiftool succeeded")
+	}
+	err = exifTool.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exifs, err = exifTool.FileExifs(logger, filepath.Join(t.TempDir(), "date-only.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exifs) != 1 || !exifs[0].DateOnly {
+		t.Errorf("after restart: got %+v, want one date only exif", exifs)
+	}
+}
+
+func TestPositionOffset(t *testing.T) {
+	tests := []struct {
+		position, numFiles int
+		want               time.Duration
+	}{
+		{0, 1, 0},
+		{2, 3, 2 * time.Second},
+		{86399, 86400, 86399 * time.Second},
+		// One file too many for a second each.
+		{86400, 86401, 86400 * 999 * time.Millisecond},
+		{99999, 100000, 99999 * 864 * time.Millisecond},
+		{86399999, 86400000, 24*time.Hour - time.Millisecond},
+		// Past a file per millisecond, the rest share the last one.
+		{86400000, 86400001, 24*time.Hour - time.Millisecond},
+		{100000000, 100000001, 24*time.Hour - time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := positionOffset(tt.position, tt.numFiles)
+		if got != tt.want {
+			t.Errorf("positionOffset(%d, %d) = %s, want %s", tt.position, tt.numFiles, got, tt.want)
+		}
+		if got >= 24*time.Hour {
+			t.Errorf("positionOffset(%d, %d) = %s, past the end of the day", tt.position, tt.numFiles, got)
+		}
+	}
+}
+
+func TestDirCreationTime(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "2001-07 Italy", "scans")
+	err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.tif", "b.tif", "c.tif"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Directories don't count towards a file's position.
+	var listings dirListings
+	got, err := dirCreationTime(filepath.Join(dir, "c.tif"), defaultDirDatePatterns, &listings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2001, 7, 1, 0, 0, 2, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// The listing is kept, so a file renamed in the meantime doesn't move
+	// the others.
+	err = os.Rename(filepath.Join(dir, "a.tif"), filepath.Join(dir, "z.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = dirCreationTime(filepath.Join(dir, "b.tif"), defaultDirDatePatterns, &listings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = time.Date(2001, 7, 1, 0, 0, 1, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("after a rename: got %s, want %s", got, want)
+	}
+	got, err = dirCreationTime(filepath.Join(root, "a.tif"), defaultDirDatePatterns, &listings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsZero() {
+		t.Errorf("got %s for an undated directory, want the zero time", got)
+	}
+}
+
+// mp4Box returns an ISO base media file format box of typ holding payload.
+func mp4Box(typ, payload string) string {
+	size := 8 + len(payload)
+	return string([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}) + typ + payload
+}
+
+func TestMotionPhotoVideo(t *testing.T) {
+	jpeg := "\xff\xd8\xff\xe1" + strings.Repeat("\x00", 100) +
+		// Not the ftyp box of a video, for its brand.
+		mp4Box("ftyp", "abcd\x00\x00\x00\x00") + "\xff\xd9"
+	video := mp4Box("ftyp", "mp42\x00\x00\x00\x00isommp42") + mp4Box("moov", strings.Repeat("m", 32)) + mp4Box("mdat", strings.Repeat("v", 100))
+	tests := []struct {
+		name       string
+		data       string
+		wantOffset int64
+		wantLength int64
+		wantOK     bool
+	}{{
+		name:       "motion photo",
+		data:       jpeg + video,
+		wantOffset: int64(len(jpeg)),
+		wantLength: int64(len(video)),
+		wantOK:     true,
+	}, {
+		name:       "trailer",
+		data:       jpeg + video + "\x00\x00\x00\x03SEFT",
+		wantOffset: int64(len(jpeg)),
+		wantLength: int64(len(video)),
+		wantOK:     true,
+	}, {
+		name: "HEIC",
+		data: mp4Box("ftyp", "heic\x00\x00\x00\x00mif1heic") + mp4Box("meta", strings.Repeat("m", 32)),
+	}, {
+		name: "no movie",
+		data: jpeg + mp4Box("ftyp", "mp42\x00\x00\x00\x00isommp42") + mp4Box("mdat", strings.Repeat("v", 100)),
+	}, {
+		name: "JPEG",
+		data: jpeg,
+	}}
+	for _, tt := range tests {
+		filePath := filepath.Join(t.TempDir(), "file")
+		err := os.WriteFile(filePath, []byte(tt.data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, length, ok, err := motionPhotoVideo(filePath)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if offset != tt.wantOffset || length != tt.wantLength || ok != tt.wantOK {
+			t.Errorf("%s: got %d, %d, %v, want %d, %d, %v", tt.name, offset, length, ok, tt.wantOffset, tt.wantLength, tt.wantOK)
+		}
+	}
+}
+
+func TestDigiKamWriter(t *testing.T) {
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	tempDir := t.TempDir()
+	root := filepath.Join(tempDir, "Pictures")
+	// Two collections with the same albums and file names. Only the one the
+	// moved files are in may be updated.
+	schema := `
+CREATE TABLE AlbumRoots (id INTEGER PRIMARY KEY, label TEXT, status INTEGER, type INTEGER, identifier TEXT, specificPath TEXT);
+CREATE TABLE Albums (id INTEGER PRIMARY KEY, albumRoot INTEGER, relativePath TEXT, date DATE, UNIQUE (albumRoot, relativePath));
+CREATE TABLE Images (id INTEGER PRIMARY KEY, album INTEGER, name TEXT);
+INSERT INTO AlbumRoots VALUES (1, 'Backup', 0, 1, 'volumeid:?uuid=0000', '/Backup');
+INSERT INTO AlbumRoots VALUES (2, 'Pictures', 0, 1, 'volumeid:?uuid=1111', ` + quoteSQL(filepath.ToSlash(strings.TrimPrefix(root, filepath.VolumeName(root)))) + `);
+INSERT INTO Albums VALUES (1, 1, '/', '2024-01-01'), (2, 1, '/2024', '2024-01-01');
+INSERT INTO Albums VALUES (3, 2, '/', '2024-01-01'), (4, 2, '/2024', '2024-01-01');
+INSERT INTO Images VALUES (1, 1, 'a.jpg'), (2, 2, 'b.jpg'), (3, 3, 'a.jpg'), (4, 4, 'b.jpg');
+`
+	database := filepath.Join(tempDir, "digikam4.db")
+	cmd := exec.Command(sqlite3, database)
+	cmd.Stdin = strings.NewReader(schema)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	script := filepath.Join(tempDir, "digikam.sql")
+	digiKamWriter, err := newDigiKamWriter(script, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves := [][2]string{
+		{filepath.Join(root, "a.jpg"), filepath.Join(root, "2024", "03", "2024-03-01.jpg")},
+		{filepath.Join(root, "2024", "b.jpg"), filepath.Join(root, "2024-02-01.jpg")},
+	}
+	for _, move := range moves {
+		err := digiKamWriter.Add(move[0], move[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = digiKamWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cmd = exec.Command(sqlite3, "-bail", database)
+	cmd.Stdin = file
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	cmd = exec.Command(sqlite3, database, "SELECT Albums.albumRoot, Albums.relativePath, Images.name FROM Images JOIN Albums ON Albums.id = Images.album ORDER BY Images.id;")
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	got := strings.Fields(string(output))
+	want := []string{
+		"1|/|a.jpg",
+		"1|/2024|b.jpg",
+		"2|/2024/03|2024-03-01.jpg",
+		"2|/|2024-02-01.jpg",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestArchiveIndexLookup(t *testing.T) {
+	archiveDir := t.TempDir()
+	cardDir := t.TempDir()
+	// Files of the same size with different contents, and files of another
+	// size, some of which are in the archive.
+	files := map[string]string{
+		filepath.Join(archiveDir, "2024", "a.jpg"): "aaaa",
+		filepath.Join(archiveDir, "2024", "b.jpg"): "bbbb",
+		filepath.Join(archiveDir, "2024", "c.jpg"): "cccccc",
+		filepath.Join(cardDir, "1.jpg"):            "aaaa",
+		filepath.Join(cardDir, "2.jpg"):            "bbbb",
+		filepath.Join(cardDir, "3.jpg"):            "dddd",
+		filepath.Join(cardDir, "4.jpg"):            "cccccc",
+		filepath.Join(cardDir, "5.jpg"):            "eeeeee",
+		filepath.Join(cardDir, "6.jpg"):            "fffffff",
+	}
+	for name, data := range files {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(name, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := newArchiveIndex(t.Context(), []string{archiveDir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"1.jpg": filepath.Join(archiveDir, "2024", "a.jpg"),
+		"2.jpg": filepath.Join(archiveDir, "2024", "b.jpg"),
+		"3.jpg": "",
+		"4.jpg": filepath.Join(archiveDir, "2024", "c.jpg"),
+		"5.jpg": "",
+		"6.jpg": "",
+	}
+	logger := slog.New(slog.DiscardHandler)
+	var waitGroup sync.WaitGroup
+	for name, wantPath := range want {
+		waitGroup.Go(func() {
+			archivedPath, err := index.Lookup(t.Context(), logger, filepath.Join(cardDir, name))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if archivedPath != wantPath {
+				t.Errorf("%s: got %q, want %q", name, archivedPath, wantPath)
+			}
+		})
+	}
+	waitGroup.Wait()
+	// An archived file is never a copy of itself.
+	archivedPath, err := index.Lookup(t.Context(), logger, filepath.Join(archiveDir, "2024", "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archivedPath != "" {
+		t.Errorf("a.jpg: got %q, want none", archivedPath)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ExportIndexCmd struct {
+	FileSelector
+	// Output is the file to write the index to, or empty for stdout.
+	Output string
+	// Format is jsonl, csv or tsv.
+	Format          string
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	Verbose         bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func ExportIndexCommand(args []string) (*ExportIndexCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	exportIndexCmd := &ExportIndexCmd{
+		FileSelector: fileSelector,
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&exportIndexCmd.Output, "out", "", "File to write the index to. (default stdout)")
+	flagset.StringVar(&exportIndexCmd.Format, "format", "", "Format of the index: jsonl, csv or tsv. (default taken from the extension of -out, or jsonl)")
+	flagset.IntVar(&exportIndexCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means one per CPU.")
+	flagset.DurationVar(&exportIndexCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&exportIndexCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		exportIndexCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		exportIndexCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&exportIndexCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		exportIndexCmd.DateSourceRules = append(exportIndexCmd.DateSourceRules, rule)
+		return nil
+	})
+	exportIndexCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&exportIndexCmd.Verbose, "verbose", false, "Verbose output.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = exportIndexCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	if exportIndexCmd.Format == "" {
+		switch strings.ToLower(filepath.Ext(exportIndexCmd.Output)) {
+		case ".csv":
+			exportIndexCmd.Format = "csv"
+		case ".tsv":
+			exportIndexCmd.Format = "tsv"
+		default:
+			exportIndexCmd.Format = "jsonl"
+		}
+	}
+	switch exportIndexCmd.Format {
+	case "jsonl", "csv", "tsv":
+	case "parquet":
+		return nil, fmt.Errorf("parquet is not supported, use jsonl or csv and convert with e.g. duckdb")
+	default:
+		return nil, fmt.Errorf("invalid -format %q, must be jsonl, csv or tsv", exportIndexCmd.Format)
+	}
+	if exportIndexCmd.NumWorkers == 0 {
+		exportIndexCmd.NumWorkers = runtime.NumCPU()
+	}
+	exportIndexCmd.logger = newLogger(exportIndexCmd.Stderr, exportIndexCmd.Verbose)
+	return exportIndexCmd, nil
+}
+
+// indexRow is a row of the index. The JSON field names double as the CSV
+// column names.
+type indexRow struct {
+	Path               string   `json:"path"`
+	Size               int64    `json:"size"`
+	ModTime            string   `json:"mod_time"`
+	CreationTime       string   `json:"creation_time"`
+	CreationTimeSource string   `json:"creation_time_source"`
+	Make               string   `json:"make"`
+	Model              string   `json:"model"`
+	SerialNumber       string   `json:"serial_number"`
+	FileType           string   `json:"file_type"`
+	Latitude           *float64 `json:"latitude"`
+	Longitude          *float64 `json:"longitude"`
+	Country            string   `json:"country"`
+	City               string   `json:"city"`
+}
+
+var indexColumns = []string{"path", "size", "mod_time", "creation_time", "creation_time_source", "make", "model", "serial_number", "file_type", "latitude", "longitude", "country", "city"}
+
+func (row indexRow) record() []string {
+	formatFloat := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+	return []string{row.Path, strconv.FormatInt(row.Size, 10), row.ModTime, row.CreationTime, row.CreationTimeSource, row.Make, row.Model, row.SerialNumber, row.FileType, formatFloat(row.Latitude), formatFloat(row.Longitude), row.Country, row.City}
+}
+
+// Run writes a row with the metadata of every selected file, in the order
+// the workers finish them.
+func (exportIndexCmd *ExportIndexCmd) Run(ctx context.Context) error {
+	unmount, err := exportIndexCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	output := exportIndexCmd.Stdout
+	if exportIndexCmd.Output != "" {
+		file, err := os.Create(exportIndexCmd.Output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+	bufferedOutput := bufio.NewWriter(output)
+	var writeRow func(row indexRow) error
+	var flush func() error
+	if exportIndexCmd.Format == "jsonl" {
+		encoder := json.NewEncoder(bufferedOutput)
+		encoder.SetEscapeHTML(false)
+		writeRow = func(row indexRow) error {
+			return encoder.Encode(row)
+		}
+		flush = bufferedOutput.Flush
+	} else {
+		writer := csv.NewWriter(bufferedOutput)
+		if exportIndexCmd.Format == "tsv" {
+			writer.Comma = '\t'
+		}
+		err := writer.Write(indexColumns)
+		if err != nil {
+			return err
+		}
+		writeRow = func(row indexRow) error {
+			return writer.Write(row.record())
+		}
+		flush = func() error {
+			writer.Flush()
+			err := writer.Error()
+			if err != nil {
+				return err
+			}
+			return bufferedOutput.Flush()
+		}
+	}
+	var cache *exifCache
+	if !exportIndexCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			exportIndexCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var writeMutex sync.Mutex
+	var writeErr error
+	var numRows atomic.Int64
+	var waitGroup sync.WaitGroup
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	queue := make(chan string)
+	stopWorkers := sync.OnceFunc(func() {
+		close(queue)
+		waitGroup.Wait()
+	})
+	defer stopWorkers()
+	for i := 0; i < exportIndexCmd.NumWorkers; i++ {
+		exifTool, err := startExifTool(ctx, exportIndexCmd.Stderr, exportIndexCmd.Timeout, exportIndexCmd.Charset, exportIndexCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = exportIndexCmd.DateSourceRules
+		exifTool.ReadArgs = exportIndexCmd.ExifToolArgs
+		exifTool.Tags = exportIndexCmd.Where.Tags()
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					exportIndexCmd.logger.Warn(err.Error())
+				}
+			}()
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for filePath := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				logger := exportIndexCmd.logger.With(slog.String("filePath", filePath))
+				fileInfo, err := os.Stat(filePath)
+				if err != nil {
+					logger.Error(err.Error())
+					continue
+				}
+				exifs, err := exifTool.FileExifs(logger, filePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				if !exportIndexCmd.MatchExifs(exifs) {
+					logger.Debug("not selected by -where")
+					continue
+				}
+				// Files without a creation time are still indexed, with it
+				// left empty.
+				exif, err := fileExif(logger, filePath, exifs)
+				if err != nil {
+					logger.Info(err.Error())
+					if len(exifs) > 0 {
+						exif = exifs[0]
+					}
+				}
+				row := indexRow{
+					Path:               filePath,
+					Size:               fileInfo.Size(),
+					ModTime:            fileInfo.ModTime().Format(time.RFC3339Nano),
+					CreationTimeSource: exif.CreationTimeSource,
+					Make:               exif.Make,
+					Model:              exif.Model,
+					SerialNumber:       exif.SerialNumber,
+					FileType:           exif.FileTypeExtension,
+					Country:            exif.Country,
+					City:               exif.City,
+				}
+				if !exif.CreationTime.IsZero() {
+					row.CreationTime = exif.CreationTime.Format(time.RFC3339Nano)
+				}
+				if exif.GPSPosition != nil {
+					row.Latitude = &exif.GPSPosition.Latitude
+					row.Longitude = &exif.GPSPosition.Longitude
+				}
+				writeMutex.Lock()
+				if writeErr == nil {
+					writeErr = writeRow(row)
+					if writeErr != nil {
+						cancel(writeErr)
+					}
+				}
+				writeMutex.Unlock()
+				numRows.Add(1)
+			}
+			exitedEarly = false
+		}()
+	}
+	walkErr := exportIndexCmd.Walk(nil, func(root, filePath string) error {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case queue <- filePath:
+			return nil
+		}
+	})
+	stopWorkers()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	if exportIndexCmd.Output != "" {
+		fmt.Fprintf(exportIndexCmd.Stderr, "indexed %d files into %s\n", numRows.Load(), exportIndexCmd.Output)
+	}
+	return nil
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+type ExtractCmd struct {
+	Archives    []string
+	FileRegexps []*regexp.Regexp
+	// DirTemplate and NameTemplate work like they do for MoveCmd, with each
+	// entry's path within its archive taken to be relative to the current
+	// directory.
+	DirTemplate     *template.Template
+	NameTemplate    *template.Template
+	MonthNames      [12]string
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	DateSourceRules []dateSourceRule
+	// List prints the matching entries of each archive without extracting
+	// anything.
+	List            bool
+	IncludeHidden   bool
+	Verbose         bool
+	DryRun          bool
+	ReplaceIfExists bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func ExtractCommand(args []string) (*ExtractCmd, error) {
+	extractCmd := &ExtractCmd{
+		DirTemplate:  template.Must(newMoveTemplate("{{.Dir}}")),
+		NameTemplate: template.Must(newMoveTemplate("{{.Name}}")),
+		MonthNames:   localeMonthNames["en"],
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil extract [FLAGS] ARCHIVE...")
+		flagset.PrintDefaults()
+	}
+	flagset.IntVar(&extractCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means one per CPU.")
+	flagset.DurationVar(&extractCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&extractCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		extractCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		extractCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		extractCmd.DateSourceRules = append(extractCmd.DateSourceRules, rule)
+		return nil
+	})
+	flagset.BoolVar(&extractCmd.List, "list", false, "List the matching entries of each archive without extracting them.")
+	flagset.BoolVar(&extractCmd.IncludeHidden, "include-hidden", false, "Don't skip .DS_Store, Thumbs.db, desktop.ini and AppleDouble ._ files.")
+	flagset.BoolVar(&extractCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&extractCmd.DryRun, "dry-run", false, "Print extract operations without executing.")
+	flagset.BoolVar(&extractCmd.ReplaceIfExists, "replace-if-exists", false, "If a file with the same name already exists in the destination, replace it, moving the replaced file into a .exifutil-trash directory next to it (see exifutil trash).")
+	flagset.Func("month-names", "Month names for {{.MonthName}} and {{.Strftime \"%B\"}}: locale:xx (e.g. locale:de) or 12 comma separated names (default locale:en).", func(value string) error {
+		monthNames, err := parseMonthNames(value)
+		if err != nil {
+			return err
+		}
+		extractCmd.MonthNames = monthNames
+		return nil
+	})
+	flagset.Func("to", "Destination directory template e.g. '/archive/{{.Year}}/{{.Month}}'. {{.Dir}} is the entry's directory within the archive, relative to the current directory. (default {{.Dir}})", func(value string) error {
+		t, err := newMoveTemplate(value)
+		if err != nil {
+			return err
+		}
+		extractCmd.DirTemplate = t
+		return nil
+	})
+	flagset.Func("name", "File name template e.g. '{{.Timestamp}}{{.Ext}}'. (default {{.Name}})", func(value string) error {
+		t, err := newMoveTemplate(value)
+		if err != nil {
+			return err
+		}
+		if walkTemplates(t).UsesField("DailyIndex") {
+			return fmt.Errorf("{{.DailyIndex}} is not supported by extract")
+		}
+		extractCmd.NameTemplate = t
+		return nil
+	})
+	flagset.Func("file", "Include file regex, matched against the name of each entry. Can be repeated. All entries are included if none are given.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		extractCmd.FileRegexps = append(extractCmd.FileRegexps, r)
+		return nil
+	})
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("no archives given")
+	}
+	for _, arg := range flagset.Args() {
+		archive, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		extractCmd.Archives = append(extractCmd.Archives, archive)
+	}
+	if extractCmd.NumWorkers == 0 {
+		extractCmd.NumWorkers = runtime.NumCPU()
+	}
+	extractCmd.logger = newLogger(extractCmd.Stdout, extractCmd.Verbose)
+	return extractCmd, nil
+}
+
+// extractJob is an archive entry that has been extracted into a temporary
+// directory of its own for exiftool to read.
+type extractJob struct {
+	ArchivePath string
+	EntryName   string
+	TempDir     string
+	FilePath    string
+}
+
+func (extractCmd *ExtractCmd) Run(ctx context.Context) error {
+	// newFilePath is shared with MoveCmd.
+	moveCmd := &MoveCmd{
+		DirTemplate:  extractCmd.DirTemplate,
+		NameTemplate: extractCmd.NameTemplate,
+		MonthNames:   extractCmd.MonthNames,
+	}
+	var waitGroup sync.WaitGroup
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	jobs := make(chan extractJob)
+	// Closing jobs tells the workers to exit once they have finished the
+	// entry they are currently working on.
+	stopWorkers := sync.OnceFunc(func() {
+		close(jobs)
+		waitGroup.Wait()
+	})
+	defer stopWorkers()
+	if !extractCmd.List {
+		for i := 0; i < extractCmd.NumWorkers; i++ {
+			exifTool, err := startExifTool(ctx, extractCmd.Stderr, extractCmd.Timeout, extractCmd.Charset, extractCmd.ExifToolConfig)
+			if err != nil {
+				return err
+			}
+			// The cache identifies files by inode and modification time, which
+			// temporary files reuse, so it must not be used here.
+			exifTool.DateSourceRules = extractCmd.DateSourceRules
+			exifTool.ReadArgs = extractCmd.ExifToolArgs
+			waitGroup.Add(1)
+			numWorkersAlive.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				defer func() {
+					err := exifTool.Close()
+					if err != nil {
+						extractCmd.logger.Warn(err.Error())
+					}
+				}()
+				exitedEarly := true
+				defer func() {
+					if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+						cancel(errAllWorkersExited)
+					}
+				}()
+				for job := range jobs {
+					ok := extractCmd.extract(ctx, exifTool, moveCmd, job)
+					err := os.RemoveAll(job.TempDir)
+					if err != nil {
+						extractCmd.logger.Warn(err.Error())
+					}
+					if !ok {
+						return
+					}
+				}
+				exitedEarly = false
+			}()
+		}
+	}
+	for _, archivePath := range extractCmd.Archives {
+		err := walkArchive(archivePath, func(entry archiveEntry, lookup func(name string) (archiveEntry, bool)) error {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			name := path.Base(entry.Name)
+			if !extractCmd.IncludeHidden && isHiddenSystemFile(name) {
+				return nil
+			}
+			if len(extractCmd.FileRegexps) > 0 && !slices.ContainsFunc(extractCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+				return fileRegexp.MatchString(name)
+			}) {
+				return nil
+			}
+			// Don't let a malicious archive write outside the destination.
+			if !filepath.IsLocal(filepath.FromSlash(entry.Name)) {
+				extractCmd.logger.Warn("skipping entry with unsafe path", slog.String("archivePath", archivePath), slog.String("entryName", entry.Name))
+				return nil
+			}
+			if extractCmd.List {
+				fmt.Fprintf(extractCmd.Stdout, "%s:%s\n", archivePath, entry.Name)
+				return nil
+			}
+			tempDir, err := os.MkdirTemp("", "exifutil-extract-*")
+			if err != nil {
+				return err
+			}
+			filePath := filepath.Join(tempDir, name)
+			err = extractEntry(entry, filePath)
+			// Google Takeout keeps the photo taken time of files without
+			// EXIF in a JSON sidecar, so extract those too for fileExif to
+			// find. Only zip archives can look them up out of order.
+			if err == nil {
+				for _, suffix := range []string{".json", ".supplemental-metadata.json"} {
+					if sidecar, ok := lookup(entry.Name + suffix); ok {
+						err = extractEntry(sidecar, filePath+suffix)
+					}
+				}
+				if sidecar, ok := lookup(strings.TrimSuffix(entry.Name, path.Ext(entry.Name)) + ".json"); ok && err == nil {
+					err = extractEntry(sidecar, strings.TrimSuffix(filePath, filepath.Ext(filePath))+".json")
+				}
+			}
+			if err != nil {
+				os.RemoveAll(tempDir)
+				extractCmd.logger.Error(err.Error(), slog.String("archivePath", archivePath), slog.String("entryName", entry.Name))
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				os.RemoveAll(tempDir)
+				return context.Cause(ctx)
+			case jobs <- extractJob{ArchivePath: archivePath, EntryName: entry.Name, TempDir: tempDir, FilePath: filePath}:
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	stopWorkers()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// extract moves the file of job to where the templates say it should go. It
+// returns false if the worker's exiftool is no longer usable.
+func (extractCmd *ExtractCmd) extract(ctx context.Context, exifTool *exifTool, moveCmd *MoveCmd, job extractJob) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	logger := extractCmd.logger.With(slog.String("archivePath", job.ArchivePath), slog.String("entryName", job.EntryName))
+	exifs, err := exifTool.FileExifs(logger, job.FilePath)
+	if err != nil {
+		// exiftool is killed when the run is interrupted.
+		if ctx.Err() != nil {
+			return false
+		}
+		logger.Error(err.Error())
+		if errors.Is(err, errUnreadableFile) {
+			return true
+		}
+		if !errors.Is(err, errExifToolTimeout) {
+			return false
+		}
+		err := exifTool.Restart()
+		if err != nil {
+			logger.Error(err.Error())
+			return false
+		}
+		return true
+	}
+	exif, err := fileExif(logger, job.FilePath, exifs)
+	if err != nil {
+		logger.Error(err.Error())
+		return true
+	}
+	newFilePath, err := moveCmd.newFilePath(filepath.FromSlash(job.EntryName), exif)
+	if err != nil {
+		logger.Error(err.Error())
+		return true
+	}
+	if extractCmd.DryRun {
+		b, err := json.Marshal(exif)
+		if err != nil {
+			logger.Warn(err.Error())
+		}
+		fmt.Fprintf(extractCmd.Stdout, "%s:%s => %s %s\n", job.ArchivePath, job.EntryName, newFilePath, string(b))
+		return true
+	}
+	err = os.MkdirAll(filepath.Dir(newFilePath), 0755)
+	if err != nil {
+		logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+		return true
+	}
+	err = renameNoReplace(osFS{}, job.FilePath, newFilePath, extractCmd.ReplaceIfExists)
+	// The temporary directory is usually on a different filesystem from the
+	// destination, in which case the file has to be copied over instead.
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		err = copyNoReplace(job.FilePath, newFilePath)
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("newFilePath", newFilePath))
+			return true
+		}
+		logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+		return true
+	}
+	logger.Info("extracted file", slog.String("newFilePath", newFilePath))
+	return true
+}
+
+// copyNoReplace copies the file at oldPath to newPath, which must not exist,
+// preserving its modification time.
+func copyNoReplace(oldPath, newPath string) error {
+	src, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fileInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return os.Chtimes(newPath, fileInfo.ModTime(), fileInfo.ModTime())
+}
+
+// archiveEntry is a regular file inside an archive.
+type archiveEntry struct {
+	// Name is the slash separated path of the file within the archive.
+	Name    string
+	ModTime time.Time
+	Open    func() (io.ReadCloser, error)
+}
+
+// walkArchive calls fn for each regular file in the zip, tar or gzipped tar
+// archive at archivePath. Entries of tar archives can only be opened during
+// the call to fn for that entry. lookup returns other entries by name, but
+// only for zip archives since tar archives can't be read out of order.
+func walkArchive(archivePath string, fn func(entry archiveEntry, lookup func(name string) (archiveEntry, bool)) error) error {
+	lowerPath := strings.ToLower(archivePath)
+	switch {
+	case strings.HasSuffix(lowerPath, ".zip"):
+		zipReader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer zipReader.Close()
+		zipEntry := func(file *zip.File) archiveEntry {
+			return archiveEntry{Name: file.Name, ModTime: file.Modified, Open: file.Open}
+		}
+		files := make(map[string]*zip.File)
+		for _, file := range zipReader.File {
+			files[file.Name] = file
+		}
+		lookup := func(name string) (archiveEntry, bool) {
+			file, ok := files[name]
+			if !ok {
+				return archiveEntry{}, false
+			}
+			return zipEntry(file), true
+		}
+		for _, file := range zipReader.File {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			err := fn(zipEntry(file), lookup)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(lowerPath, ".tar"), strings.HasSuffix(lowerPath, ".tar.gz"), strings.HasSuffix(lowerPath, ".tgz"):
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		var reader io.Reader = file
+		if !strings.HasSuffix(lowerPath, ".tar") {
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				return err
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+		tarReader := tar.NewReader(reader)
+		lookup := func(name string) (archiveEntry, bool) {
+			return archiveEntry{}, false
+		}
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			err = fn(archiveEntry{
+				Name:    header.Name,
+				ModTime: header.ModTime,
+				Open: func() (io.ReadCloser, error) {
+					return io.NopCloser(tarReader), nil
+				},
+			}, lookup)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("%s: unsupported archive format, must be .zip, .tar, .tar.gz or .tgz", archivePath)
+}
+
+// extractEntry writes the contents of entry to filePath, preserving its
+// modification time.
+func extractEntry(entry archiveEntry, filePath string) error {
+	reader, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(filePath, entry.ModTime, entry.ModTime)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"text/template"
+	"time"
+)
+
+type FixExtensionsCmd struct {
+	FileSelector
+	ExtMap         map[string]string
+	NumWorkers     int
+	MaxPending     int
+	Timeout        time.Duration
+	Charset        string
+	ExifToolConfig string
+	ExifToolArgs   []string
+	NoCache        bool
+	Report         string
+	Verbose        bool
+	DryRun         bool
+	Force          bool
+	NoLock         bool
+	Plan           bool
+	Durable        bool
+	Stdout         io.Writer
+	Stderr         io.Writer
+	logger         *slog.Logger
+}
+
+func FixExtensionsCommand(args []string) (*FixExtensionsCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	fixExtensionsCmd := &FixExtensionsCmd{
+		FileSelector: fileSelector,
+		ExtMap:       defaultExtMap,
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.IntVar(&fixExtensionsCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means auto-tune based on the number of CPUs and measured throughput.")
+	flagset.IntVar(&fixExtensionsCmd.MaxPending, "max-pending", defaultMaxPending, "Maximum number of files queued up ahead of the workers.")
+	flagset.DurationVar(&fixExtensionsCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&fixExtensionsCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		fixExtensionsCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		fixExtensionsCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&fixExtensionsCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("ext-map", "Comma separated from=to extension replacements applied to the detected extension, and under which two extensions count as the same (default jpeg=jpg,tif=tiff).", func(value string) error {
+		extMap, err := parseExtMap(value)
+		if err != nil {
+			return err
+		}
+		fixExtensionsCmd.ExtMap = extMap
+		return nil
+	})
+	fixExtensionsCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&fixExtensionsCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&fixExtensionsCmd.DryRun, "dry-run", false, "Print rename operations without executing.")
+	flagset.BoolVar(&fixExtensionsCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&fixExtensionsCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	flagset.BoolVar(&fixExtensionsCmd.Plan, "plan", false, "Work out the new name of every file before renaming any, and rename nothing if two or more files would get the same new name.")
+	flagset.BoolVar(&fixExtensionsCmd.Durable, "durable", false, "Fsync each renamed file and its directory so that renames survive a power loss. Slower.")
+	flagset.StringVar(&fixExtensionsCmd.Report, "report", "", "Write a record of every operation to this CSV file (or TSV, if it ends in .tsv).")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = fixExtensionsCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	fixExtensionsCmd.logger = newLogger(fixExtensionsCmd.Stdout, fixExtensionsCmd.Verbose)
+	return fixExtensionsCmd, nil
+}
+
+// Run renames every file whose extension doesn't match its actual type,
+// leaving the rest of its name alone. Files that already have the right
+// extension are left alone entirely.
+func (fixExtensionsCmd *FixExtensionsCmd) Run(ctx context.Context) error {
+	moveCmd := &MoveCmd{
+		FileSelector: fixExtensionsCmd.FileSelector,
+		MoveOptions: MoveOptions{
+			NumWorkers:     fixExtensionsCmd.NumWorkers,
+			MaxPending:     fixExtensionsCmd.MaxPending,
+			Timeout:        fixExtensionsCmd.Timeout,
+			Charset:        fixExtensionsCmd.Charset,
+			ExifToolConfig: fixExtensionsCmd.ExifToolConfig,
+			ExifToolArgs:   fixExtensionsCmd.ExifToolArgs,
+			NoCache:        fixExtensionsCmd.NoCache,
+			OnParseError:   "skip",
+			Report:         fixExtensionsCmd.Report,
+			Verbose:        fixExtensionsCmd.Verbose,
+			DryRun:         fixExtensionsCmd.DryRun,
+			Force:          fixExtensionsCmd.Force,
+			NoLock:         fixExtensionsCmd.NoLock,
+			Durable:        fixExtensionsCmd.Durable,
+		},
+		DirTemplate:        template.Must(newMoveTemplate("{{.Dir}}")),
+		NameTemplate:       template.Must(newMoveTemplate("{{.Name}}")),
+		FixExt:             true,
+		ExtMap:             fixExtensionsCmd.ExtMap,
+		IgnoreCreationTime: true,
+		Plan:               fixExtensionsCmd.Plan,
+		Stdout:             fixExtensionsCmd.Stdout,
+		Stderr:             fixExtensionsCmd.Stderr,
+		logger:             fixExtensionsCmd.logger,
+	}
+	return moveCmd.Run(ctx)
+}
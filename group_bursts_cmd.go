@@ -0,0 +1,339 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type GroupBurstsCmd struct {
+	FileSelector
+	// Threshold is the maximum time between consecutive shots of a burst.
+	Threshold time.Duration
+	// MinSize is the minimum number of shots that make up a burst.
+	MinSize int
+	// Strategy is either dir, to move each burst into its own subdirectory,
+	// or prefix, to give the shots of each burst a shared name prefix.
+	Strategy        string
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	Verbose         bool
+	DryRun          bool
+	Force           bool
+	NoLock          bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func GroupBurstsCommand(args []string) (*GroupBurstsCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	groupBurstsCmd := &GroupBurstsCmd{
+		FileSelector: fileSelector,
+		Strategy:     "dir",
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.IntVar(&groupBurstsCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means one per CPU.")
+	flagset.DurationVar(&groupBurstsCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&groupBurstsCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		groupBurstsCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		groupBurstsCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&groupBurstsCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		groupBurstsCmd.DateSourceRules = append(groupBurstsCmd.DateSourceRules, rule)
+		return nil
+	})
+	flagset.DurationVar(&groupBurstsCmd.Threshold, "threshold", time.Second, "Maximum time between consecutive shots of a burst.")
+	flagset.IntVar(&groupBurstsCmd.MinSize, "min-size", 3, "Minimum number of shots in a burst.")
+	flagset.Func("strategy", "How to group bursts: dir (move each burst into its own subdirectory, the default) or prefix (give each burst's files a shared name prefix).", func(value string) error {
+		switch value {
+		case "dir", "prefix":
+			groupBurstsCmd.Strategy = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be dir or prefix", value)
+	})
+	groupBurstsCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&groupBurstsCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&groupBurstsCmd.DryRun, "dry-run", false, "Print group operations without executing.")
+	flagset.BoolVar(&groupBurstsCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&groupBurstsCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = groupBurstsCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	if groupBurstsCmd.MinSize < 2 {
+		return nil, fmt.Errorf("-min-size must be at least 2")
+	}
+	if groupBurstsCmd.NumWorkers == 0 {
+		groupBurstsCmd.NumWorkers = runtime.NumCPU()
+	}
+	groupBurstsCmd.logger = newLogger(groupBurstsCmd.Stdout, groupBurstsCmd.Verbose)
+	return groupBurstsCmd, nil
+}
+
+// burstFile is a file that may be part of a burst.
+type burstFile struct {
+	FilePath string
+	Exif     Exif
+}
+
+func (groupBurstsCmd *GroupBurstsCmd) Run(ctx context.Context) error {
+	unmount, err := groupBurstsCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if !groupBurstsCmd.DryRun {
+		err := groupBurstsCmd.CheckSafety(groupBurstsCmd.Force, groupBurstsCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if !groupBurstsCmd.DryRun && !groupBurstsCmd.NoLock {
+		unlock, err := groupBurstsCmd.Lock(groupBurstsCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var files []*burstFile
+	// Leave bursts grouped by a previous run alone.
+	err = groupBurstsCmd.Walk(func(dirPath string) bool {
+		return strings.HasPrefix(filepath.Base(dirPath), "burst-")
+	}, func(root, filePath string) error {
+		if !strings.HasPrefix(filepath.Base(filePath), "burst-") {
+			files = append(files, &burstFile{FilePath: filePath})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = groupBurstsCmd.fetchExifs(ctx, files)
+	if err != nil {
+		return err
+	}
+	var numBursts, numGrouped int
+	for _, burst := range groupBurstsCmd.findBursts(files) {
+		numBursts++
+		// Bursts are named after their first shot, so that they sort
+		// alongside the rest of the directory.
+		name := "burst-" + burst[0].Exif.CreationTime.Format("2006-01-02T150405.000-0700")
+		for _, file := range burst {
+			var newFilePath string
+			switch groupBurstsCmd.Strategy {
+			case "dir":
+				newFilePath = filepath.Join(filepath.Dir(file.FilePath), name, filepath.Base(file.FilePath))
+			case "prefix":
+				newFilePath = filepath.Join(filepath.Dir(file.FilePath), name+"-"+filepath.Base(file.FilePath))
+			}
+			if groupBurstsCmd.DryRun {
+				fmt.Fprintf(groupBurstsCmd.Stdout, "%s => %s\n", file.FilePath, newFilePath)
+				continue
+			}
+			logger := groupBurstsCmd.logger.With(slog.String("filePath", file.FilePath))
+			err := os.MkdirAll(filepath.Dir(newFilePath), 0755)
+			if err != nil {
+				logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+				continue
+			}
+			err = renameNoReplace(osFS{}, file.FilePath, newFilePath, false)
+			if err != nil {
+				if errors.Is(err, fs.ErrExist) {
+					logger.Info("file already exists, skipping", slog.String("newFilePath", newFilePath))
+					continue
+				}
+				logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+				continue
+			}
+			numGrouped++
+			logger.Info("moved file", slog.String("newFilePath", newFilePath))
+		}
+	}
+	if !groupBurstsCmd.DryRun {
+		fmt.Fprintf(groupBurstsCmd.Stderr, "grouped %d files into %d bursts\n", numGrouped, numBursts)
+	}
+	return nil
+}
+
+// findBursts returns the runs of at least MinSize files taken by the same
+// camera in the same directory, each no more than Threshold after the
+// previous one. Files without a creation time are never part of a burst.
+func (groupBurstsCmd *GroupBurstsCmd) findBursts(files []*burstFile) [][]*burstFile {
+	type burstKey struct {
+		Dir   string
+		Make  string
+		Model string
+	}
+	candidates := make(map[burstKey][]*burstFile)
+	var keys []burstKey
+	for _, file := range files {
+		if file.Exif.CreationTime.IsZero() {
+			continue
+		}
+		key := burstKey{Dir: filepath.Dir(file.FilePath), Make: file.Exif.Make, Model: file.Exif.Model}
+		if _, ok := candidates[key]; !ok {
+			keys = append(keys, key)
+		}
+		candidates[key] = append(candidates[key], file)
+	}
+	var bursts [][]*burstFile
+	for _, key := range keys {
+		files := candidates[key]
+		// Shots within the same millisecond fall back to name order, which
+		// for most cameras follows the shutter count.
+		slices.SortFunc(files, func(a, b *burstFile) int {
+			return cmp.Or(a.Exif.CreationTime.Compare(b.Exif.CreationTime), cmp.Compare(a.FilePath, b.FilePath))
+		})
+		start := 0
+		for i := 1; i <= len(files); i++ {
+			if i < len(files) && files[i].Exif.CreationTime.Sub(files[i-1].Exif.CreationTime) <= groupBurstsCmd.Threshold {
+				continue
+			}
+			if i-start >= groupBurstsCmd.MinSize {
+				bursts = append(bursts, files[start:i])
+			}
+			start = i
+		}
+	}
+	return bursts
+}
+
+func (groupBurstsCmd *GroupBurstsCmd) fetchExifs(ctx context.Context, files []*burstFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var cache *exifCache
+	if !groupBurstsCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			groupBurstsCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var waitGroup sync.WaitGroup
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	// Wait for the workers before cancelling ctx, otherwise the exiftool
+	// processes of files still being worked on are killed.
+	defer waitGroup.Wait()
+	queue := make(chan *burstFile)
+	defer close(queue)
+	for i := 0; i < min(groupBurstsCmd.NumWorkers, len(files)); i++ {
+		exifTool, err := startExifTool(ctx, groupBurstsCmd.Stderr, groupBurstsCmd.Timeout, groupBurstsCmd.Charset, groupBurstsCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = groupBurstsCmd.DateSourceRules
+		exifTool.ReadArgs = groupBurstsCmd.ExifToolArgs
+		exifTool.Tags = groupBurstsCmd.Where.Tags()
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					groupBurstsCmd.logger.Warn(err.Error())
+				}
+			}()
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for file := range queue {
+				logger := groupBurstsCmd.logger.With(slog.String("filePath", file.FilePath))
+				exifs, err := exifTool.FileExifs(logger, file.FilePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				if !groupBurstsCmd.MatchExifs(exifs) {
+					logger.Debug("not selected by -where")
+					continue
+				}
+				exif, err := fileExif(logger, file.FilePath, exifs)
+				if err != nil {
+					logger.Info(err.Error())
+					continue
+				}
+				file.Exif = exif
+			}
+			exitedEarly = false
+		}()
+	}
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case queue <- file:
+		}
+	}
+	return nil
+}
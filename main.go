@@ -6,13 +6,44 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 )
 
 const helptext = `Usage:
-  exifutil rename    # Rename files to their canonical timestamp name.
-  exifutil partition # Partition files by their creation date.
+  exifutil rename          # Rename files to their canonical timestamp name.
+  exifutil partition       # Partition files by their creation date.
+  exifutil shift-tz        # Correct the timezone of files shot in the wrong timezone.
+  exifutil backfill-dates  # Write DateTimeOriginal into files lacking it from their GPS time, name or sidecar.
+  exifutil move            # Move files to a destination built from their metadata.
+  exifutil compare         # Report files missing from either of two directory trees.
+  exifutil thumbs          # Extract embedded previews from RAW files.
+  exifutil group-bursts    # Group burst shots into their own directories.
+  exifutil split-by-event  # Split files into events separated by gaps in time.
+  exifutil fix-extensions  # Correct file extensions that don't match the actual file type.
+  exifutil rehearse        # Dry-run rename, partition or move on a random sample of files and summarize the outcomes.
+  exifutil bench           # Measure throughput on a sample of files with different numbers of workers.
+  exifutil watch           # Rerun rename, partition or move periodically, or install a service that does.
+  exifutil daemon          # Serve rename, partition and move over a socket, keeping exiftool running in between.
+  exifutil ctl             # Run rename, partition or move in a running daemon.
+  exifutil export-index    # Export the metadata of files to JSON Lines or CSV for analysis.
+  exifutil checksum-verify # Check files against a manifest written by -manifest.
+  exifutil archive         # Move files older than a given age into a date-partitioned archive.
+  exifutil extract         # Extract files from ZIP and TAR archives by their metadata.
+  exifutil merge-livp      # Replace .livp Live Photos with their still image and video.
+  exifutil reconcile       # Merge files with the same contents under old and canonical names, recording the aliases.
+  exifutil orphan-sidecars # Report (or trash) .xmp, .aae and .json sidecars whose file no longer exists.
+  exifutil trash           # List, restore or empty files replaced by -replace-if-exists.
+  exifutil skiplist        # Show or clear the files skipped by -skip-list.
+  exifutil doctor          # Check the environment for common problems.
+  exifutil completion      # Print a bash, zsh or fish completion script.
+  exifutil NAME            # Run exifutil-NAME from the PATH, if it exists.
+
+While rename, partition or move is running, send it SIGUSR1 or press Enter to
+print its progress.
 `
 
 func main() {
@@ -43,6 +74,9 @@ func main() {
 		<-userInterrupt // Soft interrupt.
 		cancel()
 		<-userInterrupt // Hard interrupt.
+		// Remotes are otherwise unmounted by the subcommand when it
+		// returns.
+		unmountRcloneRemotes()
 		os.Exit(1)
 	}()
 	exit := func(subcmd string, err error) {
@@ -71,8 +105,280 @@ func main() {
 		if err != nil {
 			exit(subcmd, err)
 		}
+	case "backfill-dates":
+		backfillDatesCmd, err := BackfillDatesCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = backfillDatesCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "move":
+		moveCmd, err := MoveCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = moveCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "archive":
+		archiveCmd, err := ArchiveCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = archiveCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "compare":
+		compareCmd, err := CompareCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = compareCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "shift-tz":
+		shiftTZCmd, err := ShiftTZCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = shiftTZCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "group-bursts":
+		groupBurstsCmd, err := GroupBurstsCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = groupBurstsCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "split-by-event":
+		splitByEventCmd, err := SplitByEventCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = splitByEventCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "fix-extensions":
+		fixExtensionsCmd, err := FixExtensionsCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = fixExtensionsCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "thumbs":
+		thumbsCmd, err := ThumbsCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = thumbsCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "rehearse":
+		rehearseCmd, err := RehearseCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = rehearseCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "bench":
+		benchCmd, err := BenchCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = benchCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "watch":
+		watchCmd, err := WatchCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = watchCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "daemon":
+		daemonCmd, err := DaemonCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = daemonCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "ctl":
+		ctlCmd, err := CtlCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = ctlCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "export-index":
+		exportIndexCmd, err := ExportIndexCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = exportIndexCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "checksum-verify":
+		checksumVerifyCmd, err := ChecksumVerifyCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = checksumVerifyCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "extract":
+		extractCmd, err := ExtractCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = extractCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "trash":
+		trashCmd, err := TrashCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = trashCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "merge-livp":
+		mergeLivpCmd, err := MergeLivpCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = mergeLivpCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "orphan-sidecars":
+		orphanSidecarsCmd, err := OrphanSidecarsCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = orphanSidecarsCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "reconcile":
+		reconcileCmd, err := ReconcileCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = reconcileCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "skiplist":
+		skiplistCmd, err := SkiplistCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = skiplistCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "doctor":
+		doctorCmd, err := DoctorCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = doctorCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
+	case "completion":
+		completionCmd, err := CompletionCommand(args)
+		if err != nil {
+			exit(subcmd, err)
+		}
+		err = completionCmd.Run(ctx)
+		if err != nil {
+			exit(subcmd, err)
+		}
 	default:
-		fmt.Fprintf(os.Stderr, "unrecognized subcommand %q\n", subcmd)
-		return
+		// Like git, run exifutil-NAME from the PATH for subcommands that
+		// aren't built in.
+		pluginCmd, err := newPluginCmd(subcmd, args)
+		if errors.Is(err, exec.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "unrecognized subcommand %q\n", subcmd)
+			return
+		}
+		if err != nil {
+			exit(subcmd, err)
+		}
+		// The plugin is in the same process group, so it gets the same
+		// interrupts and decides for itself how to handle them.
+		err = pluginCmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		if err != nil {
+			exit(subcmd, err)
+		}
+	}
+}
+
+// newPluginCmd returns the command running the external subcommand
+// exifutil-NAME found in the PATH with args, or an error wrapping
+// exec.ErrNotFound if there is none. Plugins get their configuration from
+// the environment:
+//
+//   - EXIFUTIL_EXECUTABLE is the path of exifutil itself, for plugins that
+//     run built-in subcommands.
+//   - EXIFUTIL_CACHE_DIR is the directory of the cache of file metadata.
+//   - EXIFUTIL_FILENAME_CHARSET is the default -charset passed to exiftool,
+//     if there is one on this platform.
+func newPluginCmd(name string, args []string) (*exec.Cmd, error) {
+	// Don't let a subcommand like ../foo escape the PATH.
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, "-") {
+		return nil, fmt.Errorf("exifutil-%s: %w", name, exec.ErrNotFound)
+	}
+	pluginPath, err := exec.LookPath("exifutil-" + name)
+	if err != nil {
+		return nil, err
+	}
+	env := os.Environ()
+	executable, err := os.Executable()
+	if err == nil {
+		env = append(env, "EXIFUTIL_EXECUTABLE="+executable)
+	}
+	userCacheDir, err := os.UserCacheDir()
+	if err == nil {
+		env = append(env, "EXIFUTIL_CACHE_DIR="+filepath.Join(userCacheDir, "exifutil", "exif"))
+	}
+	if defaultFilenameCharset != "" {
+		env = append(env, "EXIFUTIL_FILENAME_CHARSET="+defaultFilenameCharset)
 	}
+	cmd := exec.Command(pluginPath, args...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
 }
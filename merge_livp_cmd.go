@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type MergeLivpCmd struct {
+	FileSelector
+	// Keep keeps each .livp once its contents have been written out,
+	// instead of removing it.
+	Keep    bool
+	Verbose bool
+	DryRun  bool
+	Force   bool
+	NoLock  bool
+	Stdout  io.Writer
+	Stderr  io.Writer
+	logger  *slog.Logger
+}
+
+func MergeLivpCommand(args []string) (*MergeLivpCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	mergeLivpCmd := &MergeLivpCmd{
+		FileSelector: fileSelector,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.BoolVar(&mergeLivpCmd.Keep, "keep", false, "Keep each .livp after writing out its still image and video, instead of removing it.")
+	mergeLivpCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&mergeLivpCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&mergeLivpCmd.DryRun, "dry-run", false, "Print merge operations without executing.")
+	flagset.BoolVar(&mergeLivpCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&mergeLivpCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = mergeLivpCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	mergeLivpCmd.logger = newLogger(mergeLivpCmd.Stdout, mergeLivpCmd.Verbose)
+	return mergeLivpCmd, nil
+}
+
+// Run replaces each .livp with the still image and video inside it, named
+// after the .livp e.g. IMG_1234.livp becomes IMG_1234.HEIC and IMG_1234.MOV,
+// the pair Photos.app and most other tools expect a Live Photo to be.
+func (mergeLivpCmd *MergeLivpCmd) Run(ctx context.Context) error {
+	unmount, err := mergeLivpCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if !mergeLivpCmd.DryRun {
+		err := mergeLivpCmd.CheckSafety(mergeLivpCmd.Force, mergeLivpCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if !mergeLivpCmd.DryRun && !mergeLivpCmd.NoLock {
+		unlock, err := mergeLivpCmd.Lock(mergeLivpCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return mergeLivpCmd.Walk(nil, func(root, filePath string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isLivp(filePath) {
+			return nil
+		}
+		logger := mergeLivpCmd.logger.With(slog.String("filePath", filePath))
+		stillPath, videoPath, err := mergeLivpCmd.merge(filePath)
+		if err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				logger.Info("file already exists, skipping", slog.String("stillPath", stillPath), slog.String("videoPath", videoPath))
+				return nil
+			}
+			logger.Error(err.Error())
+			return nil
+		}
+		if mergeLivpCmd.DryRun {
+			fmt.Fprintf(mergeLivpCmd.Stdout, "%s => %s + %s\n", filePath, stillPath, videoPath)
+			return nil
+		}
+		logger.Info("merged livp", slog.String("stillPath", stillPath), slog.String("videoPath", videoPath))
+		return nil
+	})
+}
+
+// merge writes out the still image and video of the .livp at filePath next
+// to it and removes it, unless Keep is set. Neither is written if either
+// already exists.
+func (mergeLivpCmd *MergeLivpCmd) merge(filePath string) (stillPath, videoPath string, err error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	livp, err := openLivp(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer livp.Close()
+	stem := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	stillPath = stem + path.Ext(livp.Still.Name)
+	videoPath = stem + path.Ext(livp.Video.Name)
+	for _, newPath := range []string{stillPath, videoPath} {
+		_, err := os.Lstat(newPath)
+		if err == nil {
+			return stillPath, videoPath, fmt.Errorf("%s: %w", newPath, fs.ErrExist)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return stillPath, videoPath, err
+		}
+	}
+	if mergeLivpCmd.DryRun {
+		return stillPath, videoPath, nil
+	}
+	// The .livp's modification time is the one the photo had before it
+	// was exported, unlike the times of the entries inside.
+	err = extractEntry(archiveEntry{Name: livp.Still.Name, ModTime: fileInfo.ModTime(), Open: livp.Still.Open}, stillPath)
+	if err != nil {
+		os.Remove(stillPath)
+		return stillPath, videoPath, err
+	}
+	err = extractEntry(archiveEntry{Name: livp.Video.Name, ModTime: fileInfo.ModTime(), Open: livp.Video.Open}, videoPath)
+	if err != nil {
+		os.Remove(stillPath)
+		os.Remove(videoPath)
+		return stillPath, videoPath, err
+	}
+	if mergeLivpCmd.Keep {
+		return stillPath, videoPath, nil
+	}
+	return stillPath, videoPath, os.Remove(filePath)
+}
+
+// isLivp reports whether filePath is a .livp, the ZIP archive holding the
+// still image and video of a Live Photo that some Apple exports (like
+// iCloud.com downloads) write in place of the usual pair of files.
+func isLivp(filePath string) bool {
+	return strings.EqualFold(filepath.Ext(filePath), ".livp")
+}
+
+// livpArchive is an open .livp.
+type livpArchive struct {
+	*zip.ReadCloser
+	Still *zip.File
+	Video *zip.File
+}
+
+// openLivp opens the .livp at filePath and finds its still image and video.
+func openLivp(filePath string) (*livpArchive, error) {
+	zipReader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	livp := &livpArchive{ReadCloser: zipReader}
+	for _, file := range zipReader.File {
+		name := path.Base(file.Name)
+		if file.FileInfo().IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(path.Ext(name)) {
+		case ".heic", ".jpg", ".jpeg":
+			if livp.Still == nil {
+				livp.Still = file
+			}
+		case ".mov", ".mp4":
+			if livp.Video == nil {
+				livp.Video = file
+			}
+		}
+	}
+	if livp.Still == nil || livp.Video == nil {
+		zipReader.Close()
+		return nil, fmt.Errorf("%s: not a Live Photo, it must hold a still image and a video", filePath)
+	}
+	return livp, nil
+}
+
+// extractLivpStill writes the still image of the .livp at filePath to a
+// temporary file and returns its path, which the caller must remove.
+func extractLivpStill(filePath string) (string, error) {
+	livp, err := openLivp(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer livp.Close()
+	reader, err := livp.Still.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	tempFile, err := os.CreateTemp("", "exifutil-*"+path.Ext(livp.Still.Name))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tempFile, reader)
+	if err == nil {
+		err = tempFile.Close()
+	} else {
+		tempFile.Close()
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
@@ -0,0 +1,2996 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+type MoveCmd struct {
+	FileSelector
+	FilePermissions
+	RetryPolicy
+	MoveOptions
+	// DirTemplate is evaluated against each file's moveTemplateData to
+	// obtain the directory it should be moved to.
+	DirTemplate *template.Template
+	// NameTemplate is evaluated against each file's moveTemplateData to
+	// obtain the name it should be given.
+	NameTemplate *template.Template
+	// ReplicaTemplates are evaluated like DirTemplate to obtain further
+	// directories each file is copied to, under its new name, before it is
+	// moved.
+	ReplicaTemplates []*template.Template
+	// MonthNames are the names used for the MonthName template field and the
+	// %B and %b Strftime verbs.
+	MonthNames [12]string
+	// DayBoundary is the time of day at which a day starts for the DayFormat
+	// template method, so that photos taken in the small hours belong to
+	// the day before.
+	DayBoundary time.Duration
+	// MediaTypes classify files for the MediaType template field. The
+	// first rule a file matches gives its media type.
+	MediaTypes []mediaTypeRule
+	// NormalizeExt lowercases the extension of each new file name and
+	// replaces it according to ExtMap e.g. .JPEG becomes .jpg.
+	NormalizeExt bool
+	// FixExt replaces the extension of each new file name with the one of
+	// the file's actual type, if they differ, e.g. a HEIC named .jpg
+	// becomes .heic.
+	FixExt bool
+	ExtMap map[string]string
+	// DateOnlyNames names files whose creation time is DateOnly after their
+	// date and an ordinal e.g. 2003-06-15_0001 in the Timestamp template
+	// field, instead of a time of day they were never given.
+	DateOnlyNames bool
+	// ordinals maps destination directories and dates to the last ordinal
+	// given out for them by DateOnlyNames or DailyIndex.
+	ordinalsMutex sync.Mutex
+	ordinals      map[string]int
+	// dailyIndexed is set if NameTemplate uses DailyIndex, in which case the
+	// new paths are only worked out once every file has been read.
+	dailyIndexed bool
+	// IgnoreCreationTime moves files whose creation time can't be
+	// determined all the same, for templates that don't use it.
+	IgnoreCreationTime bool
+	// CreatedBefore, if set, leaves files created at or after it (or whose
+	// creation time is unknown) where they are.
+	CreatedBefore time.Time
+	// RecordOriginal writes the name of each file whose name changes into
+	// its XMP-xmpMM:PreservedFileName tag, unless an earlier rename already
+	// did.
+	RecordOriginal bool
+	// Plan works out the new path of every file before moving any, and
+	// moves nothing if two or more files would end up with the same new
+	// path. It holds the whole plan in memory, unlike a normal run.
+	Plan bool
+	// MergeSimilarDirs moves files into an existing directory whose name
+	// only differs from the destination directory's name in case or
+	// surrounding white space, instead of creating a near-duplicate.
+	MergeSimilarDirs bool
+	// OnResult, if set, is called with the Result of every file as soon as
+	// it is known. It is called concurrently from multiple workers.
+	OnResult func(Result)
+	Stdout   io.Writer
+	Stderr   io.Writer
+	logger   *slog.Logger
+	// settle, if set by watch, holds back files that are still changing
+	// until a later run.
+	settle *settleTracker
+	// placed, if set by partition, reports whether a file's path shows it
+	// is already where it belongs, so that it can be skipped without
+	// reading its metadata.
+	placed func(filePath string) bool
+	// fsys, if set, is the filesystem renameInto moves files in, in place of
+	// the operating system's.
+	fsys fileSystem
+}
+
+func MoveCommand(args []string) (*MoveCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	moveCmd := &MoveCmd{
+		FileSelector: fileSelector,
+		NameTemplate: template.Must(newMoveTemplate("{{.Name}}")),
+		MonthNames:   localeMonthNames["en"],
+		MediaTypes:   defaultMediaTypes,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	moveCmd.FileSelector.RegisterFlags(flagset)
+	moveCmd.FilePermissions.RegisterFlags(flagset)
+	moveCmd.RetryPolicy.RegisterFlags(flagset)
+	moveCmd.MoveOptions.RegisterFlags(flagset)
+	flagset.Func("month-names", "Month names for {{.MonthName}} and {{.Strftime \"%B\"}}: locale:xx (e.g. locale:de) or 12 comma separated names (default locale:en).", func(value string) error {
+		monthNames, err := parseMonthNames(value)
+		if err != nil {
+			return err
+		}
+		moveCmd.MonthNames = monthNames
+		return nil
+	})
+	flagset.Func("day-boundary", "Time of day at which a day starts for {{.DayFormat}} e.g. 04:00 to count photos taken after midnight as the evening before's. (default 00:00)", func(value string) error {
+		dayBoundary, err := parseDayBoundary(value)
+		if err != nil {
+			return err
+		}
+		moveCmd.DayBoundary = dayBoundary
+		return nil
+	})
+	mediaTypesSet := false
+	flagset.Func("media-type", "Rule giving {{.MediaType}} the value NAME for files matching any of a comma separated list of extensions and MIME type patterns e.g. 'videos=video/*,lrv' or 'raw=cr2,nef,arw'. MIME types are told by exiftool from the file contents. Can be repeated, the first matching rule wins, and files matching none get an empty {{.MediaType}}. (default photos=image/* and videos=video/*)", func(value string) error {
+		rule, err := parseMediaTypeRule(value)
+		if err != nil {
+			return err
+		}
+		if !mediaTypesSet {
+			moveCmd.MediaTypes = nil
+			mediaTypesSet = true
+		}
+		moveCmd.MediaTypes = append(moveCmd.MediaTypes, rule)
+		return nil
+	})
+	flagset.BoolVar(&moveCmd.Plan, "plan", false, "Work out the new path of every file before moving any, and move nothing if two or more files would get the same new path.")
+	flagset.BoolVar(&moveCmd.DateOnlyNames, "date-only-names", false, "Give files whose creation time is a date at exactly midnight, as scanners write for everything they scan, the date and an ordinal e.g. 2003-06-15_0001 for {{.Timestamp}} instead of a made-up time of day.")
+	flagset.Func("to", "Destination directory template e.g. '/archive/{{.Year}}/{{.Month}}/{{.Model}}', which may start with an rclone remote as rclone://REMOTE/PATH e.g. 'rclone://b2/archive/{{.Year}}' or an S3 bucket as s3://BUCKET/PREFIX e.g. 's3://photos/archive/{{.Year}}'. Required.", func(value string) error {
+		value, err := moveCmd.FileSelector.localPath(value)
+		if err != nil {
+			return err
+		}
+		t, err := newMoveTemplate(value)
+		if err != nil {
+			return err
+		}
+		moveCmd.DirTemplate = t
+		return nil
+	})
+	flagset.Func("replica-to", "Directory template like -to that each file is also copied to under its new name, e.g. an external drive alongside a NAS. Each copy is checked against the original's SHA-256, and the file is only moved once every copy is good. Can be repeated.", func(value string) error {
+		value, err := moveCmd.FileSelector.localPath(value)
+		if err != nil {
+			return err
+		}
+		t, err := newMoveTemplate(value)
+		if err != nil {
+			return err
+		}
+		moveCmd.ReplicaTemplates = append(moveCmd.ReplicaTemplates, t)
+		return nil
+	})
+	flagset.Func("name", "Destination file name template e.g. '{{.Timestamp}}{{.Ext}}' or '{{.Date}}_{{.DailyIndex}}{{.Ext}}' (default '{{.Name}}').", func(value string) error {
+		t, err := newMoveTemplate(value)
+		if err != nil {
+			return err
+		}
+		moveCmd.NameTemplate = t
+		return nil
+	})
+	flagset.BoolVar(&moveCmd.RecordOriginal, "record-original-name", false, "Write the name each renamed file had before its first rename into its XMP-xmpMM:PreservedFileName tag with exiftool, so that it travels with the file. A name already recorded by an earlier rename is kept.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if moveCmd.DirTemplate == nil {
+		return nil, fmt.Errorf("-to is required")
+	}
+	err = moveCmd.MoveOptions.setDefaults()
+	if err != nil {
+		return nil, err
+	}
+	err = moveCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	moveCmd.logger = newLogger(moveCmd.Stdout, moveCmd.Verbose)
+	return moveCmd, nil
+}
+
+// MoveOptions are the options move shares with the subcommands built on it,
+// rename and partition. They embed it so that the options behave the same
+// in all three.
+type MoveOptions struct {
+	NumWorkers int
+	// NumMoveWorkers, if non-zero, is the number of workers moving files,
+	// separate from the NumWorkers reading their metadata, so that slow
+	// destination storage doesn't leave the exiftool sessions idle and vice
+	// versa.
+	NumMoveWorkers int
+	// PinDirs sends every file in a directory to the same worker, and with
+	// NumMoveWorkers every file moved into a directory to the same move
+	// worker, so that each directory is read, created and written to by one
+	// worker at a time and its files are reported in the order they were
+	// walked. The number of workers is not auto-tuned.
+	PinDirs bool
+	// MaxPending is the number of files the walker may queue up ahead of
+	// the workers. It bounds memory use regardless of the size of the tree.
+	MaxPending     int
+	Timeout        time.Duration
+	Charset        string
+	ExifToolConfig string
+	ExifToolArgs   []string
+	// ExtHandlers configure how files are treated by their extension. They
+	// default to those of extensions.json in the user config directory.
+	ExtHandlers     map[string]extHandler
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	ClockOffsets    []clockOffsetRule
+	TimeZone        *time.Location
+	AmbiguousTime   string
+	// ModTimeOnly takes the creation time of every file from its
+	// modification time, without running exiftool at all.
+	ModTimeOnly bool
+	// DirDatePatterns, if set, give files whose metadata has no creation
+	// time the date in the name of their directory. WriteDirDates writes
+	// that date into their DateTimeOriginal as well.
+	DirDatePatterns []*regexp.Regexp
+	WriteDirDates   bool
+	MinAge          time.Duration
+	StableFor       time.Duration
+	OnParseError    string
+	Report          string
+	// Manifest, if set, is where to write a manifest of the files moved or
+	// already in place.
+	Manifest string
+	// DigiKamSQL, if set, is where to write the SQL that updates the digiKam
+	// database of the collection at DigiKamRoot for the files moved.
+	DigiKamSQL  string
+	DigiKamRoot string
+	// Announce, if set, is the Immich or PhotoPrism server told to rescan
+	// the directories files were moved out of and into at the end of the
+	// run, as immich=URL or photoprism=URL. AnnounceRoot is the directory
+	// PhotoPrism indexes, and AnnounceToken its access token or Immich's
+	// API key.
+	Announce      string
+	AnnounceRoot  string
+	AnnounceToken string
+	// ArchiveDirs, if set, are directories whose files are looked up by
+	// contents before each file is moved, skipping the files already in
+	// them under whatever name.
+	ArchiveDirs []string
+	// HashAlgorithm is the algorithm files are hashed with to be looked up
+	// in ArchiveDirs, sha256 if empty.
+	HashAlgorithm string
+	// SkipList skips the files on the skip list in the user cache directory,
+	// and adds the files whose creation time can't be determined to it.
+	SkipList bool
+	// AutoRotate losslessly rotates JPEGs according to their Orientation
+	// tag once they are moved, for tools that ignore it.
+	AutoRotate bool
+	// ExtractVideos writes the video embedded in motion photos and
+	// .livp files next to their new path, under the same name.
+	ExtractVideos bool
+	// CameraSuffix tells apart files that would get the same new path, like
+	// photos taken at the same instant by two cameras, by adding a hash
+	// identifying the camera to the name of the file that would collide.
+	CameraSuffix bool
+	// MetricsAddr, if set, is the address to serve Prometheus metrics on
+	// for the duration of the run.
+	MetricsAddr string
+	// QuarantineDir, if set, is where files whose creation time could not be
+	// determined are moved to (or symlinked into, if QuarantineSymlink is
+	// set) so that they can be reviewed by hand.
+	QuarantineDir     string
+	QuarantineSymlink bool
+	Verbose           bool
+	DryRun            bool
+	Force             bool
+	NoLock            bool
+	ReplaceIfExists   bool
+	// PreviewTree prints the directories files would end up in as a tree
+	// instead of a line per file. It implies DryRun.
+	PreviewTree bool
+	// MaxNameLength and MaxPathLength, if non-zero, are the maximum lengths
+	// in bytes of a new file name and path. LongNames is what happens to new
+	// paths exceeding them: skip or truncate.
+	MaxNameLength int
+	MaxPathLength int
+	LongNames     string
+	// NormalizeNames is the Unicode normalization form, nfc or nfd, that new
+	// paths are put in. Existing files and directories whose names only
+	// differ from a new path in their normalization form are reused rather
+	// than duplicated.
+	NormalizeNames string
+	// CheckFreeSpace, if set, works out the new path of every file before
+	// moving any as -plan does, and checks that each destination filesystem
+	// has the free space for the files moved onto it from other
+	// filesystems. If one doesn't, it is abort (move nothing) or warn.
+	CheckFreeSpace string
+	// Durable makes every move fsync the file and the directories involved
+	// before moving on to the next file.
+	Durable bool
+	// OnSuccessExec is the command run after each successful move, one
+	// template per argument. Each template is evaluated against hookData.
+	OnSuccessExec []*template.Template
+	// WebhookURL, if set, is sent a POST request with the JSON encoded
+	// hookData of each successful move.
+	WebhookURL string
+}
+
+// RegisterFlags adds the flags of every option to flagset, and sets the
+// defaults of the options whose flags don't.
+func (options *MoveOptions) RegisterFlags(flagset *flag.FlagSet) {
+	options.ExifToolArgs = defaultReadArgs
+	options.AmbiguousTime = "earlier"
+	options.OnParseError = "skip"
+	options.LongNames = "skip"
+	flagset.IntVar(&options.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means auto-tune based on the number of CPUs and measured throughput.")
+	flagset.IntVar(&options.NumMoveWorkers, "num-move-workers", 0, "Number of concurrent workers moving files, separately from the -num-workers reading metadata. 0 means the workers reading metadata move the files themselves.")
+	flagset.BoolVar(&options.PinDirs, "pin-dirs", false, "Give all the files in a directory to the same worker, and with -num-move-workers all the files moved into a directory to the same move worker, for better use of the filesystem's caches and the files of each directory in walk order in -report. A directory much larger than the rest leaves the other workers idle. -num-workers 0 means one per CPU, without auto-tuning.")
+	flagset.IntVar(&options.MaxPending, "max-pending", defaultMaxPending, "Maximum number of files queued up ahead of the workers.")
+	flagset.DurationVar(&options.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&options.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		options.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		options.ExifToolArgs = args
+		return nil
+	})
+	flagset.Func("ext-config", "JSON file configuring how files are treated by their extension, in place of extensions.json in the user config directory e.g. {\"xmp\": {\"sidecar\": true}, \"png\": {\"extractor\": \"mtime\"}, \"raf\": {\"dateSources\": [\"CreateDate\"]}, \"tmp\": {\"skip\": true}}.", func(value string) error {
+		extHandlers, err := parseExtConfig(value)
+		if err != nil {
+			return err
+		}
+		options.ExtHandlers = extHandlers
+		return nil
+	})
+	flagset.BoolVar(&options.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins. Use mtime to skip exiftool entirely and take every file's modification time instead.", func(value string) error {
+		if value == "mtime" {
+			options.ModTimeOnly = true
+			return nil
+		}
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		options.DateSourceRules = append(options.DateSourceRules, rule)
+		return nil
+	})
+	flagset.Func("clock-offset", "Amount to add to the creation times of files from cameras whose model or serial number matches a regex, to line up cameras whose clocks were off when merging them e.g. 'ILCE-7M3=-1m30s' or '^0123456$=+1h'. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseClockOffsetRule(value)
+		if err != nil {
+			return err
+		}
+		options.ClockOffsets = append(options.ClockOffsets, rule)
+		return nil
+	})
+	flagset.Func("time-zone", "Time zone e.g. Europe/Berlin to place creation times without a UTC offset in, which are otherwise taken to be in UTC. Offsets the files record themselves (OffsetTimeOriginal, TimeZone) take precedence.", func(value string) error {
+		location, err := time.LoadLocation(value)
+		if err != nil {
+			return err
+		}
+		options.TimeZone = location
+		return nil
+	})
+	flagset.Func("ambiguous-time", "What to do with a creation time that a daylight saving time change in -time-zone made ambiguous (or skipped over): earlier (the default) or later to take the earlier or later of the instants it could be, or skip. Files given either are marked in -report.", func(value string) error {
+		switch value {
+		case "earlier", "later", "skip":
+			options.AmbiguousTime = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be earlier, later or skip", value)
+	})
+	flagset.DurationVar(&options.MinAge, "min-age", 0, "Skip files modified less than this long ago, as they may still be being written to.")
+	flagset.DurationVar(&options.StableFor, "stable-for", 0, "Skip files whose size changes over this interval, as they may still be being written to.")
+	flagset.BoolVar(&options.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&options.DryRun, "dry-run", false, "Print the moves that would be made without executing them.")
+	flagset.BoolVar(&options.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&options.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	flagset.BoolVar(&options.PreviewTree, "preview-tree", false, "Instead of a line per file, print the tree of directories the files would end up in, with the number of files each would get and which directories would be created. Implies -dry-run.")
+	flagset.IntVar(&options.MaxNameLength, "max-name", 255, "Maximum length in bytes of a new file name, which most filesystems limit to 255. 0 means no limit.")
+	flagset.IntVar(&options.MaxPathLength, "max-path", 0, "Maximum length in bytes of a new file path e.g. 260 for tools limited to Windows' MAX_PATH, or 1024 for some SMB servers. 0 means no limit.")
+	flagset.Func("long-names", "What to do with a new path longer than -max-name or -max-path: skip (the default) or truncate (shorten its name, keeping the extension and adding a hash of the full name so that shortened names stay unique).", func(value string) error {
+		switch value {
+		case "skip", "truncate":
+			options.LongNames = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be skip or truncate", value)
+	})
+	flagset.Func("normalize-names", "Unicode normalization form to give new paths: nfc (as Linux and Windows usually write names) or nfd (as older macOS file systems do). Existing files and directories whose names only differ in form are reused instead of duplicated.", func(value string) error {
+		switch value {
+		case "nfc", "nfd":
+			options.NormalizeNames = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be nfc or nfd", value)
+	})
+	flagset.Func("check-free-space", "Before moving anything, add up the bytes to be moved onto each filesystem from other filesystems (like a date directory that is a mount or a symlink to another drive) and, if one of them lacks the free space, abort without moving anything or warn and carry on. Holds the whole plan in memory, as -plan does.", func(value string) error {
+		switch value {
+		case "abort", "warn":
+			options.CheckFreeSpace = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be abort or warn", value)
+	})
+	flagset.BoolVar(&options.Durable, "durable", false, "Fsync each moved file and its directories so that moves survive a power loss. Slower.")
+	flagset.BoolVar(&options.ReplaceIfExists, "replace-if-exists", false, "If a file with the new path already exists, replace it, moving the replaced file into a .exifutil-trash directory next to it (see exifutil trash).")
+	flagset.Func("on-success-exec", "Command to run after each file is moved e.g. 'indexer add {{.NewPath}}'. Arguments are split on spaces and each one is a template with the fields OldPath, NewPath, CreationTime and CreationTimeSource.", func(value string) error {
+		templates, err := newHookTemplates(value)
+		if err != nil {
+			return err
+		}
+		options.OnSuccessExec = templates
+		return nil
+	})
+	flagset.StringVar(&options.WebhookURL, "webhook-url", "", "URL to POST a JSON object with the fields OldPath, NewPath, CreationTime and CreationTimeSource to after each file is moved.")
+	flagset.StringVar(&options.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. localhost:9101) while running.")
+	flagset.StringVar(&options.Report, "report", "", "Write a record of every operation to this CSV file (or TSV, if it ends in .tsv).")
+	flagset.StringVar(&options.Manifest, "manifest", "", "After the run, write the SHA-256 of every file moved or already in place to this file, in the format of sha256sum so that sha256sum -c can check it later for bit rot. If it ends in .csv or .tsv, it has the creation time of every file as well.")
+	flagset.StringVar(&options.DigiKamSQL, "digikam-sql", "", "Write SQL that updates a digiKam database for every file moved to this file, to run with e.g. 'sqlite3 digikam4.db < FILE' while digiKam is closed. Requires -digikam-root.")
+	flagset.StringVar(&options.DigiKamRoot, "digikam-root", "", "Directory of the digiKam collection the files are in, as added under Settings > Collections.")
+	flagset.Func("announce", "Tell an Immich or PhotoPrism server to rescan the directories files were moved out of and into at the end of the run: immich=URL with the URL of the external library e.g. https://immich.example.com/api/libraries/ID, or photoprism=URL with the URL of the server, which needs -announce-root.", func(value string) error {
+		_, _, err := parseAnnounce(value)
+		if err != nil {
+			return err
+		}
+		options.Announce = value
+		return nil
+	})
+	flagset.StringVar(&options.AnnounceRoot, "announce-root", "", "Directory PhotoPrism indexes as its originals, as seen from this machine.")
+	flagset.StringVar(&options.AnnounceToken, "announce-token", "", "Immich API key or PhotoPrism access token for -announce. (default $EXIFUTIL_ANNOUNCE_TOKEN)")
+	flagset.Func("skip-archived", "Skip files whose contents are already somewhere under this directory, under any name, e.g. the archive an SD card is being imported into for the second time. Can be repeated.", func(value string) error {
+		dir, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		options.ArchiveDirs = append(options.ArchiveDirs, dir)
+		return nil
+	})
+	flagset.Func("hash-algorithm", "Hash algorithm used to look files up in -skip-archived: sha256 hashes each file on a single CPU, giving the same hashes as sha256sum, and sha256-tree hashes the chunks of large files on every CPU at once, to keep up with fast drives, giving hashes of large files that no other tool does. exifutil bench measures both on a sample of the files. (default sha256)", func(value string) error {
+		algorithm, err := parseHashAlgorithm(value)
+		if err != nil {
+			return err
+		}
+		options.HashAlgorithm = algorithm
+		return nil
+	})
+	flagset.BoolVar(&options.ExtractVideos, "extract-motion-video", false, "Write the video embedded in motion photos (Samsung and Google JPEG or HEIC) and .livp Live Photos next to each moved file under the same name, e.g. 2021-06-01_120000.mp4 next to 2021-06-01_120000.jpg. The photo itself is left intact.")
+	flagset.BoolVar(&options.CameraSuffix, "camera-suffix", false, "When a new path is already taken by a different file, such as a photo taken at the same instant by a second camera, add a short hash of the camera's make, model and serial number e.g. _3fa9c1 before the extension instead of skipping the file. With -plan, files colliding with each other are told apart in the same way, whatever order they are read in.")
+	flagset.BoolVar(&options.AutoRotate, "auto-rotate", false, "Losslessly rotate JPEGs according to their EXIF Orientation with jpegtran once they are moved, along with their -replica-to copies, keeping their color profile and other metadata, and reset the Orientation to normal, for tools that ignore it. JPEGs whose dimensions don't allow a perfect lossless rotation are left as they are.")
+	flagset.BoolVar(&options.SkipList, "skip-list", false, "Remember files whose creation time could not be determined by their contents, and skip them in later runs instead of reading them again. See exifutil skiplist.")
+	flagset.Func("quarantine-dir", "Move files whose metadata could not be read or parsed into this directory for manual review.", func(value string) error {
+		quarantineDir, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		options.QuarantineDir = quarantineDir
+		return nil
+	})
+	flagset.BoolVar(&options.QuarantineSymlink, "quarantine-symlink", false, "Symlink files into -quarantine-dir instead of moving them.")
+	flagset.BoolFunc("dir-dates", "Give files whose metadata has no creation time (like scanned film) the date at the start of the name of the nearest directory containing them, e.g. '2001-07-14 Wedding', '2001-07 Italy' or '1998 Summer'. Files in the same directory are spaced a second apart in name order.", func(value string) error {
+		dirDates, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if !dirDates {
+			options.DirDatePatterns = nil
+		} else if len(options.DirDatePatterns) == 0 {
+			options.DirDatePatterns = defaultDirDatePatterns
+		}
+		return nil
+	})
+	flagset.Func("dir-date-pattern", "Like -dir-dates, but with a regex matched against directory names in place of the default patterns. It must capture the year in a group named year, and may capture the month and day in groups named month and day e.g. '^(?P<day>\\d{2})\\.(?P<month>\\d{2})\\.(?P<year>\\d{4})'. Can be repeated, the first matching pattern wins.", func(value string) error {
+		pattern, err := parseDirDatePattern(value)
+		if err != nil {
+			return err
+		}
+		if slices.Equal(options.DirDatePatterns, defaultDirDatePatterns) {
+			options.DirDatePatterns = nil
+		}
+		options.DirDatePatterns = append(options.DirDatePatterns, pattern)
+		return nil
+	})
+	flagset.BoolVar(&options.WriteDirDates, "write-dir-dates", false, "Also write dates inferred by -dir-dates or -dir-date-pattern into each file's DateTimeOriginal.")
+	flagset.Func("on-parse-error", "What to do when a file's creation time cannot be determined: skip (the default), strict (abort the run) or fallback (use the file's modification time).", func(value string) error {
+		switch value {
+		case "skip", "strict", "fallback":
+			options.OnParseError = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be skip, strict or fallback", value)
+	})
+}
+
+// setDefaults fills in, once the flags have been parsed, the options whose
+// defaults depend on other options or on the environment.
+func (options *MoveOptions) setDefaults() error {
+	if options.PreviewTree {
+		options.DryRun = true
+	}
+	if options.Announce != "" && options.AnnounceToken == "" {
+		options.AnnounceToken = os.Getenv("EXIFUTIL_ANNOUNCE_TOKEN")
+	}
+	if options.ExtHandlers == nil {
+		extHandlers, err := defaultExtConfig()
+		if err != nil {
+			return err
+		}
+		options.ExtHandlers = extHandlers
+	}
+	return nil
+}
+
+func (moveCmd *MoveCmd) Run(ctx context.Context) error {
+	unmount, err := moveCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if !moveCmd.DryRun {
+		err := moveCmd.CheckSafety(moveCmd.Force, moveCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if !moveCmd.DryRun && !moveCmd.NoLock {
+		unlock, err := moveCmd.Lock(moveCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var cache *exifCache
+	if !moveCmd.NoCache && !moveCmd.ModTimeOnly {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			moveCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	if moveCmd.MaxPending < 0 {
+		return fmt.Errorf("-max-pending must not be negative")
+	}
+	if moveCmd.NumMoveWorkers < 0 {
+		return fmt.Errorf("-num-move-workers must not be negative")
+	}
+	if moveCmd.ModTimeOnly && moveCmd.Where != nil {
+		return fmt.Errorf("-where needs file metadata and cannot be combined with -date-source mtime")
+	}
+	if moveCmd.ModTimeOnly && moveCmd.AutoRotate {
+		return fmt.Errorf("-auto-rotate needs file metadata and cannot be combined with -date-source mtime")
+	}
+	if moveCmd.ModTimeOnly && moveCmd.usesMIMEType() {
+		return fmt.Errorf("-media-type MIME types need file metadata and cannot be combined with -date-source mtime, give extensions instead")
+	}
+	uses := walkTemplates(moveCmd.templates()...)
+	if moveCmd.ModTimeOnly && (uses.UsesField("FileNumber") || uses.UsesField("ShutterCount")) {
+		return fmt.Errorf("{{.FileNumber}} and {{.ShutterCount}} need file metadata and cannot be combined with -date-source mtime")
+	}
+	if moveCmd.ModTimeOnly && len(uses.Tags) > 0 {
+		return fmt.Errorf("{{.Tag}} in templates needs file metadata and cannot be combined with -date-source mtime")
+	}
+	if walkTemplates(append([]*template.Template{moveCmd.DirTemplate}, moveCmd.ReplicaTemplates...)...).UsesField("DailyIndex") {
+		return fmt.Errorf("{{.DailyIndex}} can only be used in the file name")
+	}
+	moveCmd.dailyIndexed = walkTemplates(moveCmd.NameTemplate).UsesField("DailyIndex")
+	var waitGroup sync.WaitGroup
+	var numProcessed atomic.Int64
+	var lastProcessed atomic.Value
+	var numWorkersAlive atomic.Int64
+	// numRetries counts the filesystem operations retried after transient
+	// errors.
+	var numRetries atomic.Int64
+	// Only the first few skipped files are remembered for the summary at the
+	// end, so that a run over millions of unparseable files doesn't hold on
+	// to all their paths. The report has the full list.
+	var skippedMutex sync.Mutex
+	var skipped []string
+	var numSkipped int
+	skip := func(filePath string) {
+		skippedMutex.Lock()
+		defer skippedMutex.Unlock()
+		numSkipped++
+		if len(skipped) < maxSkippedListed {
+			skipped = append(skipped, filePath)
+		}
+	}
+	// similarDirs caches the directory each destination directory resolves
+	// to when MergeSimilarDirs is set.
+	var similarDirsMutex sync.Mutex
+	similarDirs := make(map[string]string)
+	// listings are the directories of the files walked, listed before any
+	// of their files are moved, for -dir-dates.
+	listings := &dirListings{}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var report *reportWriter
+	if moveCmd.Report != "" {
+		var err error
+		report, err = newReportWriter(moveCmd.Report)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := report.Close()
+			if err != nil {
+				moveCmd.logger.Error(err.Error(), slog.String("report", moveCmd.Report))
+			}
+		}()
+	}
+	var manifest *manifestWriter
+	if moveCmd.Manifest != "" && !moveCmd.DryRun {
+		var err error
+		manifest, err = newManifestWriter(moveCmd.Manifest)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := manifest.Close()
+			if err != nil {
+				moveCmd.logger.Error(err.Error(), slog.String("manifest", moveCmd.Manifest))
+			}
+		}()
+	}
+	var digiKam *digiKamWriter
+	if moveCmd.DigiKamSQL != "" && !moveCmd.DryRun {
+		if moveCmd.DigiKamRoot == "" {
+			return fmt.Errorf("-digikam-sql needs -digikam-root")
+		}
+		var err error
+		digiKam, err = newDigiKamWriter(moveCmd.DigiKamSQL, moveCmd.DigiKamRoot)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := digiKam.Close()
+			if err != nil {
+				moveCmd.logger.Error(err.Error(), slog.String("digikamSQL", moveCmd.DigiKamSQL))
+			}
+		}()
+	}
+	var announce *announcer
+	if moveCmd.Announce != "" && !moveCmd.DryRun {
+		var err error
+		announce, err = newAnnouncer(moveCmd.Announce, moveCmd.AnnounceRoot, moveCmd.AnnounceToken)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// Files moved before an interrupt still have to be announced.
+			err := announce.Announce(context.WithoutCancel(ctx))
+			if err != nil {
+				moveCmd.logger.Error(err.Error(), slog.String("announce", moveCmd.Announce))
+			}
+		}()
+	}
+	var archive *archiveIndex
+	if len(moveCmd.ArchiveDirs) > 0 {
+		var err error
+		archive, err = newArchiveIndex(ctx, moveCmd.ArchiveDirs, moveCmd.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+	}
+	var skips *skipList
+	if moveCmd.SkipList {
+		var err error
+		skips, err = openSkipList()
+		if err != nil {
+			return err
+		}
+	}
+	filePaths := make(chan string, moveCmd.MaxPending)
+	var metrics *runMetrics
+	if moveCmd.MetricsAddr != "" {
+		metrics = &runMetrics{
+			numProcessed: &numProcessed,
+			numWorkers:   &numWorkersAlive,
+			queueDepth:   func() int { return len(filePaths) },
+		}
+		stopMetrics, err := serveMetrics(moveCmd.logger, moveCmd.MetricsAddr, metrics)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+	progress := newProgressTracker(&numProcessed, func() int { return len(filePaths) })
+	// record writes the outcome of an operation to the report, metrics,
+	// manifest and digiKam SQL, and passes it on to OnResult.
+	record := func(filePath, newFilePath string, exif Exif, status string, err error) {
+		report.Write(filePath, newFilePath, exif, status)
+		if moveCmd.OnResult != nil {
+			moveCmd.OnResult(Result{Path: filePath, NewPath: newFilePath, Action: status, Err: err, Exif: exif})
+		}
+		metrics.Count(status)
+		progress.Count(status)
+		if status == "moved" || status == "unchanged" {
+			err := manifest.Add(newFilePath, exif)
+			if err != nil {
+				moveCmd.logger.Error(err.Error(), slog.String("manifest", moveCmd.Manifest))
+			}
+		}
+		if status == "moved" {
+			archive.Add(newFilePath)
+			err := digiKam.Add(filePath, newFilePath)
+			if err != nil {
+				moveCmd.logger.Error(err.Error(), slog.String("digikamSQL", moveCmd.DigiKamSQL))
+			}
+			announce.Add(filePath, newFilePath)
+		}
+	}
+	dryRun := newDryRunSummary()
+	var dirLocks keyedMutex
+	// execute moves filePath and its companion files to newFilePath, or
+	// prints what it would do if DryRun is set.
+	execute := func(logger *slog.Logger, filePath, newFilePath string, exif Exif) {
+		companionFiles := fileCompanions(filePath, moveCmd.ExtHandlers)
+		if moveCmd.DryRun {
+			// The tree is printed at the end in place of the lines.
+			stdout := moveCmd.Stdout
+			if moveCmd.PreviewTree {
+				stdout = io.Discard
+			}
+			b, err := json.Marshal(exif)
+			if err != nil {
+				logger.Warn(err.Error())
+			}
+			fmt.Fprintf(stdout, "%s => %s %s\n", filePath, newFilePath, string(b))
+			record(filePath, newFilePath, exif, "dry-run", nil)
+			replicaPaths, err := moveCmd.replicaFilePaths(filePath, newFilePath, exif)
+			if err != nil {
+				logger.Warn(err.Error())
+			}
+			if moveCmd.ExtractVideos && hasMotionVideo(exif) {
+				ext, ok, err := motionVideoExt(filePath)
+				if err != nil {
+					logger.Warn(err.Error())
+				} else if ok {
+					fmt.Fprintf(stdout, "%s => %s (video)\n", filePath, strings.TrimSuffix(newFilePath, filepath.Ext(newFilePath))+ext)
+				}
+			}
+			for _, replicaPath := range replicaPaths {
+				fmt.Fprintf(stdout, "%s => %s (copy)\n", filePath, replicaPath)
+				for _, companionFile := range companionFiles {
+					fmt.Fprintf(stdout, "%s => %s (copy)\n", companionFile.FilePath, newCompanionFilePath(filePath, replicaPath, companionFile))
+				}
+			}
+			err = dryRun.Add(filePath, newFilePath)
+			if err != nil {
+				logger.Warn(err.Error())
+			}
+			for _, companionFile := range companionFiles {
+				newCompanionPath := newCompanionFilePath(filePath, newFilePath, companionFile)
+				fmt.Fprintf(stdout, "%s => %s\n", companionFile.FilePath, newCompanionPath)
+				record(companionFile.FilePath, newCompanionPath, exif, "dry-run", nil)
+				err := dryRun.Add(companionFile.FilePath, newCompanionPath)
+				if err != nil {
+					logger.Warn(err.Error())
+				}
+			}
+			return
+		}
+		replicaPaths, err := moveCmd.replicaFilePaths(filePath, newFilePath, exif)
+		if err != nil {
+			logger.Error(err.Error())
+			record(filePath, newFilePath, exif, "failed", err)
+			return
+		}
+		// The file is only moved once every replica is known to be good,
+		// so that a failed copy leaves it where it can be copied again.
+		err = moveCmd.replicate(ctx, logger, &dirLocks, filePath, replicaPaths)
+		if err != nil {
+			logger.Error(err.Error())
+			record(filePath, newFilePath, exif, "failed", err)
+			return
+		}
+		err = moveCmd.renameInto(ctx, logger, &dirLocks, &numRetries, filePath, newFilePath)
+		if err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("newFilePath", newFilePath))
+				record(filePath, newFilePath, exif, "exists", err)
+				return
+			}
+			logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+			record(filePath, newFilePath, exif, "failed", err)
+			return
+		}
+		// The file and its replicas are rotated where they end up, so that
+		// the original is left untouched if it can't be moved.
+		if moveCmd.AutoRotate && exif.FileTypeExtension == "jpg" {
+			orientation := whereString(exif.Tags["Orientation"])
+			for _, rotatePath := range append([]string{newFilePath}, replicaPaths...) {
+				rotated, err := rotateJPEG(ctx, rotatePath, orientation, moveCmd.Charset)
+				if err != nil {
+					if ctx.Err() != nil {
+						break
+					}
+					logger.Warn("not rotating file: "+err.Error(), slog.String("newFilePath", rotatePath))
+				} else if rotated {
+					logger.Info("rotated file", slog.String("newFilePath", rotatePath), slog.String("orientation", orientation))
+				}
+			}
+		}
+		// Likewise the original name is only recorded once the file has
+		// been renamed, as a file that fails to move still has it.
+		if moveCmd.RecordOriginal && filepath.Base(newFilePath) != filepath.Base(filePath) {
+			for _, recordPath := range append([]string{newFilePath}, replicaPaths...) {
+				err := recordOriginalName(ctx, recordPath, filepath.Base(filePath), moveCmd.Charset)
+				if err != nil {
+					if ctx.Err() != nil {
+						break
+					}
+					logger.Warn("not recording original name: "+err.Error(), slog.String("newFilePath", recordPath))
+				}
+			}
+		}
+		err = moveCmd.Apply(newFilePath)
+		if err != nil {
+			logger.Warn(err.Error(), slog.String("newFilePath", newFilePath))
+		}
+		if moveCmd.Durable {
+			err := syncMove(filePath, newFilePath)
+			if err != nil {
+				logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+			}
+		}
+		logger.Info("moved file", slog.String("newFilePath", newFilePath))
+		record(filePath, newFilePath, exif, "moved", nil)
+		moveCmd.runHooks(ctx, logger, hookData{
+			OldPath:            filePath,
+			NewPath:            newFilePath,
+			CreationTime:       exif.CreationTime,
+			CreationTimeSource: exif.CreationTimeSource,
+		})
+		if moveCmd.ExtractVideos && hasMotionVideo(exif) {
+			moveCmd.extractMotionVideo(logger, newFilePath)
+		}
+		for _, companionFile := range companionFiles {
+			newCompanionPath := newCompanionFilePath(filePath, newFilePath, companionFile)
+			var companionReplicaPaths []string
+			for _, replicaPath := range replicaPaths {
+				companionReplicaPaths = append(companionReplicaPaths, newCompanionFilePath(filePath, replicaPath, companionFile))
+			}
+			err := moveCmd.replicate(ctx, logger, &dirLocks, companionFile.FilePath, companionReplicaPaths)
+			if err != nil {
+				logger.Error(err.Error(), slog.String("companionFilePath", companionFile.FilePath))
+				record(companionFile.FilePath, newCompanionPath, exif, "failed", err)
+				continue
+			}
+			err = moveCmd.renameInto(ctx, logger, &dirLocks, &numRetries, companionFile.FilePath, newCompanionPath)
+			if err != nil {
+				if errors.Is(err, fs.ErrExist) {
+					logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("newFilePath", newCompanionPath))
+					record(companionFile.FilePath, newCompanionPath, exif, "exists", err)
+					continue
+				}
+				logger.Error(err.Error(), slog.String("newFilePath", newCompanionPath))
+				record(companionFile.FilePath, newCompanionPath, exif, "failed", err)
+				continue
+			}
+			err = moveCmd.Apply(newCompanionPath)
+			if err != nil {
+				logger.Warn(err.Error(), slog.String("newFilePath", newCompanionPath))
+			}
+			if moveCmd.Durable {
+				err := syncMove(companionFile.FilePath, newCompanionPath)
+				if err != nil {
+					logger.Error(err.Error(), slog.String("newFilePath", newCompanionPath))
+				}
+			}
+			logger.Info("moved file", slog.String("companionFilePath", companionFile.FilePath), slog.String("newFilePath", newCompanionPath))
+			record(companionFile.FilePath, newCompanionPath, exif, "moved", nil)
+			moveCmd.runHooks(ctx, logger, hookData{
+				OldPath:            companionFile.FilePath,
+				NewPath:            newCompanionPath,
+				CreationTime:       exif.CreationTime,
+				CreationTimeSource: exif.CreationTimeSource,
+			})
+		}
+	}
+	// With Plan set, the workers only work out where each file would go, and
+	// the moves are executed once the plan is known to be free of conflicts.
+	// Daily indexes are given out in order of creation time, so with
+	// dailyIndexed set the workers only read the files and the plan is
+	// worked out once they are done.
+	planning := moveCmd.Plan || moveCmd.dailyIndexed || moveCmd.CheckFreeSpace != ""
+	// claimed holds the new paths given out by place for CameraSuffix,
+	// whose files may not have been moved there yet.
+	var claimedMutex sync.Mutex
+	claimed := make(map[string]bool)
+	// place works out the new path of filePath and returns the move to make,
+	// unless the file is already there or its new path can't be worked out.
+	place := func(logger *slog.Logger, filePath string, exif Exif) (plannedMove, bool) {
+		newFilePath, err := moveCmd.newFilePath(filePath, exif)
+		if err != nil {
+			logger.Error(err.Error())
+			record(filePath, "", exif, "failed", err)
+			return plannedMove{}, false
+		}
+		if moveCmd.MergeSimilarDirs {
+			newDir := filepath.Dir(newFilePath)
+			similarDirsMutex.Lock()
+			similarDir, ok := similarDirs[newDir]
+			if !ok {
+				similarDir, err = findSimilarDir(newDir)
+				if err == nil {
+					similarDirs[newDir] = similarDir
+				}
+			}
+			similarDirsMutex.Unlock()
+			if err != nil {
+				logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+				record(filePath, newFilePath, exif, "failed", err)
+				return plannedMove{}, false
+			}
+			if similarDir != newDir {
+				logger.Debug("merging into existing directory", slog.String("dir", newDir), slog.String("similarDir", similarDir))
+				newFilePath = filepath.Join(similarDir, filepath.Base(newFilePath))
+			}
+		}
+		// A plan's collisions are resolved once all of it is known, so
+		// that the outcome doesn't depend on the order files are read in.
+		if moveCmd.CameraSuffix {
+			claimedMutex.Lock()
+			taken := !planning && claimed[newFilePath]
+			if !taken {
+				taken, err = takenByOtherFile(ctx, filePath, newFilePath)
+			}
+			if taken {
+				if suffix := cameraSuffix(exif); suffix != "" {
+					newFilePath = addNameSuffix(newFilePath, suffix)
+				}
+			}
+			claimed[newFilePath] = true
+			claimedMutex.Unlock()
+			if err != nil {
+				logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+				record(filePath, newFilePath, exif, "failed", err)
+				return plannedMove{}, false
+			}
+		}
+		if newFilePath == filePath {
+			logger.Debug("file already has its new path")
+			record(filePath, newFilePath, exif, "unchanged", nil)
+			return plannedMove{}, false
+		}
+		return plannedMove{FilePath: filePath, NewFilePath: newFilePath, Exif: exif}, true
+	}
+	var planMutex sync.Mutex
+	var plan []plannedMove
+	var unindexed []plannedMove
+	var plannedQuarantines []string
+	quarantine := func(logger *slog.Logger, filePath string) {
+		if planning {
+			planMutex.Lock()
+			plannedQuarantines = append(plannedQuarantines, filePath)
+			planMutex.Unlock()
+			return
+		}
+		moveCmd.quarantine(logger, report, filePath)
+	}
+	// With NumMoveWorkers set, the workers hand the moves they work out over
+	// to the move workers instead of executing them themselves.
+	// With PinDirs, each move worker has a lane of its own instead.
+	var moves chan plannedMove
+	var moveLanes []chan plannedMove
+	var moveWaitGroup sync.WaitGroup
+	if moveCmd.NumMoveWorkers > 0 {
+		moves = make(chan plannedMove, moveCmd.MaxPending)
+		if moveCmd.PinDirs {
+			for range moveCmd.NumMoveWorkers {
+				moveLanes = append(moveLanes, make(chan plannedMove, max(moveCmd.MaxPending/moveCmd.NumMoveWorkers, 1)))
+			}
+		}
+		for i := 0; i < moveCmd.NumMoveWorkers; i++ {
+			queue := moves
+			if moveLanes != nil {
+				queue = moveLanes[i]
+			}
+			moveWaitGroup.Add(1)
+			go func() {
+				defer moveWaitGroup.Done()
+				worker := progress.Worker("move worker")
+				defer progress.Stop(worker)
+				for {
+					progress.Start(worker, "")
+					move, ok := <-queue
+					if !ok {
+						break
+					}
+					if ctx.Err() != nil {
+						continue
+					}
+					progress.Start(worker, move.FilePath)
+					execute(moveCmd.logger.With(slog.String("filePath", move.FilePath)), move.FilePath, move.NewFilePath, move.Exif)
+				}
+			}()
+		}
+	}
+	// stopTuner is replaced below if the number of workers is auto-tuned.
+	stopTuner := func() {}
+	// Closing filePaths tells the workers to exit once they have finished the
+	// file they are currently working on, and closing moves then tells the
+	// move workers to exit once every move handed to them is done.
+	stopWorkers := sync.OnceFunc(func() {
+		stopTuner()
+		close(filePaths)
+		waitGroup.Wait()
+		if moves != nil {
+			close(moves)
+			for _, lane := range moveLanes {
+				close(lane)
+			}
+			moveWaitGroup.Wait()
+		}
+	})
+	defer stopWorkers()
+	// With PinDirs, the number of workers is fixed and each one has a lane
+	// of its own, which a router hands the walked files out to by their
+	// directory.
+	numWorkers := moveCmd.NumWorkers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	var lanes []chan string
+	if moveCmd.PinDirs {
+		for range numWorkers {
+			lanes = append(lanes, make(chan string, max(moveCmd.MaxPending/numWorkers, 1)))
+		}
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				for _, lane := range lanes {
+					close(lane)
+				}
+			}()
+			for filePath := range filePaths {
+				select {
+				case <-ctx.Done():
+				case lanes[dirLane(filePath, len(lanes))] <- filePath:
+				}
+			}
+		}()
+	}
+	var numStarted int
+	startWorker := func() error {
+		queue := filePaths
+		if lanes != nil {
+			queue = lanes[numStarted]
+		}
+		numStarted++
+		// Workers only need exiftool if the creation time comes from the
+		// files' metadata.
+		var exifTool *exifTool
+		if !moveCmd.ModTimeOnly {
+			var err error
+			exifTool, err = startExifTool(ctx, moveCmd.Stderr, moveCmd.Timeout, moveCmd.Charset, moveCmd.ExifToolConfig)
+			if err != nil {
+				return err
+			}
+			exifTool.Cache = cache
+			exifTool.DateSourceRules = moveCmd.DateSourceRules
+			exifTool.ExtHandlers = moveCmd.ExtHandlers
+			exifTool.ReadArgs = moveCmd.ExifToolArgs
+			exifTool.Tags = moveCmd.Tags()
+		}
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				if exifTool == nil {
+					return
+				}
+				err := exifTool.Close()
+				if err != nil {
+					moveCmd.logger.Warn(err.Error())
+				}
+			}()
+			// If every worker has exited early because its exiftool session
+			// died, nothing is left to receive from filePaths and the walker
+			// would block forever.
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+				// Nothing else receives the files of a pinned worker's
+				// directories.
+				if lanes != nil && exitedEarly {
+					cancel(errPinnedWorkerExited)
+				}
+			}()
+			worker := progress.Worker("worker")
+			defer progress.Stop(worker)
+			for {
+				progress.Start(worker, "")
+				filePath, ok := <-queue
+				if !ok {
+					break
+				}
+				if ctx.Err() != nil {
+					continue
+				}
+				progress.Start(worker, filePath)
+				numProcessed.Add(1)
+				lastProcessed.Store(filePath)
+				logger := moveCmd.logger.With(slog.String("filePath", filePath))
+				if moveCmd.MinAge > 0 || moveCmd.StableFor > 0 {
+					err := checkFileStable(ctx, filePath, moveCmd.MinAge, moveCmd.StableFor)
+					if err != nil {
+						logger.Warn(err.Error())
+						record(filePath, "", Exif{}, "unstable", err)
+						continue
+					}
+				}
+				archivedPath, err := archive.Lookup(ctx, logger, filePath)
+				if err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
+					logger.Error(err.Error())
+					record(filePath, "", Exif{}, "failed", err)
+					continue
+				}
+				if archivedPath != "" {
+					logger.Info("file is already archived, skipping", slog.String("archivedPath", archivedPath))
+					record(filePath, archivedPath, Exif{}, "archived", nil)
+					continue
+				}
+				entry, ok, err := skips.Lookup(ctx, filePath)
+				if err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
+					logger.Error(err.Error())
+					record(filePath, "", Exif{}, "failed", err)
+					continue
+				}
+				if ok {
+					logger.Info("file is on the skip list, skipping", slog.String("reason", entry.Reason))
+					record(filePath, "", Exif{}, "skipped", fmt.Errorf("on the skip list: %s", entry.Reason))
+					skip(filePath)
+					continue
+				}
+				var exif Exif
+				if moveCmd.ModTimeOnly || moveCmd.ExtHandlers[strings.ToLower(filepath.Ext(filePath))].Extractor == "mtime" {
+					// -where can't be checked without the metadata, so with
+					// -ext-config mtime files are left where they are rather
+					// than moved unfiltered.
+					if !moveCmd.MatchExifs(nil) {
+						logger.Debug("not selected by -where, its metadata isn't read")
+						continue
+					}
+					var fileInfo fs.FileInfo
+					err := moveCmd.RetryPolicy.Do(ctx, logger, &numRetries, func() error {
+						var err error
+						fileInfo, err = os.Stat(filePath)
+						return err
+					})
+					if err != nil {
+						logger.Error(err.Error())
+						record(filePath, "", Exif{}, "failed", err)
+						continue
+					}
+					exif = Exif{CreationTime: fileInfo.ModTime(), CreationTimeSource: "FileModifyDate"}
+				} else {
+					exifs, err := exifTool.FileExifs(logger, filePath)
+					if err != nil {
+						// exiftool is killed when the run is interrupted.
+						if ctx.Err() != nil {
+							return
+						}
+						logger.Error(err.Error())
+						record(filePath, "", Exif{}, "failed", err)
+						quarantine(logger, filePath)
+						if errors.Is(err, errUnreadableFile) {
+							continue
+						}
+						if !errors.Is(err, errExifToolTimeout) {
+							return
+						}
+						err := exifTool.Restart()
+						if err != nil {
+							logger.Error(err.Error())
+							return
+						}
+						metrics.CountRestart()
+						continue
+					}
+					if !moveCmd.MatchExifs(exifs) {
+						logger.Debug("not selected by -where")
+						continue
+					}
+					exif, err = fileExif(logger, filePath, exifs)
+					if errors.Is(err, errNoCreationTime) && len(moveCmd.DirDatePatterns) > 0 {
+						creationTime, dirErr := dirCreationTime(filePath, moveCmd.DirDatePatterns, listings)
+						if dirErr != nil {
+							logger.Warn(dirErr.Error())
+						} else if !creationTime.IsZero() {
+							exif, err = exifs[0], nil
+							exif.CreationTime = creationTime
+							exif.CreationTimeSource = "DirectoryName"
+							if moveCmd.WriteDirDates && !moveCmd.DryRun {
+								_, writeErr := exifTool.Execute("-overwrite_original", "-DateTimeOriginal="+creationTime.Format("2006:01:02 15:04:05"), filePath)
+								if writeErr != nil {
+									if ctx.Err() != nil {
+										return
+									}
+									logger.Warn(writeErr.Error())
+									if errors.Is(writeErr, errExifToolTimeout) {
+										restartErr := exifTool.Restart()
+										if restartErr != nil {
+											logger.Error(restartErr.Error())
+											return
+										}
+										metrics.CountRestart()
+									}
+								}
+							}
+						}
+					}
+					if errors.Is(err, errNoCreationTime) && moveCmd.IgnoreCreationTime {
+						exif, err = exifs[0], nil
+					}
+					if err != nil {
+						switch moveCmd.OnParseError {
+						case "strict":
+							logger.Error(err.Error())
+							record(filePath, "", Exif{}, "failed", err)
+							cancel(fmt.Errorf("%s: %w", filePath, err))
+							continue
+						case "fallback":
+							logger.Warn(err.Error() + ", falling back to modification time")
+							var fileInfo fs.FileInfo
+							err := moveCmd.RetryPolicy.Do(ctx, logger, &numRetries, func() error {
+								var err error
+								fileInfo, err = os.Stat(filePath)
+								return err
+							})
+							if err != nil {
+								logger.Error(err.Error())
+								record(filePath, "", Exif{}, "skipped", err)
+								skip(filePath)
+								quarantine(logger, filePath)
+								continue
+							}
+							exif = Exif{CreationTime: fileInfo.ModTime(), CreationTimeSource: "FileModifyDate"}
+						default:
+							logger.Error(err.Error())
+							record(filePath, "", Exif{}, "skipped", err)
+							skip(filePath)
+							if !moveCmd.DryRun {
+								// The file has to be hashed before it is
+								// quarantined.
+								err := skips.Add(ctx, filePath, err.Error())
+								if err != nil && ctx.Err() == nil {
+									logger.Warn("not adding file to the skip list: " + err.Error())
+								}
+							}
+							quarantine(logger, filePath)
+							continue
+						}
+					}
+				}
+				exif = applyClockOffset(exif, moveCmd.ClockOffsets)
+				exif, err = applyTimeZone(exif, moveCmd.TimeZone, moveCmd.AmbiguousTime)
+				if err != nil {
+					logger.Error(err.Error(), slog.Time("creationTime", exif.CreationTime))
+					record(filePath, "", exif, "skipped", err)
+					skip(filePath)
+					quarantine(logger, filePath)
+					continue
+				}
+				if exif.AmbiguousTime {
+					logger.Warn("creation time is ambiguous because of a daylight saving time change, taking the "+moveCmd.AmbiguousTime+" one", slog.Time("creationTime", exif.CreationTime))
+				}
+				if !moveCmd.CreatedBefore.IsZero() && (exif.CreationTime.IsZero() || !exif.CreationTime.Before(moveCmd.CreatedBefore)) {
+					logger.Debug("not created before " + moveCmd.CreatedBefore.Format(time.DateOnly))
+					continue
+				}
+				if moveCmd.dailyIndexed {
+					planMutex.Lock()
+					unindexed = append(unindexed, plannedMove{FilePath: filePath, Exif: exif})
+					planMutex.Unlock()
+					continue
+				}
+				move, ok := place(logger, filePath, exif)
+				if !ok {
+					continue
+				}
+				if planning {
+					planMutex.Lock()
+					plan = append(plan, move)
+					planMutex.Unlock()
+					continue
+				}
+				if moves != nil {
+					queue := moves
+					if moveLanes != nil {
+						queue = moveLanes[dirLane(move.NewFilePath, len(moveLanes))]
+					}
+					select {
+					case <-ctx.Done():
+					case queue <- move:
+					}
+					continue
+				}
+				execute(logger, move.FilePath, move.NewFilePath, move.Exif)
+			}
+			exitedEarly = false
+		}()
+		return nil
+	}
+	for i := 0; i < numWorkers; i++ {
+		err := startWorker()
+		if err != nil {
+			return err
+		}
+	}
+	if moveCmd.NumWorkers == 0 && !moveCmd.PinDirs {
+		tunerCtx, cancelTuner := context.WithCancel(ctx)
+		tunerDone := make(chan struct{})
+		go func() {
+			defer close(tunerDone)
+			autoTuneWorkers(tunerCtx, moveCmd.logger, &numProcessed, numWorkers, startWorker)
+		}()
+		stopTuner = func() {
+			cancelTuner()
+			<-tunerDone
+		}
+	}
+	progressCtx, cancelProgress := context.WithCancel(ctx)
+	defer cancelProgress()
+	go logProgress(progressCtx, moveCmd.logger, &numProcessed, &lastProcessed, func() int {
+		numPending := len(filePaths)
+		for _, lane := range lanes {
+			numPending += len(lane)
+		}
+		return numPending
+	})
+	go printProgressOnRequest(progressCtx, moveCmd.Stderr, progress)
+	// Photos.app, AppleDouble and sidecar companions found during the walk
+	// are moved together with their original rather than on their own, and
+	// files of extensions configured to be skipped are left out. Files
+	// given explicitly are always processed.
+	explicitFilePaths := make(map[string]bool)
+	for _, filePath := range moveCmd.FilePaths {
+		explicitFilePaths[filePath] = true
+	}
+	scannedDirs := make(map[string]bool)
+	companionNames := make(map[string]bool)
+	walkErr := moveCmd.Walk(func(dirPath string) bool {
+		// Don't pick quarantined files back up if the quarantine directory
+		// is inside the root.
+		return moveCmd.QuarantineDir != "" && dirPath == moveCmd.QuarantineDir
+	}, func(root, filePath string) error {
+		if !explicitFilePaths[filePath] {
+			dir := filepath.Dir(filePath)
+			if !scannedDirs[dir] {
+				scannedDirs[dir] = true
+				dirEntries, err := os.ReadDir(dir)
+				if err != nil {
+					return err
+				}
+				for name := range applePhotosCompanionNames(dirEntries) {
+					companionNames[filepath.Join(dir, name)] = true
+				}
+				for name := range appleDoubleCompanionNames(dirEntries) {
+					companionNames[filepath.Join(dir, name)] = true
+				}
+				for name := range sidecarCompanionNames(dirEntries, moveCmd.ExtHandlers) {
+					companionNames[filepath.Join(dir, name)] = true
+				}
+			}
+			if companionNames[filePath] || moveCmd.ExtHandlers[strings.ToLower(filepath.Ext(filePath))].Skip {
+				return nil
+			}
+		}
+		if len(moveCmd.DirDatePatterns) > 0 {
+			_, err := listings.List(filepath.Dir(filePath))
+			if err != nil {
+				return err
+			}
+		}
+		if moveCmd.placed != nil && moveCmd.placed(filePath) {
+			moveCmd.logger.Info("file is already in place, skipping", slog.String("filePath", filePath))
+			record(filePath, "", Exif{}, "skipped", errors.New("already in place"))
+			return nil
+		}
+		err := moveCmd.settle.Settled(filePath)
+		if err != nil {
+			moveCmd.logger.Info(err.Error(), slog.String("filePath", filePath))
+			record(filePath, "", Exif{}, "unstable", err)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case filePaths <- filePath:
+			progress.Walked()
+			return nil
+		}
+	})
+	progress.WalkFinished()
+	stopWorkers()
+	cancelProgress()
+	if moveCmd.dailyIndexed && walkErr == nil && ctx.Err() == nil {
+		slices.SortFunc(unindexed, func(a, b plannedMove) int {
+			return cmp.Or(a.Exif.CreationTime.Compare(b.Exif.CreationTime), strings.Compare(a.FilePath, b.FilePath))
+		})
+		for _, move := range unindexed {
+			move, ok := place(moveCmd.logger.With(slog.String("filePath", move.FilePath)), move.FilePath, move.Exif)
+			if ok {
+				plan = append(plan, move)
+			}
+		}
+	}
+	if planning && walkErr == nil && ctx.Err() == nil {
+		if moveCmd.CameraSuffix {
+			resolveCameraCollisions(plan)
+		}
+		conflicts := planConflicts(plan)
+		var shortfalls []error
+		if len(conflicts) == 0 && moveCmd.CheckFreeSpace != "" {
+			shortfalls = freeSpaceShortfalls(plan, moveCmd.ExtHandlers)
+		}
+		if len(conflicts) > 0 {
+			for _, conflict := range conflicts {
+				fmt.Fprintf(moveCmd.Stderr, "%d files would be moved to %s:\n", len(conflict), conflict[0].NewFilePath)
+				for _, plannedMove := range conflict {
+					fmt.Fprintln(moveCmd.Stderr, "  "+plannedMove.FilePath)
+					record(plannedMove.FilePath, plannedMove.NewFilePath, plannedMove.Exif, "conflict", fmt.Errorf("%d files would be moved to %s", len(conflict), plannedMove.NewFilePath))
+				}
+			}
+			walkErr = fmt.Errorf("found %d conflicting new paths, nothing was moved", len(conflicts))
+		} else if len(shortfalls) > 0 && moveCmd.CheckFreeSpace == "abort" {
+			for _, err := range shortfalls {
+				moveCmd.logger.Error(err.Error())
+			}
+			walkErr = fmt.Errorf("not enough free space on %d filesystems, nothing was moved", len(shortfalls))
+		} else {
+			for _, err := range shortfalls {
+				moveCmd.logger.Warn(err.Error())
+			}
+			for _, filePath := range plannedQuarantines {
+				moveCmd.quarantine(moveCmd.logger.With(slog.String("filePath", filePath)), report, filePath)
+			}
+			// Execute the plan in a deterministic order, since it was put
+			// together by however many workers in whatever order they
+			// finished.
+			slices.SortFunc(plan, func(a, b plannedMove) int {
+				return strings.Compare(a.FilePath, b.FilePath)
+			})
+			for _, plannedMove := range plan {
+				if ctx.Err() != nil {
+					break
+				}
+				execute(moveCmd.logger.With(slog.String("filePath", plannedMove.FilePath)), plannedMove.FilePath, plannedMove.NewFilePath, plannedMove.Exif)
+			}
+		}
+	}
+	if numSkipped > 0 {
+		fmt.Fprintf(moveCmd.Stderr, "skipped %d files whose creation time could not be determined:\n", numSkipped)
+		for _, filePath := range skipped {
+			fmt.Fprintln(moveCmd.Stderr, "  "+filePath)
+		}
+		if numSkipped > len(skipped) {
+			fmt.Fprintf(moveCmd.Stderr, "  ... and %d more\n", numSkipped-len(skipped))
+		}
+	}
+	if moveCmd.PreviewTree {
+		dryRun.PrintTree(moveCmd.Stdout)
+	}
+	if moveCmd.DryRun {
+		dryRun.Print(moveCmd.Stderr)
+	}
+	if n := numRetries.Load(); n > 0 {
+		fmt.Fprintf(moveCmd.Stderr, "retried %d filesystem operations after transient errors\n", n)
+	}
+	if ctx.Err() != nil {
+		lastFilePath, _ := lastProcessed.Load().(string)
+		fmt.Fprintf(moveCmd.Stderr, "stopped after processing %d files (last processed: %s)\n", numProcessed.Load(), lastFilePath)
+		return context.Cause(ctx)
+	}
+	return walkErr
+}
+
+// dirLane returns which of numLanes lanes the files in the directory of
+// filePath go to with -pin-dirs.
+func dirLane(filePath string, numLanes int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(filepath.Dir(filePath)))
+	return int(hash.Sum32() % uint32(numLanes))
+}
+
+// maxRenameAttempts is how many times renameInto tries to move a file whose
+// destination directory keeps disappearing.
+const maxRenameAttempts = 3
+
+// renameInto creates the directory of newFilePath if needed and moves
+// filePath there. Workers moving files into the same directory take turns,
+// so that two files headed for the same new path can't both pass
+// renameNoReplace's check for an existing file before either is renamed. If
+// the directory disappears between being created and the rename (e.g. an
+// exifutil trash empty running at the same time removed it for being empty),
+// the move is retried.
+func (moveCmd *MoveCmd) renameInto(ctx context.Context, logger *slog.Logger, dirLocks *keyedMutex, numRetries *atomic.Int64, filePath, newFilePath string) error {
+	fsys := moveCmd.fsys
+	if fsys == nil {
+		fsys = osFS{}
+	}
+	dir := filepath.Dir(newFilePath)
+	// Directories differing only in case are the same directory on
+	// case-insensitive filesystems.
+	unlock := dirLocks.Lock(strings.ToLower(dir))
+	defer unlock()
+	for attempt := 1; ; attempt++ {
+		err := moveCmd.RetryPolicy.Do(ctx, logger, numRetries, func() error {
+			return moveCmd.MkdirAll(fsys, dir, moveCmd.Durable)
+		})
+		if err == nil {
+			var retried bool
+			err = moveCmd.RetryPolicy.Do(ctx, logger, numRetries, func() error {
+				err := renameNoReplace(fsys, filePath, newFilePath, moveCmd.ReplaceIfExists)
+				if isCrossDeviceError(err) {
+					err = moveAcrossFileSystems(ctx, filePath, newFilePath, moveCmd.ReplaceIfExists)
+				}
+				// A rename that failed with a transient error may have gone
+				// through on the server anyway.
+				if err != nil && retried && errors.Is(err, fs.ErrNotExist) {
+					_, srcErr := fsys.Lstat(filePath)
+					_, dstErr := fsys.Lstat(newFilePath)
+					if errors.Is(srcErr, fs.ErrNotExist) && dstErr == nil {
+						return nil
+					}
+				}
+				retried = true
+				return err
+			})
+		}
+		if err == nil || !errors.Is(err, fs.ErrNotExist) || attempt == maxRenameAttempts {
+			return err
+		}
+		// Only the destination disappearing is worth retrying.
+		_, statErr := fsys.Lstat(filePath)
+		if statErr != nil {
+			return err
+		}
+	}
+}
+
+// moveAcrossFileSystems moves the file at oldPath to newPath on another
+// filesystem, which a rename can't do. The file is copied next to newPath
+// under a temporary name, checked against the original and renamed into
+// place, so that newPath never holds a partial copy, and only then is the
+// original removed.
+func moveAcrossFileSystems(ctx context.Context, oldPath, newPath string, replaceIfExists bool) error {
+	fileInfo, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(newPath), ".exifutil-*"+filepath.Ext(newPath))
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	defer os.Remove(tempPath)
+	err = os.Remove(tempPath)
+	if err != nil {
+		return err
+	}
+	err = copyNoReplace(oldPath, tempPath)
+	if err != nil {
+		return err
+	}
+	tempHash, err := hashFile(ctx, tempPath)
+	if err != nil {
+		return err
+	}
+	if tempHash != hash {
+		return fmt.Errorf("%s: copy does not match the original", newPath)
+	}
+	err = os.Chmod(tempPath, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = renameNoReplace(osFS{}, tempPath, newPath, replaceIfExists)
+	if err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+// dryRunSummary tallies the side effects of the moves of a dry run, so that
+// problems like a lack of disk space can be caught before the real run. Its
+// methods may be called concurrently.
+type dryRunSummary struct {
+	mutex sync.Mutex
+	// newDirs are the directories that would be created.
+	newDirs map[string]bool
+	// existingDirs maps existing destination directories (and their
+	// ancestors) to the ID of the filesystem they are on.
+	existingDirs map[string]string
+	fileSystems  map[string]*fileSystemUsage
+	// fileSystemIDs are the keys of fileSystems in the order they were
+	// first seen.
+	fileSystemIDs []string
+	// numFiles maps destination directories to the number of files that
+	// would be moved into them.
+	numFiles map[string]int
+}
+
+// fileSystemUsage is how much a dry run would move onto one filesystem.
+type fileSystemUsage struct {
+	// Dir is the first existing destination directory seen on the
+	// filesystem, used to name it and query its free space.
+	Dir      string
+	NumFiles int
+	Bytes    int64
+	// IncomingBytes are the bytes of files coming from other filesystems,
+	// which unlike renames within the filesystem take up free space.
+	IncomingBytes int64
+}
+
+func newDryRunSummary() *dryRunSummary {
+	return &dryRunSummary{
+		newDirs:      make(map[string]bool),
+		existingDirs: make(map[string]string),
+		fileSystems:  make(map[string]*fileSystemUsage),
+		numFiles:     make(map[string]int),
+	}
+}
+
+// Add records the move of filePath to newFilePath.
+func (summary *dryRunSummary) Add(filePath, newFilePath string) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	summary.numFiles[filepath.Dir(newFilePath)]++
+	// Find the nearest existing ancestor of the destination directory, which
+	// is the filesystem the file would end up on, noting every directory
+	// on the way there as one that would be created.
+	dir := filepath.Dir(newFilePath)
+	var id string
+	for {
+		if existingID, ok := summary.existingDirs[dir]; ok {
+			id = existingID
+			break
+		}
+		if !summary.newDirs[dir] {
+			dirInfo, err := os.Stat(dir)
+			if err == nil {
+				id = fileSystemID(dir, dirInfo)
+				summary.existingDirs[dir] = id
+				break
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			summary.newDirs[dir] = true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return fmt.Errorf("%s: no existing ancestor directory", newFilePath)
+		}
+		dir = parent
+	}
+	usage := summary.fileSystems[id]
+	if usage == nil {
+		usage = &fileSystemUsage{Dir: dir}
+		summary.fileSystems[id] = usage
+		summary.fileSystemIDs = append(summary.fileSystemIDs, id)
+	}
+	usage.NumFiles++
+	usage.Bytes += fileInfo.Size()
+	if fileSystemID(filePath, fileInfo) != id {
+		usage.IncomingBytes += fileInfo.Size()
+	}
+	return nil
+}
+
+// Print writes the summary to w, warning about every filesystem without
+// enough free space for the files that would be moved onto it.
+func (summary *dryRunSummary) Print(w io.Writer) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	fmt.Fprintf(w, "would create %d directories\n", len(summary.newDirs))
+	for _, id := range summary.fileSystemIDs {
+		usage := summary.fileSystems[id]
+		fmt.Fprintf(w, "would move %d files (%s) onto the filesystem of %s", usage.NumFiles, formatBytes(usage.Bytes), usage.Dir)
+		if usage.IncomingBytes == 0 {
+			fmt.Fprintln(w)
+			continue
+		}
+		fmt.Fprintf(w, ", %s of it from other filesystems", formatBytes(usage.IncomingBytes))
+		free, err := freeSpace(usage.Dir)
+		if err != nil {
+			fmt.Fprintf(w, " (free space unknown: %v)\n", err)
+			continue
+		}
+		fmt.Fprintf(w, " (%s free)\n", formatBytes(int64(free)))
+		if uint64(usage.IncomingBytes) > free {
+			fmt.Fprintf(w, "warning: not enough free space on the filesystem of %s, %s short\n", usage.Dir, formatBytes(usage.IncomingBytes-int64(free)))
+		}
+	}
+}
+
+// PrintTree writes the destination directories to w as a tree like the one
+// tree(1) prints, below the deepest directory they have in common, with the
+// number of files each would get and whether it would be created.
+func (summary *dryRunSummary) PrintTree(w io.Writer) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	if len(summary.numFiles) == 0 {
+		return
+	}
+	dirs := make([]string, 0, len(summary.numFiles))
+	for dir := range summary.numFiles {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	root := dirs[0]
+	isBelow := func(dir, root string) bool {
+		return dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+	}
+	for _, dir := range dirs[1:] {
+		for !isBelow(dir, root) {
+			root = filepath.Dir(root)
+		}
+	}
+	children := make(map[string][]string)
+	for _, dir := range dirs {
+		for dir != root {
+			parent := filepath.Dir(dir)
+			if slices.Contains(children[parent], dir) {
+				break
+			}
+			children[parent] = append(children[parent], dir)
+			dir = parent
+		}
+	}
+	describe := func(dir string) string {
+		var details []string
+		switch n := summary.numFiles[dir]; n {
+		case 0:
+		case 1:
+			details = append(details, "1 file")
+		default:
+			details = append(details, fmt.Sprintf("%d files", n))
+		}
+		if summary.newDirs[dir] {
+			details = append(details, "new")
+		}
+		if len(details) == 0 {
+			return ""
+		}
+		return " (" + strings.Join(details, ", ") + ")"
+	}
+	fmt.Fprintln(w, root+describe(root))
+	var printChildren func(dir, indent string)
+	printChildren = func(dir, indent string) {
+		slices.Sort(children[dir])
+		for i, child := range children[dir] {
+			branch, nextIndent := "├── ", "│   "
+			if i == len(children[dir])-1 {
+				branch, nextIndent = "└── ", "    "
+			}
+			fmt.Fprintln(w, indent+branch+filepath.Base(child)+describe(child))
+			printChildren(child, indent+nextIndent)
+		}
+	}
+	printChildren(root, "")
+}
+
+// Shortfalls returns an error for every filesystem without enough free space
+// for the files that would be moved onto it from other filesystems.
+// Filesystems whose free space can't be queried are assumed to have enough.
+func (summary *dryRunSummary) Shortfalls() []error {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	var errs []error
+	for _, id := range summary.fileSystemIDs {
+		usage := summary.fileSystems[id]
+		if usage.IncomingBytes == 0 {
+			continue
+		}
+		free, err := freeSpace(usage.Dir)
+		if err != nil || uint64(usage.IncomingBytes) <= free {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("not enough free space on the filesystem of %s: %s to move onto it, %s free", usage.Dir, formatBytes(usage.IncomingBytes), formatBytes(int64(free))))
+	}
+	return errs
+}
+
+// plannedMove is a file whose move has been worked out by a run with Plan
+// set, but not yet executed. Its NewFilePath is empty until its daily index
+// is given out.
+type plannedMove struct {
+	FilePath    string
+	NewFilePath string
+	Exif        Exif
+}
+
+// freeSpaceShortfalls returns an error for every filesystem that the planned
+// moves and their companion files would need more free space on than it has.
+func freeSpaceShortfalls(plan []plannedMove, extHandlers map[string]extHandler) []error {
+	summary := newDryRunSummary()
+	for _, plannedMove := range plan {
+		// A file that can't be stat'ed won't be moved either, so it needs
+		// no space.
+		_ = summary.Add(plannedMove.FilePath, plannedMove.NewFilePath)
+		for _, companionFile := range fileCompanions(plannedMove.FilePath, extHandlers) {
+			_ = summary.Add(companionFile.FilePath, newCompanionFilePath(plannedMove.FilePath, plannedMove.NewFilePath, companionFile))
+		}
+	}
+	return summary.Shortfalls()
+}
+
+// cameraSuffix returns the suffix CameraSuffix adds to the names of files
+// with exif, a short hash of their camera's make, model and serial number,
+// or "" if exif has none of them.
+func cameraSuffix(exif Exif) string {
+	if exif.Make == "" && exif.Model == "" && exif.SerialNumber == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(exif.Make + "\x00" + exif.Model + "\x00" + exif.SerialNumber))
+	return "_" + hex.EncodeToString(sum[:3])
+}
+
+// addNameSuffix adds suffix to the name of filePath, before its extension.
+func addNameSuffix(filePath, suffix string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + suffix + ext
+}
+
+// takenByOtherFile reports whether newFilePath is already taken by a file
+// other than filePath, with different contents. A copy of filePath doesn't
+// count, so that importing the same file twice still finds it exists.
+func takenByOtherFile(ctx context.Context, filePath, newFilePath string) (bool, error) {
+	newFileInfo, err := os.Stat(newFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(fileInfo, newFileInfo) {
+		return false, nil
+	}
+	if fileInfo.Size() != newFileInfo.Size() {
+		return true, nil
+	}
+	hash, err := hashFile(ctx, filePath)
+	if err != nil {
+		return false, err
+	}
+	newHash, err := hashFile(ctx, newFilePath)
+	if err != nil {
+		return false, err
+	}
+	return hash != newHash, nil
+}
+
+// resolveCameraCollisions tells apart the planned moves sharing a new path
+// by the camera they were taken with. The move whose camera suffix sorts
+// first keeps the path, and the others get their camera suffix. Moves from
+// the same camera as the one keeping the path are left to collide.
+func resolveCameraCollisions(plan []plannedMove) {
+	byNewFilePath := make(map[string][]int)
+	for i, plannedMove := range plan {
+		byNewFilePath[plannedMove.NewFilePath] = append(byNewFilePath[plannedMove.NewFilePath], i)
+	}
+	for _, indexes := range byNewFilePath {
+		if len(indexes) < 2 {
+			continue
+		}
+		slices.SortFunc(indexes, func(a, b int) int {
+			return cmp.Or(strings.Compare(cameraSuffix(plan[a].Exif), cameraSuffix(plan[b].Exif)), strings.Compare(plan[a].FilePath, plan[b].FilePath))
+		})
+		keeper := cameraSuffix(plan[indexes[0]].Exif)
+		for _, i := range indexes[1:] {
+			if suffix := cameraSuffix(plan[i].Exif); suffix != "" && suffix != keeper {
+				plan[i].NewFilePath = addNameSuffix(plan[i].NewFilePath, suffix)
+			}
+		}
+	}
+}
+
+// planConflicts returns the groups of planned moves that share the same new
+// path, sorted by new path and then by old path.
+func planConflicts(plan []plannedMove) [][]plannedMove {
+	byNewFilePath := make(map[string][]plannedMove)
+	for _, plannedMove := range plan {
+		byNewFilePath[plannedMove.NewFilePath] = append(byNewFilePath[plannedMove.NewFilePath], plannedMove)
+	}
+	var conflicts [][]plannedMove
+	for _, plannedMoves := range byNewFilePath {
+		if len(plannedMoves) < 2 {
+			continue
+		}
+		slices.SortFunc(plannedMoves, func(a, b plannedMove) int {
+			return strings.Compare(a.FilePath, b.FilePath)
+		})
+		conflicts = append(conflicts, plannedMoves)
+	}
+	slices.SortFunc(conflicts, func(a, b []plannedMove) int {
+		return strings.Compare(a[0].NewFilePath, b[0].NewFilePath)
+	})
+	return conflicts
+}
+
+// quarantine moves filePath and its companion files into the quarantine
+// directory, or symlinks them there if -quarantine-symlink is set. It does
+// nothing if -quarantine-dir is not set.
+func (moveCmd *MoveCmd) quarantine(logger *slog.Logger, report *reportWriter, filePath string) {
+	if moveCmd.QuarantineDir == "" {
+		return
+	}
+	filePathsToQuarantine := []string{filePath}
+	for _, companionFile := range fileCompanions(filePath, moveCmd.ExtHandlers) {
+		filePathsToQuarantine = append(filePathsToQuarantine, companionFile.FilePath)
+	}
+	for _, filePath := range filePathsToQuarantine {
+		quarantinePath := filepath.Join(moveCmd.QuarantineDir, filepath.Base(filePath))
+		if moveCmd.DryRun {
+			fmt.Fprintf(moveCmd.Stdout, "%s => %s (quarantine)\n", filePath, quarantinePath)
+			report.Write(filePath, quarantinePath, Exif{}, "dry-run")
+			if moveCmd.OnResult != nil {
+				moveCmd.OnResult(Result{Path: filePath, NewPath: quarantinePath, Action: "dry-run"})
+			}
+			continue
+		}
+		err := os.MkdirAll(moveCmd.QuarantineDir, 0755)
+		if err != nil {
+			logger.Error(err.Error(), slog.String("quarantinePath", quarantinePath))
+			return
+		}
+		if moveCmd.QuarantineSymlink {
+			err = os.Symlink(filePath, quarantinePath)
+		} else {
+			err = renameNoReplace(osFS{}, filePath, quarantinePath, false)
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				logger.Warn("file already exists in quarantine, leaving file in place", slog.String("quarantinePath", quarantinePath))
+				continue
+			}
+			logger.Error(err.Error(), slog.String("quarantinePath", quarantinePath))
+			continue
+		}
+		logger.Info("quarantined file", slog.String("quarantinePath", quarantinePath))
+		report.Write(filePath, quarantinePath, Exif{}, "quarantined")
+		if moveCmd.OnResult != nil {
+			moveCmd.OnResult(Result{Path: filePath, NewPath: quarantinePath, Action: "quarantined"})
+		}
+	}
+}
+
+// findSimilarDir returns the existing sibling of dir whose name matches dir's
+// name case-insensitively and ignoring surrounding white space and Unicode
+// normalization form, so that e.g.
+// "2024-01-02 " is reused instead of creating "2024-01-02" next to it. It
+// returns dir itself if dir exists or there is no such sibling.
+func findSimilarDir(dir string) (string, error) {
+	dirEntries, err := os.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return dir, nil
+		}
+		return "", err
+	}
+	name := strings.TrimSpace(filepath.Base(dir))
+	similarDir := dir
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		if dirEntry.Name() == filepath.Base(dir) {
+			return dir, nil
+		}
+		if similarDir == dir && strings.EqualFold(normalizeUnicode(strings.TrimSpace(dirEntry.Name()), "nfc"), normalizeUnicode(name, "nfc")) {
+			similarDir = filepath.Join(filepath.Dir(dir), dirEntry.Name())
+		}
+	}
+	return similarDir, nil
+}
+
+// jpegtranTransforms maps the values of the EXIF Orientation tag, as exiftool
+// prints them with and without -n, to the jpegtran transform that makes
+// them normal.
+var jpegtranTransforms = map[string][]string{
+	"Mirror horizontal":                   {"-flip", "horizontal"},
+	"Rotate 180":                          {"-rotate", "180"},
+	"Mirror vertical":                     {"-flip", "vertical"},
+	"Mirror horizontal and rotate 270 CW": {"-transpose"},
+	"Rotate 90 CW":                        {"-rotate", "90"},
+	"Mirror horizontal and rotate 90 CW":  {"-transverse"},
+	"Rotate 270 CW":                       {"-rotate", "270"},
+	"2":                                   {"-flip", "horizontal"},
+	"3":                                   {"-rotate", "180"},
+	"4":                                   {"-flip", "vertical"},
+	"5":                                   {"-transpose"},
+	"6":                                   {"-rotate", "90"},
+	"7":                                   {"-transverse"},
+	"8":                                   {"-rotate", "270"},
+}
+
+// hasMotionVideo reports whether a file of exif's type may have a video
+// embedded, so that others aren't read in full to look for one.
+func hasMotionVideo(exif Exif) bool {
+	switch exif.FileTypeExtension {
+	case "jpg", "heic", "livp":
+		return true
+	}
+	return false
+}
+
+// extractMotionVideo writes the video of the motion photo or .livp at
+// newFilePath next to it under the same name, the way the video of a Live
+// Photo sits next to its still image. An existing video is left alone.
+func (moveCmd *MoveCmd) extractMotionVideo(logger *slog.Logger, newFilePath string) {
+	ext, ok, err := motionVideoExt(newFilePath)
+	if err != nil {
+		logger.Warn("not extracting video: "+err.Error(), slog.String("newFilePath", newFilePath))
+		return
+	}
+	if !ok {
+		return
+	}
+	videoPath := strings.TrimSuffix(newFilePath, filepath.Ext(newFilePath)) + ext
+	err = writeMotionVideo(newFilePath, videoPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			logger.Info("video already exists, skipping", slog.String("videoPath", videoPath))
+			return
+		}
+		logger.Error(err.Error(), slog.String("videoPath", videoPath))
+		return
+	}
+	err = moveCmd.Apply(videoPath)
+	if err != nil {
+		logger.Warn(err.Error(), slog.String("videoPath", videoPath))
+	}
+	logger.Info("extracted video", slog.String("videoPath", videoPath))
+}
+
+// rotateJPEG losslessly rotates the JPEG filePath with jpegtran so that its
+// orientation is normal, and sets its Orientation tag to match with
+// exiftool. It reports whether the file needed rotating. The file is
+// replaced in one go, keeping its permissions and modification time, and
+// left as it was if the rotation can't be done perfectly because its
+// dimensions aren't a multiple of the JPEG block size.
+func rotateJPEG(ctx context.Context, filePath, orientation, charset string) (bool, error) {
+	transform, ok := jpegtranTransforms[orientation]
+	if !ok {
+		return false, nil
+	}
+	_, _, isMotionPhoto, err := motionPhotoVideo(filePath)
+	if err != nil {
+		return false, err
+	}
+	if isMotionPhoto {
+		return false, fmt.Errorf("jpegtran would drop the video of a motion photo")
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), ".*.jpg")
+	if err != nil {
+		return false, err
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	args := append([]string{"-copy", "all", "-perfect"}, transform...)
+	args = append(args, "-outfile", tempFile.Name(), filePath)
+	output, err := exec.CommandContext(ctx, "jpegtran", args...).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("jpegtran: %w: %s", err, bytes.TrimSpace(output))
+	}
+	args = append(slices.Clone(exifToolPlatformArgs), "-n", "-Orientation=1", "-overwrite_original")
+	if charset != "" {
+		args = append(args, "-charset", "filename="+charset)
+	}
+	args = append(args, tempFile.Name())
+	output, err = exec.CommandContext(ctx, "exiftool", args...).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("exiftool: %w: %s", err, bytes.TrimSpace(output))
+	}
+	err = os.Chmod(tempFile.Name(), fileInfo.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	err = os.Chtimes(tempFile.Name(), fileInfo.ModTime(), fileInfo.ModTime())
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tempFile.Name(), filePath)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordOriginalName writes originalName, the name the file at filePath had
+// before it was renamed, into its XMP-xmpMM:PreservedFileName tag with
+// exiftool, keeping its modification time. A name already in the tag is
+// left alone, since it is the name from before an earlier rename.
+func recordOriginalName(ctx context.Context, filePath, originalName, charset string) error {
+	args := append(slices.Clone(exifToolPlatformArgs), "-P", "-overwrite_original", "-wm", "cg", "-XMP-xmpMM:PreservedFileName="+originalName)
+	if charset != "" {
+		args = append(args, "-charset", "filename="+charset)
+	}
+	args = append(args, filePath)
+	output, err := exec.CommandContext(ctx, "exiftool", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exiftool: %w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// normalizedPath puts each element of newFilePath in the Unicode
+// normalization form form, except where a file or directory already exists
+// under the same name in another form, whose name is kept so that it is
+// reused instead of duplicated on file systems that tell the forms apart.
+// filePath, the file being moved, doesn't count as existing so that it can
+// be renamed into form.
+func normalizedPath(filePath, newFilePath, form string) (string, error) {
+	volume := filepath.VolumeName(newFilePath)
+	path := volume + string(filepath.Separator)
+	elements := strings.Split(strings.TrimPrefix(newFilePath[len(volume):], string(filepath.Separator)), string(filepath.Separator))
+	exists := true
+	for _, element := range elements {
+		normalizedElement := normalizeUnicode(element, form)
+		if !exists {
+			path = filepath.Join(path, normalizedElement)
+			continue
+		}
+		_, err := os.Lstat(filepath.Join(path, normalizedElement))
+		if err == nil {
+			path = filepath.Join(path, normalizedElement)
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// Names with a single form, such as ASCII names, can't exist under
+		// another.
+		if normalizeUnicode(element, "nfc") == normalizeUnicode(element, "nfd") {
+			exists = false
+			path = filepath.Join(path, normalizedElement)
+			continue
+		}
+		dirEntries, err := os.ReadDir(path)
+		if err != nil {
+			return "", err
+		}
+		exists = false
+		name := normalizedElement
+		for _, dirEntry := range dirEntries {
+			if normalizeUnicode(dirEntry.Name(), form) == normalizedElement && filepath.Join(path, dirEntry.Name()) != filePath {
+				exists = true
+				name = dirEntry.Name()
+				break
+			}
+		}
+		path = filepath.Join(path, name)
+	}
+	return path, nil
+}
+
+// hookData is the data available to the -on-success-exec templates and the
+// body of each -webhook-url request.
+type hookData struct {
+	OldPath            string
+	NewPath            string
+	CreationTime       time.Time
+	CreationTimeSource string
+}
+
+// newHookTemplates parses an -on-success-exec command into one template per
+// argument, so that paths containing spaces are still passed as a single
+// argument.
+func newHookTemplates(text string) ([]*template.Template, error) {
+	var templates []*template.Template
+	for _, field := range strings.Fields(text) {
+		t, err := template.New("").Option("missingkey=error").Parse(field)
+		if err != nil {
+			return nil, err
+		}
+		err = t.Execute(io.Discard, hookData{})
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return templates, nil
+}
+
+// webhookClient is used to send -webhook-url requests. The timeout keeps an
+// unresponsive endpoint from stalling the workers indefinitely.
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// runHooks runs the -on-success-exec command and sends the -webhook-url
+// request for a successful move. Failures are logged but otherwise ignored,
+// since the file has already been moved.
+func (moveCmd *MoveCmd) runHooks(ctx context.Context, logger *slog.Logger, data hookData) {
+	if len(moveCmd.OnSuccessExec) > 0 {
+		args := make([]string, len(moveCmd.OnSuccessExec))
+		for i, t := range moveCmd.OnSuccessExec {
+			var b strings.Builder
+			err := t.Execute(&b, data)
+			if err != nil {
+				logger.Warn(err.Error())
+				return
+			}
+			args[i] = b.String()
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = moveCmd.Stdout
+		cmd.Stderr = moveCmd.Stderr
+		err := cmd.Run()
+		if err != nil {
+			logger.Warn(err.Error(), slog.String("command", cmd.String()))
+		}
+	}
+	if moveCmd.WebhookURL != "" {
+		b, err := json.Marshal(data)
+		if err != nil {
+			logger.Warn(err.Error())
+			return
+		}
+		request, err := http.NewRequestWithContext(ctx, "POST", moveCmd.WebhookURL, bytes.NewReader(b))
+		if err != nil {
+			logger.Warn(err.Error())
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := webhookClient.Do(request)
+		if err != nil {
+			logger.Warn(err.Error())
+			return
+		}
+		_, _ = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			logger.Warn("webhook returned "+response.Status, slog.String("webhookURL", moveCmd.WebhookURL))
+		}
+	}
+}
+
+// moveTemplateData is the data available to the -to and -name templates.
+// Path separators in every field but Dir are replaced with -, so that only
+// the template itself adds directories to the new path.
+type moveTemplateData struct {
+	// Dir is the directory the file is currently in.
+	Dir string
+	// Name is the current name of the file, including its extension.
+	Name string
+	// Ext is the extension of the file, including the dot.
+	Ext string
+	// Timestamp is the canonical timestamp name of the file, without the
+	// extension e.g. 2006-01-02T150405.000-0700.
+	Timestamp string
+	// DailyIndex numbers the files of each day in the same directory in
+	// order of creation time, from 0001, continuing after the highest
+	// number already used by files there e.g. '{{.Date}}_{{.DailyIndex}}'
+	// gives 2006-01-02_0001. It can only be used in the file name.
+	DailyIndex string
+	// Date is the creation date of the file e.g. 2006-01-02.
+	Date   string
+	Year   string
+	Month  string
+	Day    string
+	Hour   string
+	Minute string
+	Second string
+	Make   string
+	Model  string
+	// Country and City come from the file's location tags. They are empty
+	// if it has none, and empty path segments are dropped, so
+	// '{{.Year}}/{{.Country}}/{{.City}}' puts files without location tags
+	// straight into their year.
+	Country string
+	City    string
+	// Latitude and Longitude are the file's GPS position in signed decimal
+	// degrees to 4 decimal places e.g. 35.6895, or empty if it isn't
+	// geotagged.
+	Latitude  string
+	Longitude string
+	// MonthName is the name of the creation month according to
+	// -month-names e.g. März.
+	MonthName string
+	// MediaType is the name of the first -media-type rule the file matches,
+	// photos or videos by default, or empty if it matches none.
+	MediaType string
+	// FileNumber is the number the camera gave the file from its running
+	// file counter e.g. 4523 for IMG_4523.JPG, which photographers use to
+	// cross-reference files, from the FileNumber or ImageNumber tag or else
+	// from a camera-style name like IMG_4523 or DSC04523. It is empty if
+	// the file has none e.g. '{{.Date}}_IMG{{.FileNumber}}{{.Ext}}' gives
+	// 2024-01-02_IMG4523.jpg.
+	FileNumber string
+	// ShutterCount is the number of shutter actuations of the camera when
+	// the file was taken, from the maker notes' ShutterCount or ImageCount
+	// tag, or empty if they have none.
+	ShutterCount string
+	// CreationTime is available for templates that need a layout not
+	// covered above e.g. {{.CreationTime.Format "Jan 2006"}}.
+	CreationTime time.Time
+	monthNames   [12]string
+	dayBoundary  time.Duration
+	tags         map[string]any
+}
+
+// Tag returns the value of any tag exiftool reads, including user-defined
+// tags from -exiftool-config, e.g. {{.Tag "LensModel"}}. It is empty if the
+// file doesn't have the tag. Path separators are replaced, like in every
+// other field that comes from the file or the flags.
+func (data moveTemplateData) Tag(name string) string {
+	value, ok := data.tags[name]
+	if !ok {
+		return ""
+	}
+	return pathSegmentReplacer.Replace(whereString(value))
+}
+
+// templateUses is what templates read of moveTemplateData.
+type templateUses struct {
+	// Fields are the fields they refer to.
+	Fields []string
+	// Tags are the tags they read with Tag, which have to be asked of
+	// exiftool. Only names given as string constants are found.
+	Tags []string
+}
+
+// walkTemplates returns what templates read of moveTemplateData. Nil
+// templates are skipped.
+func walkTemplates(templates ...*template.Template) templateUses {
+	var uses templateUses
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, node := range node.Nodes {
+				walk(node)
+			}
+		case *parse.ActionNode:
+			walk(node.Pipe)
+		case *parse.IfNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.RangeNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.WithNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.TemplateNode:
+			walk(node.Pipe)
+		case *parse.PipeNode:
+			if node == nil {
+				return
+			}
+			for _, cmd := range node.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for i, arg := range node.Args {
+				field, ok := arg.(*parse.FieldNode)
+				if ok && slices.Equal(field.Ident, []string{"Tag"}) && i+1 < len(node.Args) {
+					if name, ok := node.Args[i+1].(*parse.StringNode); ok && !slices.Contains(uses.Tags, name.Text) {
+						uses.Tags = append(uses.Tags, name.Text)
+					}
+				}
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			if len(node.Ident) > 0 && !slices.Contains(uses.Fields, node.Ident[0]) {
+				uses.Fields = append(uses.Fields, node.Ident[0])
+			}
+		}
+	}
+	for _, t := range templates {
+		if t != nil && t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+	return uses
+}
+
+// UsesField reports whether the templates read the moveTemplateData field
+// name.
+func (uses templateUses) UsesField(name string) bool {
+	return slices.Contains(uses.Fields, name)
+}
+
+// templates returns the -to, -name and -replica-to templates.
+func (moveCmd *MoveCmd) templates() []*template.Template {
+	return append([]*template.Template{moveCmd.DirTemplate, moveCmd.NameTemplate}, moveCmd.ReplicaTemplates...)
+}
+
+// Tags returns the tags read by the -to, -name and -replica-to templates
+// and the -where expression, the Orientation for AutoRotate and the
+// MIMEType for MediaType.
+func (moveCmd *MoveCmd) Tags() []string {
+	tags := slices.Clone(moveCmd.Where.Tags())
+	if moveCmd.AutoRotate && !slices.Contains(tags, "Orientation") {
+		tags = append(tags, "Orientation")
+	}
+	if moveCmd.usesMIMEType() && !slices.Contains(tags, "MIMEType") {
+		tags = append(tags, "MIMEType")
+	}
+	uses := walkTemplates(moveCmd.templates()...)
+	for _, field := range []struct {
+		Name string
+		Tags []string
+	}{
+		{"FileNumber", fileNumberTags},
+		{"ShutterCount", shutterCountTags},
+	} {
+		if !uses.UsesField(field.Name) {
+			continue
+		}
+		for _, tag := range field.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, tag := range uses.Tags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// fileNumberTags are the tags FileNumber is read from, in order. Canon
+// writes FileNumber as the folder and file number e.g. 100-4523.
+var fileNumberTags = []string{"FileNumber", "ImageNumber"}
+
+// shutterCountTags are the tags ShutterCount is read from, in order.
+var shutterCountTags = []string{"ShutterCount", "ImageCount"}
+
+// cameraFileNameRegexp matches the names cameras and phones give files
+// after their file counter e.g. IMG_4523, DSC04523, DSCF4523, _DSC4523 or
+// GOPR4523.
+var cameraFileNameRegexp = regexp.MustCompile(`^[A-Z_]{2,5}_?(\d{4,})$`)
+
+// fileNumber returns the FileNumber template field of filePath.
+func fileNumber(filePath string, tags map[string]any) string {
+	if number := counterTag(tags, fileNumberTags...); number != "" {
+		return number
+	}
+	name := filepath.Base(filePath)
+	match := cameraFileNameRegexp.FindStringSubmatch(strings.TrimSuffix(name, filepath.Ext(name)))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// counterTag returns the last run of digits in the first of names that tags
+// have with one e.g. 4523 for a FileNumber of 100-4523.
+func counterTag(tags map[string]any, names ...string) string {
+	for _, name := range names {
+		value, ok := tags[name]
+		if !ok {
+			continue
+		}
+		s := whereString(value)
+		end := strings.LastIndexFunc(s, isASCIIDigit) + 1
+		if end == 0 {
+			continue
+		}
+		start := strings.LastIndexFunc(s[:end], func(r rune) bool { return !isASCIIDigit(r) }) + 1
+		return s[start:end]
+	}
+	return ""
+}
+
+func isASCIIDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+// usesMIMEType reports whether a template uses MediaType and a -media-type
+// rule matches MIME types, which have to be asked of exiftool.
+func (moveCmd *MoveCmd) usesMIMEType() bool {
+	if !slices.ContainsFunc(moveCmd.MediaTypes, func(rule mediaTypeRule) bool {
+		return len(rule.MIMETypes) > 0
+	}) {
+		return false
+	}
+	return walkTemplates(moveCmd.templates()...).UsesField("MediaType")
+}
+
+// mediaTypeRule gives the media type Name to files with one of Exts or
+// whose MIME type matches one of MIMETypes.
+type mediaTypeRule struct {
+	Name string
+	// Exts are lowercase extensions, including the dot.
+	Exts []string
+	// MIMETypes are path.Match patterns e.g. video/* or image/x-canon-cr2.
+	MIMETypes []string
+}
+
+// defaultMediaTypes put images under photos and videos under videos, by
+// the MIME type exiftool tells from their contents.
+var defaultMediaTypes = []mediaTypeRule{
+	{Name: "photos", MIMETypes: []string{"image/*"}},
+	{Name: "videos", MIMETypes: []string{"video/*"}},
+}
+
+// parseMediaTypeRule parses a -media-type value of the form
+// NAME=PATTERN,PATTERN where each pattern is an extension (mts or .mts) or,
+// if it contains a slash, a MIME type pattern e.g. 'videos=video/*,lrv'.
+func parseMediaTypeRule(value string) (mediaTypeRule, error) {
+	name, patterns, ok := strings.Cut(value, "=")
+	if !ok || name == "" || patterns == "" {
+		return mediaTypeRule{}, fmt.Errorf("invalid media type %q, must be NAME=PATTERN,PATTERN", value)
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return mediaTypeRule{}, fmt.Errorf("invalid media type name %q, it must be a single directory name", name)
+	}
+	rule := mediaTypeRule{Name: name}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.Contains(pattern, "/") {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return mediaTypeRule{}, fmt.Errorf("invalid MIME type pattern %q: %w", pattern, err)
+			}
+			rule.MIMETypes = append(rule.MIMETypes, pattern)
+			continue
+		}
+		pattern = strings.TrimPrefix(pattern, ".")
+		if pattern == "" || strings.Contains(pattern, ".") {
+			return mediaTypeRule{}, fmt.Errorf("invalid extension %q", pattern)
+		}
+		rule.Exts = append(rule.Exts, "."+pattern)
+	}
+	return rule, nil
+}
+
+// mediaType returns the name of the first of rules that the file at
+// filePath, with the metadata exif, matches.
+func mediaType(rules []mediaTypeRule, filePath string, exif Exif) string {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	mimeType, _ := exif.Tags["MIMEType"].(string)
+	mimeType = strings.ToLower(mimeType)
+	for _, rule := range rules {
+		if slices.Contains(rule.Exts, ext) {
+			return rule.Name
+		}
+		if mimeType == "" {
+			continue
+		}
+		for _, pattern := range rule.MIMETypes {
+			if ok, _ := path.Match(pattern, mimeType); ok {
+				return rule.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Strftime formats the creation time according to a strftime-like format
+// e.g. {{.Strftime "%Y/%m-%B"}}.
+func (data moveTemplateData) Strftime(format string) string {
+	return strftime(format, data.CreationTime, data.monthNames)
+}
+
+// DayFormat formats the day the file belongs to according to a Go time
+// layout, which is the day it was created unless it was created before
+// -day-boundary e.g. {{.DayFormat "2006/01/02"}}.
+func (data moveTemplateData) DayFormat(layout string) string {
+	return data.CreationTime.Add(-data.dayBoundary).Format(layout)
+}
+
+// parseDayBoundary parses a -day-boundary time of day of the form HH:MM.
+func parseDayBoundary(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, must be HH:MM e.g. 04:00", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func newMoveTemplate(text string) (*template.Template, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// Catch references to nonexistent fields up front instead of once per
+	// file.
+	err = t.Execute(io.Discard, moveTemplateData{
+		CreationTime: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		monthNames:   localeMonthNames["en"],
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// pathSegmentReplacer keeps free-text tags and names used in templates
+// (a Model like "EOS 5D/5Ds", a -month-names entry) from adding directories
+// to the new path.
+var pathSegmentReplacer = strings.NewReplacer("/", "-", `\`, "-")
+
+// templateData returns the moveTemplateData of filePath.
+func (moveCmd *MoveCmd) templateData(filePath string, exif Exif) moveTemplateData {
+	t := exif.CreationTime
+	data := moveTemplateData{
+		Dir:          filepath.Dir(filePath),
+		Name:         filepath.Base(filePath),
+		Ext:          filepath.Ext(filePath),
+		Timestamp:    t.Format("2006-01-02T150405.000-0700"),
+		Date:         t.Format("2006-01-02"),
+		Year:         t.Format("2006"),
+		Month:        t.Format("01"),
+		Day:          t.Format("02"),
+		Hour:         t.Format("15"),
+		Minute:       t.Format("04"),
+		Second:       t.Format("05"),
+		Make:         pathSegmentReplacer.Replace(exif.Make),
+		Model:        pathSegmentReplacer.Replace(exif.Model),
+		Country:      pathSegmentReplacer.Replace(exif.Country),
+		City:         pathSegmentReplacer.Replace(exif.City),
+		MonthName:    pathSegmentReplacer.Replace(moveCmd.MonthNames[t.Month()-1]),
+		MediaType:    mediaType(moveCmd.MediaTypes, filePath, exif),
+		FileNumber:   pathSegmentReplacer.Replace(fileNumber(filePath, exif.Tags)),
+		ShutterCount: pathSegmentReplacer.Replace(counterTag(exif.Tags, shutterCountTags...)),
+		CreationTime: t,
+		monthNames:   moveCmd.MonthNames,
+		dayBoundary:  moveCmd.DayBoundary,
+		tags:         exif.Tags,
+	}
+	if exif.GPSPosition != nil {
+		data.Latitude = strconv.FormatFloat(exif.GPSPosition.Latitude, 'f', 4, 64)
+		data.Longitude = strconv.FormatFloat(exif.GPSPosition.Longitude, 'f', 4, 64)
+	}
+	return data
+}
+
+// newFilePath evaluates the -to and -name templates for filePath.
+func (moveCmd *MoveCmd) newFilePath(filePath string, exif Exif) (string, error) {
+	data := moveCmd.templateData(filePath, exif)
+	var b strings.Builder
+	err := moveCmd.DirTemplate.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(b.String())
+	if err != nil {
+		return "", err
+	}
+	if moveCmd.DateOnlyNames && exif.DateOnly {
+		data.Timestamp, err = moveCmd.dateOrdinal(filePath, dir, data.Date)
+		if err != nil {
+			return "", err
+		}
+	}
+	if moveCmd.dailyIndexed {
+		data.DailyIndex, err = moveCmd.dailyIndex(filePath, dir, data)
+		if err != nil {
+			return "", err
+		}
+	}
+	b.Reset()
+	err = moveCmd.NameTemplate.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	name := b.String()
+	if moveCmd.NormalizeExt {
+		name = normalizeExt(name, moveCmd.ExtMap)
+	}
+	if moveCmd.FixExt {
+		name = fixExt(name, exif.FileTypeExtension, moveCmd.ExtMap)
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("-name template produced invalid file name %q", name)
+	}
+	newFilePath := filepath.Join(dir, name)
+	if moveCmd.NormalizeNames != "" {
+		newFilePath, err = normalizedPath(filePath, newFilePath, moveCmd.NormalizeNames)
+		if err != nil {
+			return "", err
+		}
+	}
+	return moveCmd.fitPathLength(newFilePath)
+}
+
+// replicaFilePaths evaluates the -replica-to templates for filePath, giving
+// each replica the same name as newFilePath.
+func (moveCmd *MoveCmd) replicaFilePaths(filePath, newFilePath string, exif Exif) ([]string, error) {
+	if len(moveCmd.ReplicaTemplates) == 0 {
+		return nil, nil
+	}
+	data := moveCmd.templateData(filePath, exif)
+	var replicaPaths []string
+	for _, replicaTemplate := range moveCmd.ReplicaTemplates {
+		var b strings.Builder
+		err := replicaTemplate.Execute(&b, data)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := filepath.Abs(b.String())
+		if err != nil {
+			return nil, err
+		}
+		replicaPaths = append(replicaPaths, filepath.Join(dir, filepath.Base(newFilePath)))
+	}
+	return replicaPaths, nil
+}
+
+// replicate copies filePath to each of replicaPaths and checks every copy
+// against the SHA-256 of filePath, read back from the destination rather
+// than trusted from the write. A replica that already exists with the same
+// contents, from an earlier run that failed before the move, counts as
+// done.
+func (moveCmd *MoveCmd) replicate(ctx context.Context, logger *slog.Logger, dirLocks *keyedMutex, filePath string, replicaPaths []string) error {
+	if len(replicaPaths) == 0 {
+		return nil
+	}
+	hash, err := hashFile(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	for _, replicaPath := range replicaPaths {
+		err := func() error {
+			dir := filepath.Dir(replicaPath)
+			unlock := dirLocks.Lock(strings.ToLower(dir))
+			defer unlock()
+			err := moveCmd.MkdirAll(osFS{}, dir, moveCmd.Durable)
+			if err != nil {
+				return err
+			}
+			err = copyNoReplace(filePath, replicaPath)
+			copied := err == nil
+			if err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			replicaHash, err := hashFile(ctx, replicaPath)
+			if err != nil {
+				return err
+			}
+			if replicaHash != hash {
+				if copied {
+					os.Remove(replicaPath)
+					return fmt.Errorf("%s: copy does not match the original", replicaPath)
+				}
+				return fmt.Errorf("%s: %w with different contents", replicaPath, fs.ErrExist)
+			}
+			if !copied {
+				logger.Debug("replica already exists", slog.String("replicaPath", replicaPath))
+				return nil
+			}
+			err = moveCmd.Apply(replicaPath)
+			if err != nil {
+				logger.Warn(err.Error(), slog.String("replicaPath", replicaPath))
+			}
+			if moveCmd.Durable {
+				err := syncFile(replicaPath)
+				if err == nil {
+					err = syncDir(osFS{}, dir)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			logger.Info("copied file", slog.String("replicaPath", replicaPath))
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dateOrdinalRegexp matches the names given by DateOnlyNames, capturing
+// the date and the ordinal.
+var dateOrdinalRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})_(\d{4,})$`)
+
+// dateOrdinal returns the name without extension DateOnlyNames gives
+// filePath in dir: date followed by one more than the highest ordinal
+// already used for that date in dir. A file already named after its date
+// keeps its name, so that running again doesn't renumber everything.
+func (moveCmd *MoveCmd) dateOrdinal(filePath, dir, date string) (string, error) {
+	stem := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	if match := dateOrdinalRegexp.FindStringSubmatch(stem); match != nil && match[1] == date {
+		return stem, nil
+	}
+	moveCmd.ordinalsMutex.Lock()
+	defer moveCmd.ordinalsMutex.Unlock()
+	key := dir + string(filepath.Separator) + date
+	ordinal, ok := moveCmd.ordinals[key]
+	if !ok {
+		dirEntries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			match := dateOrdinalRegexp.FindStringSubmatch(strings.TrimSuffix(name, filepath.Ext(name)))
+			if match == nil || match[1] != date {
+				continue
+			}
+			n, err := strconv.Atoi(match[2])
+			if err == nil {
+				ordinal = max(ordinal, n)
+			}
+		}
+		if moveCmd.ordinals == nil {
+			moveCmd.ordinals = make(map[string]int)
+		}
+	}
+	ordinal++
+	moveCmd.ordinals[key] = ordinal
+	return fmt.Sprintf("%s_%04d", date, ordinal), nil
+}
+
+// dailyIndex returns the DailyIndex of filePath when it is moved into dir.
+// Names are numbered separately for every text around the index in the
+// -name template, which includes the date when the name has one. A file
+// that is already in dir with a name of the same pattern keeps its number.
+func (moveCmd *MoveCmd) dailyIndex(filePath, dir string, data moveTemplateData) (string, error) {
+	data.DailyIndex = "\x00"
+	var b strings.Builder
+	err := moveCmd.NameTemplate.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	prefix, suffix, ok := strings.Cut(b.String(), "\x00")
+	if !ok {
+		return "", nil
+	}
+	suffix = strings.TrimSuffix(suffix, filepath.Ext(suffix))
+	// index returns the number in name if it has the pattern, ignoring its
+	// extension.
+	index := func(name string) (int, bool) {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			return 0, false
+		}
+		digits := rest[:len(rest)-len(strings.TrimLeft(rest, "0123456789"))]
+		rest = rest[len(digits):]
+		if digits == "" || strings.TrimSuffix(rest, filepath.Ext(rest)) != suffix {
+			return 0, false
+		}
+		n, err := strconv.Atoi(digits)
+		return n, err == nil
+	}
+	if filepath.Dir(filePath) == dir {
+		if n, ok := index(filepath.Base(filePath)); ok {
+			return fmt.Sprintf("%04d", n), nil
+		}
+	}
+	moveCmd.ordinalsMutex.Lock()
+	defer moveCmd.ordinalsMutex.Unlock()
+	key := dir + "\x00" + prefix + "\x00" + suffix
+	ordinal, ok := moveCmd.ordinals[key]
+	if !ok {
+		dirEntries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		for _, dirEntry := range dirEntries {
+			if n, ok := index(dirEntry.Name()); ok {
+				ordinal = max(ordinal, n)
+			}
+		}
+		if moveCmd.ordinals == nil {
+			moveCmd.ordinals = make(map[string]int)
+		}
+	}
+	ordinal++
+	moveCmd.ordinals[key] = ordinal
+	return fmt.Sprintf("%04d", ordinal), nil
+}
+
+// fitPathLength checks newFilePath against MaxNameLength and MaxPathLength,
+// so that overly long paths are caught with a clear error before anything is
+// moved instead of failing in the middle of a run with whatever error the
+// OS or file server returns. With LongNames set to truncate, the name is
+// shortened to fit instead.
+func (moveCmd *MoveCmd) fitPathLength(newFilePath string) (string, error) {
+	name := filepath.Base(newFilePath)
+	var excess int
+	if moveCmd.MaxNameLength > 0 && len(name) > moveCmd.MaxNameLength {
+		excess = len(name) - moveCmd.MaxNameLength
+	}
+	if moveCmd.MaxPathLength > 0 && len(newFilePath) > moveCmd.MaxPathLength {
+		excess = max(excess, len(newFilePath)-moveCmd.MaxPathLength)
+	}
+	if excess == 0 {
+		return newFilePath, nil
+	}
+	if moveCmd.LongNames != "truncate" {
+		return "", fmt.Errorf("new path %s is %d bytes too long for -max-name %d or -max-path %d (use -long-names truncate to shorten it)", newFilePath, excess, moveCmd.MaxNameLength, moveCmd.MaxPathLength)
+	}
+	name, ok := truncateName(name, excess)
+	if !ok {
+		return "", fmt.Errorf("new path %s is %d bytes too long for -max-name %d or -max-path %d, even with its name truncated", newFilePath, excess, moveCmd.MaxNameLength, moveCmd.MaxPathLength)
+	}
+	return filepath.Join(filepath.Dir(newFilePath), name), nil
+}
+
+// newCompanionFilePath returns the path a companion file should be moved to
+// when its original is moved from filePath to newFilePath. Companions keep
+// their own names if the original kept its name, otherwise they are named
+// after the original's new name.
+func newCompanionFilePath(filePath, newFilePath string, companionFile companionFile) string {
+	if companionFile.AppleDouble {
+		// An AppleDouble file is named after whatever file it belongs to.
+		ownerFile := companionFile
+		ownerFile.FilePath = filepath.Join(filepath.Dir(companionFile.FilePath), strings.TrimPrefix(filepath.Base(companionFile.FilePath), "._"))
+		ownerFile.AppleDouble = false
+		newOwnerPath := newFilePath
+		if ownerFile.FilePath != filePath {
+			newOwnerPath = newCompanionFilePath(filePath, newFilePath, ownerFile)
+		}
+		return filepath.Join(filepath.Dir(newOwnerPath), "._"+filepath.Base(newOwnerPath))
+	}
+	if filepath.Base(filePath) == filepath.Base(newFilePath) {
+		return filepath.Join(filepath.Dir(newFilePath), filepath.Base(companionFile.FilePath))
+	}
+	if companionFile.FullName {
+		return newFilePath + filepath.Ext(companionFile.FilePath)
+	}
+	return strings.TrimSuffix(newFilePath, filepath.Ext(newFilePath)) + companionFile.Suffix + filepath.Ext(companionFile.FilePath)
+}
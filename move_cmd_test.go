@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestRenameInto(t *testing.T) {
+	trashDir := "/b/c/" + trashDirName + "/" + time.Now().Format("2006-01-02")
+	tests := []struct {
+		name            string
+		files           map[string]string
+		fail            [][2]string
+		replaceIfExists bool
+		wantErr         error
+		wantFiles       map[string]string
+	}{{
+		name:      "creates directory",
+		files:     map[string]string{"/a/x.jpg": "x"},
+		wantFiles: map[string]string{"/b/c/y.jpg": "x"},
+	}, {
+		name:      "collision",
+		files:     map[string]string{"/a/x.jpg": "x", "/b/c/y.jpg": "y"},
+		wantErr:   fs.ErrExist,
+		wantFiles: map[string]string{"/a/x.jpg": "x", "/b/c/y.jpg": "y"},
+	}, {
+		name:            "replace",
+		files:           map[string]string{"/a/x.jpg": "x", "/b/c/y.jpg": "y"},
+		replaceIfExists: true,
+		wantFiles:       map[string]string{"/b/c/y.jpg": "x", trashDir + "/y.jpg": "y"},
+	}, {
+		name:      "mkdir error",
+		files:     map[string]string{"/a/x.jpg": "x"},
+		fail:      [][2]string{{"mkdir", "/b/c"}},
+		wantErr:   fs.ErrPermission,
+		wantFiles: map[string]string{"/a/x.jpg": "x"},
+	}, {
+		name:      "rename error",
+		files:     map[string]string{"/a/x.jpg": "x"},
+		fail:      [][2]string{{"rename", "/a/x.jpg"}},
+		wantErr:   fs.ErrPermission,
+		wantFiles: map[string]string{"/a/x.jpg": "x"},
+	}, {
+		name:      "missing source",
+		files:     map[string]string{"/a/z.jpg": "z"},
+		wantErr:   fs.ErrNotExist,
+		wantFiles: map[string]string{"/a/z.jpg": "z"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := newMemFS(tt.files)
+			for _, fail := range tt.fail {
+				fsys.fail(fail[0], fail[1], syscall.EACCES)
+			}
+			moveCmd := &MoveCmd{fsys: fsys}
+			moveCmd.ReplaceIfExists = tt.replaceIfExists
+			err := moveCmd.renameInto(context.Background(), newLogger(io.Discard, false), &keyedMutex{}, nil, "/a/x.jpg", "/b/c/y.jpg")
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			for name, want := range tt.wantFiles {
+				got, ok := fsys.readFile(name)
+				if !ok || got != want {
+					t.Errorf("%s: got %q (exists: %v), want %q", name, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameIntoConcurrent(t *testing.T) {
+	const numWorkers = 16
+	srcDir := t.TempDir()
+	newFilePath := filepath.Join(t.TempDir(), "dst", "2021-06-01_120000.jpg")
+	for i := range numWorkers {
+		err := os.WriteFile(filepath.Join(srcDir, strconv.Itoa(i)+".jpg"), []byte(strconv.Itoa(i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	moveCmd := &MoveCmd{}
+	logger := newLogger(io.Discard, false)
+	var dirLocks keyedMutex
+	errs := make([]error, numWorkers)
+	var waitGroup sync.WaitGroup
+	start := make(chan struct{})
+	for i := range numWorkers {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			<-start
+			errs[i] = moveCmd.renameInto(context.Background(), logger, &dirLocks, nil, filepath.Join(srcDir, strconv.Itoa(i)+".jpg"), newFilePath)
+		}()
+	}
+	close(start)
+	waitGroup.Wait()
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			if winner >= 0 {
+				t.Fatalf("both %d and %d were moved to %s", winner, i, newFilePath)
+			}
+			winner = i
+			continue
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			t.Errorf("%d: got error %v, want %v", i, err, fs.ErrExist)
+		}
+		_, err := os.Stat(filepath.Join(srcDir, strconv.Itoa(i)+".jpg"))
+		if err != nil {
+			t.Errorf("%d: lost: %v", i, err)
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("no file was moved to %s", newFilePath)
+	}
+	b, err := os.ReadFile(newFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != strconv.Itoa(winner) {
+		t.Errorf("%s: got the contents of %s.jpg, want those of %d.jpg", newFilePath, b, winner)
+	}
+}
+
+func TestRenameIntoVanishedDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		vanish    int
+		wantErr   error
+		wantFiles map[string]string
+	}{{
+		name:      "once",
+		vanish:    1,
+		wantFiles: map[string]string{"/b/c/y.jpg": "x"},
+	}, {
+		name:      "every attempt",
+		vanish:    maxRenameAttempts,
+		wantErr:   fs.ErrNotExist,
+		wantFiles: map[string]string{"/a/x.jpg": "x"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := newMemFS(map[string]string{"/a/x.jpg": "x"})
+			vanished := 0
+			// Something like exifutil trash empty removes the directory
+			// for being empty between its creation and the rename.
+			fsys.beforeRename = func(oldPath, newPath string) {
+				if vanished < tt.vanish {
+					vanished++
+					err := fsys.Remove(filepath.ToSlash(filepath.Dir(newPath)))
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}
+			moveCmd := &MoveCmd{fsys: fsys}
+			err := moveCmd.renameInto(context.Background(), newLogger(io.Discard, false), &keyedMutex{}, nil, "/a/x.jpg", "/b/c/y.jpg")
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if vanished != tt.vanish {
+				t.Errorf("directory vanished %d times, want %d", vanished, tt.vanish)
+			}
+			for name, want := range tt.wantFiles {
+				got, ok := fsys.readFile(name)
+				if !ok || got != want {
+					t.Errorf("%s: got %q (exists: %v), want %q", name, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWalkTemplates(t *testing.T) {
+	tests := []struct {
+		templates []string
+		fields    []string
+		tags      []string
+	}{{
+		templates: []string{"{{.Timestamp}}{{.Ext}}"},
+		fields:    []string{"Timestamp", "Ext"},
+	}, {
+		templates: []string{"{{.Dir}}/{{.MediaType}}", "{{.Date}}_{{.DailyIndex}}{{.Ext}}"},
+		fields:    []string{"Dir", "MediaType", "Date", "DailyIndex", "Ext"},
+	}, {
+		// Fields are found inside if, with and range, and tags given as
+		// string constants are found anywhere a Tag is called.
+		templates: []string{`{{if .Model}}{{.Model}}{{else}}{{.Tag "LensModel"}}{{end}}/{{with .Tag "Rating"}}{{.}}{{end}}`, `{{.Tag "LensModel" | printf "%s"}}{{.FileNumber}}`},
+		fields:    []string{"Model", "Tag", "FileNumber"},
+		tags:      []string{"LensModel", "Rating"},
+	}, {
+		// A tag name that is not a constant can't be known up front.
+		templates: []string{"{{.Tag .Make}}"},
+		fields:    []string{"Tag", "Make"},
+	}}
+	for _, tt := range tests {
+		var templates []*template.Template
+		for _, text := range tt.templates {
+			templates = append(templates, template.Must(newMoveTemplate(text)))
+		}
+		// Missing templates are skipped.
+		uses := walkTemplates(append(templates, nil)...)
+		if !slices.Equal(uses.Fields, tt.fields) {
+			t.Errorf("%q: got fields %q, want %q", tt.templates, uses.Fields, tt.fields)
+		}
+		if !slices.Equal(uses.Tags, tt.tags) {
+			t.Errorf("%q: got tags %q, want %q", tt.templates, uses.Tags, tt.tags)
+		}
+		for _, field := range tt.fields {
+			if !uses.UsesField(field) {
+				t.Errorf("%q: UsesField(%q) = false", tt.templates, field)
+			}
+		}
+		if uses.UsesField("ShutterCount") {
+			t.Errorf("%q: UsesField(ShutterCount) = true", tt.templates)
+		}
+	}
+}
+
+func TestTemplateDataPathSegments(t *testing.T) {
+	moveCmd := &MoveCmd{MonthNames: [12]string{"Jan/Jän"}}
+	exif := Exif{
+		CreationTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Make:         "Canon/Kodak",
+		Model:        `EOS 5D\5Ds`,
+		Country:      "Bosnia/Herzegovina",
+		City:         "Buda/Pest",
+		Tags: map[string]any{
+			"LensModel":    "EF24-70mm f/2.8L",
+			"FileNumber":   "100/4523",
+			"ShutterCount": 1234,
+		},
+	}
+	data := moveCmd.templateData("/photos/IMG_0001.jpg", exif)
+	tmpl := template.Must(newMoveTemplate(`{{.Make}}|{{.Model}}|{{.Country}}|{{.City}}|{{.MonthName}}|{{.FileNumber}}|{{.ShutterCount}}|{{.Tag "LensModel"}}`))
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Canon-Kodak|EOS 5D-5Ds|Bosnia-Herzegovina|Buda-Pest|Jan-Jän|4523|1234|EF24-70mm f-2.8L"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
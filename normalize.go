@@ -0,0 +1,400 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"unicode/utf8"
+)
+
+// unicodeCompositions lists the canonical compositions of Unicode 14.0.0 that
+// NFC puts back together, as triples of runes: the composed character, then
+// the two it decomposes into. Hangul syllables are composed algorithmically
+// instead.
+var unicodeCompositions = "" +
+	"\u00c0\u0041\u0300\u00c1\u0041\u0301\u00c2\u0041\u0302\u00c3\u0041\u0303\u00c4\u0041\u0308\u00c5\u0041\u030a\u00c7\u0043\u0327\u00c8\u0045\u0300" +
+	"\u00c9\u0045\u0301\u00ca\u0045\u0302\u00cb\u0045\u0308\u00cc\u0049\u0300\u00cd\u0049\u0301\u00ce\u0049\u0302\u00cf\u0049\u0308\u00d1\u004e\u0303" +
+	"\u00d2\u004f\u0300\u00d3\u004f\u0301\u00d4\u004f\u0302\u00d5\u004f\u0303\u00d6\u004f\u0308\u00d9\u0055\u0300\u00da\u0055\u0301\u00db\u0055\u0302" +
+	"\u00dc\u0055\u0308\u00dd\u0059\u0301\u00e0\u0061\u0300\u00e1\u0061\u0301\u00e2\u0061\u0302\u00e3\u0061\u0303\u00e4\u0061\u0308\u00e5\u0061\u030a" +
+	"\u00e7\u0063\u0327\u00e8\u0065\u0300\u00e9\u0065\u0301\u00ea\u0065\u0302\u00eb\u0065\u0308\u00ec\u0069\u0300\u00ed\u0069\u0301\u00ee\u0069\u0302" +
+	"\u00ef\u0069\u0308\u00f1\u006e\u0303\u00f2\u006f\u0300\u00f3\u006f\u0301\u00f4\u006f\u0302\u00f5\u006f\u0303\u00f6\u006f\u0308\u00f9\u0075\u0300" +
+	"\u00fa\u0075\u0301\u00fb\u0075\u0302\u00fc\u0075\u0308\u00fd\u0079\u0301\u00ff\u0079\u0308\u0100\u0041\u0304\u0101\u0061\u0304\u0102\u0041\u0306" +
+	"\u0103\u0061\u0306\u0104\u0041\u0328\u0105\u0061\u0328\u0106\u0043\u0301\u0107\u0063\u0301\u0108\u0043\u0302\u0109\u0063\u0302\u010a\u0043\u0307" +
+	"\u010b\u0063\u0307\u010c\u0043\u030c\u010d\u0063\u030c\u010e\u0044\u030c\u010f\u0064\u030c\u0112\u0045\u0304\u0113\u0065\u0304\u0114\u0045\u0306" +
+	"\u0115\u0065\u0306\u0116\u0045\u0307\u0117\u0065\u0307\u0118\u0045\u0328\u0119\u0065\u0328\u011a\u0045\u030c\u011b\u0065\u030c\u011c\u0047\u0302" +
+	"\u011d\u0067\u0302\u011e\u0047\u0306\u011f\u0067\u0306\u0120\u0047\u0307\u0121\u0067\u0307\u0122\u0047\u0327\u0123\u0067\u0327\u0124\u0048\u0302" +
+	"\u0125\u0068\u0302\u0128\u0049\u0303\u0129\u0069\u0303\u012a\u0049\u0304\u012b\u0069\u0304\u012c\u0049\u0306\u012d\u0069\u0306\u012e\u0049\u0328" +
+	"\u012f\u0069\u0328\u0130\u0049\u0307\u0134\u004a\u0302\u0135\u006a\u0302\u0136\u004b\u0327\u0137\u006b\u0327\u0139\u004c\u0301\u013a\u006c\u0301" +
+	"\u013b\u004c\u0327\u013c\u006c\u0327\u013d\u004c\u030c\u013e\u006c\u030c\u0143\u004e\u0301\u0144\u006e\u0301\u0145\u004e\u0327\u0146\u006e\u0327" +
+	"\u0147\u004e\u030c\u0148\u006e\u030c\u014c\u004f\u0304\u014d\u006f\u0304\u014e\u004f\u0306\u014f\u006f\u0306\u0150\u004f\u030b\u0151\u006f\u030b" +
+	"\u0154\u0052\u0301\u0155\u0072\u0301\u0156\u0052\u0327\u0157\u0072\u0327\u0158\u0052\u030c\u0159\u0072\u030c\u015a\u0053\u0301\u015b\u0073\u0301" +
+	"\u015c\u0053\u0302\u015d\u0073\u0302\u015e\u0053\u0327\u015f\u0073\u0327\u0160\u0053\u030c\u0161\u0073\u030c\u0162\u0054\u0327\u0163\u0074\u0327" +
+	"\u0164\u0054\u030c\u0165\u0074\u030c\u0168\u0055\u0303\u0169\u0075\u0303\u016a\u0055\u0304\u016b\u0075\u0304\u016c\u0055\u0306\u016d\u0075\u0306" +
+	"\u016e\u0055\u030a\u016f\u0075\u030a\u0170\u0055\u030b\u0171\u0075\u030b\u0172\u0055\u0328\u0173\u0075\u0328\u0174\u0057\u0302\u0175\u0077\u0302" +
+	"\u0176\u0059\u0302\u0177\u0079\u0302\u0178\u0059\u0308\u0179\u005a\u0301\u017a\u007a\u0301\u017b\u005a\u0307\u017c\u007a\u0307\u017d\u005a\u030c" +
+	"\u017e\u007a\u030c\u01a0\u004f\u031b\u01a1\u006f\u031b\u01af\u0055\u031b\u01b0\u0075\u031b\u01cd\u0041\u030c\u01ce\u0061\u030c\u01cf\u0049\u030c" +
+	"\u01d0\u0069\u030c\u01d1\u004f\u030c\u01d2\u006f\u030c\u01d3\u0055\u030c\u01d4\u0075\u030c\u01d5\u00dc\u0304\u01d6\u00fc\u0304\u01d7\u00dc\u0301" +
+	"\u01d8\u00fc\u0301\u01d9\u00dc\u030c\u01da\u00fc\u030c\u01db\u00dc\u0300\u01dc\u00fc\u0300\u01de\u00c4\u0304\u01df\u00e4\u0304\u01e0\u0226\u0304" +
+	"\u01e1\u0227\u0304\u01e2\u00c6\u0304\u01e3\u00e6\u0304\u01e6\u0047\u030c\u01e7\u0067\u030c\u01e8\u004b\u030c\u01e9\u006b\u030c\u01ea\u004f\u0328" +
+	"\u01eb\u006f\u0328\u01ec\u01ea\u0304\u01ed\u01eb\u0304\u01ee\u01b7\u030c\u01ef\u0292\u030c\u01f0\u006a\u030c\u01f4\u0047\u0301\u01f5\u0067\u0301" +
+	"\u01f8\u004e\u0300\u01f9\u006e\u0300\u01fa\u00c5\u0301\u01fb\u00e5\u0301\u01fc\u00c6\u0301\u01fd\u00e6\u0301\u01fe\u00d8\u0301\u01ff\u00f8\u0301" +
+	"\u0200\u0041\u030f\u0201\u0061\u030f\u0202\u0041\u0311\u0203\u0061\u0311\u0204\u0045\u030f\u0205\u0065\u030f\u0206\u0045\u0311\u0207\u0065\u0311" +
+	"\u0208\u0049\u030f\u0209\u0069\u030f\u020a\u0049\u0311\u020b\u0069\u0311\u020c\u004f\u030f\u020d\u006f\u030f\u020e\u004f\u0311\u020f\u006f\u0311" +
+	"\u0210\u0052\u030f\u0211\u0072\u030f\u0212\u0052\u0311\u0213\u0072\u0311\u0214\u0055\u030f\u0215\u0075\u030f\u0216\u0055\u0311\u0217\u0075\u0311" +
+	"\u0218\u0053\u0326\u0219\u0073\u0326\u021a\u0054\u0326\u021b\u0074\u0326\u021e\u0048\u030c\u021f\u0068\u030c\u0226\u0041\u0307\u0227\u0061\u0307" +
+	"\u0228\u0045\u0327\u0229\u0065\u0327\u022a\u00d6\u0304\u022b\u00f6\u0304\u022c\u00d5\u0304\u022d\u00f5\u0304\u022e\u004f\u0307\u022f\u006f\u0307" +
+	"\u0230\u022e\u0304\u0231\u022f\u0304\u0232\u0059\u0304\u0233\u0079\u0304\u0385\u00a8\u0301\u0386\u0391\u0301\u0388\u0395\u0301\u0389\u0397\u0301" +
+	"\u038a\u0399\u0301\u038c\u039f\u0301\u038e\u03a5\u0301\u038f\u03a9\u0301\u0390\u03ca\u0301\u03aa\u0399\u0308\u03ab\u03a5\u0308\u03ac\u03b1\u0301" +
+	"\u03ad\u03b5\u0301\u03ae\u03b7\u0301\u03af\u03b9\u0301\u03b0\u03cb\u0301\u03ca\u03b9\u0308\u03cb\u03c5\u0308\u03cc\u03bf\u0301\u03cd\u03c5\u0301" +
+	"\u03ce\u03c9\u0301\u03d3\u03d2\u0301\u03d4\u03d2\u0308\u0400\u0415\u0300\u0401\u0415\u0308\u0403\u0413\u0301\u0407\u0406\u0308\u040c\u041a\u0301" +
+	"\u040d\u0418\u0300\u040e\u0423\u0306\u0419\u0418\u0306\u0439\u0438\u0306\u0450\u0435\u0300\u0451\u0435\u0308\u0453\u0433\u0301\u0457\u0456\u0308" +
+	"\u045c\u043a\u0301\u045d\u0438\u0300\u045e\u0443\u0306\u0476\u0474\u030f\u0477\u0475\u030f\u04c1\u0416\u0306\u04c2\u0436\u0306\u04d0\u0410\u0306" +
+	"\u04d1\u0430\u0306\u04d2\u0410\u0308\u04d3\u0430\u0308\u04d6\u0415\u0306\u04d7\u0435\u0306\u04da\u04d8\u0308\u04db\u04d9\u0308\u04dc\u0416\u0308" +
+	"\u04dd\u0436\u0308\u04de\u0417\u0308\u04df\u0437\u0308\u04e2\u0418\u0304\u04e3\u0438\u0304\u04e4\u0418\u0308\u04e5\u0438\u0308\u04e6\u041e\u0308" +
+	"\u04e7\u043e\u0308\u04ea\u04e8\u0308\u04eb\u04e9\u0308\u04ec\u042d\u0308\u04ed\u044d\u0308\u04ee\u0423\u0304\u04ef\u0443\u0304\u04f0\u0423\u0308" +
+	"\u04f1\u0443\u0308\u04f2\u0423\u030b\u04f3\u0443\u030b\u04f4\u0427\u0308\u04f5\u0447\u0308\u04f8\u042b\u0308\u04f9\u044b\u0308\u0622\u0627\u0653" +
+	"\u0623\u0627\u0654\u0624\u0648\u0654\u0625\u0627\u0655\u0626\u064a\u0654\u06c0\u06d5\u0654\u06c2\u06c1\u0654\u06d3\u06d2\u0654\u0929\u0928\u093c" +
+	"\u0931\u0930\u093c\u0934\u0933\u093c\u09cb\u09c7\u09be\u09cc\u09c7\u09d7\u0b48\u0b47\u0b56\u0b4b\u0b47\u0b3e\u0b4c\u0b47\u0b57\u0b94\u0b92\u0bd7" +
+	"\u0bca\u0bc6\u0bbe\u0bcb\u0bc7\u0bbe\u0bcc\u0bc6\u0bd7\u0c48\u0c46\u0c56\u0cc0\u0cbf\u0cd5\u0cc7\u0cc6\u0cd5\u0cc8\u0cc6\u0cd6\u0cca\u0cc6\u0cc2" +
+	"\u0ccb\u0cca\u0cd5\u0d4a\u0d46\u0d3e\u0d4b\u0d47\u0d3e\u0d4c\u0d46\u0d57\u0dda\u0dd9\u0dca\u0ddc\u0dd9\u0dcf\u0ddd\u0ddc\u0dca\u0dde\u0dd9\u0ddf" +
+	"\u1026\u1025\u102e\u1b06\u1b05\u1b35\u1b08\u1b07\u1b35\u1b0a\u1b09\u1b35\u1b0c\u1b0b\u1b35\u1b0e\u1b0d\u1b35\u1b12\u1b11\u1b35\u1b3b\u1b3a\u1b35" +
+	"\u1b3d\u1b3c\u1b35\u1b40\u1b3e\u1b35\u1b41\u1b3f\u1b35\u1b43\u1b42\u1b35\u1e00\u0041\u0325\u1e01\u0061\u0325\u1e02\u0042\u0307\u1e03\u0062\u0307" +
+	"\u1e04\u0042\u0323\u1e05\u0062\u0323\u1e06\u0042\u0331\u1e07\u0062\u0331\u1e08\u00c7\u0301\u1e09\u00e7\u0301\u1e0a\u0044\u0307\u1e0b\u0064\u0307" +
+	"\u1e0c\u0044\u0323\u1e0d\u0064\u0323\u1e0e\u0044\u0331\u1e0f\u0064\u0331\u1e10\u0044\u0327\u1e11\u0064\u0327\u1e12\u0044\u032d\u1e13\u0064\u032d" +
+	"\u1e14\u0112\u0300\u1e15\u0113\u0300\u1e16\u0112\u0301\u1e17\u0113\u0301\u1e18\u0045\u032d\u1e19\u0065\u032d\u1e1a\u0045\u0330\u1e1b\u0065\u0330" +
+	"\u1e1c\u0228\u0306\u1e1d\u0229\u0306\u1e1e\u0046\u0307\u1e1f\u0066\u0307\u1e20\u0047\u0304\u1e21\u0067\u0304\u1e22\u0048\u0307\u1e23\u0068\u0307" +
+	"\u1e24\u0048\u0323\u1e25\u0068\u0323\u1e26\u0048\u0308\u1e27\u0068\u0308\u1e28\u0048\u0327\u1e29\u0068\u0327\u1e2a\u0048\u032e\u1e2b\u0068\u032e" +
+	"\u1e2c\u0049\u0330\u1e2d\u0069\u0330\u1e2e\u00cf\u0301\u1e2f\u00ef\u0301\u1e30\u004b\u0301\u1e31\u006b\u0301\u1e32\u004b\u0323\u1e33\u006b\u0323" +
+	"\u1e34\u004b\u0331\u1e35\u006b\u0331\u1e36\u004c\u0323\u1e37\u006c\u0323\u1e38\u1e36\u0304\u1e39\u1e37\u0304\u1e3a\u004c\u0331\u1e3b\u006c\u0331" +
+	"\u1e3c\u004c\u032d\u1e3d\u006c\u032d\u1e3e\u004d\u0301\u1e3f\u006d\u0301\u1e40\u004d\u0307\u1e41\u006d\u0307\u1e42\u004d\u0323\u1e43\u006d\u0323" +
+	"\u1e44\u004e\u0307\u1e45\u006e\u0307\u1e46\u004e\u0323\u1e47\u006e\u0323\u1e48\u004e\u0331\u1e49\u006e\u0331\u1e4a\u004e\u032d\u1e4b\u006e\u032d" +
+	"\u1e4c\u00d5\u0301\u1e4d\u00f5\u0301\u1e4e\u00d5\u0308\u1e4f\u00f5\u0308\u1e50\u014c\u0300\u1e51\u014d\u0300\u1e52\u014c\u0301\u1e53\u014d\u0301" +
+	"\u1e54\u0050\u0301\u1e55\u0070\u0301\u1e56\u0050\u0307\u1e57\u0070\u0307\u1e58\u0052\u0307\u1e59\u0072\u0307\u1e5a\u0052\u0323\u1e5b\u0072\u0323" +
+	"\u1e5c\u1e5a\u0304\u1e5d\u1e5b\u0304\u1e5e\u0052\u0331\u1e5f\u0072\u0331\u1e60\u0053\u0307\u1e61\u0073\u0307\u1e62\u0053\u0323\u1e63\u0073\u0323" +
+	"\u1e64\u015a\u0307\u1e65\u015b\u0307\u1e66\u0160\u0307\u1e67\u0161\u0307\u1e68\u1e62\u0307\u1e69\u1e63\u0307\u1e6a\u0054\u0307\u1e6b\u0074\u0307" +
+	"\u1e6c\u0054\u0323\u1e6d\u0074\u0323\u1e6e\u0054\u0331\u1e6f\u0074\u0331\u1e70\u0054\u032d\u1e71\u0074\u032d\u1e72\u0055\u0324\u1e73\u0075\u0324" +
+	"\u1e74\u0055\u0330\u1e75\u0075\u0330\u1e76\u0055\u032d\u1e77\u0075\u032d\u1e78\u0168\u0301\u1e79\u0169\u0301\u1e7a\u016a\u0308\u1e7b\u016b\u0308" +
+	"\u1e7c\u0056\u0303\u1e7d\u0076\u0303\u1e7e\u0056\u0323\u1e7f\u0076\u0323\u1e80\u0057\u0300\u1e81\u0077\u0300\u1e82\u0057\u0301\u1e83\u0077\u0301" +
+	"\u1e84\u0057\u0308\u1e85\u0077\u0308\u1e86\u0057\u0307\u1e87\u0077\u0307\u1e88\u0057\u0323\u1e89\u0077\u0323\u1e8a\u0058\u0307\u1e8b\u0078\u0307" +
+	"\u1e8c\u0058\u0308\u1e8d\u0078\u0308\u1e8e\u0059\u0307\u1e8f\u0079\u0307\u1e90\u005a\u0302\u1e91\u007a\u0302\u1e92\u005a\u0323\u1e93\u007a\u0323" +
+	"\u1e94\u005a\u0331\u1e95\u007a\u0331\u1e96\u0068\u0331\u1e97\u0074\u0308\u1e98\u0077\u030a\u1e99\u0079\u030a\u1e9b\u017f\u0307\u1ea0\u0041\u0323" +
+	"\u1ea1\u0061\u0323\u1ea2\u0041\u0309\u1ea3\u0061\u0309\u1ea4\u00c2\u0301\u1ea5\u00e2\u0301\u1ea6\u00c2\u0300\u1ea7\u00e2\u0300\u1ea8\u00c2\u0309" +
+	"\u1ea9\u00e2\u0309\u1eaa\u00c2\u0303\u1eab\u00e2\u0303\u1eac\u1ea0\u0302\u1ead\u1ea1\u0302\u1eae\u0102\u0301\u1eaf\u0103\u0301\u1eb0\u0102\u0300" +
+	"\u1eb1\u0103\u0300\u1eb2\u0102\u0309\u1eb3\u0103\u0309\u1eb4\u0102\u0303\u1eb5\u0103\u0303\u1eb6\u1ea0\u0306\u1eb7\u1ea1\u0306\u1eb8\u0045\u0323" +
+	"\u1eb9\u0065\u0323\u1eba\u0045\u0309\u1ebb\u0065\u0309\u1ebc\u0045\u0303\u1ebd\u0065\u0303\u1ebe\u00ca\u0301\u1ebf\u00ea\u0301\u1ec0\u00ca\u0300" +
+	"\u1ec1\u00ea\u0300\u1ec2\u00ca\u0309\u1ec3\u00ea\u0309\u1ec4\u00ca\u0303\u1ec5\u00ea\u0303\u1ec6\u1eb8\u0302\u1ec7\u1eb9\u0302\u1ec8\u0049\u0309" +
+	"\u1ec9\u0069\u0309\u1eca\u0049\u0323\u1ecb\u0069\u0323\u1ecc\u004f\u0323\u1ecd\u006f\u0323\u1ece\u004f\u0309\u1ecf\u006f\u0309\u1ed0\u00d4\u0301" +
+	"\u1ed1\u00f4\u0301\u1ed2\u00d4\u0300\u1ed3\u00f4\u0300\u1ed4\u00d4\u0309\u1ed5\u00f4\u0309\u1ed6\u00d4\u0303\u1ed7\u00f4\u0303\u1ed8\u1ecc\u0302" +
+	"\u1ed9\u1ecd\u0302\u1eda\u01a0\u0301\u1edb\u01a1\u0301\u1edc\u01a0\u0300\u1edd\u01a1\u0300\u1ede\u01a0\u0309\u1edf\u01a1\u0309\u1ee0\u01a0\u0303" +
+	"\u1ee1\u01a1\u0303\u1ee2\u01a0\u0323\u1ee3\u01a1\u0323\u1ee4\u0055\u0323\u1ee5\u0075\u0323\u1ee6\u0055\u0309\u1ee7\u0075\u0309\u1ee8\u01af\u0301" +
+	"\u1ee9\u01b0\u0301\u1eea\u01af\u0300\u1eeb\u01b0\u0300\u1eec\u01af\u0309\u1eed\u01b0\u0309\u1eee\u01af\u0303\u1eef\u01b0\u0303\u1ef0\u01af\u0323" +
+	"\u1ef1\u01b0\u0323\u1ef2\u0059\u0300\u1ef3\u0079\u0300\u1ef4\u0059\u0323\u1ef5\u0079\u0323\u1ef6\u0059\u0309\u1ef7\u0079\u0309\u1ef8\u0059\u0303" +
+	"\u1ef9\u0079\u0303\u1f00\u03b1\u0313\u1f01\u03b1\u0314\u1f02\u1f00\u0300\u1f03\u1f01\u0300\u1f04\u1f00\u0301\u1f05\u1f01\u0301\u1f06\u1f00\u0342" +
+	"\u1f07\u1f01\u0342\u1f08\u0391\u0313\u1f09\u0391\u0314\u1f0a\u1f08\u0300\u1f0b\u1f09\u0300\u1f0c\u1f08\u0301\u1f0d\u1f09\u0301\u1f0e\u1f08\u0342" +
+	"\u1f0f\u1f09\u0342\u1f10\u03b5\u0313\u1f11\u03b5\u0314\u1f12\u1f10\u0300\u1f13\u1f11\u0300\u1f14\u1f10\u0301\u1f15\u1f11\u0301\u1f18\u0395\u0313" +
+	"\u1f19\u0395\u0314\u1f1a\u1f18\u0300\u1f1b\u1f19\u0300\u1f1c\u1f18\u0301\u1f1d\u1f19\u0301\u1f20\u03b7\u0313\u1f21\u03b7\u0314\u1f22\u1f20\u0300" +
+	"\u1f23\u1f21\u0300\u1f24\u1f20\u0301\u1f25\u1f21\u0301\u1f26\u1f20\u0342\u1f27\u1f21\u0342\u1f28\u0397\u0313\u1f29\u0397\u0314\u1f2a\u1f28\u0300" +
+	"\u1f2b\u1f29\u0300\u1f2c\u1f28\u0301\u1f2d\u1f29\u0301\u1f2e\u1f28\u0342\u1f2f\u1f29\u0342\u1f30\u03b9\u0313\u1f31\u03b9\u0314\u1f32\u1f30\u0300" +
+	"\u1f33\u1f31\u0300\u1f34\u1f30\u0301\u1f35\u1f31\u0301\u1f36\u1f30\u0342\u1f37\u1f31\u0342\u1f38\u0399\u0313\u1f39\u0399\u0314\u1f3a\u1f38\u0300" +
+	"\u1f3b\u1f39\u0300\u1f3c\u1f38\u0301\u1f3d\u1f39\u0301\u1f3e\u1f38\u0342\u1f3f\u1f39\u0342\u1f40\u03bf\u0313\u1f41\u03bf\u0314\u1f42\u1f40\u0300" +
+	"\u1f43\u1f41\u0300\u1f44\u1f40\u0301\u1f45\u1f41\u0301\u1f48\u039f\u0313\u1f49\u039f\u0314\u1f4a\u1f48\u0300\u1f4b\u1f49\u0300\u1f4c\u1f48\u0301" +
+	"\u1f4d\u1f49\u0301\u1f50\u03c5\u0313\u1f51\u03c5\u0314\u1f52\u1f50\u0300\u1f53\u1f51\u0300\u1f54\u1f50\u0301\u1f55\u1f51\u0301\u1f56\u1f50\u0342" +
+	"\u1f57\u1f51\u0342\u1f59\u03a5\u0314\u1f5b\u1f59\u0300\u1f5d\u1f59\u0301\u1f5f\u1f59\u0342\u1f60\u03c9\u0313\u1f61\u03c9\u0314\u1f62\u1f60\u0300" +
+	"\u1f63\u1f61\u0300\u1f64\u1f60\u0301\u1f65\u1f61\u0301\u1f66\u1f60\u0342\u1f67\u1f61\u0342\u1f68\u03a9\u0313\u1f69\u03a9\u0314\u1f6a\u1f68\u0300" +
+	"\u1f6b\u1f69\u0300\u1f6c\u1f68\u0301\u1f6d\u1f69\u0301\u1f6e\u1f68\u0342\u1f6f\u1f69\u0342\u1f70\u03b1\u0300\u1f72\u03b5\u0300\u1f74\u03b7\u0300" +
+	"\u1f76\u03b9\u0300\u1f78\u03bf\u0300\u1f7a\u03c5\u0300\u1f7c\u03c9\u0300\u1f80\u1f00\u0345\u1f81\u1f01\u0345\u1f82\u1f02\u0345\u1f83\u1f03\u0345" +
+	"\u1f84\u1f04\u0345\u1f85\u1f05\u0345\u1f86\u1f06\u0345\u1f87\u1f07\u0345\u1f88\u1f08\u0345\u1f89\u1f09\u0345\u1f8a\u1f0a\u0345\u1f8b\u1f0b\u0345" +
+	"\u1f8c\u1f0c\u0345\u1f8d\u1f0d\u0345\u1f8e\u1f0e\u0345\u1f8f\u1f0f\u0345\u1f90\u1f20\u0345\u1f91\u1f21\u0345\u1f92\u1f22\u0345\u1f93\u1f23\u0345" +
+	"\u1f94\u1f24\u0345\u1f95\u1f25\u0345\u1f96\u1f26\u0345\u1f97\u1f27\u0345\u1f98\u1f28\u0345\u1f99\u1f29\u0345\u1f9a\u1f2a\u0345\u1f9b\u1f2b\u0345" +
+	"\u1f9c\u1f2c\u0345\u1f9d\u1f2d\u0345\u1f9e\u1f2e\u0345\u1f9f\u1f2f\u0345\u1fa0\u1f60\u0345\u1fa1\u1f61\u0345\u1fa2\u1f62\u0345\u1fa3\u1f63\u0345" +
+	"\u1fa4\u1f64\u0345\u1fa5\u1f65\u0345\u1fa6\u1f66\u0345\u1fa7\u1f67\u0345\u1fa8\u1f68\u0345\u1fa9\u1f69\u0345\u1faa\u1f6a\u0345\u1fab\u1f6b\u0345" +
+	"\u1fac\u1f6c\u0345\u1fad\u1f6d\u0345\u1fae\u1f6e\u0345\u1faf\u1f6f\u0345\u1fb0\u03b1\u0306\u1fb1\u03b1\u0304\u1fb2\u1f70\u0345\u1fb3\u03b1\u0345" +
+	"\u1fb4\u03ac\u0345\u1fb6\u03b1\u0342\u1fb7\u1fb6\u0345\u1fb8\u0391\u0306\u1fb9\u0391\u0304\u1fba\u0391\u0300\u1fbc\u0391\u0345\u1fc1\u00a8\u0342" +
+	"\u1fc2\u1f74\u0345\u1fc3\u03b7\u0345\u1fc4\u03ae\u0345\u1fc6\u03b7\u0342\u1fc7\u1fc6\u0345\u1fc8\u0395\u0300\u1fca\u0397\u0300\u1fcc\u0397\u0345" +
+	"\u1fcd\u1fbf\u0300\u1fce\u1fbf\u0301\u1fcf\u1fbf\u0342\u1fd0\u03b9\u0306\u1fd1\u03b9\u0304\u1fd2\u03ca\u0300\u1fd6\u03b9\u0342\u1fd7\u03ca\u0342" +
+	"\u1fd8\u0399\u0306\u1fd9\u0399\u0304\u1fda\u0399\u0300\u1fdd\u1ffe\u0300\u1fde\u1ffe\u0301\u1fdf\u1ffe\u0342\u1fe0\u03c5\u0306\u1fe1\u03c5\u0304" +
+	"\u1fe2\u03cb\u0300\u1fe4\u03c1\u0313\u1fe5\u03c1\u0314\u1fe6\u03c5\u0342\u1fe7\u03cb\u0342\u1fe8\u03a5\u0306\u1fe9\u03a5\u0304\u1fea\u03a5\u0300" +
+	"\u1fec\u03a1\u0314\u1fed\u00a8\u0300\u1ff2\u1f7c\u0345\u1ff3\u03c9\u0345\u1ff4\u03ce\u0345\u1ff6\u03c9\u0342\u1ff7\u1ff6\u0345\u1ff8\u039f\u0300" +
+	"\u1ffa\u03a9\u0300\u1ffc\u03a9\u0345\u219a\u2190\u0338\u219b\u2192\u0338\u21ae\u2194\u0338\u21cd\u21d0\u0338\u21ce\u21d4\u0338\u21cf\u21d2\u0338" +
+	"\u2204\u2203\u0338\u2209\u2208\u0338\u220c\u220b\u0338\u2224\u2223\u0338\u2226\u2225\u0338\u2241\u223c\u0338\u2244\u2243\u0338\u2247\u2245\u0338" +
+	"\u2249\u2248\u0338\u2260\u003d\u0338\u2262\u2261\u0338\u226d\u224d\u0338\u226e\u003c\u0338\u226f\u003e\u0338\u2270\u2264\u0338\u2271\u2265\u0338" +
+	"\u2274\u2272\u0338\u2275\u2273\u0338\u2278\u2276\u0338\u2279\u2277\u0338\u2280\u227a\u0338\u2281\u227b\u0338\u2284\u2282\u0338\u2285\u2283\u0338" +
+	"\u2288\u2286\u0338\u2289\u2287\u0338\u22ac\u22a2\u0338\u22ad\u22a8\u0338\u22ae\u22a9\u0338\u22af\u22ab\u0338\u22e0\u227c\u0338\u22e1\u227d\u0338" +
+	"\u22e2\u2291\u0338\u22e3\u2292\u0338\u22ea\u22b2\u0338\u22eb\u22b3\u0338\u22ec\u22b4\u0338\u22ed\u22b5\u0338\u304c\u304b\u3099\u304e\u304d\u3099" +
+	"\u3050\u304f\u3099\u3052\u3051\u3099\u3054\u3053\u3099\u3056\u3055\u3099\u3058\u3057\u3099\u305a\u3059\u3099\u305c\u305b\u3099\u305e\u305d\u3099" +
+	"\u3060\u305f\u3099\u3062\u3061\u3099\u3065\u3064\u3099\u3067\u3066\u3099\u3069\u3068\u3099\u3070\u306f\u3099\u3071\u306f\u309a\u3073\u3072\u3099" +
+	"\u3074\u3072\u309a\u3076\u3075\u3099\u3077\u3075\u309a\u3079\u3078\u3099\u307a\u3078\u309a\u307c\u307b\u3099\u307d\u307b\u309a\u3094\u3046\u3099" +
+	"\u309e\u309d\u3099\u30ac\u30ab\u3099\u30ae\u30ad\u3099\u30b0\u30af\u3099\u30b2\u30b1\u3099\u30b4\u30b3\u3099\u30b6\u30b5\u3099\u30b8\u30b7\u3099" +
+	"\u30ba\u30b9\u3099\u30bc\u30bb\u3099\u30be\u30bd\u3099\u30c0\u30bf\u3099\u30c2\u30c1\u3099\u30c5\u30c4\u3099\u30c7\u30c6\u3099\u30c9\u30c8\u3099" +
+	"\u30d0\u30cf\u3099\u30d1\u30cf\u309a\u30d3\u30d2\u3099\u30d4\u30d2\u309a\u30d6\u30d5\u3099\u30d7\u30d5\u309a\u30d9\u30d8\u3099\u30da\u30d8\u309a" +
+	"\u30dc\u30db\u3099\u30dd\u30db\u309a\u30f4\u30a6\u3099\u30f7\u30ef\u3099\u30f8\u30f0\u3099\u30f9\u30f1\u3099\u30fa\u30f2\u3099\u30fe\u30fd\u3099"
+
+// unicodeDecompositionExclusions lists, in the same way, the canonical
+// decompositions that NFC doesn't undo, with a zero second rune for
+// singletons such as U+212B ANGSTROM SIGN. The CJK compatibility ideographs
+// are left out.
+var unicodeDecompositionExclusions = "" +
+	"\u0340\u0300\u0000\u0341\u0301\u0000\u0343\u0313\u0000\u0344\u0308\u0301\u0374\u02b9\u0000\u037e\u003b\u0000\u0387\u00b7\u0000\u0958\u0915\u093c" +
+	"\u0959\u0916\u093c\u095a\u0917\u093c\u095b\u091c\u093c\u095c\u0921\u093c\u095d\u0922\u093c\u095e\u092b\u093c\u095f\u092f\u093c\u09dc\u09a1\u09bc" +
+	"\u09dd\u09a2\u09bc\u09df\u09af\u09bc\u0a33\u0a32\u0a3c\u0a36\u0a38\u0a3c\u0a59\u0a16\u0a3c\u0a5a\u0a17\u0a3c\u0a5b\u0a1c\u0a3c\u0a5e\u0a2b\u0a3c" +
+	"\u0b5c\u0b21\u0b3c\u0b5d\u0b22\u0b3c\u0f43\u0f42\u0fb7\u0f4d\u0f4c\u0fb7\u0f52\u0f51\u0fb7\u0f57\u0f56\u0fb7\u0f5c\u0f5b\u0fb7\u0f69\u0f40\u0fb5" +
+	"\u0f73\u0f71\u0f72\u0f75\u0f71\u0f74\u0f76\u0fb2\u0f80\u0f78\u0fb3\u0f80\u0f81\u0f71\u0f80\u0f93\u0f92\u0fb7\u0f9d\u0f9c\u0fb7\u0fa2\u0fa1\u0fb7" +
+	"\u0fa7\u0fa6\u0fb7\u0fac\u0fab\u0fb7\u0fb9\u0f90\u0fb5\u1f71\u03ac\u0000\u1f73\u03ad\u0000\u1f75\u03ae\u0000\u1f77\u03af\u0000\u1f79\u03cc\u0000" +
+	"\u1f7b\u03cd\u0000\u1f7d\u03ce\u0000\u1fbb\u0386\u0000\u1fbe\u03b9\u0000\u1fc9\u0388\u0000\u1fcb\u0389\u0000\u1fd3\u0390\u0000\u1fdb\u038a\u0000" +
+	"\u1fe3\u03b0\u0000\u1feb\u038e\u0000\u1fee\u0385\u0000\u1fef\u0060\u0000\u1ff9\u038c\u0000\u1ffb\u038f\u0000\u1ffd\u00b4\u0000\u2000\u2002\u0000" +
+	"\u2001\u2003\u0000\u2126\u03a9\u0000\u212a\u004b\u0000\u212b\u00c5\u0000\u2329\u3008\u0000\u232a\u3009\u0000\u2adc\u2add\u0338\ufb1d\u05d9\u05b4" +
+	"\ufb1f\u05f2\u05b7\ufb2a\u05e9\u05c1\ufb2b\u05e9\u05c2\ufb2c\ufb49\u05c1\ufb2d\ufb49\u05c2\ufb2e\u05d0\u05b7\ufb2f\u05d0\u05b8\ufb30\u05d0\u05bc" +
+	"\ufb31\u05d1\u05bc\ufb32\u05d2\u05bc\ufb33\u05d3\u05bc\ufb34\u05d4\u05bc\ufb35\u05d5\u05bc\ufb36\u05d6\u05bc\ufb38\u05d8\u05bc\ufb39\u05d9\u05bc" +
+	"\ufb3a\u05da\u05bc\ufb3b\u05db\u05bc\ufb3c\u05dc\u05bc\ufb3e\u05de\u05bc\ufb40\u05e0\u05bc\ufb41\u05e1\u05bc\ufb43\u05e3\u05bc\ufb44\u05e4\u05bc" +
+	"\ufb46\u05e6\u05bc\ufb47\u05e7\u05bc\ufb48\u05e8\u05bc\ufb49\u05e9\u05bc\ufb4a\u05ea\u05bc\ufb4b\u05d5\u05b9\ufb4c\u05d1\u05bf\ufb4d\u05db\u05bf" +
+	"\ufb4e\u05e4\u05bf"
+
+// unicodeCombiningClasses are the canonical combining classes of the
+// non-starters in the Basic Multilingual Plane. Every other rune is a
+// starter.
+var unicodeCombiningClasses = map[rune]uint8{
+	0x0300: 230, 0x0301: 230, 0x0302: 230, 0x0303: 230, 0x0304: 230, 0x0305: 230,
+	0x0306: 230, 0x0307: 230, 0x0308: 230, 0x0309: 230, 0x030A: 230, 0x030B: 230,
+	0x030C: 230, 0x030D: 230, 0x030E: 230, 0x030F: 230, 0x0310: 230, 0x0311: 230,
+	0x0312: 230, 0x0313: 230, 0x0314: 230, 0x0315: 232, 0x0316: 220, 0x0317: 220,
+	0x0318: 220, 0x0319: 220, 0x031A: 232, 0x031B: 216, 0x031C: 220, 0x031D: 220,
+	0x031E: 220, 0x031F: 220, 0x0320: 220, 0x0321: 202, 0x0322: 202, 0x0323: 220,
+	0x0324: 220, 0x0325: 220, 0x0326: 220, 0x0327: 202, 0x0328: 202, 0x0329: 220,
+	0x032A: 220, 0x032B: 220, 0x032C: 220, 0x032D: 220, 0x032E: 220, 0x032F: 220,
+	0x0330: 220, 0x0331: 220, 0x0332: 220, 0x0333: 220, 0x0334: 1, 0x0335: 1,
+	0x0336: 1, 0x0337: 1, 0x0338: 1, 0x0339: 220, 0x033A: 220, 0x033B: 220,
+	0x033C: 220, 0x033D: 230, 0x033E: 230, 0x033F: 230, 0x0340: 230, 0x0341: 230,
+	0x0342: 230, 0x0343: 230, 0x0344: 230, 0x0345: 240, 0x0346: 230, 0x0347: 220,
+	0x0348: 220, 0x0349: 220, 0x034A: 230, 0x034B: 230, 0x034C: 230, 0x034D: 220,
+	0x034E: 220, 0x0350: 230, 0x0351: 230, 0x0352: 230, 0x0353: 220, 0x0354: 220,
+	0x0355: 220, 0x0356: 220, 0x0357: 230, 0x0358: 232, 0x0359: 220, 0x035A: 220,
+	0x035B: 230, 0x035C: 233, 0x035D: 234, 0x035E: 234, 0x035F: 233, 0x0360: 234,
+	0x0361: 234, 0x0362: 233, 0x0363: 230, 0x0364: 230, 0x0365: 230, 0x0366: 230,
+	0x0367: 230, 0x0368: 230, 0x0369: 230, 0x036A: 230, 0x036B: 230, 0x036C: 230,
+	0x036D: 230, 0x036E: 230, 0x036F: 230, 0x0483: 230, 0x0484: 230, 0x0485: 230,
+	0x0486: 230, 0x0487: 230, 0x0591: 220, 0x0592: 230, 0x0593: 230, 0x0594: 230,
+	0x0595: 230, 0x0596: 220, 0x0597: 230, 0x0598: 230, 0x0599: 230, 0x059A: 222,
+	0x059B: 220, 0x059C: 230, 0x059D: 230, 0x059E: 230, 0x059F: 230, 0x05A0: 230,
+	0x05A1: 230, 0x05A2: 220, 0x05A3: 220, 0x05A4: 220, 0x05A5: 220, 0x05A6: 220,
+	0x05A7: 220, 0x05A8: 230, 0x05A9: 230, 0x05AA: 220, 0x05AB: 230, 0x05AC: 230,
+	0x05AD: 222, 0x05AE: 228, 0x05AF: 230, 0x05B0: 10, 0x05B1: 11, 0x05B2: 12,
+	0x05B3: 13, 0x05B4: 14, 0x05B5: 15, 0x05B6: 16, 0x05B7: 17, 0x05B8: 18,
+	0x05B9: 19, 0x05BA: 19, 0x05BB: 20, 0x05BC: 21, 0x05BD: 22, 0x05BF: 23,
+	0x05C1: 24, 0x05C2: 25, 0x05C4: 230, 0x05C5: 220, 0x05C7: 18, 0x0610: 230,
+	0x0611: 230, 0x0612: 230, 0x0613: 230, 0x0614: 230, 0x0615: 230, 0x0616: 230,
+	0x0617: 230, 0x0618: 30, 0x0619: 31, 0x061A: 32, 0x064B: 27, 0x064C: 28,
+	0x064D: 29, 0x064E: 30, 0x064F: 31, 0x0650: 32, 0x0651: 33, 0x0652: 34,
+	0x0653: 230, 0x0654: 230, 0x0655: 220, 0x0656: 220, 0x0657: 230, 0x0658: 230,
+	0x0659: 230, 0x065A: 230, 0x065B: 230, 0x065C: 220, 0x065D: 230, 0x065E: 230,
+	0x065F: 220, 0x0670: 35, 0x06D6: 230, 0x06D7: 230, 0x06D8: 230, 0x06D9: 230,
+	0x06DA: 230, 0x06DB: 230, 0x06DC: 230, 0x06DF: 230, 0x06E0: 230, 0x06E1: 230,
+	0x06E2: 230, 0x06E3: 220, 0x06E4: 230, 0x06E7: 230, 0x06E8: 230, 0x06EA: 220,
+	0x06EB: 230, 0x06EC: 230, 0x06ED: 220, 0x0711: 36, 0x0730: 230, 0x0731: 220,
+	0x0732: 230, 0x0733: 230, 0x0734: 220, 0x0735: 230, 0x0736: 230, 0x0737: 220,
+	0x0738: 220, 0x0739: 220, 0x073A: 230, 0x073B: 220, 0x073C: 220, 0x073D: 230,
+	0x073E: 220, 0x073F: 230, 0x0740: 230, 0x0741: 230, 0x0742: 220, 0x0743: 230,
+	0x0744: 220, 0x0745: 230, 0x0746: 220, 0x0747: 230, 0x0748: 220, 0x0749: 230,
+	0x074A: 230, 0x07EB: 230, 0x07EC: 230, 0x07ED: 230, 0x07EE: 230, 0x07EF: 230,
+	0x07F0: 230, 0x07F1: 230, 0x07F2: 220, 0x07F3: 230, 0x07FD: 220, 0x0816: 230,
+	0x0817: 230, 0x0818: 230, 0x0819: 230, 0x081B: 230, 0x081C: 230, 0x081D: 230,
+	0x081E: 230, 0x081F: 230, 0x0820: 230, 0x0821: 230, 0x0822: 230, 0x0823: 230,
+	0x0825: 230, 0x0826: 230, 0x0827: 230, 0x0829: 230, 0x082A: 230, 0x082B: 230,
+	0x082C: 230, 0x082D: 230, 0x0859: 220, 0x085A: 220, 0x085B: 220, 0x0898: 230,
+	0x0899: 220, 0x089A: 220, 0x089B: 220, 0x089C: 230, 0x089D: 230, 0x089E: 230,
+	0x089F: 230, 0x08CA: 230, 0x08CB: 230, 0x08CC: 230, 0x08CD: 230, 0x08CE: 230,
+	0x08CF: 220, 0x08D0: 220, 0x08D1: 220, 0x08D2: 220, 0x08D3: 220, 0x08D4: 230,
+	0x08D5: 230, 0x08D6: 230, 0x08D7: 230, 0x08D8: 230, 0x08D9: 230, 0x08DA: 230,
+	0x08DB: 230, 0x08DC: 230, 0x08DD: 230, 0x08DE: 230, 0x08DF: 230, 0x08E0: 230,
+	0x08E1: 230, 0x08E3: 220, 0x08E4: 230, 0x08E5: 230, 0x08E6: 220, 0x08E7: 230,
+	0x08E8: 230, 0x08E9: 220, 0x08EA: 230, 0x08EB: 230, 0x08EC: 230, 0x08ED: 220,
+	0x08EE: 220, 0x08EF: 220, 0x08F0: 27, 0x08F1: 28, 0x08F2: 29, 0x08F3: 230,
+	0x08F4: 230, 0x08F5: 230, 0x08F6: 220, 0x08F7: 230, 0x08F8: 230, 0x08F9: 220,
+	0x08FA: 220, 0x08FB: 230, 0x08FC: 230, 0x08FD: 230, 0x08FE: 230, 0x08FF: 230,
+	0x093C: 7, 0x094D: 9, 0x0951: 230, 0x0952: 220, 0x0953: 230, 0x0954: 230,
+	0x09BC: 7, 0x09CD: 9, 0x09FE: 230, 0x0A3C: 7, 0x0A4D: 9, 0x0ABC: 7,
+	0x0ACD: 9, 0x0B3C: 7, 0x0B4D: 9, 0x0BCD: 9, 0x0C3C: 7, 0x0C4D: 9,
+	0x0C55: 84, 0x0C56: 91, 0x0CBC: 7, 0x0CCD: 9, 0x0D3B: 9, 0x0D3C: 9,
+	0x0D4D: 9, 0x0DCA: 9, 0x0E38: 103, 0x0E39: 103, 0x0E3A: 9, 0x0E48: 107,
+	0x0E49: 107, 0x0E4A: 107, 0x0E4B: 107, 0x0EB8: 118, 0x0EB9: 118, 0x0EBA: 9,
+	0x0EC8: 122, 0x0EC9: 122, 0x0ECA: 122, 0x0ECB: 122, 0x0F18: 220, 0x0F19: 220,
+	0x0F35: 220, 0x0F37: 220, 0x0F39: 216, 0x0F71: 129, 0x0F72: 130, 0x0F74: 132,
+	0x0F7A: 130, 0x0F7B: 130, 0x0F7C: 130, 0x0F7D: 130, 0x0F80: 130, 0x0F82: 230,
+	0x0F83: 230, 0x0F84: 9, 0x0F86: 230, 0x0F87: 230, 0x0FC6: 220, 0x1037: 7,
+	0x1039: 9, 0x103A: 9, 0x108D: 220, 0x135D: 230, 0x135E: 230, 0x135F: 230,
+	0x1714: 9, 0x1715: 9, 0x1734: 9, 0x17D2: 9, 0x17DD: 230, 0x18A9: 228,
+	0x1939: 222, 0x193A: 230, 0x193B: 220, 0x1A17: 230, 0x1A18: 220, 0x1A60: 9,
+	0x1A75: 230, 0x1A76: 230, 0x1A77: 230, 0x1A78: 230, 0x1A79: 230, 0x1A7A: 230,
+	0x1A7B: 230, 0x1A7C: 230, 0x1A7F: 220, 0x1AB0: 230, 0x1AB1: 230, 0x1AB2: 230,
+	0x1AB3: 230, 0x1AB4: 230, 0x1AB5: 220, 0x1AB6: 220, 0x1AB7: 220, 0x1AB8: 220,
+	0x1AB9: 220, 0x1ABA: 220, 0x1ABB: 230, 0x1ABC: 230, 0x1ABD: 220, 0x1ABF: 220,
+	0x1AC0: 220, 0x1AC1: 230, 0x1AC2: 230, 0x1AC3: 220, 0x1AC4: 220, 0x1AC5: 230,
+	0x1AC6: 230, 0x1AC7: 230, 0x1AC8: 230, 0x1AC9: 230, 0x1ACA: 220, 0x1ACB: 230,
+	0x1ACC: 230, 0x1ACD: 230, 0x1ACE: 230, 0x1B34: 7, 0x1B44: 9, 0x1B6B: 230,
+	0x1B6C: 220, 0x1B6D: 230, 0x1B6E: 230, 0x1B6F: 230, 0x1B70: 230, 0x1B71: 230,
+	0x1B72: 230, 0x1B73: 230, 0x1BAA: 9, 0x1BAB: 9, 0x1BE6: 7, 0x1BF2: 9,
+	0x1BF3: 9, 0x1C37: 7, 0x1CD0: 230, 0x1CD1: 230, 0x1CD2: 230, 0x1CD4: 1,
+	0x1CD5: 220, 0x1CD6: 220, 0x1CD7: 220, 0x1CD8: 220, 0x1CD9: 220, 0x1CDA: 230,
+	0x1CDB: 230, 0x1CDC: 220, 0x1CDD: 220, 0x1CDE: 220, 0x1CDF: 220, 0x1CE0: 230,
+	0x1CE2: 1, 0x1CE3: 1, 0x1CE4: 1, 0x1CE5: 1, 0x1CE6: 1, 0x1CE7: 1,
+	0x1CE8: 1, 0x1CED: 220, 0x1CF4: 230, 0x1CF8: 230, 0x1CF9: 230, 0x1DC0: 230,
+	0x1DC1: 230, 0x1DC2: 220, 0x1DC3: 230, 0x1DC4: 230, 0x1DC5: 230, 0x1DC6: 230,
+	0x1DC7: 230, 0x1DC8: 230, 0x1DC9: 230, 0x1DCA: 220, 0x1DCB: 230, 0x1DCC: 230,
+	0x1DCD: 234, 0x1DCE: 214, 0x1DCF: 220, 0x1DD0: 202, 0x1DD1: 230, 0x1DD2: 230,
+	0x1DD3: 230, 0x1DD4: 230, 0x1DD5: 230, 0x1DD6: 230, 0x1DD7: 230, 0x1DD8: 230,
+	0x1DD9: 230, 0x1DDA: 230, 0x1DDB: 230, 0x1DDC: 230, 0x1DDD: 230, 0x1DDE: 230,
+	0x1DDF: 230, 0x1DE0: 230, 0x1DE1: 230, 0x1DE2: 230, 0x1DE3: 230, 0x1DE4: 230,
+	0x1DE5: 230, 0x1DE6: 230, 0x1DE7: 230, 0x1DE8: 230, 0x1DE9: 230, 0x1DEA: 230,
+	0x1DEB: 230, 0x1DEC: 230, 0x1DED: 230, 0x1DEE: 230, 0x1DEF: 230, 0x1DF0: 230,
+	0x1DF1: 230, 0x1DF2: 230, 0x1DF3: 230, 0x1DF4: 230, 0x1DF5: 230, 0x1DF6: 232,
+	0x1DF7: 228, 0x1DF8: 228, 0x1DF9: 220, 0x1DFA: 218, 0x1DFB: 230, 0x1DFC: 233,
+	0x1DFD: 220, 0x1DFE: 230, 0x1DFF: 220, 0x20D0: 230, 0x20D1: 230, 0x20D2: 1,
+	0x20D3: 1, 0x20D4: 230, 0x20D5: 230, 0x20D6: 230, 0x20D7: 230, 0x20D8: 1,
+	0x20D9: 1, 0x20DA: 1, 0x20DB: 230, 0x20DC: 230, 0x20E1: 230, 0x20E5: 1,
+	0x20E6: 1, 0x20E7: 230, 0x20E8: 220, 0x20E9: 230, 0x20EA: 1, 0x20EB: 1,
+	0x20EC: 220, 0x20ED: 220, 0x20EE: 220, 0x20EF: 220, 0x20F0: 230, 0x2CEF: 230,
+	0x2CF0: 230, 0x2CF1: 230, 0x2D7F: 9, 0x2DE0: 230, 0x2DE1: 230, 0x2DE2: 230,
+	0x2DE3: 230, 0x2DE4: 230, 0x2DE5: 230, 0x2DE6: 230, 0x2DE7: 230, 0x2DE8: 230,
+	0x2DE9: 230, 0x2DEA: 230, 0x2DEB: 230, 0x2DEC: 230, 0x2DED: 230, 0x2DEE: 230,
+	0x2DEF: 230, 0x2DF0: 230, 0x2DF1: 230, 0x2DF2: 230, 0x2DF3: 230, 0x2DF4: 230,
+	0x2DF5: 230, 0x2DF6: 230, 0x2DF7: 230, 0x2DF8: 230, 0x2DF9: 230, 0x2DFA: 230,
+	0x2DFB: 230, 0x2DFC: 230, 0x2DFD: 230, 0x2DFE: 230, 0x2DFF: 230, 0x302A: 218,
+	0x302B: 228, 0x302C: 232, 0x302D: 222, 0x302E: 224, 0x302F: 224, 0x3099: 8,
+	0x309A: 8, 0xA66F: 230, 0xA674: 230, 0xA675: 230, 0xA676: 230, 0xA677: 230,
+	0xA678: 230, 0xA679: 230, 0xA67A: 230, 0xA67B: 230, 0xA67C: 230, 0xA67D: 230,
+	0xA69E: 230, 0xA69F: 230, 0xA6F0: 230, 0xA6F1: 230, 0xA806: 9, 0xA82C: 9,
+	0xA8C4: 9, 0xA8E0: 230, 0xA8E1: 230, 0xA8E2: 230, 0xA8E3: 230, 0xA8E4: 230,
+	0xA8E5: 230, 0xA8E6: 230, 0xA8E7: 230, 0xA8E8: 230, 0xA8E9: 230, 0xA8EA: 230,
+	0xA8EB: 230, 0xA8EC: 230, 0xA8ED: 230, 0xA8EE: 230, 0xA8EF: 230, 0xA8F0: 230,
+	0xA8F1: 230, 0xA92B: 220, 0xA92C: 220, 0xA92D: 220, 0xA953: 9, 0xA9B3: 7,
+	0xA9C0: 9, 0xAAB0: 230, 0xAAB2: 230, 0xAAB3: 230, 0xAAB4: 220, 0xAAB7: 230,
+	0xAAB8: 230, 0xAABE: 230, 0xAABF: 230, 0xAAC1: 230, 0xAAF6: 9, 0xABED: 9,
+	0xFB1E: 26, 0xFE20: 230, 0xFE21: 230, 0xFE22: 230, 0xFE23: 230, 0xFE24: 230,
+	0xFE25: 230, 0xFE26: 230, 0xFE27: 220, 0xFE28: 220, 0xFE29: 220, 0xFE2A: 220,
+	0xFE2B: 220, 0xFE2C: 220, 0xFE2D: 220, 0xFE2E: 230, 0xFE2F: 230,
+}
+
+// unicodeDecompositions indexes both tables by composed character, and
+// unicodeCompositionPairs indexes unicodeCompositions by the pair it
+// decomposes into.
+var unicodeDecompositions, unicodeCompositionPairs = func() (map[rune][2]rune, map[[2]rune]rune) {
+	decompositions := make(map[rune][2]rune)
+	compositionPairs := make(map[[2]rune]rune)
+	runes := []rune(unicodeCompositions)
+	for i := 0; i+2 < len(runes); i += 3 {
+		decompositions[runes[i]] = [2]rune{runes[i+1], runes[i+2]}
+		compositionPairs[[2]rune{runes[i+1], runes[i+2]}] = runes[i]
+	}
+	runes = []rune(unicodeDecompositionExclusions)
+	for i := 0; i+2 < len(runes); i += 3 {
+		decompositions[runes[i]] = [2]rune{runes[i+1], runes[i+2]}
+	}
+	return decompositions, compositionPairs
+}()
+
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// normalizeUnicode returns s in the Unicode normalization form form, nfc or
+// nfd. Any other form returns s unchanged. It covers the accented letters,
+// kana and Hangul that macOS decomposes in file names, but not the CJK
+// compatibility ideographs or anything outside the Basic Multilingual Plane.
+func normalizeUnicode(s, form string) string {
+	if form != "nfc" && form != "nfd" {
+		return s
+	}
+	isASCII := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			isASCII = false
+			break
+		}
+	}
+	if isASCII {
+		return s
+	}
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		runes = decomposeRune(runes, r)
+	}
+	// Put every run of non-starters in canonical order.
+	for i := 0; i < len(runes); {
+		if unicodeCombiningClasses[runes[i]] == 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && unicodeCombiningClasses[runes[j]] != 0 {
+			j++
+		}
+		slices.SortStableFunc(runes[i:j], func(a, b rune) int {
+			return cmp.Compare(unicodeCombiningClasses[a], unicodeCombiningClasses[b])
+		})
+		i = j
+	}
+	if form == "nfd" {
+		return string(runes)
+	}
+	composed := make([]rune, 0, len(runes))
+	starter := -1
+	var lastClass uint8
+	for _, r := range runes {
+		class := unicodeCombiningClasses[r]
+		if starter >= 0 {
+			// r can't be composed with the starter if there is a character
+			// in between that it can't be moved past.
+			blocked := len(composed)-1 != starter && (lastClass == 0 || lastClass >= class)
+			if !blocked {
+				if c, ok := composeRunes(composed[starter], r); ok {
+					composed[starter] = c
+					continue
+				}
+			}
+		}
+		if class == 0 {
+			starter = len(composed)
+		}
+		lastClass = class
+		composed = append(composed, r)
+	}
+	return string(composed)
+}
+
+// decomposeRune appends the full canonical decomposition of r to runes.
+func decomposeRune(runes []rune, r rune) []rune {
+	if r >= hangulSBase && r < hangulSBase+hangulSCount {
+		s := r - hangulSBase
+		runes = append(runes, hangulLBase+s/hangulNCount, hangulVBase+(s%hangulNCount)/hangulTCount)
+		if t := s % hangulTCount; t != 0 {
+			runes = append(runes, hangulTBase+t)
+		}
+		return runes
+	}
+	if decomposition, ok := unicodeDecompositions[r]; ok {
+		runes = decomposeRune(runes, decomposition[0])
+		if decomposition[1] == 0 {
+			return runes
+		}
+		return decomposeRune(runes, decomposition[1])
+	}
+	return append(runes, r)
+}
+
+// composeRunes returns the character that a and b compose into, if any.
+func composeRunes(a, b rune) (rune, bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+(b-hangulVBase))*hangulTCount, true
+	}
+	if a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 && b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + (b - hangulTBase), true
+	}
+	c, ok := unicodeCompositionPairs[[2]rune{a, b}]
+	return c, ok
+}
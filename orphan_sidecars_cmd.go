@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type OrphanSidecarsCmd struct {
+	Roots          []string
+	ExcludeRegexps []*regexp.Regexp
+	Recursive      bool
+	IncludeHidden  bool
+	// SidecarExts are the lowercased extensions, with the leading dot, of
+	// the files that are taken to be sidecars.
+	SidecarExts []string
+	// MissingExts are the sidecar extensions that every other file is
+	// expected to have a sidecar with.
+	MissingExts []string
+	// Trash moves orphaned sidecars into the trash instead of only
+	// reporting them.
+	Trash   bool
+	Verbose bool
+	DryRun  bool
+	NoLock  bool
+	Stdout  io.Writer
+	Stderr  io.Writer
+	logger  *slog.Logger
+}
+
+func OrphanSidecarsCommand(args []string) (*OrphanSidecarsCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	orphanSidecarsCmd := &OrphanSidecarsCmd{
+		Roots:       []string{cwd},
+		SidecarExts: []string{".xmp", ".aae", ".json"},
+		Stdout:      stdout,
+		Stderr:      stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil orphan-sidecars [FLAGS] [DIR...]")
+		flagset.PrintDefaults()
+	}
+	flagset.Func("root", "Specify an additional root directory to check. Can be repeated.", func(value string) error {
+		err := checkLocalPath(value)
+		if err != nil {
+			return err
+		}
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		orphanSidecarsCmd.Roots = append(orphanSidecarsCmd.Roots, root)
+		return nil
+	})
+	flagset.Func("exclude", "Exclude file or directory regex, matched against names. Excluded files count neither as sidecars nor as the files they belong to. Can be repeated.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		orphanSidecarsCmd.ExcludeRegexps = append(orphanSidecarsCmd.ExcludeRegexps, r)
+		return nil
+	})
+	flagset.BoolVar(&orphanSidecarsCmd.Recursive, "recursive", false, "Walk the roots recursively.")
+	flagset.BoolVar(&orphanSidecarsCmd.IncludeHidden, "include-hidden", false, "Don't skip .DS_Store, Thumbs.db, desktop.ini and AppleDouble ._ files.")
+	flagset.Func("sidecar-ext", "Comma separated extensions of the files taken to be sidecars. (default xmp,aae,json)", func(value string) error {
+		exts, err := parseSidecarExts(value)
+		if err != nil {
+			return err
+		}
+		orphanSidecarsCmd.SidecarExts = exts
+		return nil
+	})
+	flagset.Func("missing", "Comma separated sidecar extensions e.g. xmp. Also report every file that has no sidecar with one of them.", func(value string) error {
+		exts, err := parseSidecarExts(value)
+		if err != nil {
+			return err
+		}
+		orphanSidecarsCmd.MissingExts = exts
+		return nil
+	})
+	flagset.BoolVar(&orphanSidecarsCmd.Trash, "trash", false, "Move orphaned sidecars into the trash, from where exifutil trash restore can put them back. Files missing a sidecar are only ever reported.")
+	flagset.BoolVar(&orphanSidecarsCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&orphanSidecarsCmd.DryRun, "dry-run", false, "With -trash, print trash operations without executing.")
+	flagset.BoolVar(&orphanSidecarsCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range orphanSidecarsCmd.MissingExts {
+		if !slices.Contains(orphanSidecarsCmd.SidecarExts, ext) {
+			return nil, fmt.Errorf("-missing: %s is not one of the -sidecar-ext extensions", ext)
+		}
+	}
+	if flagset.NArg() > 0 {
+		// Positional arguments take the place of the current directory.
+		orphanSidecarsCmd.Roots = orphanSidecarsCmd.Roots[1:]
+		for _, arg := range flagset.Args() {
+			err := checkLocalPath(arg)
+			if err != nil {
+				return nil, err
+			}
+			root, err := filepath.Abs(arg)
+			if err != nil {
+				return nil, err
+			}
+			orphanSidecarsCmd.Roots = append(orphanSidecarsCmd.Roots, root)
+		}
+	}
+	orphanSidecarsCmd.logger = newLogger(orphanSidecarsCmd.Stdout, orphanSidecarsCmd.Verbose)
+	return orphanSidecarsCmd, nil
+}
+
+// parseSidecarExts parses a comma separated list of extensions, with or
+// without the leading dot, into lowercased extensions with the dot.
+func parseSidecarExts(value string) ([]string, error) {
+	var exts []string
+	for _, ext := range strings.Split(value, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" || strings.ContainsAny(ext, `./\`) {
+			return nil, fmt.Errorf("invalid extension %q", ext)
+		}
+		exts = append(exts, "."+ext)
+	}
+	return exts, nil
+}
+
+// Run reports the sidecars (.xmp, .aae and .json files by default) whose
+// file no longer exists in the same directory, as is often left behind by
+// deleting photos by hand, and with -missing the files that have no
+// sidecar. With -trash the orphaned sidecars are moved into the trash.
+func (orphanSidecarsCmd *OrphanSidecarsCmd) Run(ctx context.Context) error {
+	if orphanSidecarsCmd.Trash && !orphanSidecarsCmd.DryRun && !orphanSidecarsCmd.NoLock {
+		selector := &FileSelector{Roots: orphanSidecarsCmd.Roots}
+		unlock, err := selector.Lock(orphanSidecarsCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var numOrphans, numMissing, numDirs int
+	for _, root := range orphanSidecarsCmd.Roots {
+		err := filepath.WalkDir(root, func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !dirEntry.IsDir() {
+				return nil
+			}
+			if path != root {
+				if !orphanSidecarsCmd.Recursive || dirEntry.Name() == trashDirName || orphanSidecarsCmd.excluded(dirEntry.Name()) {
+					return fs.SkipDir
+				}
+			}
+			orphans, missing, err := orphanSidecarsCmd.checkDir(path)
+			if err != nil {
+				return err
+			}
+			numDirs++
+			for _, filePath := range orphans {
+				numOrphans++
+				if !orphanSidecarsCmd.Trash {
+					fmt.Fprintf(orphanSidecarsCmd.Stdout, "orphaned sidecar: %s\n", filePath)
+					continue
+				}
+				if orphanSidecarsCmd.DryRun {
+					fmt.Fprintf(orphanSidecarsCmd.Stdout, "%s (trash)\n", filePath)
+					continue
+				}
+				err := moveToTrash(osFS{}, filePath)
+				if err != nil {
+					orphanSidecarsCmd.logger.Error(err.Error(), slog.String("filePath", filePath))
+					continue
+				}
+				orphanSidecarsCmd.logger.Info("trashed orphaned sidecar", slog.String("filePath", filePath))
+			}
+			for _, sidecar := range missing {
+				numMissing++
+				fmt.Fprintf(orphanSidecarsCmd.Stdout, "missing %s: %s\n", sidecar.Ext, sidecar.FilePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(orphanSidecarsCmd.Stderr, "checked %d directories: %d orphaned sidecars, %d missing sidecars\n", numDirs, numOrphans, numMissing)
+	return nil
+}
+
+func (orphanSidecarsCmd *OrphanSidecarsCmd) excluded(name string) bool {
+	return slices.ContainsFunc(orphanSidecarsCmd.ExcludeRegexps, func(r *regexp.Regexp) bool {
+		return r.MatchString(name)
+	})
+}
+
+// missingSidecar is a file without a sidecar of the extension Ext.
+type missingSidecar struct {
+	FilePath string
+	Ext      string
+}
+
+// checkDir returns the sidecars in dir whose file isn't in dir, and the
+// files in dir that lack a sidecar with one of MissingExts. Names are
+// compared case-insensitively, because cameras and photo managers disagree
+// on the case of extensions.
+func (orphanSidecarsCmd *OrphanSidecarsCmd) checkDir(dir string) (orphans []string, missing []missingSidecar, err error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sidecarNames, fileNames []string
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !dirEntry.Type().IsRegular() || name == lockFileName || orphanSidecarsCmd.excluded(name) {
+			continue
+		}
+		if !orphanSidecarsCmd.IncludeHidden && isHiddenSystemFile(name) {
+			continue
+		}
+		if slices.Contains(orphanSidecarsCmd.SidecarExts, strings.ToLower(filepath.Ext(name))) {
+			sidecarNames = append(sidecarNames, name)
+		} else {
+			fileNames = append(fileNames, name)
+		}
+	}
+	// A sidecar is named either after the full name of its file
+	// (IMG_1234.CR2.xmp) or after its name without the extension
+	// (IMG_1234.xmp), so both are looked up.
+	files := make(map[string]bool)
+	for _, name := range fileNames {
+		name = strings.ToLower(name)
+		files[name] = true
+		files[strings.TrimSuffix(name, filepath.Ext(name))] = true
+	}
+	hasSidecar := make(map[string]map[string]bool)
+	for _, sidecarName := range sidecarNames {
+		ext := strings.ToLower(filepath.Ext(sidecarName))
+		if ext == ".json" && strings.EqualFold(sidecarName, "metadata.json") {
+			// Google Takeout describes each album in a metadata.json.
+			continue
+		}
+		found := false
+		for _, name := range sidecarFileNames(sidecarName) {
+			name = strings.ToLower(name)
+			if !files[name] {
+				continue
+			}
+			found = true
+			if hasSidecar[name] == nil {
+				hasSidecar[name] = make(map[string]bool)
+			}
+			hasSidecar[name][ext] = true
+		}
+		if !found {
+			orphans = append(orphans, filepath.Join(dir, sidecarName))
+		}
+	}
+	for _, name := range fileNames {
+		lowerName := strings.ToLower(name)
+		for _, ext := range orphanSidecarsCmd.MissingExts {
+			if hasSidecar[lowerName][ext] || hasSidecar[strings.TrimSuffix(lowerName, filepath.Ext(lowerName))][ext] {
+				continue
+			}
+			missing = append(missing, missingSidecar{FilePath: filepath.Join(dir, name), Ext: ext})
+		}
+	}
+	return orphans, missing, nil
+}
+
+// takeoutDuplicateRegexp matches the name Google Takeout gives the JSON
+// sidecar of the second and later files with the same name, which puts the
+// counter after the extension (IMG_1234.jpg(1).json for IMG_1234(1).jpg).
+var takeoutDuplicateRegexp = regexp.MustCompile(`^(.*?)(\.[^.]+)?(\(\d+\))$`)
+
+// sidecarFileNames returns the names, or names without the extension, that
+// the file a sidecar named sidecarName belongs to may have.
+func sidecarFileNames(sidecarName string) []string {
+	name := strings.TrimSuffix(sidecarName, filepath.Ext(sidecarName))
+	names := []string{name}
+	switch strings.ToLower(filepath.Ext(sidecarName)) {
+	case ".aae":
+		// Photos.app names the sidecar of an original's adjustments
+		// IMG_O1234.AAE.
+		match := applePhotosRegexp.FindStringSubmatch(sidecarName)
+		if match != nil && match[1] == "O" {
+			names = append(names, "IMG_"+match[2])
+		}
+	case ".json":
+		// Like takeoutCreationTime, allow for the .supplemental-metadata
+		// suffix of newer Takeout exports.
+		if trimmed, ok := strings.CutSuffix(name, ".supplemental-metadata"); ok {
+			name = trimmed
+			names = append(names, name)
+		}
+		match := takeoutDuplicateRegexp.FindStringSubmatch(name)
+		if match != nil {
+			names = append(names, match[1]+match[3]+match[2])
+		}
+	}
+	return names
+}
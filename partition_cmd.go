@@ -1,229 +1,217 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"log/slog"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
 )
 
 type PartitionCmd struct {
-	FileRegexps     []*regexp.Regexp
-	NumWorkers      int
-	Verbose         bool
-	DryRun          bool
-	ReplaceIfExists bool
-	Stdout          io.Writer
-	Stderr          io.Writer
-	logger          *slog.Logger
+	FileSelector
+	FilePermissions
+	RetryPolicy
+	MoveOptions
+	// DirFormat is the Go time layout of the date directories files are
+	// moved into, which may nest them e.g. 2006/2006-01/2006-01-02.
+	DirFormat string
+	// DayBoundary is the time of day at which a day starts, so that files
+	// created before it go into the previous day's directory.
+	DayBoundary time.Duration
+	// SplitMedia puts the date directories of each media type, according to
+	// MediaTypes, under a directory named after it e.g. photos/2006-01-02
+	// and videos/2006-01-02.
+	SplitMedia bool
+	MediaTypes []mediaTypeRule
+	OnResult   func(Result)
+	Stdout     io.Writer
+	Stderr     io.Writer
+	logger     *slog.Logger
+	// settle is passed on to MoveCmd.
+	settle *settleTracker
 }
 
 func PartitionCommand(args []string) (*PartitionCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
 	partitionCmd := &PartitionCmd{
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		FileSelector: fileSelector,
+		DirFormat:    defaultDirFormat,
+		MediaTypes:   defaultMediaTypes,
+		Stdout:       stdout,
+		Stderr:       stderr,
 	}
 	flagset := flag.NewFlagSet("", flag.ContinueOnError)
-	flagset.IntVar(&partitionCmd.NumWorkers, "num-workers", 8, "Number of concurrent workers.")
-	flagset.BoolVar(&partitionCmd.Verbose, "verbose", false, "Verbose output.")
-	flagset.BoolVar(&partitionCmd.DryRun, "dry-run", false, "Print partition operations without executing.")
-	flagset.BoolVar(&partitionCmd.ReplaceIfExists, "replace-if-exists", false, "If a file with the same name already exists in the date directory, replace it.")
-	flagset.Func("file", "Include file regex. Can be repeated.", func(value string) error {
-		r, err := compileRegexp(value)
+	partitionCmd.FileSelector.RegisterFlags(flagset)
+	partitionCmd.FilePermissions.RegisterFlags(flagset)
+	partitionCmd.RetryPolicy.RegisterFlags(flagset)
+	partitionCmd.MoveOptions.RegisterFlags(flagset)
+	flagset.Func("dir-format", "Go time layout of the date directories e.g. '2006/2006-01/2006-01-02' to nest them by year and month, or '2006/01' for months only. Slashes separate directories, and the layout may only produce letters, digits, spaces and . _ + -. (default 2006-01-02)", func(value string) error {
+		err := checkDirFormat(value)
 		if err != nil {
 			return err
 		}
-		partitionCmd.FileRegexps = append(partitionCmd.FileRegexps, r)
+		partitionCmd.DirFormat = value
 		return nil
 	})
-	err := flagset.Parse(args)
-	if err != nil {
-		return nil, err
-	}
-	logLevel := slog.LevelError
-	if partitionCmd.Verbose {
-		logLevel = slog.LevelInfo
-	}
-	partitionCmd.logger = slog.New(slog.NewTextHandler(partitionCmd.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-		Level:     logLevel,
-		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
-			switch attr.Key {
-			case slog.TimeKey:
-				return slog.Attr{}
-			case slog.SourceKey:
-				source := attr.Value.Any().(*slog.Source)
-				return slog.Any(slog.SourceKey, &slog.Source{
-					Function: source.Function,
-					File:     filepath.Base(source.File),
-					Line:     source.Line,
-				})
-			default:
-				return attr
-			}
-		},
-	}))
-	return partitionCmd, nil
-}
-
-func (partitionCmd *PartitionCmd) Run(ctx context.Context) error {
-	var waitGroup sync.WaitGroup
-	defer waitGroup.Wait()
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	filePaths := make(chan string)
-	for i := 0; i < partitionCmd.NumWorkers; i++ {
-		exifToolCmd := exec.Command("exiftool", "-stay_open", "True", "-@", "-")
-		setpgid(exifToolCmd)
-		exifToolStdin, err := exifToolCmd.StdinPipe()
-		if err != nil {
-			return err
-		}
-		exifToolStdout, err := exifToolCmd.StdoutPipe()
+	flagset.Func("day-boundary", "Time of day at which a day starts e.g. 04:00 to put photos taken after midnight into the previous day's directory, along with the rest of the evening. (default 00:00)", func(value string) error {
+		dayBoundary, err := parseDayBoundary(value)
 		if err != nil {
 			return err
 		}
-		exifToolStderr, err := exifToolCmd.StderrPipe()
+		partitionCmd.DayBoundary = dayBoundary
+		return nil
+	})
+	flagset.BoolVar(&partitionCmd.SplitMedia, "split-media", false, "Put the date directories of photos and videos under separate photos and videos directories e.g. photos/2006-01-02 and videos/2006-01-02, telling them apart by the MIME type exiftool reads from their contents. Files that are neither are partitioned as usual.")
+	mediaTypesSet := false
+	flagset.Func("media-type", "With -split-media, the directory NAME to put files matching any of a comma separated list of extensions and MIME type patterns under e.g. 'videos=video/*,lrv' or 'raw=cr2,nef,arw'. Can be repeated, the first matching rule wins. (default photos=image/* and videos=video/*)", func(value string) error {
+		rule, err := parseMediaTypeRule(value)
 		if err != nil {
 			return err
 		}
-		go func() {
-			_, _ = io.Copy(partitionCmd.Stderr, exifToolStderr)
-		}()
-		err = exifToolCmd.Start()
-		if err != nil {
-			return fmt.Errorf("%s: %w", exifToolCmd.String(), err)
+		if !mediaTypesSet {
+			partitionCmd.MediaTypes = nil
+			mediaTypesSet = true
 		}
-		waitGroup.Add(1)
-		go func() {
-			defer waitGroup.Done()
-			defer func() {
-				_, err := io.WriteString(exifToolStdin, "-stay_open\n"+
-					"False\n")
-				if err != nil {
-					partitionCmd.logger.Warn(err.Error())
-				}
-				stop(exifToolCmd)
-			}()
-			var buf bytes.Buffer
-			reader := bufio.NewReader(exifToolStdout)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case filePath := <-filePaths:
-					logger := partitionCmd.logger.With(slog.String("filePath", filePath))
-					_, err := io.WriteString(exifToolStdin, "-json\n"+
-						filePath+"\n"+
-						"-execute\n")
-					if err != nil {
-						logger.Error(err.Error())
-						break
-					}
-					buf.Reset()
-					for {
-						line, err := reader.ReadBytes('\n')
-						if err != nil {
-							if err == io.EOF {
-								logger.Error("exiftool returned EOF prematurely")
-								return
-							}
-							logger.Error(err.Error())
-							return
-						}
-						if string(line) != "{ready}\n" {
-							buf.Write(line)
-							continue
-						}
-						break
-					}
-					exifs := parseExifs(logger, buf.Bytes())
-					if len(exifs) == 0 {
-						logger.Error("exiftool returned empty array", slog.String("data", buf.String()))
-						break
-					}
-					exif := exifs[0]
-					if exif.CreationTime.IsZero() {
-						logger.Error("unable to fetch file creation time", slog.String("data", buf.String()))
-						break
-					}
-					dateDirPath := filepath.Join(filepath.Dir(filePath), exif.CreationTime.Format("2006-01-02"))
-					newFilePath := filepath.Join(dateDirPath, filepath.Base(filePath))
-					if partitionCmd.DryRun {
-						b, err := json.Marshal(exif)
-						if err != nil {
-							logger.Warn(err.Error())
-						}
-						fmt.Fprintf(partitionCmd.Stdout, "%s => %s %s\n", filePath, newFilePath, string(b))
-						break
-					}
-					err = os.MkdirAll(dateDirPath, 0755)
-					if err != nil {
-						logger.Error(err.Error(), slog.String("dateDirPath", dateDirPath))
-						break
-					}
-					if partitionCmd.ReplaceIfExists {
-						err := os.Rename(filePath, newFilePath)
-						if err != nil {
-							logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
-							break
-						}
-						logger.Info("moved file", slog.String("newFilePath", newFilePath))
-						break
-					}
-					_, err = os.Stat(newFilePath)
-					if err != nil {
-						if !errors.Is(err, fs.ErrNotExist) {
-							logger.Error(err.Error(), slog.String("name", newFilePath))
-							break
-						}
-						err := os.Rename(filePath, newFilePath)
-						if err != nil {
-							logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
-							break
-						}
-						logger.Info("moved file", slog.String("newFilePath", newFilePath))
-					} else {
-						logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("newFilePath", newFilePath))
-					}
-				}
+		partitionCmd.MediaTypes = append(partitionCmd.MediaTypes, rule)
+		return nil
+	})
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = partitionCmd.MoveOptions.setDefaults()
+	if err != nil {
+		return nil, err
+	}
+	err = partitionCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	partitionCmd.logger = newLogger(partitionCmd.Stdout, partitionCmd.Verbose)
+	return partitionCmd, nil
+}
+
+// defaultDirFormat is the layout of the date directories partition moves
+// files into, unless told otherwise by -dir-format.
+const defaultDirFormat = "2006-01-02"
+
+// dirFormatSegmentRegexp matches what a segment of a -dir-format may
+// produce.
+var dirFormatSegmentRegexp = regexp.MustCompile(`^[\p{L}\p{N}._+-][\p{L}\p{N} ._+-]*$`)
+
+// checkDirFormat checks that the time layout of -dir-format produces
+// path-safe directory names that depend on the date, whatever the date and
+// time zone.
+func checkDirFormat(layout string) error {
+	times := []time.Time{
+		time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		time.Date(2019, time.December, 31, 23, 59, 59, 0, time.FixedZone("", -(9*60+30)*60)),
+	}
+	var formatted []string
+	for _, t := range times {
+		dir := t.Format(layout)
+		for _, segment := range strings.Split(dir, "/") {
+			if segment == "" || segment == "." || segment == ".." || !dirFormatSegmentRegexp.MatchString(segment) || strings.HasSuffix(segment, " ") || strings.HasSuffix(segment, ".") {
+				return fmt.Errorf("%q produces directory name %q, which is empty, ends in a space or dot, or contains characters other than letters, digits, spaces and . _ + -", layout, segment)
 			}
-		}()
-		cwd, err := os.Getwd()
-		if err != nil {
-			return err
 		}
-		dirEntries, err := os.ReadDir(cwd)
-		if err != nil {
-			return err
-		}
-		for _, dirEntry := range dirEntries {
-			if dirEntry.IsDir() {
-				continue
+		formatted = append(formatted, dir)
+	}
+	if formatted[0] == formatted[1] {
+		return fmt.Errorf("%q does not depend on the date, it must contain e.g. 2006 for the year", layout)
+	}
+	return nil
+}
+
+// dirFormatRegexp matches the names of the top-level directories that
+// layout produces, which hold the files already partitioned. Runs of
+// digits and of letters in the layout's output (like 2006 and January)
+// match any run of the same kind.
+func dirFormatRegexp(layout string) *regexp.Regexp {
+	segment, _, _ := strings.Cut(time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC).Format(layout), "/")
+	var b strings.Builder
+	b.WriteString("^")
+	runes := []rune(segment)
+	for i := 0; i < len(runes); {
+		j := i + 1
+		switch {
+		case unicode.IsDigit(runes[i]):
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
 			}
-			name := dirEntry.Name()
-			for _, fileRegexp := range partitionCmd.FileRegexps {
-				if fileRegexp.MatchString(name) {
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					case filePaths <- filepath.Join(cwd, name):
-						break
-					}
-				}
+			b.WriteString(`\d+`)
+		case unicode.IsLetter(runes[i]):
+			for j < len(runes) && unicode.IsLetter(runes[j]) {
+				j++
 			}
+			b.WriteString(`\p{L}+`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
 		}
+		i = j
 	}
-	return nil
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// inDirFormat reports whether filePath is in a directory that layout
+// produces, like 2021-06-01/IMG_1234.jpg for 2006-01-02, judging by its
+// path alone.
+func inDirFormat(layout, filePath string) bool {
+	segments := strings.Split(filepath.ToSlash(filepath.Dir(filePath)), "/")
+	n := strings.Count(layout, "/") + 1
+	if len(segments) < n {
+		return false
+	}
+	dir := strings.Join(segments[len(segments)-n:], "/")
+	t, err := time.Parse(layout, dir)
+	return err == nil && t.Format(layout) == dir
+}
+
+func (partitionCmd *PartitionCmd) Run(ctx context.Context) error {
+	fileSelector := partitionCmd.FileSelector
+	// Files already partitioned, including those moved during this very
+	// walk, must not be partitioned again into a directory of their own.
+	// Directories named like the top of DirFormat are left out of the walk,
+	// and files found (or given) in a date directory anyway, like when a
+	// root is one, are skipped by their path.
+	fileSelector.ExcludeRegexps = append(slices.Clip(fileSelector.ExcludeRegexps), dirFormatRegexp(partitionCmd.DirFormat))
+	dirTemplate := "{{.Dir}}/{{.DayFormat " + strconv.Quote(partitionCmd.DirFormat) + "}}"
+	if partitionCmd.SplitMedia {
+		// Files of no media type get an empty path segment, which is
+		// dropped.
+		dirTemplate = "{{.Dir}}/{{.MediaType}}/{{.DayFormat " + strconv.Quote(partitionCmd.DirFormat) + "}}"
+	}
+	moveCmd := &MoveCmd{
+		FileSelector:     fileSelector,
+		FilePermissions:  partitionCmd.FilePermissions,
+		RetryPolicy:      partitionCmd.RetryPolicy,
+		MoveOptions:      partitionCmd.MoveOptions,
+		DirTemplate:      template.Must(newMoveTemplate(dirTemplate)),
+		NameTemplate:     template.Must(newMoveTemplate("{{.Name}}")),
+		DayBoundary:      partitionCmd.DayBoundary,
+		MediaTypes:       partitionCmd.MediaTypes,
+		MergeSimilarDirs: true,
+		OnResult:         partitionCmd.OnResult,
+		Stdout:           partitionCmd.Stdout,
+		Stderr:           partitionCmd.Stderr,
+		logger:           partitionCmd.logger,
+		settle:           partitionCmd.settle,
+		placed: func(filePath string) bool {
+			return inDirFormat(partitionCmd.DirFormat, filePath)
+		},
+	}
+	return moveCmd.Run(ctx)
 }
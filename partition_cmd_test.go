@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestPartitionRun(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{{
+		args: nil,
+		want: []string{
+			`2003-06-15/date-only\.tif`,
+			`2021-03-04/no-timezone\.jpg`,
+			`2022-07-08/quicktime-utc\.mov`,
+			`corrupt\.jpg`,
+			`unknown\.jpg`,
+		},
+	}, {
+		args: []string{"-dir-format", "2006/01"},
+		want: []string{
+			`2003/06/date-only\.tif`,
+			`2021/03/no-timezone\.jpg`,
+			`2022/07/quicktime-utc\.mov`,
+			`corrupt\.jpg`,
+			`unknown\.jpg`,
+		},
+	}, {
+		// The media type is told by the MIME type exiftool reads.
+		args: []string{"-split-media"},
+		want: []string{
+			`corrupt\.jpg`,
+			`photos/2003-06-15/date-only\.tif`,
+			`photos/2021-03-04/no-timezone\.jpg`,
+			`unknown\.jpg`,
+			`videos/2022-07-08/quicktime-utc\.mov`,
+		},
+	}}
+	useFakeExifTool(t)
+	for _, tt := range tests {
+		root := newTestTree(t, "no-timezone.jpg", "date-only.tif", "quicktime-utc.mov", "corrupt.jpg", "unknown.jpg")
+		partitionCmd, err := PartitionCommand(append(append([]string{"-no-cache", "-file", "."}, tt.args...), root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partitionCmd.Stdout = io.Discard
+		partitionCmd.Stderr = io.Discard
+		partitionCmd.logger = newLogger(io.Discard, false)
+		err = partitionCmd.Run(t.Context())
+		if err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		matchFiles(t, treeFiles(t, root), tt.want...)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rcloneScheme is the prefix of roots and destinations on an rclone remote,
+// as in rclone://gdrive/Photos for the path Photos on the remote gdrive.
+const rcloneScheme = "rclone://"
+
+// s3Scheme is the prefix of roots and destinations in an S3 bucket, as in
+// s3://photos/2024 for the prefix 2024 of the bucket photos. They are
+// mounted with rclone's S3 backend, which takes its credentials from the
+// environment like the AWS CLI does.
+const s3Scheme = "s3://"
+
+// s3BucketRegexp matches the name of an S3 bucket.
+var s3BucketRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// rcloneMountTimeout is how long an rclone remote has to be mounted in.
+const rcloneMountTimeout = 30 * time.Second
+
+// rcloneRemotes are the remotes of the rclone:// and s3:// roots and
+// destinations given to a subcommand. Their paths are resolved to where the
+// remotes will be mounted as they are parsed, but the remotes are only
+// mounted by Mount, once the subcommand runs, and for as long as it runs.
+type rcloneRemotes struct {
+	mutex sync.Mutex
+	// mounts are the mounts by remote, shared by every path on the same
+	// remote.
+	mounts map[string]*rcloneMount
+}
+
+// rcloneMount is a remote mounted by rclone mount.
+type rcloneMount struct {
+	// remote is the remote as rclone takes it e.g. gdrive:.
+	remote string
+	dir    string
+	// cmd is the rclone mount process, or nil while the remote isn't
+	// mounted.
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+var (
+	// numMountPoints numbers the mount points of the process, so that the
+	// same remote given to two subcommands run by the daemon at once gets
+	// two of them.
+	numMountPoints atomic.Int64
+
+	activeMountsMutex sync.Mutex
+	// activeMounts are the remotes mounted at the moment, for a hard
+	// interrupt to unmount before exiting.
+	activeMounts = make(map[*rcloneMount]bool)
+)
+
+// localPath returns the local path of a root or destination. An rclone://
+// path is given as its path under where its remote will be mounted with
+// rclone mount, so that any remote rclone supports (Drive, Dropbox, B2...)
+// can be walked, read and written like a local directory without syncing it
+// first. An s3:// path is the same for an S3 bucket, with no rclone remote
+// to configure. Other URLs are rejected as remote storage that has to be
+// mounted first, as they would otherwise be taken to be relative paths.
+func (remotes *rcloneRemotes) localPath(path string) (string, error) {
+	var remote, mountName, remotePath string
+	switch {
+	case strings.HasPrefix(path, rcloneScheme):
+		var name string
+		name, remotePath, _ = strings.Cut(strings.TrimPrefix(path, rcloneScheme), "/")
+		if name == "" || strings.ContainsAny(name, `:\`) {
+			return "", fmt.Errorf("%s: invalid rclone remote, must be of the form rclone://REMOTE/PATH", path)
+		}
+		remote = name + ":"
+		mountName = "exifutil-rclone-" + name
+	case strings.HasPrefix(path, s3Scheme):
+		var bucket string
+		bucket, remotePath, _ = strings.Cut(strings.TrimPrefix(path, s3Scheme), "/")
+		if !s3BucketRegexp.MatchString(bucket) {
+			return "", fmt.Errorf("%s: invalid S3 bucket, must be of the form s3://BUCKET/PREFIX", path)
+		}
+		// An on the fly remote, so that there is nothing to set up with
+		// rclone config.
+		remote = ":s3,env_auth=true:" + bucket
+		mountName = "exifutil-s3-" + bucket
+	default:
+		err := checkLocalPath(path)
+		if err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	_, err := exec.LookPath("rclone")
+	if err != nil {
+		return "", fmt.Errorf("%s: rclone not found in the PATH, it is needed for rclone:// and s3:// paths", path)
+	}
+	dir := remotes.mountPoint(remote, mountName)
+	if remotePath == "" {
+		return dir, nil
+	}
+	// The path is appended as is rather than joined, as -to may be a
+	// template whose actions must not be cleaned like a path.
+	return dir + "/" + remotePath, nil
+}
+
+// isRemotePath reports whether path is on a remote that is only mounted
+// once the subcommand runs, so that it can't be looked at before then.
+func isRemotePath(path string) bool {
+	return strings.HasPrefix(path, rcloneScheme) || strings.HasPrefix(path, s3Scheme)
+}
+
+// mountPoint returns the directory remote will be mounted on, named after
+// name.
+func (remotes *rcloneRemotes) mountPoint(remote, name string) string {
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+	if mount := remotes.mounts[remote]; mount != nil {
+		return mount.dir
+	}
+	if remotes.mounts == nil {
+		remotes.mounts = make(map[string]*rcloneMount)
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d-%d", name, os.Getpid(), numMountPoints.Add(1)))
+	remotes.mounts[remote] = &rcloneMount{remote: remote, dir: dir}
+	return dir
+}
+
+// Mount mounts the remotes that aren't mounted yet and returns a function
+// that unmounts them again, which must be called once the subcommand is
+// done with them. A nil rcloneRemotes has nothing to mount.
+func (remotes *rcloneRemotes) Mount() (unmount func(), err error) {
+	if remotes == nil {
+		return func() {}, nil
+	}
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+	var mounted []*rcloneMount
+	unmount = func() {
+		for _, mount := range mounted {
+			mount.unmount()
+		}
+	}
+	for _, mount := range remotes.mounts {
+		if mount.cmd != nil {
+			continue
+		}
+		err := mount.mount()
+		if err != nil {
+			unmount()
+			return nil, fmt.Errorf("rclone mount %s: %w", mount.remote, err)
+		}
+		mounted = append(mounted, mount)
+	}
+	return unmount, nil
+}
+
+// mount mounts the remote on its directory.
+func (mount *rcloneMount) mount() error {
+	err := makeMountPoint(mount.dir)
+	if err != nil {
+		return err
+	}
+	// Writes are cached locally until the file is closed, so that files
+	// can be moved and rewritten on remotes that only support uploading
+	// whole files.
+	cmd := exec.Command("rclone", "mount", mount.remote, mount.dir, "--vfs-cache-mode", "writes")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	setpgid(cmd)
+	err = cmd.Start()
+	if err != nil {
+		os.Remove(mount.dir)
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	timeout := time.After(rcloneMountTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !mounted(mount.dir) {
+		select {
+		case <-exited:
+			os.Remove(mount.dir)
+			return errors.New(strings.TrimSpace(stderr.String()))
+		case <-timeout:
+			stop(cmd)
+			<-exited
+			os.Remove(mount.dir)
+			return fmt.Errorf("not mounted after %s", rcloneMountTimeout)
+		case <-ticker.C:
+		}
+	}
+	mount.cmd = cmd
+	mount.exited = exited
+	activeMountsMutex.Lock()
+	activeMounts[mount] = true
+	activeMountsMutex.Unlock()
+	return nil
+}
+
+// unmount stops rclone mount, which uploads the files still in its cache
+// before it exits.
+func (mount *rcloneMount) unmount() {
+	activeMountsMutex.Lock()
+	defer activeMountsMutex.Unlock()
+	if !activeMounts[mount] {
+		return
+	}
+	stop(mount.cmd)
+	<-mount.exited
+	os.Remove(mount.dir)
+	delete(activeMounts, mount)
+	mount.cmd = nil
+}
+
+// unmountRcloneRemotes unmounts every remote mounted at the moment, for a
+// hard interrupt that exits without waiting for the subcommand to return.
+func unmountRcloneRemotes() {
+	activeMountsMutex.Lock()
+	mounts := make([]*rcloneMount, 0, len(activeMounts))
+	for mount := range activeMounts {
+		mounts = append(mounts, mount)
+	}
+	activeMountsMutex.Unlock()
+	for _, mount := range mounts {
+		mount.unmount()
+	}
+}
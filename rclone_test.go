@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// useFakeRclone puts an rclone on the PATH that fails to mount anything.
+func useFakeRclone(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script in place of rclone")
+	}
+	binDir := t.TempDir()
+	script := "#!/bin/sh\necho \"mount of $2 failed\" >&2\nexit 1\n"
+	err := os.WriteFile(filepath.Join(binDir, "rclone"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRcloneRemotesLocalPath(t *testing.T) {
+	useFakeRclone(t)
+	var remotes rcloneRemotes
+	root, err := remotes.localPath("rclone://gdrive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, err := remotes.localPath("rclone://gdrive/Photos/{{.Year}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paths on the same remote share its mount, which isn't made until
+	// the subcommand runs.
+	if photos != root+"/Photos/{{.Year}}" {
+		t.Errorf("got %q, want it under %q", photos, root)
+	}
+	if _, err := os.Stat(root); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mount point exists before the run: %v", err)
+	}
+	other, err := remotes.localPath("rclone://b2/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(other, root) {
+		t.Errorf("got %q for another remote, want a mount point of its own", other)
+	}
+	// Another subcommand, as run by the daemon, gets mounts of its own.
+	var otherRemotes rcloneRemotes
+	otherRoot, err := otherRemotes.localPath("rclone://gdrive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherRoot == root {
+		t.Errorf("two subcommands share the mount point %q", root)
+	}
+	bucket, err := remotes.localPath("s3://photos/archive/{{.Year}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(bucket, "/archive/{{.Year}}") || strings.HasPrefix(bucket, root) || !strings.Contains(bucket, "exifutil-s3-photos-") {
+		t.Errorf("got %q for an S3 bucket, want a mount point of its own", bucket)
+	}
+	for _, path := range []string{"rclone://", "rclone://gdrive:/Photos", "s3://", "s3://Photos/prefix", "sftp://host/path"} {
+		_, err := remotes.localPath(path)
+		if err == nil {
+			t.Errorf("%s: no error", path)
+		}
+	}
+	local, err := remotes.localPath("photos/2024")
+	if err != nil || local != "photos/2024" {
+		t.Errorf("got %q, %v for a local path, want it as is", local, err)
+	}
+}
+
+func TestRcloneRemotesMount(t *testing.T) {
+	useFakeRclone(t)
+	selector, err := newFileSelector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = selector.ParseArgs([]string{"rclone://gdrive/Photos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The path can't be looked at before the remote is mounted, so it is
+	// taken to be a directory.
+	if len(selector.Roots) != 1 || len(selector.FilePaths) != 0 || !strings.HasSuffix(selector.Roots[0], "/Photos") {
+		t.Fatalf("got roots %q and files %q, want the remote's Photos", selector.Roots, selector.FilePaths)
+	}
+	_, err = selector.MountRemotes()
+	if err == nil || !strings.Contains(err.Error(), "rclone mount gdrive:") || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("got %v, want rclone's error", err)
+	}
+	if _, err := os.Stat(filepath.Dir(selector.Roots[0])); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mount point left behind after a failed mount: %v", err)
+	}
+	if len(activeMounts) != 0 {
+		t.Errorf("got %d active mounts, want none", len(activeMounts))
+	}
+
+	// An S3 bucket is mounted with rclone's S3 backend rather than a
+	// configured remote.
+	selector, err = newFileSelector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = selector.ParseArgs([]string{"s3://photos/2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selector.Roots) != 1 || len(selector.FilePaths) != 0 || !strings.HasSuffix(selector.Roots[0], "/2024") {
+		t.Fatalf("got roots %q and files %q, want the bucket's 2024 prefix", selector.Roots, selector.FilePaths)
+	}
+	_, err = selector.MountRemotes()
+	if err == nil || !strings.Contains(err.Error(), "rclone mount :s3,env_auth=true:photos") {
+		t.Errorf("got %v, want rclone's error for the bucket", err)
+	}
+
+	// A selector without remotes has nothing to mount.
+	unmount, err := (&FileSelector{}).MountRemotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmount()
+}
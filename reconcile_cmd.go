@@ -0,0 +1,807 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ReconcileCmd struct {
+	ArchiveDir     string
+	ExcludeRegexps []*regexp.Regexp
+	IncludeHidden  bool
+	// CanonicalRegexps match the names that files are given by rename or
+	// partition. Of the files with the same contents, the one with a
+	// matching name is kept.
+	CanonicalRegexps []*regexp.Regexp
+	// SidecarExts are the lowercased extensions, with the leading dot, of
+	// the sidecars merged together with the files they belong to.
+	SidecarExts []string
+	// Catalog is the CSV file that the name of every duplicate removed is
+	// appended to, as an alias of the file kept.
+	Catalog string
+	// Review is the HTML file to write a review of the duplicates and near
+	// duplicates to, in place of merging them.
+	Review        string
+	NumWorkers    int
+	Timeout       time.Duration
+	Charset       string
+	NoCache       bool
+	HashAlgorithm string
+	Verbose       bool
+	DryRun        bool
+	NoLock        bool
+	Stdout        io.Writer
+	Stderr        io.Writer
+	logger        *slog.Logger
+}
+
+// catalogFileName is the default -catalog, in the archive directory.
+const catalogFileName = ".exifutil-aliases.csv"
+
+// defaultCanonicalRegexps match the timestamp names given by rename
+// (2024-01-02T150405.000+0100.jpg) and -daily-index (2024-01-02_0001.jpg),
+// along with any suffix added to tell files apart.
+var defaultCanonicalRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{6}\.\d{3}[+-]\d{4}`),
+	regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_\d{4,}`),
+}
+
+func ReconcileCommand(args []string) (*ReconcileCmd, error) {
+	reconcileCmd := &ReconcileCmd{
+		SidecarExts:   []string{".xmp"},
+		HashAlgorithm: hashSHA256,
+		Stdout:        stdout,
+		Stderr:        stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil reconcile [FLAGS] ARCHIVE_DIR")
+		flagset.PrintDefaults()
+	}
+	flagset.Func("exclude", "Exclude file or directory regex, matched against names. Can be repeated.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		reconcileCmd.ExcludeRegexps = append(reconcileCmd.ExcludeRegexps, r)
+		return nil
+	})
+	flagset.BoolVar(&reconcileCmd.IncludeHidden, "include-hidden", false, "Don't skip .DS_Store, Thumbs.db, desktop.ini and AppleDouble ._ files.")
+	flagset.Func("canonical", "Regex matching the names files are given by rename or partition, for archives organized with a custom -name template. Of the files with the same contents, the one whose name matches is kept. Can be repeated. (default the timestamp names of rename and -daily-index)", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		reconcileCmd.CanonicalRegexps = append(reconcileCmd.CanonicalRegexps, r)
+		return nil
+	})
+	flagset.Func("sidecar-ext", "Comma separated extensions of the sidecars merged together with the files they are named after. (default xmp)", func(value string) error {
+		exts, err := parseSidecarExts(value)
+		if err != nil {
+			return err
+		}
+		reconcileCmd.SidecarExts = exts
+		return nil
+	})
+	flagset.StringVar(&reconcileCmd.Catalog, "catalog", "", "CSV file to append the path of every file kept and the paths it was also found under to. (default "+catalogFileName+" in ARCHIVE_DIR)")
+	flagset.StringVar(&reconcileCmd.Review, "review", "", "Instead of merging anything, write a page to this HTML file showing the files with the same contents, and the files with different contents taken at the same second by the same camera, side by side with their embedded thumbnails and the metadata they differ in. The files ticked on the page are written into a shell script that deletes them.")
+	flagset.IntVar(&reconcileCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers hashing files. 0 means one per CPU.")
+	flagset.DurationVar(&reconcileCmd.Timeout, "timeout", time.Minute, "With -review, maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&reconcileCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.BoolVar(&reconcileCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("hash-algorithm", "Hash algorithm used to find files with the same contents: sha256 hashes each file on a single CPU, giving the same hashes as sha256sum, and sha256-tree hashes the chunks of large files on every CPU at once, to keep up with fast drives, giving hashes of large files that no other tool does. (default sha256)", func(value string) error {
+		algorithm, err := parseHashAlgorithm(value)
+		if err != nil {
+			return err
+		}
+		reconcileCmd.HashAlgorithm = algorithm
+		return nil
+	})
+	flagset.BoolVar(&reconcileCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&reconcileCmd.DryRun, "dry-run", false, "Print the duplicates that would be removed without removing them or writing the catalog.")
+	flagset.BoolVar(&reconcileCmd.NoLock, "no-lock", false, "Don't take the lock on the archive directory that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("expected 1 archive directory, got %d", flagset.NArg())
+	}
+	err = checkLocalPath(flagset.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	reconcileCmd.ArchiveDir, err = filepath.Abs(flagset.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	if reconcileCmd.Catalog == "" {
+		reconcileCmd.Catalog = filepath.Join(reconcileCmd.ArchiveDir, catalogFileName)
+	} else {
+		reconcileCmd.Catalog, err = filepath.Abs(reconcileCmd.Catalog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reconcileCmd.Review != "" {
+		reconcileCmd.Review, err = filepath.Abs(reconcileCmd.Review)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reconcileCmd.CanonicalRegexps == nil {
+		reconcileCmd.CanonicalRegexps = defaultCanonicalRegexps
+	}
+	if reconcileCmd.NumWorkers == 0 {
+		reconcileCmd.NumWorkers = runtime.NumCPU()
+	}
+	reconcileCmd.logger = newLogger(reconcileCmd.Stdout, reconcileCmd.Verbose)
+	return reconcileCmd, nil
+}
+
+// reconcileFile is a file in the archive being reconciled.
+type reconcileFile struct {
+	FilePath string
+	Size     int64
+	ModTime  time.Time
+	// Hash is only computed for files whose size is shared with another
+	// file.
+	Hash string
+	// Exif and Thumbnail are only read for -review.
+	Exif      Exif
+	Thumbnail []byte
+}
+
+// Run finds the files in the archive directory with the same contents but
+// different names, such as a shoot imported once under the camera's names
+// (DSC_1234.NEF) and again after exifutil rename, and keeps the one with a
+// canonical name. The others are moved into the trash, their companion files
+// are merged into those of the file kept where it has none of its own, and
+// their paths are recorded in the catalog as aliases of the file kept.
+func (reconcileCmd *ReconcileCmd) Run(ctx context.Context) error {
+	if !reconcileCmd.DryRun && !reconcileCmd.NoLock && reconcileCmd.Review == "" {
+		selector := &FileSelector{Roots: []string{reconcileCmd.ArchiveDir}}
+		unlock, err := selector.Lock(reconcileCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	files, err := reconcileCmd.listFiles()
+	if err != nil {
+		return err
+	}
+	// Only files of the same size can have the same contents, so the rest
+	// needn't be hashed.
+	bySize := make(map[int64][]*reconcileFile)
+	for _, file := range files {
+		bySize[file.Size] = append(bySize[file.Size], file)
+	}
+	var candidates []*reconcileFile
+	for _, file := range files {
+		if len(bySize[file.Size]) > 1 {
+			candidates = append(candidates, file)
+		}
+	}
+	paths := make([]string, len(candidates))
+	for i, file := range candidates {
+		paths[i] = file.FilePath
+	}
+	fileHashes, err := hashFiles(ctx, reconcileCmd.logger, reconcileCmd.NumWorkers, reconcileCmd.HashAlgorithm, paths)
+	if err != nil {
+		return err
+	}
+	for i, file := range candidates {
+		file.Hash = fileHashes[i]
+	}
+	if reconcileCmd.Review != "" {
+		return reconcileCmd.writeReview(ctx, files)
+	}
+	byHash := make(map[string][]*reconcileFile)
+	var hashes []string
+	for _, file := range candidates {
+		if byHash[file.Hash] == nil {
+			hashes = append(hashes, file.Hash)
+		}
+		byHash[file.Hash] = append(byHash[file.Hash], file)
+	}
+	var catalog *catalogWriter
+	if !reconcileCmd.DryRun {
+		catalog, err = newCatalogWriter(reconcileCmd.Catalog)
+		if err != nil {
+			return err
+		}
+		defer catalog.Close()
+	}
+	var numMerged, numUnresolved int
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		group := byHash[hash]
+		if len(group) < 2 {
+			continue
+		}
+		kept, aliases := reconcileCmd.pickCanonical(group)
+		if kept == nil {
+			// Renaming one of them first is up to the user.
+			numUnresolved++
+			var filePaths []string
+			for _, file := range group {
+				filePaths = append(filePaths, file.FilePath)
+			}
+			fmt.Fprintf(reconcileCmd.Stdout, "no canonical name: %s\n", strings.Join(filePaths, ", "))
+			continue
+		}
+		for _, alias := range aliases {
+			if reconcileCmd.DryRun {
+				fmt.Fprintf(reconcileCmd.Stdout, "%s => %s (alias)\n", alias.FilePath, kept.FilePath)
+				numMerged++
+				continue
+			}
+			err := reconcileCmd.merge(alias.FilePath, kept.FilePath)
+			if err != nil {
+				reconcileCmd.logger.Error(err.Error(), slog.String("filePath", alias.FilePath))
+				continue
+			}
+			err = catalog.Add(reconcileCmd.relPath(kept.FilePath), reconcileCmd.relPath(alias.FilePath), hash)
+			if err != nil {
+				return err
+			}
+			numMerged++
+			fmt.Fprintf(reconcileCmd.Stdout, "%s => %s (alias)\n", alias.FilePath, kept.FilePath)
+		}
+	}
+	if catalog != nil {
+		err := catalog.Close()
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(reconcileCmd.Stderr, "checked %d files: %d duplicates merged, %d sets of duplicates without a canonical name\n", len(files), numMerged, numUnresolved)
+	return nil
+}
+
+func (reconcileCmd *ReconcileCmd) listFiles() ([]*reconcileFile, error) {
+	var files []*reconcileFile
+	err := filepath.WalkDir(reconcileCmd.ArchiveDir, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := dirEntry.Name()
+		if dirEntry.IsDir() {
+			if path != reconcileCmd.ArchiveDir && (name == trashDirName || reconcileCmd.excluded(name)) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !dirEntry.Type().IsRegular() || name == lockFileName || path == reconcileCmd.Catalog || path == reconcileCmd.Review || reconcileCmd.excluded(name) {
+			return nil
+		}
+		if !reconcileCmd.IncludeHidden && isHiddenSystemFile(name) {
+			return nil
+		}
+		// Sidecars are merged together with their files rather than on
+		// their own.
+		if slices.Contains(reconcileCmd.SidecarExts, strings.ToLower(filepath.Ext(name))) {
+			return nil
+		}
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		// Empty files are all the same, but not duplicates of each other.
+		if fileInfo.Size() == 0 {
+			return nil
+		}
+		files = append(files, &reconcileFile{FilePath: path, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (reconcileCmd *ReconcileCmd) excluded(name string) bool {
+	return slices.ContainsFunc(reconcileCmd.ExcludeRegexps, func(r *regexp.Regexp) bool {
+		return r.MatchString(name)
+	})
+}
+
+// pickCanonical returns the file of a set of files with the same contents
+// that is kept, and the others. The file kept is the first, in path order,
+// with a canonical name. If none has one, kept is nil.
+func (reconcileCmd *ReconcileCmd) pickCanonical(group []*reconcileFile) (kept *reconcileFile, aliases []*reconcileFile) {
+	group = slices.Clone(group)
+	slices.SortFunc(group, func(a, b *reconcileFile) int {
+		return strings.Compare(a.FilePath, b.FilePath)
+	})
+	index := slices.IndexFunc(group, func(file *reconcileFile) bool {
+		name := filepath.Base(file.FilePath)
+		return slices.ContainsFunc(reconcileCmd.CanonicalRegexps, func(r *regexp.Regexp) bool {
+			return r.MatchString(name)
+		})
+	})
+	if index < 0 {
+		return nil, nil
+	}
+	kept = group[index]
+	return kept, slices.Delete(group, index, index+1)
+}
+
+// merge moves the duplicate at aliasPath into the trash. Its companion files
+// are moved next to keptPath under the names they would have had if it had
+// been renamed to keptPath, unless keptPath already has a companion of that
+// name, in which case they are trashed as well.
+func (reconcileCmd *ReconcileCmd) merge(aliasPath, keptPath string) error {
+	extHandlers := make(map[string]extHandler)
+	for _, ext := range reconcileCmd.SidecarExts {
+		extHandlers[ext] = extHandler{Sidecar: true}
+	}
+	for _, companionFile := range fileCompanions(aliasPath, extHandlers) {
+		newCompanionPath := newCompanionFilePath(aliasPath, keptPath, companionFile)
+		_, err := os.Lstat(newCompanionPath)
+		if err == nil {
+			err := moveToTrash(osFS{}, companionFile.FilePath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = os.Rename(companionFile.FilePath, newCompanionPath)
+		if err != nil {
+			return err
+		}
+		reconcileCmd.logger.Info("merged companion file", slog.String("filePath", companionFile.FilePath), slog.String("newFilePath", newCompanionPath))
+	}
+	return moveToTrash(osFS{}, aliasPath)
+}
+
+// relPath returns filePath relative to the archive directory, so that the
+// catalog stays valid if the archive is moved.
+func (reconcileCmd *ReconcileCmd) relPath(filePath string) string {
+	rel, err := filepath.Rel(reconcileCmd.ArchiveDir, filePath)
+	if err != nil {
+		return filePath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// catalogWriter appends the aliases found by reconcile to a CSV file with
+// the columns path, alias, hash and reconciled_at, writing the header if the
+// file is new.
+type catalogWriter struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCatalogWriter(name string) (*catalogWriter, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	catalogWriter := &catalogWriter{file: file, writer: csv.NewWriter(file)}
+	if fileInfo.Size() == 0 {
+		err := catalogWriter.writer.Write([]string{"path", "alias", "hash", "reconciled_at"})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return catalogWriter, nil
+}
+
+// Add records alias as another path the file at filePath was found under.
+// Each record is flushed at once, so that the catalog is complete up to the
+// last merged file even if the run is interrupted.
+func (catalogWriter *catalogWriter) Add(filePath, alias, hash string) error {
+	err := catalogWriter.writer.Write([]string{filePath, alias, hash, time.Now().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+	catalogWriter.writer.Flush()
+	return catalogWriter.writer.Error()
+}
+
+// Close closes the catalog. It is safe to call more than once.
+func (catalogWriter *catalogWriter) Close() error {
+	if catalogWriter.file == nil {
+		return nil
+	}
+	catalogWriter.writer.Flush()
+	err := catalogWriter.writer.Error()
+	closeErr := catalogWriter.file.Close()
+	catalogWriter.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// reviewTags are the tags beyond those of Exif that -review compares the
+// files of a group on.
+var reviewTags = []string{"ImageSize", "Software", "Orientation"}
+
+// reviewGroup is a set of duplicates or near duplicates shown together on
+// the -review page.
+type reviewGroup struct {
+	// Identical reports whether the files have the same contents, rather
+	// than only the same creation time and camera.
+	Identical bool
+	Files     []reviewFile
+	Rows      []reviewRow
+}
+
+type reviewFile struct {
+	FilePath  string
+	Thumbnail template.URL
+	// Selected pre-ticks the files reconcile would merge into the file
+	// with a canonical name.
+	Selected bool
+}
+
+// reviewRow is a field of metadata, with a value for every file of a group.
+type reviewRow struct {
+	Name   string
+	Values []string
+	// Differs reports whether the files don't all have the same value.
+	Differs bool
+}
+
+// writeReview writes the -review page for files, whose hashes are filled in
+// for the files that share a size. Files with the same hash are grouped
+// together, as are files of the same type with different contents taken at
+// the same second by the same camera, such as a photo and an edited copy of
+// it with rewritten metadata.
+func (reconcileCmd *ReconcileCmd) writeReview(ctx context.Context, files []*reconcileFile) error {
+	err := reconcileCmd.readExifs(ctx, files, false)
+	if err != nil {
+		return err
+	}
+	parents := make(map[*reconcileFile]*reconcileFile)
+	var find func(file *reconcileFile) *reconcileFile
+	find = func(file *reconcileFile) *reconcileFile {
+		parent, ok := parents[file]
+		if !ok || parent == file {
+			return file
+		}
+		root := find(parent)
+		parents[file] = root
+		return root
+	}
+	byKey := make(map[string]*reconcileFile)
+	for _, file := range files {
+		var keys []string
+		if file.Hash != "" {
+			keys = append(keys, "hash:"+file.Hash)
+		}
+		exif := file.Exif
+		if !exif.CreationTime.IsZero() && (exif.Make != "" || exif.Model != "") {
+			keys = append(keys, "time:"+strings.Join([]string{
+				exif.CreationTime.UTC().Format("2006-01-02T15:04:05"),
+				exif.Make,
+				exif.Model,
+				exif.SerialNumber,
+				strings.ToLower(filepath.Ext(file.FilePath)),
+			}, "\x00"))
+		}
+		for _, key := range keys {
+			if other, ok := byKey[key]; ok {
+				parents[find(file)] = find(other)
+			} else {
+				byKey[key] = file
+			}
+		}
+	}
+	members := make(map[*reconcileFile][]*reconcileFile)
+	var roots []*reconcileFile
+	for _, file := range files {
+		root := find(file)
+		if members[root] == nil {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], file)
+	}
+	var grouped []*reconcileFile
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			grouped = append(grouped, members[root]...)
+		}
+	}
+	err = reconcileCmd.readExifs(ctx, grouped, true)
+	if err != nil {
+		return err
+	}
+	var groups []reviewGroup
+	for _, root := range roots {
+		group := members[root]
+		if len(group) < 2 {
+			continue
+		}
+		slices.SortFunc(group, func(a, b *reconcileFile) int {
+			return strings.Compare(a.FilePath, b.FilePath)
+		})
+		identical := !slices.ContainsFunc(group, func(file *reconcileFile) bool {
+			return file.Hash == "" || file.Hash != group[0].Hash
+		})
+		var aliases []*reconcileFile
+		if identical {
+			_, aliases = reconcileCmd.pickCanonical(group)
+		}
+		reviewGroup := reviewGroup{Identical: identical}
+		for _, file := range group {
+			reviewFile := reviewFile{
+				FilePath: file.FilePath,
+				Selected: slices.Contains(aliases, file),
+			}
+			if len(file.Thumbnail) > 0 {
+				reviewFile.Thumbnail = template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(file.Thumbnail))
+			}
+			reviewGroup.Files = append(reviewGroup.Files, reviewFile)
+		}
+		reviewGroup.Rows = reviewRows(group)
+		groups = append(groups, reviewGroup)
+	}
+	var b bytes.Buffer
+	err = reviewTemplate.Execute(&b, map[string]any{
+		"ArchiveDir": reconcileCmd.ArchiveDir,
+		"Groups":     groups,
+	})
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(reconcileCmd.Review, b.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(reconcileCmd.Stderr, "checked %d files: wrote %d groups of duplicates and near duplicates to %s\n", len(files), len(groups), reconcileCmd.Review)
+	return nil
+}
+
+// reviewRows returns the metadata of the files of a group, one row per
+// field.
+func reviewRows(group []*reconcileFile) []reviewRow {
+	fields := []struct {
+		Name  string
+		Value func(file *reconcileFile) string
+	}{
+		{"Size", func(file *reconcileFile) string { return formatBytes(file.Size) }},
+		{"Modified", func(file *reconcileFile) string { return file.ModTime.Format(time.DateTime) }},
+		{"Created", func(file *reconcileFile) string {
+			if file.Exif.CreationTime.IsZero() {
+				return ""
+			}
+			return file.Exif.CreationTime.Format("2006-01-02 15:04:05.000 -07:00")
+		}},
+		{"Created from", func(file *reconcileFile) string { return file.Exif.CreationTimeSource }},
+		{"Make", func(file *reconcileFile) string { return file.Exif.Make }},
+		{"Model", func(file *reconcileFile) string { return file.Exif.Model }},
+		{"Serial number", func(file *reconcileFile) string { return file.Exif.SerialNumber }},
+		{"GPS position", func(file *reconcileFile) string {
+			if file.Exif.GPSPosition == nil {
+				return ""
+			}
+			return fmt.Sprintf("%.6f, %.6f", file.Exif.GPSPosition.Latitude, file.Exif.GPSPosition.Longitude)
+		}},
+	}
+	for _, tag := range reviewTags {
+		fields = append(fields, struct {
+			Name  string
+			Value func(file *reconcileFile) string
+		}{tag, func(file *reconcileFile) string {
+			value, ok := file.Exif.Tags[tag]
+			if !ok {
+				return ""
+			}
+			return fmt.Sprint(value)
+		}})
+	}
+	var rows []reviewRow
+	for _, field := range fields {
+		row := reviewRow{Name: field.Name}
+		for _, file := range group {
+			value := field.Value(file)
+			row.Differs = row.Differs || (len(row.Values) > 0 && value != row.Values[0])
+			row.Values = append(row.Values, value)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// readExifs reads the metadata of files with exiftool, or their embedded
+// thumbnails if thumbnails is set. Files that can't be read are left
+// without.
+func (reconcileCmd *ReconcileCmd) readExifs(ctx context.Context, files []*reconcileFile, thumbnails bool) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var cache *exifCache
+	if !reconcileCmd.NoCache && !thumbnails {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			reconcileCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var waitGroup sync.WaitGroup
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	// Wait for the workers before cancelling ctx, otherwise the exiftool
+	// processes of files still being worked on are killed.
+	defer waitGroup.Wait()
+	queue := make(chan *reconcileFile)
+	defer close(queue)
+	for i := 0; i < min(reconcileCmd.NumWorkers, len(files)); i++ {
+		exifTool, err := startExifTool(ctx, reconcileCmd.Stderr, reconcileCmd.Timeout, reconcileCmd.Charset, "")
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.ReadArgs = defaultReadArgs
+		exifTool.Tags = reviewTags
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					reconcileCmd.logger.Warn(err.Error())
+				}
+			}()
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for file := range queue {
+				logger := reconcileCmd.logger.With(slog.String("filePath", file.FilePath))
+				var err error
+				if thumbnails {
+					file.Thumbnail, err = readThumbnail(exifTool, file.FilePath)
+				} else {
+					var exifs []Exif
+					exifs, err = exifTool.FileExifs(logger, file.FilePath)
+					if len(exifs) > 0 {
+						file.Exif = exifs[0]
+					}
+				}
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+			}
+			exitedEarly = false
+		}()
+	}
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case queue <- file:
+		}
+	}
+	return nil
+}
+
+// readThumbnail returns the embedded thumbnail of filePath. The small EXIF
+// thumbnail is enough to tell photos apart, and the larger previews of RAW
+// files are the fallback. It returns nil if filePath has none.
+func readThumbnail(exifTool *exifTool, filePath string) ([]byte, error) {
+	for _, tag := range []string{"-ThumbnailImage", "-PreviewImage", "-JpgFromRaw"} {
+		data, err := exifTool.Execute("-b", tag, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			return bytes.Clone(data), nil
+		}
+	}
+	return nil, nil
+}
+
+// reviewTemplate is the -review page. It works offline, and builds the
+// shell script that deletes the ticked files in the browser.
+var reviewTemplate = template.Must(template.New("review").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Duplicates in {{.ArchiveDir}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+section { border-top: 1px solid #ccc; padding: 1em 0; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.6em; text-align: left; vertical-align: top; }
+td.file { width: 200px; word-break: break-all; }
+img { max-width: 200px; max-height: 200px; display: block; margin-bottom: 0.3em; }
+.nothumb { width: 160px; height: 120px; background: #eee; color: #888; display: flex; align-items: center; justify-content: center; margin-bottom: 0.3em; }
+tr.differs { background: #fff3c4; }
+textarea { width: 100%; height: 12em; font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>Duplicates in {{.ArchiveDir}}</h1>
+<p>Tick the files to delete, then save the script at the bottom and run it with sh. Metadata the files of a group differ in is highlighted.</p>
+{{range $i, $group := .Groups}}
+<section>
+<h2>{{if $group.Identical}}Same contents{{else}}Same time and camera{{end}}</h2>
+<table>
+<tr><th></th>{{range $group.Files}}<td class="file">{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="">{{else}}<div class="nothumb">no thumbnail</div>{{end}}<label><input type="checkbox" data-path="{{.FilePath}}"{{if .Selected}} checked{{end}}> {{.FilePath}}</label></td>{{end}}</tr>
+{{range $group.Rows}}<tr{{if .Differs}} class="differs"{{end}}><th>{{.Name}}</th>{{range .Values}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</section>
+{{else}}
+<p>No duplicates found.</p>
+{{end}}
+<section>
+<h2>Script</h2>
+<textarea id="script" readonly></textarea>
+<p><a id="download" download="delete-duplicates.sh" href="#">Save delete-duplicates.sh</a></p>
+</section>
+<script>
+function quote(s) {
+  return "'" + s.replace(/'/g, "'\\''") + "'";
+}
+function update() {
+  var lines = ["#!/bin/sh", "set -e"];
+  document.querySelectorAll("input[data-path]:checked").forEach(function (input) {
+    lines.push("rm -- " + quote(input.dataset.path));
+  });
+  var script = lines.join("\n") + "\n";
+  document.getElementById("script").value = script;
+  document.getElementById("download").href = "data:text/x-shellscript;charset=utf-8," + encodeURIComponent(script);
+}
+document.querySelectorAll("input[data-path]").forEach(function (input) {
+  input.addEventListener("change", update);
+});
+update();
+</script>
+</body>
+</html>
+`))
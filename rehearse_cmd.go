@@ -0,0 +1,193 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+)
+
+type RehearseCmd struct {
+	// Sample is the number of files picked at random to rehearse on.
+	Sample int
+	// Seed, if non-zero, makes the sample the same from run to run.
+	Seed uint64
+	// Subcommand and Args are the subcommand to rehearse and its arguments.
+	Subcommand string
+	Args       []string
+	Stdout     io.Writer
+	Stderr     io.Writer
+	logger     *slog.Logger
+}
+
+func RehearseCommand(args []string) (*RehearseCmd, error) {
+	rehearseCmd := &RehearseCmd{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil rehearse [FLAGS] rename|partition|move [ARGS...]")
+		flagset.PrintDefaults()
+	}
+	flagset.IntVar(&rehearseCmd.Sample, "sample", 100, "Number of files picked at random to rehearse on.")
+	flagset.Uint64Var(&rehearseCmd.Seed, "seed", 0, "Seed of the random sample, to rehearse on the same files again after changing other flags. 0 means a different sample every time.")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("no subcommand given")
+	}
+	if rehearseCmd.Sample <= 0 {
+		return nil, fmt.Errorf("-sample must be positive")
+	}
+	rehearseCmd.Subcommand = flagset.Arg(0)
+	rehearseCmd.Args = flagset.Args()[1:]
+	// Catch mistakes in the subcommand's arguments before walking what may
+	// be a very large tree.
+	_, err = newWatchedCommand(rehearseCmd.Subcommand, rehearseCmd.Args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rehearseCmd.Subcommand, err)
+	}
+	rehearseCmd.logger = newLogger(rehearseCmd.Stdout, false)
+	return rehearseCmd, nil
+}
+
+// Run dry-runs the subcommand on a random sample of the files it would
+// select and prints how the sampled files fared: what would have happened
+// to them and where their creation times came from.
+func (rehearseCmd *RehearseCmd) Run(ctx context.Context) error {
+	reportFile, err := os.CreateTemp("", "exifutil-rehearse-*.csv")
+	if err != nil {
+		return err
+	}
+	reportPath := reportFile.Name()
+	reportFile.Close()
+	defer os.Remove(reportPath)
+	// Flags come before positional arguments, so these have to go first.
+	args := append([]string{"-dry-run", "-report", reportPath}, rehearseCmd.Args...)
+	cmd, err := newWatchedCommand(rehearseCmd.Subcommand, args)
+	if err != nil {
+		return err
+	}
+	var selector *FileSelector
+	switch cmd := cmd.(type) {
+	case *RenameCmd:
+		// Conflicts are only found when every new name is worked out
+		// before anything is renamed.
+		cmd.Plan = true
+		cmd.Stdout = io.Discard
+		selector = &cmd.FileSelector
+	case *PartitionCmd:
+		cmd.Stdout = io.Discard
+		selector = &cmd.FileSelector
+	case *MoveCmd:
+		cmd.Plan = true
+		cmd.Stdout = io.Discard
+		selector = &cmd.FileSelector
+	}
+	// The remotes stay mounted from the walk through to the run, which
+	// leaves them to this.
+	unmount, err := selector.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	// Reservoir sampling, so that only Sample paths are held in memory no
+	// matter how many files there are.
+	random := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	if rehearseCmd.Seed != 0 {
+		random = rand.New(rand.NewPCG(rehearseCmd.Seed, rehearseCmd.Seed))
+	}
+	var sample []string
+	var numFiles int
+	err = selector.Walk(nil, func(root, filePath string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		numFiles++
+		if len(sample) < rehearseCmd.Sample {
+			sample = append(sample, filePath)
+			return nil
+		}
+		i := random.IntN(numFiles)
+		if i < rehearseCmd.Sample {
+			sample[i] = filePath
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		fmt.Fprintln(rehearseCmd.Stderr, "no files selected")
+		return nil
+	}
+	selector.Roots = nil
+	selector.FilePaths = sample
+	err = cmd.Run(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		// Conflicts make rename and move fail, but they are one of the
+		// outcomes being rehearsed.
+		rehearseCmd.logger.Warn(err.Error())
+	}
+	file, err := os.Open(reportPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return err
+	}
+	statuses := make(map[string]int)
+	sources := make(map[string]int)
+	// Skip the header.
+	for _, record := range records[min(1, len(records)):] {
+		statuses[record[4]]++
+		source := record[3]
+		if source == "" {
+			source = "(none)"
+		}
+		sources[source]++
+	}
+	fmt.Fprintf(rehearseCmd.Stdout, "rehearsed %s on %d of %d files\n", rehearseCmd.Subcommand, len(sample), numFiles)
+	printDistribution(rehearseCmd.Stdout, "outcomes", statuses)
+	printDistribution(rehearseCmd.Stdout, "creation time sources", sources)
+	if statuses["conflict"] > 0 && len(sample) < numFiles {
+		fmt.Fprintln(rehearseCmd.Stdout, "conflicts are only found between sampled files, a full run may have more")
+	}
+	return nil
+}
+
+// printDistribution prints counts under a heading, most common first, with
+// each count's share of the total.
+func printDistribution(w io.Writer, heading string, counts map[string]int) {
+	var total int
+	for _, count := range counts {
+		total += count
+	}
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+	var width int
+	for _, key := range keys {
+		width = max(width, len(key))
+	}
+	fmt.Fprintf(w, "%s:\n", heading)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %-*s %6d %5.1f%%\n", width, key, counts[key], 100*float64(counts[key])/float64(total))
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestTree creates a directory holding an empty file for each of names,
+// for runs against a fakeExifTool, and keeps the run from reading or
+// writing the user's config and cache.
+func newTestTree(t *testing.T, names ...string) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+	root := t.TempDir()
+	for _, name := range names {
+		err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// treeFiles returns the slash separated paths of the files under root.
+func treeFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(root, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !dirEntry.IsDir() {
+			relPath, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(files)
+	return files
+}
+
+// matchFiles checks that each of files matches the pattern at the same
+// index.
+func matchFiles(t *testing.T, files []string, patterns ...string) {
+	t.Helper()
+	if len(files) != len(patterns) {
+		t.Fatalf("got files %q, want %q", files, patterns)
+	}
+	for i, pattern := range patterns {
+		if !regexp.MustCompile("^" + pattern + "$").MatchString(files[i]) {
+			t.Errorf("got file %q, want %q", files[i], pattern)
+		}
+	}
+}
+
+func TestRenameRun(t *testing.T) {
+	useFakeExifTool(t)
+	root := newTestTree(t, "no-timezone.jpg", "date-only.tif", "quicktime-utc.mov", "corrupt.jpg", "unknown.jpg")
+	renameCmd, err := RenameCommand([]string{"-no-cache", "-file", ".", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameCmd.Stdout = io.Discard
+	renameCmd.Stderr = io.Discard
+	renameCmd.logger = newLogger(io.Discard, false)
+	err = renameCmd.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files exiftool can't date keep their names.
+	matchFiles(t, treeFiles(t, root),
+		`2003-06-15T000000\.000\+0000\.tif`,
+		`2021-03-04T050607\.890\+0000\.jpg`,
+		`2022-07-08T091011\.\d{3}\+0000\.mov`,
+		`corrupt\.jpg`,
+		`unknown\.jpg`,
+	)
+}
+
+func TestRenameRunCorruptLivp(t *testing.T) {
+	useFakeExifTool(t)
+	// The .livp files aren't ZIP archives, so their still image can't be
+	// read. The worker all the directory's files are pinned to must get
+	// past them to the photo.
+	root := newTestTree(t, "a.livp", "b.livp", "no-timezone.jpg")
+	renameCmd, err := RenameCommand([]string{"-no-cache", "-file", ".", "-pin-dirs", "-num-workers", "1", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameCmd.Stdout = io.Discard
+	renameCmd.Stderr = io.Discard
+	renameCmd.logger = newLogger(io.Discard, false)
+	err = renameCmd.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchFiles(t, treeFiles(t, root),
+		`2021-03-04T050607\.890\+0000\.jpg`,
+		`a\.livp`,
+		`b\.livp`,
+	)
+}
+
+func TestRenameRunDirDates(t *testing.T) {
+	useFakeExifTool(t)
+	// Scans without dates, whose names sort before the dated names they
+	// are renamed to in place.
+	root := newTestTree(t)
+	dir := filepath.Join(root, "1998 Summer")
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"0001.tif", "0002.tif", "0003.tif"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	renameCmd, err := RenameCommand([]string{"-no-cache", "-file", ".", "-recursive", "-dir-dates", "-num-workers", "3", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameCmd.Stdout = io.Discard
+	renameCmd.Stderr = io.Discard
+	renameCmd.logger = newLogger(io.Discard, false)
+	err = renameCmd.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchFiles(t, treeFiles(t, root),
+		`1998 Summer/1998-01-01T000000\.000\+0000\.tif`,
+		`1998 Summer/1998-01-01T000001\.000\+0000\.tif`,
+		`1998 Summer/1998-01-01T000002\.000\+0000\.tif`,
+	)
+	for i, name := range []string{"0001.tif", "0002.tif", "0003.tif"} {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("1998-01-01T00000%d.000+0000.tif", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != name {
+			t.Errorf("got %s where %s should be", data, name)
+		}
+	}
+}
+
+func TestRenameRunAutoRotate(t *testing.T) {
+	useFakeExifTool(t)
+	root := newTestTree(t, "no-timezone.jpg")
+	renameCmd, err := RenameCommand([]string{"-no-cache", "-file", ".", "-auto-rotate", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameCmd.Stdout = io.Discard
+	renameCmd.Stderr = io.Discard
+	renameCmd.logger = newLogger(io.Discard, false)
+	err = renameCmd.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file is only rotated once it is moved, so a rotation that fails
+	// (the file isn't really a JPEG) leaves it moved and unchanged.
+	matchFiles(t, treeFiles(t, root), `2021-03-04T050607\.890\+0000\.jpg`)
+	data, err := os.ReadFile(filepath.Join(root, "2021-03-04T050607.890+0000.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "no-timezone.jpg" {
+		t.Errorf("got contents %q, want them unchanged", data)
+	}
+}
+
+func TestRenameRunRecordOriginal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script in place of exiftool")
+	}
+	useFakeExifTool(t)
+	root := newTestTree(t, "no-timezone.jpg", "date-only.tif")
+	// Writes go through a separate exiftool command, which logs its
+	// arguments and whether the file exists when it runs.
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "exiftool.log")
+	script := "#!/bin/sh\n" +
+		"for last; do :; done\n" +
+		"if [ -f \"$last\" ]; then echo \"$*\" >>" + logPath + "; else echo \"missing $last\" >>" + logPath + "; fi\n"
+	err := os.WriteFile(filepath.Join(binDir, "exiftool"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	renameCmd, err := RenameCommand([]string{"-no-cache", "-file", "jpg$", "-record-original-name", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameCmd.Stdout = io.Discard
+	renameCmd.Stderr = io.Discard
+	renameCmd.logger = newLogger(io.Discard, false)
+	err = renameCmd.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchFiles(t, treeFiles(t, root), `2021-03-04T050607\.890\+0000\.jpg`, `date-only\.tif`)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name is written into the file at its new path.
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := "-XMP-xmpMM:PreservedFileName=no-timezone.jpg " + filepath.Join(root, "2021-03-04T050607.890+0000.jpg")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], want) {
+		t.Errorf("got exiftool runs %q, want one ending in %q", lines, want)
+	}
+}
+
+func TestRenameRunWhereExtMtime(t *testing.T) {
+	useFakeExifTool(t)
+	root := newTestTree(t, "no-timezone.jpg", "screenshot.png")
+	extConfig := filepath.Join(t.TempDir(), "extensions.json")
+	err := os.WriteFile(extConfig, []byte(`{"png": {"extractor": "mtime"}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The metadata of the .png file isn't read, so -where can't select it.
+	renameCmd, err := RenameCommand([]string{"-no-cache", "-file", ".", "-ext-config", extConfig, "-where", `Make == "Canon"`, root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameCmd.Stdout = io.Discard
+	renameCmd.Stderr = io.Discard
+	renameCmd.logger = newLogger(io.Discard, false)
+	err = renameCmd.Run(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchFiles(t, treeFiles(t, root),
+		`2021-03-04T050607\.890\+0000\.jpg`,
+		`screenshot\.png`,
+	)
+}
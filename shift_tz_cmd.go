@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ShiftTZCmd struct {
+	FileSelector
+	From            time.Time
+	To              time.Time
+	Offset          string
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	MinAge          time.Duration
+	StableFor       time.Duration
+	OnParseError    string
+	Rename          bool
+	Verbose         bool
+	DryRun          bool
+	Force           bool
+	NoLock          bool
+	ReplaceIfExists bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+	location        *time.Location
+}
+
+func ShiftTZCommand(args []string) (*ShiftTZCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	shiftTZCmd := &ShiftTZCmd{
+		FileSelector: fileSelector,
+		OnParseError: "skip",
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.IntVar(&shiftTZCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means auto-tune based on the number of CPUs and measured throughput.")
+	flagset.DurationVar(&shiftTZCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&shiftTZCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		shiftTZCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		shiftTZCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&shiftTZCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		shiftTZCmd.DateSourceRules = append(shiftTZCmd.DateSourceRules, rule)
+		return nil
+	})
+	flagset.DurationVar(&shiftTZCmd.MinAge, "min-age", 0, "Skip files modified less than this long ago, as they may still be being written to.")
+	flagset.DurationVar(&shiftTZCmd.StableFor, "stable-for", 0, "Skip files whose size changes over this interval, as they may still be being written to.")
+	flagset.BoolVar(&shiftTZCmd.Rename, "rename", false, "Also rename files to their canonical timestamp name in the new timezone.")
+	shiftTZCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&shiftTZCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&shiftTZCmd.DryRun, "dry-run", false, "Print timezone changes without executing.")
+	flagset.BoolVar(&shiftTZCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&shiftTZCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	flagset.BoolVar(&shiftTZCmd.ReplaceIfExists, "replace-if-exists", false, "If a file with the new name already exists, replace it, moving the replaced file into a .exifutil-trash directory next to it (see exifutil trash).")
+	flagset.StringVar(&shiftTZCmd.Offset, "offset", "", "Timezone offset the files were actually shot in e.g. +09:00. Required.")
+	flagset.Func("from", "Only include files created on or after this date (YYYY-MM-DD).", func(value string) error {
+		from, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return err
+		}
+		shiftTZCmd.From = from
+		return nil
+	})
+	flagset.Func("to", "Only include files created on or before this date (YYYY-MM-DD).", func(value string) error {
+		to, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return err
+		}
+		shiftTZCmd.To = to
+		return nil
+	})
+	flagset.Func("on-parse-error", "What to do when a file's creation time cannot be determined: skip (the default), strict (abort the run) or fallback (use the file's modification time).", func(value string) error {
+		switch value {
+		case "skip", "strict", "fallback":
+			shiftTZCmd.OnParseError = value
+			return nil
+		}
+		return fmt.Errorf("invalid value %q, must be skip, strict or fallback", value)
+	})
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = shiftTZCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	if shiftTZCmd.Offset == "" {
+		return nil, fmt.Errorf("-offset is required")
+	}
+	offset, err := time.Parse("-07:00", shiftTZCmd.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -offset %q, expected a value like +09:00", shiftTZCmd.Offset)
+	}
+	_, seconds := offset.Zone()
+	shiftTZCmd.location = time.FixedZone("", seconds)
+	shiftTZCmd.Offset = offset.Format("-07:00")
+	if !shiftTZCmd.From.IsZero() && !shiftTZCmd.To.IsZero() && shiftTZCmd.To.Before(shiftTZCmd.From) {
+		return nil, fmt.Errorf("-to %s is before -from %s", shiftTZCmd.To.Format("2006-01-02"), shiftTZCmd.From.Format("2006-01-02"))
+	}
+	shiftTZCmd.logger = newLogger(shiftTZCmd.Stdout, shiftTZCmd.Verbose)
+	return shiftTZCmd, nil
+}
+
+func (shiftTZCmd *ShiftTZCmd) Run(ctx context.Context) error {
+	unmount, err := shiftTZCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if !shiftTZCmd.DryRun {
+		err := shiftTZCmd.CheckSafety(shiftTZCmd.Force, shiftTZCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if !shiftTZCmd.DryRun && !shiftTZCmd.NoLock {
+		unlock, err := shiftTZCmd.Lock(shiftTZCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var cache *exifCache
+	if !shiftTZCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			shiftTZCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var waitGroup sync.WaitGroup
+	var numProcessed atomic.Int64
+	var lastProcessed atomic.Value
+	var numWorkersAlive atomic.Int64
+	var skippedMutex sync.Mutex
+	var skipped []string
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	filePaths := make(chan string)
+	// stopTuner is replaced below if the number of workers is auto-tuned.
+	stopTuner := func() {}
+	// Closing filePaths tells the workers to exit once they have finished the
+	// file they are currently working on.
+	stopWorkers := sync.OnceFunc(func() {
+		stopTuner()
+		close(filePaths)
+		waitGroup.Wait()
+	})
+	defer stopWorkers()
+	startWorker := func() error {
+		exifTool, err := startExifTool(ctx, shiftTZCmd.Stderr, shiftTZCmd.Timeout, shiftTZCmd.Charset, shiftTZCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = shiftTZCmd.DateSourceRules
+		exifTool.ReadArgs = shiftTZCmd.ExifToolArgs
+		exifTool.Tags = shiftTZCmd.Where.Tags()
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					shiftTZCmd.logger.Warn(err.Error())
+				}
+			}()
+			// If every worker has exited early because its exiftool session
+			// died, nothing is left to receive from filePaths and the walker
+			// would block forever.
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for filePath := range filePaths {
+				if ctx.Err() != nil {
+					continue
+				}
+				numProcessed.Add(1)
+				lastProcessed.Store(filePath)
+				logger := shiftTZCmd.logger.With(slog.String("filePath", filePath))
+				if shiftTZCmd.MinAge > 0 || shiftTZCmd.StableFor > 0 {
+					err := checkFileStable(ctx, filePath, shiftTZCmd.MinAge, shiftTZCmd.StableFor)
+					if err != nil {
+						logger.Warn(err.Error())
+						continue
+					}
+				}
+				exifs, err := exifTool.FileExifs(logger, filePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				if !shiftTZCmd.MatchExifs(exifs) {
+					logger.Debug("not selected by -where")
+					continue
+				}
+				exif, err := fileExif(logger, filePath, exifs)
+				if err != nil {
+					switch shiftTZCmd.OnParseError {
+					case "strict":
+						logger.Error(err.Error())
+						cancel(fmt.Errorf("%s: %w", filePath, err))
+						continue
+					case "fallback":
+						logger.Warn(err.Error() + ", falling back to modification time")
+						fileInfo, err := os.Stat(filePath)
+						if err != nil {
+							logger.Error(err.Error())
+							skippedMutex.Lock()
+							skipped = append(skipped, filePath)
+							skippedMutex.Unlock()
+							continue
+						}
+						exif = Exif{CreationTime: fileInfo.ModTime()}
+					default:
+						logger.Error(err.Error())
+						skippedMutex.Lock()
+						skipped = append(skipped, filePath)
+						skippedMutex.Unlock()
+						continue
+					}
+				}
+				// The wall clock time recorded by the camera is correct, it is
+				// only the offset that is wrong. Keep the wall clock time and
+				// reinterpret it in the new timezone.
+				t := exif.CreationTime
+				date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+				if (!shiftTZCmd.From.IsZero() && date.Before(shiftTZCmd.From)) || (!shiftTZCmd.To.IsZero() && date.After(shiftTZCmd.To)) {
+					logger.Info("outside date range, skipping", slog.String("date", date.Format("2006-01-02")))
+					continue
+				}
+				creationTime := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), shiftTZCmd.location)
+				newFilePath := filePath
+				if shiftTZCmd.Rename {
+					newFilePath = canonicalFilePath(filePath, creationTime)
+				}
+				if shiftTZCmd.DryRun {
+					fmt.Fprintf(shiftTZCmd.Stdout, "%s => %s %s\n", filePath, newFilePath, creationTime.Format(time.RFC3339Nano))
+					continue
+				}
+				_, err = exifTool.Execute(
+					"-overwrite_original",
+					"-OffsetTimeOriginal="+shiftTZCmd.Offset,
+					"-OffsetTimeDigitized="+shiftTZCmd.Offset,
+					"-OffsetTime="+shiftTZCmd.Offset,
+					"-TimeZone="+shiftTZCmd.Offset,
+					filePath,
+				)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				logger.Info("shifted timezone", slog.String("offset", shiftTZCmd.Offset))
+				if newFilePath == filePath {
+					continue
+				}
+				if shiftTZCmd.ReplaceIfExists {
+					err := renameNoReplace(osFS{}, filePath, newFilePath, true)
+					if err != nil {
+						logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+						continue
+					}
+					logger.Info("renamed file", slog.String("newFilePath", newFilePath))
+					continue
+				}
+				_, err = os.Stat(newFilePath)
+				if err != nil {
+					if !errors.Is(err, fs.ErrNotExist) {
+						logger.Error(err.Error(), slog.String("name", newFilePath))
+						continue
+					}
+					err := os.Rename(filePath, newFilePath)
+					if err != nil {
+						logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+						continue
+					}
+					logger.Info("renamed file", slog.String("newFilePath", newFilePath))
+				} else {
+					logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("newFilePath", newFilePath))
+				}
+			}
+			exitedEarly = false
+		}()
+		return nil
+	}
+	numWorkers := shiftTZCmd.NumWorkers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	for i := 0; i < numWorkers; i++ {
+		err := startWorker()
+		if err != nil {
+			return err
+		}
+	}
+	if shiftTZCmd.NumWorkers == 0 {
+		tunerCtx, cancelTuner := context.WithCancel(ctx)
+		tunerDone := make(chan struct{})
+		go func() {
+			defer close(tunerDone)
+			autoTuneWorkers(tunerCtx, shiftTZCmd.logger, &numProcessed, numWorkers, startWorker)
+		}()
+		stopTuner = func() {
+			cancelTuner()
+			<-tunerDone
+		}
+	}
+
+	walkErr := shiftTZCmd.Walk(nil, func(root, filePath string) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case filePaths <- filePath:
+			return nil
+		}
+	})
+	stopWorkers()
+	if len(skipped) > 0 {
+		fmt.Fprintf(shiftTZCmd.Stderr, "skipped %d files whose creation time could not be determined:\n", len(skipped))
+		for _, filePath := range skipped {
+			fmt.Fprintln(shiftTZCmd.Stderr, "  "+filePath)
+		}
+	}
+	if ctx.Err() != nil {
+		lastFilePath, _ := lastProcessed.Load().(string)
+		fmt.Fprintf(shiftTZCmd.Stderr, "stopped after processing %d files (last processed: %s)\n", numProcessed.Load(), lastFilePath)
+		return context.Cause(ctx)
+	}
+	return walkErr
+}
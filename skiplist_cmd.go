@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+type SkiplistCmd struct {
+	// Action is one of show or clear.
+	Action  string
+	Verbose bool
+	Stdout  io.Writer
+	Stderr  io.Writer
+	logger  *slog.Logger
+}
+
+func SkiplistCommand(args []string) (*SkiplistCmd, error) {
+	skiplistCmd := &SkiplistCmd{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil skiplist show|clear [FLAGS]")
+		flagset.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("missing action")
+	}
+	switch args[0] {
+	case "show", "clear":
+		skiplistCmd.Action = args[0]
+	case "-h", "-help", "--help":
+		flagset.Usage()
+		return nil, flag.ErrHelp
+	default:
+		return nil, fmt.Errorf("invalid action %q, must be show or clear", args[0])
+	}
+	flagset.BoolVar(&skiplistCmd.Verbose, "verbose", false, "Verbose output.")
+	err := flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", flagset.Args())
+	}
+	skiplistCmd.logger = newLogger(skiplistCmd.Stderr, skiplistCmd.Verbose)
+	return skiplistCmd, nil
+}
+
+// Run shows the files on the skip list written by -skip-list, or clears it
+// so that they are tried again.
+func (skiplistCmd *SkiplistCmd) Run(ctx context.Context) error {
+	path, err := skipListPath()
+	if err != nil {
+		return err
+	}
+	switch skiplistCmd.Action {
+	case "show":
+		entries, err := readSkipList(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fmt.Fprintf(skiplistCmd.Stdout, "%s  %s  %s\n", entry.SkippedAt.Format(time.RFC3339), entry.Path, entry.Reason)
+		}
+	case "clear":
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		skiplistCmd.logger.Info("cleared skip list", slog.String("path", path))
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SplitByEventCmd struct {
+	FileSelector
+	// Gap is the minimum time between consecutive files that starts a new
+	// event.
+	Gap time.Duration
+	// GPSNames adds the position of the first geotagged file of each event
+	// to the event's directory name.
+	GPSNames        bool
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	Verbose         bool
+	DryRun          bool
+	Force           bool
+	NoLock          bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func SplitByEventCommand(args []string) (*SplitByEventCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	splitByEventCmd := &SplitByEventCmd{
+		FileSelector: fileSelector,
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.IntVar(&splitByEventCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means one per CPU.")
+	flagset.DurationVar(&splitByEventCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&splitByEventCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		splitByEventCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		splitByEventCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&splitByEventCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		splitByEventCmd.DateSourceRules = append(splitByEventCmd.DateSourceRules, rule)
+		return nil
+	})
+	flagset.DurationVar(&splitByEventCmd.Gap, "gap", 4*time.Hour, "Minimum time between consecutive files that starts a new event.")
+	flagset.BoolVar(&splitByEventCmd.GPSNames, "gps-names", false, "Add the GPS position of the first geotagged file of each event to its directory name e.g. '2024-01-02 — Event 1 (37.7750, -122.4183)'.")
+	splitByEventCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&splitByEventCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&splitByEventCmd.DryRun, "dry-run", false, "Print split operations without executing.")
+	flagset.BoolVar(&splitByEventCmd.Force, "force", false, "Skip the confirmation asked for (or, without a terminal, the refusal to run) when a root is the root of a filesystem or the home directory, or more than 100000 files are selected.")
+	flagset.BoolVar(&splitByEventCmd.NoLock, "no-lock", false, "Don't take the lock on each root that keeps two exifutil runs from renaming the same files at once. Only use this if the runs are known not to overlap.")
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = splitByEventCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	if splitByEventCmd.Gap <= 0 {
+		return nil, fmt.Errorf("-gap must be positive")
+	}
+	if splitByEventCmd.NumWorkers == 0 {
+		splitByEventCmd.NumWorkers = runtime.NumCPU()
+	}
+	splitByEventCmd.logger = newLogger(splitByEventCmd.Stdout, splitByEventCmd.Verbose)
+	return splitByEventCmd, nil
+}
+
+// eventDirRegexp matches the names of the directories split-by-event moves
+// files into, capturing the event number.
+var eventDirRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} — Event (\d+)\b`)
+
+// eventFile is a file to be split into an event.
+type eventFile struct {
+	FilePath string
+	Exif     Exif
+}
+
+func (splitByEventCmd *SplitByEventCmd) Run(ctx context.Context) error {
+	unmount, err := splitByEventCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	if !splitByEventCmd.DryRun {
+		err := splitByEventCmd.CheckSafety(splitByEventCmd.Force, splitByEventCmd.Stderr)
+		if err != nil {
+			return err
+		}
+	}
+	if !splitByEventCmd.DryRun && !splitByEventCmd.NoLock {
+		unlock, err := splitByEventCmd.Lock(splitByEventCmd.logger)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var roots []string
+	filesByRoot := make(map[string][]*eventFile)
+	var files []*eventFile
+	// Leave events split by a previous run alone.
+	err = splitByEventCmd.Walk(func(dirPath string) bool {
+		return eventDirRegexp.MatchString(filepath.Base(dirPath))
+	}, func(root, filePath string) error {
+		if _, ok := filesByRoot[root]; !ok {
+			roots = append(roots, root)
+		}
+		file := &eventFile{FilePath: filePath}
+		filesByRoot[root] = append(filesByRoot[root], file)
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = splitByEventCmd.fetchExifs(ctx, files)
+	if err != nil {
+		return err
+	}
+	var numEvents, numSplit int
+	for _, root := range roots {
+		number, err := lastEventNumber(root)
+		if err != nil {
+			return err
+		}
+		for _, event := range splitByEventCmd.findEvents(filesByRoot[root]) {
+			number++
+			numEvents++
+			// Events are named after the day they started on, in the time
+			// zone of their first file.
+			name := event[0].Exif.CreationTime.Format("2006-01-02") + " — Event " + strconv.Itoa(number)
+			if splitByEventCmd.GPSNames {
+				index := slices.IndexFunc(event, func(file *eventFile) bool {
+					return file.Exif.GPSPosition != nil
+				})
+				if index >= 0 {
+					gpsPosition := event[index].Exif.GPSPosition
+					name += fmt.Sprintf(" (%.4f, %.4f)", gpsPosition.Latitude, gpsPosition.Longitude)
+				}
+			}
+			for _, file := range event {
+				newFilePath := filepath.Join(root, name, filepath.Base(file.FilePath))
+				if splitByEventCmd.DryRun {
+					fmt.Fprintf(splitByEventCmd.Stdout, "%s => %s\n", file.FilePath, newFilePath)
+					continue
+				}
+				logger := splitByEventCmd.logger.With(slog.String("filePath", file.FilePath))
+				err := os.MkdirAll(filepath.Dir(newFilePath), 0755)
+				if err != nil {
+					logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+					continue
+				}
+				err = renameNoReplace(osFS{}, file.FilePath, newFilePath, false)
+				if err != nil {
+					if errors.Is(err, fs.ErrExist) {
+						logger.Info("file already exists, skipping", slog.String("newFilePath", newFilePath))
+						continue
+					}
+					logger.Error(err.Error(), slog.String("newFilePath", newFilePath))
+					continue
+				}
+				numSplit++
+				logger.Info("moved file", slog.String("newFilePath", newFilePath))
+			}
+		}
+	}
+	if !splitByEventCmd.DryRun {
+		fmt.Fprintf(splitByEventCmd.Stderr, "split %d files into %d events\n", numSplit, numEvents)
+	}
+	return nil
+}
+
+// lastEventNumber returns the highest number of the event directories
+// already in root, so that events found by a later run continue the
+// numbering instead of merging into existing events.
+func lastEventNumber(root string) (int, error) {
+	dirEntries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	var number int
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		match := eventDirRegexp.FindStringSubmatch(dirEntry.Name())
+		if match == nil {
+			continue
+		}
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		number = max(number, n)
+	}
+	return number, nil
+}
+
+// findEvents sorts files by creation time and splits them wherever two
+// consecutive files are at least Gap apart. Files without a creation time
+// are left out of every event.
+func (splitByEventCmd *SplitByEventCmd) findEvents(files []*eventFile) [][]*eventFile {
+	files = slices.DeleteFunc(slices.Clone(files), func(file *eventFile) bool {
+		return file.Exif.CreationTime.IsZero()
+	})
+	slices.SortFunc(files, func(a, b *eventFile) int {
+		return cmp.Or(a.Exif.CreationTime.Compare(b.Exif.CreationTime), cmp.Compare(a.FilePath, b.FilePath))
+	})
+	var events [][]*eventFile
+	start := 0
+	for i := 1; i <= len(files); i++ {
+		if i < len(files) && files[i].Exif.CreationTime.Sub(files[i-1].Exif.CreationTime) < splitByEventCmd.Gap {
+			continue
+		}
+		events = append(events, files[start:i])
+		start = i
+	}
+	return events
+}
+
+func (splitByEventCmd *SplitByEventCmd) fetchExifs(ctx context.Context, files []*eventFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var cache *exifCache
+	if !splitByEventCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			splitByEventCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var waitGroup sync.WaitGroup
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	// Wait for the workers before cancelling ctx, otherwise the exiftool
+	// processes of files still being worked on are killed.
+	defer waitGroup.Wait()
+	queue := make(chan *eventFile)
+	defer close(queue)
+	for i := 0; i < min(splitByEventCmd.NumWorkers, len(files)); i++ {
+		exifTool, err := startExifTool(ctx, splitByEventCmd.Stderr, splitByEventCmd.Timeout, splitByEventCmd.Charset, splitByEventCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = splitByEventCmd.DateSourceRules
+		exifTool.ReadArgs = splitByEventCmd.ExifToolArgs
+		exifTool.Tags = splitByEventCmd.Where.Tags()
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					splitByEventCmd.logger.Warn(err.Error())
+				}
+			}()
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for file := range queue {
+				logger := splitByEventCmd.logger.With(slog.String("filePath", file.FilePath))
+				exifs, err := exifTool.FileExifs(logger, file.FilePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				if !splitByEventCmd.MatchExifs(exifs) {
+					logger.Debug("not selected by -where")
+					continue
+				}
+				exif, err := fileExif(logger, file.FilePath, exifs)
+				if err != nil {
+					logger.Info(err.Error())
+					continue
+				}
+				file.Exif = exif
+			}
+			exitedEarly = false
+		}()
+	}
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case queue <- file:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ThumbsCmd struct {
+	FileSelector
+	OutputDir       string
+	NumWorkers      int
+	Timeout         time.Duration
+	Charset         string
+	ExifToolConfig  string
+	ExifToolArgs    []string
+	NoCache         bool
+	DateSourceRules []dateSourceRule
+	Verbose         bool
+	DryRun          bool
+	ReplaceIfExists bool
+	Durable         bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func ThumbsCommand(args []string) (*ThumbsCmd, error) {
+	fileSelector, err := newFileSelector()
+	if err != nil {
+		return nil, err
+	}
+	thumbsCmd := &ThumbsCmd{
+		FileSelector: fileSelector,
+		ExifToolArgs: defaultReadArgs,
+		Stdout:       stdout,
+		Stderr:       stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.IntVar(&thumbsCmd.NumWorkers, "num-workers", 0, "Number of concurrent workers. 0 means auto-tune based on the number of CPUs and measured throughput.")
+	flagset.DurationVar(&thumbsCmd.Timeout, "timeout", time.Minute, "Maximum time exiftool may spend on a single file before it is restarted and the file is skipped. Zero means no timeout.")
+	flagset.StringVar(&thumbsCmd.Charset, "charset", defaultFilenameCharset, "Character set of file names, passed to exiftool as -charset filename=CHARSET e.g. utf8, cp1252, latin1 or cp932.")
+	flagset.Func("exiftool-config", "exiftool config file to load, for user-defined tags such as composite tags that correct time zones. They can be used in -where and (with move and rename) in templates as {{.Tag \"NAME\"}}.", func(value string) error {
+		config, err := parseExifToolConfig(value)
+		if err != nil {
+			return err
+		}
+		thumbsCmd.ExifToolConfig = config
+		return nil
+	})
+	flagset.Func("exiftool-args", "Space separated arguments passed to exiftool when reading metadata, in place of the default -fast. Use e.g. -fast2 to also stop at the video data of large QuickTime files, at the cost of maker note time zones and PNG dates written after the image data.", func(value string) error {
+		args, err := parseExifToolArgs(value)
+		if err != nil {
+			return err
+		}
+		thumbsCmd.ExifToolArgs = args
+		return nil
+	})
+	flagset.BoolVar(&thumbsCmd.NoCache, "no-cache", false, "Don't read or write the cache of file metadata kept in the user cache directory.")
+	flagset.Func("date-source", "Tags to take the creation time from, in order, for cameras whose model matches a regex e.g. '^FC\\d+$=CreateDate,DateTimeOriginal'. Supported tags are DateTimeOriginal, CreateDate, DateCreated and CreationTime. Can be repeated, the first matching rule wins.", func(value string) error {
+		rule, err := parseDateSourceRule(value)
+		if err != nil {
+			return err
+		}
+		thumbsCmd.DateSourceRules = append(thumbsCmd.DateSourceRules, rule)
+		return nil
+	})
+	thumbsCmd.RegisterFlags(flagset)
+	flagset.BoolVar(&thumbsCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&thumbsCmd.DryRun, "dry-run", false, "Print extract operations without executing.")
+	flagset.BoolVar(&thumbsCmd.Durable, "durable", false, "Fsync each extracted preview and its directories so that they survive a power loss. Slower.")
+	flagset.BoolVar(&thumbsCmd.ReplaceIfExists, "replace-if-exists", false, "If a preview with the same name already exists, replace it.")
+	flagset.Func("out", "Directory to extract previews into, mirroring the directory structure of each root. Required.", func(value string) error {
+		outputDir, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		thumbsCmd.OutputDir = outputDir
+		return nil
+	})
+	err = flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = thumbsCmd.ParseArgs(flagset.Args())
+	if err != nil {
+		return nil, err
+	}
+	if thumbsCmd.OutputDir == "" {
+		return nil, fmt.Errorf("-out is required")
+	}
+	thumbsCmd.logger = newLogger(thumbsCmd.Stdout, thumbsCmd.Verbose)
+	return thumbsCmd, nil
+}
+
+// previewTags are the tags tried in order when extracting a preview. RAW
+// formats disagree on where they keep their largest embedded JPEG.
+var previewTags = []string{"-PreviewImage", "-JpgFromRaw", "-ThumbnailImage"}
+
+// thumbsJob is a file to extract a preview from, along with the root it was
+// found in so that its directory can be mirrored under the output directory.
+type thumbsJob struct {
+	Root     string
+	FilePath string
+}
+
+func (thumbsCmd *ThumbsCmd) Run(ctx context.Context) error {
+	unmount, err := thumbsCmd.MountRemotes()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	var cache *exifCache
+	if !thumbsCmd.NoCache {
+		var err error
+		cache, err = openExifCache()
+		if err != nil {
+			thumbsCmd.logger.Warn("not caching file metadata: " + err.Error())
+		}
+	}
+	var waitGroup sync.WaitGroup
+	var numProcessed atomic.Int64
+	var lastProcessed atomic.Value
+	var numWorkersAlive atomic.Int64
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	jobs := make(chan thumbsJob)
+	// stopTuner is replaced below if the number of workers is auto-tuned.
+	stopTuner := func() {}
+	// Closing jobs tells the workers to exit once they have finished the file
+	// they are currently working on.
+	stopWorkers := sync.OnceFunc(func() {
+		stopTuner()
+		close(jobs)
+		waitGroup.Wait()
+	})
+	defer stopWorkers()
+	startWorker := func() error {
+		exifTool, err := startExifTool(ctx, thumbsCmd.Stderr, thumbsCmd.Timeout, thumbsCmd.Charset, thumbsCmd.ExifToolConfig)
+		if err != nil {
+			return err
+		}
+		exifTool.Cache = cache
+		exifTool.DateSourceRules = thumbsCmd.DateSourceRules
+		exifTool.ReadArgs = thumbsCmd.ExifToolArgs
+		exifTool.Tags = thumbsCmd.Where.Tags()
+		waitGroup.Add(1)
+		numWorkersAlive.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer func() {
+				err := exifTool.Close()
+				if err != nil {
+					thumbsCmd.logger.Warn(err.Error())
+				}
+			}()
+			exitedEarly := true
+			defer func() {
+				if numWorkersAlive.Add(-1) == 0 && exitedEarly {
+					cancel(errAllWorkersExited)
+				}
+			}()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				numProcessed.Add(1)
+				lastProcessed.Store(job.FilePath)
+				logger := thumbsCmd.logger.With(slog.String("filePath", job.FilePath))
+				exifs, err := exifTool.FileExifs(logger, job.FilePath)
+				if err != nil {
+					// exiftool is killed when the run is interrupted.
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error(err.Error())
+					if errors.Is(err, errUnreadableFile) {
+						continue
+					}
+					if !errors.Is(err, errExifToolTimeout) {
+						return
+					}
+					err := exifTool.Restart()
+					if err != nil {
+						logger.Error(err.Error())
+						return
+					}
+					continue
+				}
+				if !thumbsCmd.MatchExifs(exifs) {
+					logger.Debug("not selected by -where")
+					continue
+				}
+				exif, err := fileExif(logger, job.FilePath, exifs)
+				if err != nil {
+					logger.Error(err.Error())
+					continue
+				}
+				rel, err := filepath.Rel(job.Root, filepath.Dir(job.FilePath))
+				if err != nil {
+					logger.Error(err.Error())
+					continue
+				}
+				previewPath := filepath.Join(thumbsCmd.OutputDir, rel, exif.CreationTime.Format("2006-01-02T150405.000-0700")+".jpg")
+				if thumbsCmd.DryRun {
+					fmt.Fprintf(thumbsCmd.Stdout, "%s => %s\n", job.FilePath, previewPath)
+					continue
+				}
+				if !thumbsCmd.ReplaceIfExists {
+					_, err := os.Stat(previewPath)
+					if err == nil {
+						logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("previewPath", previewPath))
+						continue
+					}
+				}
+				var preview []byte
+				for _, previewTag := range previewTags {
+					data, err := exifTool.Execute("-b", previewTag, job.FilePath)
+					if err != nil {
+						if ctx.Err() != nil {
+							return
+						}
+						logger.Error(err.Error())
+						if !errors.Is(err, errExifToolTimeout) {
+							return
+						}
+						err := exifTool.Restart()
+						if err != nil {
+							logger.Error(err.Error())
+							return
+						}
+						break
+					}
+					if len(data) > 0 {
+						preview = data
+						break
+					}
+				}
+				if len(preview) == 0 {
+					logger.Error("no embedded preview found")
+					continue
+				}
+				if thumbsCmd.Durable {
+					err = mkdirAllSync(osFS{}, filepath.Dir(previewPath))
+				} else {
+					err = os.MkdirAll(filepath.Dir(previewPath), 0755)
+				}
+				if err != nil {
+					logger.Error(err.Error())
+					continue
+				}
+				err = os.WriteFile(previewPath, preview, 0644)
+				if err != nil {
+					logger.Error(err.Error(), slog.String("previewPath", previewPath))
+					continue
+				}
+				if thumbsCmd.Durable {
+					err := syncFile(previewPath)
+					if err == nil {
+						err = syncDir(osFS{}, filepath.Dir(previewPath))
+					}
+					if err != nil {
+						logger.Error(err.Error(), slog.String("previewPath", previewPath))
+					}
+				}
+				logger.Info("extracted preview", slog.String("previewPath", previewPath))
+			}
+			exitedEarly = false
+		}()
+		return nil
+	}
+	numWorkers := thumbsCmd.NumWorkers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	for i := 0; i < numWorkers; i++ {
+		err := startWorker()
+		if err != nil {
+			return err
+		}
+	}
+	if thumbsCmd.NumWorkers == 0 {
+		tunerCtx, cancelTuner := context.WithCancel(ctx)
+		tunerDone := make(chan struct{})
+		go func() {
+			defer close(tunerDone)
+			autoTuneWorkers(tunerCtx, thumbsCmd.logger, &numProcessed, numWorkers, startWorker)
+		}()
+		stopTuner = func() {
+			cancelTuner()
+			<-tunerDone
+		}
+	}
+	walkErr := thumbsCmd.Walk(func(dirPath string) bool {
+		// Don't descend into the output directory if it is inside the root.
+		return dirPath == thumbsCmd.OutputDir
+	}, func(root, filePath string) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case jobs <- thumbsJob{Root: root, FilePath: filePath}:
+			return nil
+		}
+	})
+	stopWorkers()
+	if ctx.Err() != nil {
+		lastFilePath, _ := lastProcessed.Load().(string)
+		fmt.Fprintf(thumbsCmd.Stderr, "stopped after processing %d files (last processed: %s)\n", numProcessed.Load(), lastFilePath)
+		return context.Cause(ctx)
+	}
+	return walkErr
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TrashCmd struct {
+	// Action is one of list, restore or empty.
+	Action      string
+	Roots       []string
+	FileRegexps []*regexp.Regexp
+	// Keep is how long empty leaves trashed files alone for.
+	Keep            time.Duration
+	Verbose         bool
+	DryRun          bool
+	ReplaceIfExists bool
+	Stdout          io.Writer
+	Stderr          io.Writer
+	logger          *slog.Logger
+}
+
+func TrashCommand(args []string) (*TrashCmd, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	trashCmd := &TrashCmd{
+		Roots:  []string{cwd},
+		Keep:   30 * 24 * time.Hour,
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil trash list|restore|empty [FLAGS] [DIR...]")
+		flagset.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("missing action")
+	}
+	switch args[0] {
+	case "list", "restore", "empty":
+		trashCmd.Action = args[0]
+	case "-h", "-help", "--help":
+		flagset.Usage()
+		return nil, flag.ErrHelp
+	default:
+		return nil, fmt.Errorf("invalid action %q, must be list, restore or empty", args[0])
+	}
+	flagset.BoolVar(&trashCmd.Verbose, "verbose", false, "Verbose output.")
+	flagset.BoolVar(&trashCmd.DryRun, "dry-run", false, "Print restore and delete operations without executing.")
+	flagset.BoolVar(&trashCmd.ReplaceIfExists, "replace-if-exists", false, "When restoring, if a file already exists at the original path, move it into the trash and restore over it.")
+	flagset.Func("keep", "When emptying, keep files trashed less than this long ago e.g. 30d or 12h. 0 deletes everything. (default 30d)", func(value string) error {
+		keep, err := parseRetention(value)
+		if err != nil {
+			return err
+		}
+		trashCmd.Keep = keep
+		return nil
+	})
+	flagset.Func("root", "Specify an additional root directory to search for trash in. Can be repeated.", func(value string) error {
+		root, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		trashCmd.Roots = append(trashCmd.Roots, root)
+		return nil
+	})
+	flagset.Func("file", "Only act on trashed files whose original name matches this regex. Can be repeated.", func(value string) error {
+		r, err := compileRegexp(value)
+		if err != nil {
+			return err
+		}
+		trashCmd.FileRegexps = append(trashCmd.FileRegexps, r)
+		return nil
+	})
+	err = flagset.Parse(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		// Positional arguments take the place of the current directory.
+		trashCmd.Roots = trashCmd.Roots[1:]
+		for _, arg := range flagset.Args() {
+			root, err := filepath.Abs(arg)
+			if err != nil {
+				return nil, err
+			}
+			trashCmd.Roots = append(trashCmd.Roots, root)
+		}
+	}
+	trashCmd.logger = newLogger(trashCmd.Stdout, trashCmd.Verbose)
+	return trashCmd, nil
+}
+
+// parseRetention parses a duration like time.ParseDuration, but also
+// accepts a number of days e.g. 30d.
+func parseRetention(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (trashCmd *TrashCmd) Run(ctx context.Context) error {
+	for _, root := range trashCmd.Roots {
+		err := filepath.WalkDir(root, func(path string, dirEntry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !dirEntry.IsDir() || dirEntry.Name() != trashDirName {
+				return nil
+			}
+			dirEntries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			for _, dirEntry := range dirEntries {
+				if !dirEntry.IsDir() {
+					continue
+				}
+				err := trashCmd.runDir(filepath.Join(path, dirEntry.Name()))
+				if err != nil {
+					trashCmd.logger.Error(err.Error(), slog.String("dir", filepath.Join(path, dirEntry.Name())))
+				}
+			}
+			if trashCmd.Action != "list" && !trashCmd.DryRun {
+				// Only succeeds if every dated directory was emptied.
+				_ = os.Remove(path)
+			}
+			return fs.SkipDir
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDir performs the action on the entries of dir, a dated subdirectory of
+// a trash directory.
+func (trashCmd *TrashCmd) runDir(dir string) error {
+	entries, err := readTrashIndex(dir)
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool)
+	for _, entry := range entries {
+		if len(trashCmd.FileRegexps) > 0 && !slices.ContainsFunc(trashCmd.FileRegexps, func(fileRegexp *regexp.Regexp) bool {
+			return fileRegexp.MatchString(filepath.Base(entry.OriginalPath))
+		}) {
+			continue
+		}
+		trashPath := filepath.Join(dir, entry.Name)
+		logger := trashCmd.logger.With(slog.String("trashPath", trashPath))
+		switch trashCmd.Action {
+		case "list":
+			fmt.Fprintf(trashCmd.Stdout, "%s  %s => %s\n", entry.TrashedAt.Format(time.RFC3339), trashPath, entry.OriginalPath)
+		case "restore":
+			if trashCmd.DryRun {
+				fmt.Fprintf(trashCmd.Stdout, "%s => %s\n", trashPath, entry.OriginalPath)
+				continue
+			}
+			err := os.MkdirAll(filepath.Dir(entry.OriginalPath), 0755)
+			if err != nil {
+				logger.Error(err.Error(), slog.String("originalPath", entry.OriginalPath))
+				continue
+			}
+			err = renameNoReplace(osFS{}, trashPath, entry.OriginalPath, trashCmd.ReplaceIfExists)
+			if err != nil {
+				if errors.Is(err, fs.ErrExist) {
+					logger.Info("file already exists, skipping (use -replace-if-exists to replace it)", slog.String("originalPath", entry.OriginalPath))
+					continue
+				}
+				logger.Error(err.Error(), slog.String("originalPath", entry.OriginalPath))
+				continue
+			}
+			logger.Info("restored file", slog.String("originalPath", entry.OriginalPath))
+			done[entry.Name] = true
+		case "empty":
+			if time.Since(entry.TrashedAt) < trashCmd.Keep {
+				continue
+			}
+			if trashCmd.DryRun {
+				fmt.Fprintf(trashCmd.Stdout, "%s (delete)\n", trashPath)
+				continue
+			}
+			err := os.Remove(trashPath)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				logger.Error(err.Error())
+				continue
+			}
+			logger.Info("deleted file")
+			done[entry.Name] = true
+		}
+	}
+	if len(done) == 0 {
+		return nil
+	}
+	// Restoring with -replace-if-exists may have trashed files into this
+	// very directory, so read the index again rather than writing back what
+	// was read above.
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+	entries, err = readTrashIndex(dir)
+	if err != nil {
+		return err
+	}
+	entries = slices.DeleteFunc(entries, func(entry trashEntry) bool {
+		return done[entry.Name]
+	})
+	if len(entries) > 0 {
+		return writeTrashIndex(dir, entries)
+	}
+	err = os.Remove(filepath.Join(dir, trashIndexName))
+	if err != nil {
+		return err
+	}
+	// Only succeeds if nothing untracked was left behind.
+	_ = os.Remove(dir)
+	return nil
+}
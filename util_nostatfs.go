@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import (
+	"errors"
+)
+
+// freeSpace is not implemented on platforms whose syscall package lacks
+// Statfs.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem dir is on.
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
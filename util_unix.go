@@ -3,7 +3,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"syscall"
 )
 
@@ -17,3 +21,95 @@ func setpgid(cmd *exec.Cmd) {
 		Setpgid: true,
 	}
 }
+
+// isTransientError reports whether err is one that network filesystems
+// return while a server is briefly unreachable or has lost track of a file
+// handle, and which may succeed if retried.
+func isTransientError(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ESTALE)
+}
+
+func syncDir(fsys fileSystem, dir string) error {
+	file, err := fsys.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// defaultFilenameCharset is empty because file names are passed to exiftool
+// as the raw bytes stored on disk, whatever their encoding.
+const defaultFilenameCharset = ""
+
+// exifToolPlatformArgs are passed to every exiftool command.
+var exifToolPlatformArgs []string
+
+// fileIdentity identifies a file by its device and inode, which stay the
+// same when the file is renamed or moved within a filesystem.
+func fileIdentity(filePath string, fileInfo os.FileInfo) string {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return filePath
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+// fileSystemID identifies the filesystem a file is on by its device.
+func fileSystemID(filePath string, fileInfo os.FileInfo) string {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(stat.Dev)
+}
+
+// chownToParent gives filePath the owner and group of the directory it is
+// in. Symlinks are changed themselves rather than their targets.
+func chownToParent(filePath string) error {
+	parentInfo, err := os.Stat(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	stat, ok := parentInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: owner unavailable", filepath.Dir(filePath))
+	}
+	return os.Lchown(filePath, int(stat.Uid), int(stat.Gid))
+}
+
+// progressSignals are the signals that ask a running command for a progress
+// snapshot.
+var progressSignals = []os.Signal{syscall.SIGUSR1}
+
+// isCrossDeviceError reports whether err is the error a rename returns when
+// the new path is on a different filesystem.
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// processAlive reports whether a process with the given PID is running on
+// this host.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// makeMountPoint creates the empty directory dir to mount a filesystem on.
+func makeMountPoint(dir string) error {
+	return os.Mkdir(dir, 0o700)
+}
+
+// mounted reports whether a filesystem is mounted on dir, as its device is
+// then different from that of its parent.
+func mounted(dir string) bool {
+	fileInfo, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	parentInfo, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return false
+	}
+	return fileSystemID(dir, fileInfo) != fileSystemID(filepath.Dir(dir), parentInfo)
+}
@@ -3,8 +3,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
 )
 
 func stop(cmd *exec.Cmd) {
@@ -13,3 +20,109 @@ func stop(cmd *exec.Cmd) {
 }
 
 func setpgid(cmd *exec.Cmd) {}
+
+// isTransientError reports whether err is one that SMB shares return while
+// the server is briefly unreachable, and which may succeed if retried.
+func isTransientError(err error) bool {
+	const (
+		errorUnexpNetErr    syscall.Errno = 59
+		errorNetnameDeleted syscall.Errno = 64
+		errorSemTimeout     syscall.Errno = 121
+		errorNetworkBusy    syscall.Errno = 54
+		errorIOError        syscall.Errno = 1117
+	)
+	for _, errno := range []syscall.Errno{errorUnexpNetErr, errorNetnameDeleted, errorSemTimeout, errorNetworkBusy, errorIOError} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncDir is a no-op because Windows does not support flushing a directory
+// handle; NTFS journals directory entries on its own.
+func syncDir(fsys fileSystem, dir string) error {
+	return nil
+}
+
+// defaultFilenameCharset is utf8 because Go converts the UTF-16 file names
+// Windows uses into UTF-8, whereas exiftool assumes they are in the system
+// code page unless told otherwise.
+const defaultFilenameCharset = "utf8"
+
+// exifToolPlatformArgs are passed to every exiftool command. WindowsLongPath
+// lets exiftool open paths longer than MAX_PATH, which Go's os package
+// already handles on its own.
+var exifToolPlatformArgs = []string{"-api", "WindowsLongPath=1"}
+
+// fileIdentity identifies a file by its absolute path, since os.FileInfo
+// does not expose a file ID on Windows.
+func fileIdentity(filePath string, fileInfo os.FileInfo) string {
+	return filePath
+}
+
+// fileSystemID identifies the filesystem a file is on by its volume name
+// e.g. C: or \\server\share.
+func fileSystemID(filePath string, fileInfo os.FileInfo) string {
+	return strings.ToUpper(filepath.VolumeName(filePath))
+}
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the number of bytes available to the current user on
+// the filesystem dir is on.
+func freeSpace(dir string) (uint64, error) {
+	dirPtr, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytesAvailable uint64
+	ok, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(dirPtr)), uintptr(unsafe.Pointer(&freeBytesAvailable)), 0, 0)
+	if ok == 0 {
+		return 0, fmt.Errorf("GetDiskFreeSpaceEx %s: %w", dir, err)
+	}
+	return freeBytesAvailable, nil
+}
+
+// chownToParent is not supported on Windows, whose files are owned by
+// security descriptors rather than a user and group ID.
+func chownToParent(filePath string) error {
+	return errors.ErrUnsupported
+}
+
+// progressSignals are the signals that ask a running command for a progress
+// snapshot. Windows has no SIGUSR1, so only pressing Enter works there.
+var progressSignals []os.Signal
+
+// isCrossDeviceError reports whether err is the error a rename returns when
+// the new path is on a different volume.
+func isCrossDeviceError(err error) bool {
+	const errorNotSameDevice syscall.Errno = 17
+	return errors.Is(err, errorNotSameDevice)
+}
+
+// processAlive reports whether a process with the given PID is running on
+// this host. On Windows, finding a process opens a handle to it, which
+// fails if it doesn't exist.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// makeMountPoint does nothing, as WinFsp creates the directory a
+// filesystem is mounted on when it mounts, and refuses to mount on one that
+// already exists.
+func makeMountPoint(dir string) error {
+	return nil
+}
+
+// mounted reports whether a filesystem is mounted on dir, as it only exists
+// once it is.
+func mounted(dir string) bool {
+	_, err := os.Stat(dir)
+	return err == nil
+}
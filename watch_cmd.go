@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type WatchCmd struct {
+	// Install generates and installs a service running the rest of the
+	// command line in watch mode, instead of watching.
+	Install  bool
+	Interval time.Duration
+	// Settle, if non-zero, holds back files until they have gone this long
+	// without changing, as seen across runs.
+	Settle time.Duration
+	// Name is the name of the installed service.
+	Name   string
+	DryRun bool
+	// Subcommand and Args are the subcommand to run every Interval and its
+	// arguments.
+	Subcommand string
+	Args       []string
+	Stdout     io.Writer
+	Stderr     io.Writer
+	logger     *slog.Logger
+}
+
+func WatchCommand(args []string) (*WatchCmd, error) {
+	watchCmd := &WatchCmd{
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	if len(args) > 0 && args[0] == "install" {
+		watchCmd.Install = true
+		args = args[1:]
+	}
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), "Usage: exifutil watch [install] [FLAGS] rename|partition|move [ARGS...]")
+		flagset.PrintDefaults()
+	}
+	flagset.DurationVar(&watchCmd.Interval, "interval", time.Minute, "Time to wait between the end of one run and the start of the next.")
+	flagset.DurationVar(&watchCmd.Settle, "settle", 0, "Only process a file once it has gone this long without its size, modification time or mode changing, as seen across runs, so that a file still being copied in is left for a later run and processed once instead of once per change. Cheaper than the subcommand's -stable-for, which waits on every file.")
+	flagset.StringVar(&watchCmd.Name, "name", "", "Name of the service created by install. (default exifutil-SUBCOMMAND)")
+	flagset.BoolVar(&watchCmd.DryRun, "dry-run", false, "With install, print the service definition and the commands that would enable it without doing either.")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("no subcommand given")
+	}
+	if watchCmd.Interval <= 0 {
+		return nil, fmt.Errorf("-interval must be positive")
+	}
+	if watchCmd.Settle < 0 {
+		return nil, fmt.Errorf("-settle must not be negative")
+	}
+	watchCmd.Subcommand = flagset.Arg(0)
+	watchCmd.Args = flagset.Args()[1:]
+	if watchCmd.Name == "" {
+		watchCmd.Name = "exifutil-" + watchCmd.Subcommand
+	}
+	// Catch mistakes in the subcommand's arguments now rather than on the
+	// first run, which for install would be inside a service.
+	_, err = newWatchedCommand(watchCmd.Subcommand, watchCmd.Args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", watchCmd.Subcommand, err)
+	}
+	watchCmd.logger = newLogger(watchCmd.Stdout, false)
+	return watchCmd, nil
+}
+
+// watchedCommand is a subcommand that can be run repeatedly by watch.
+type watchedCommand interface {
+	Run(ctx context.Context) error
+}
+
+// newWatchedCommand parses the arguments of one of the subcommands that
+// organize files in place, which are the ones worth running continuously.
+func newWatchedCommand(subcmd string, args []string) (watchedCommand, error) {
+	switch subcmd {
+	case "rename":
+		renameCmd, err := RenameCommand(args)
+		if err != nil {
+			return nil, err
+		}
+		return renameCmd, nil
+	case "partition":
+		partitionCmd, err := PartitionCommand(args)
+		if err != nil {
+			return nil, err
+		}
+		return partitionCmd, nil
+	case "move":
+		moveCmd, err := MoveCommand(args)
+		if err != nil {
+			return nil, err
+		}
+		return moveCmd, nil
+	}
+	return nil, fmt.Errorf("%q is not one of rename, partition or move", subcmd)
+}
+
+func (watchCmd *WatchCmd) Run(ctx context.Context) error {
+	if watchCmd.Install {
+		return watchCmd.install(ctx)
+	}
+	cmd, err := newWatchedCommand(watchCmd.Subcommand, watchCmd.Args)
+	if err != nil {
+		return err
+	}
+	var settle *settleTracker
+	if watchCmd.Settle > 0 {
+		settle = newSettleTracker(watchCmd.Settle)
+		switch cmd := cmd.(type) {
+		case *RenameCmd:
+			cmd.settle = settle
+		case *PartitionCmd:
+			cmd.settle = settle
+		case *MoveCmd:
+			cmd.settle = settle
+		}
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+		err := cmd.Run(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// A failed run (e.g. a root on a drive that isn't mounted right
+			// now) shouldn't stop the next one.
+			watchCmd.logger.Error(err.Error(), slog.String("subcommand", watchCmd.Subcommand))
+		}
+		settle.Prune()
+		timer.Reset(watchCmd.Interval)
+	}
+}
+
+// install writes a systemd user unit (on Linux) or a launchd agent (on
+// macOS) that runs exifutil watch with the same arguments, and enables it.
+// The service runs in the current directory with the current PATH, so that
+// relative roots and exiftool resolve the same way they do now.
+func (watchCmd *WatchCmd) install(ctx context.Context) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	programArgs := []string{executable, "watch", "-interval", watchCmd.Interval.String()}
+	if watchCmd.Settle > 0 {
+		programArgs = append(programArgs, "-settle", watchCmd.Settle.String())
+	}
+	programArgs = append(append(programArgs, watchCmd.Subcommand), watchCmd.Args...)
+	var servicePath string
+	var service []byte
+	var enableCmds [][]string
+	switch runtime.GOOS {
+	case "linux":
+		servicePath = filepath.Join(homeDir, ".config", "systemd", "user", watchCmd.Name+".service")
+		service = systemdUnit(watchCmd.Name, cwd, os.Getenv("PATH"), programArgs)
+		enableCmds = [][]string{
+			{"systemctl", "--user", "daemon-reload"},
+			{"systemctl", "--user", "enable", "--now", watchCmd.Name + ".service"},
+		}
+	case "darwin":
+		label := "com.github.bokwoon95." + watchCmd.Name
+		servicePath = filepath.Join(homeDir, "Library", "LaunchAgents", label+".plist")
+		logPath := filepath.Join(homeDir, "Library", "Logs", watchCmd.Name+".log")
+		service = launchdPlist(label, cwd, os.Getenv("PATH"), logPath, programArgs)
+		enableCmds = [][]string{
+			{"launchctl", "load", "-w", servicePath},
+		}
+	default:
+		return fmt.Errorf("install is not supported on %s, only with systemd on linux and launchd on darwin", runtime.GOOS)
+	}
+	if watchCmd.DryRun {
+		fmt.Fprintf(watchCmd.Stdout, "# %s\n%s\n", servicePath, service)
+		for _, enableCmd := range enableCmds {
+			fmt.Fprintln(watchCmd.Stdout, strings.Join(enableCmd, " "))
+		}
+		return nil
+	}
+	_, err = os.Stat(servicePath)
+	if err == nil {
+		return fmt.Errorf("%s already exists, remove it first or pick another -name", servicePath)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(servicePath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(servicePath, service, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(watchCmd.Stderr, "wrote %s\n", servicePath)
+	for _, enableCmd := range enableCmds {
+		cmd := exec.CommandContext(ctx, enableCmd[0], enableCmd[1:]...)
+		cmd.Stdout = watchCmd.Stdout
+		cmd.Stderr = watchCmd.Stderr
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%s: %w", cmd.String(), err)
+		}
+	}
+	return nil
+}
+
+// systemdUnit returns a systemd user unit running programArgs.
+func systemdUnit(name, workingDir, path string, programArgs []string) []byte {
+	quotedArgs := make([]string, len(programArgs))
+	for i, arg := range programArgs {
+		quotedArgs[i] = systemdQuote(arg)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", strings.ReplaceAll(name, "%", "%%"))
+	fmt.Fprintf(&b, "\n[Service]\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quotedArgs, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", strings.ReplaceAll(workingDir, "%", "%%"))
+	fmt.Fprintf(&b, "Environment=%s\n", systemdQuote("PATH="+path))
+	fmt.Fprintf(&b, "Restart=on-failure\n")
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=default.target\n")
+	return b.Bytes()
+}
+
+// systemdQuote quotes s as a single argument of a systemd unit setting,
+// escaping the specifiers (%) and variable expansions ($) systemd would
+// otherwise interpret.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
+
+// launchdPlist returns a launchd agent running programArgs, restarting it
+// if it exits.
+func launchdPlist(label, workingDir, path, logPath string, programArgs []string) []byte {
+	escape := func(s string) string {
+		var b strings.Builder
+		_ = xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", escape(label))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range programArgs {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", escape(arg))
+	}
+	b.WriteString("\t</array>\n")
+	fmt.Fprintf(&b, "\t<key>WorkingDirectory</key>\n\t<string>%s</string>\n", escape(workingDir))
+	fmt.Fprintf(&b, "\t<key>EnvironmentVariables</key>\n\t<dict>\n\t\t<key>PATH</key>\n\t\t<string>%s</string>\n\t</dict>\n", escape(path))
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n", escape(logPath))
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", escape(logPath))
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}